@@ -0,0 +1,117 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterMatcher("abuseipdb", newAbuseIPDBMatcher)
+}
+
+// abuseIPDBURL is the check endpoint of the AbuseIPDB API.
+var abuseIPDBURL = "https://api.abuseipdb.com/api/v2/check"
+
+// Defaults of the abuseipdb matcher.
+const (
+	defaultAbuseIPDBMaxAge = 90 // days of reports the score is computed from.
+	abuseIPDBCacheTTL      = 6 * time.Hour
+)
+
+// abuseIPDBCaches are the caches of the scores by API key and max age, shared by the blocks using them
+// so that an IP is only looked up once against the daily quota of the key.
+var (
+	abuseIPDBCachesMu sync.Mutex
+	abuseIPDBCaches   = make(map[string]*lookupCache)
+)
+
+// abuseIPDBMatcher matches the clients with an abuse confidence score of at least 'threshold'. The scores
+// are looked up in the background, see lookupCache: a client isn't matched until its score is known.
+type abuseIPDBMatcher struct {
+	key       string
+	threshold int
+	maxAge    int
+	cache     *lookupCache
+}
+
+// newAbuseIPDBMatcher creates the matcher of 'match abuseipdb <api_key> <threshold> [max_age_days]'.
+func newAbuseIPDBMatcher(args []string) (Matcher, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, errors.New("expected an API key, a threshold and optionally a max age in days")
+	}
+	threshold, err := strconv.Atoi(args[1])
+	if err != nil || threshold < 1 || threshold > 100 {
+		return nil, errors.New("the threshold should be a confidence score between 1 and 100")
+	}
+	maxAge := defaultAbuseIPDBMaxAge
+	if len(args) == 3 {
+		if maxAge, err = strconv.Atoi(args[2]); err != nil || maxAge < 1 || maxAge > 365 {
+			return nil, errors.New("the max age should be a number of days between 1 and 365")
+		}
+	}
+
+	cacheKey := args[0] + "/" + strconv.Itoa(maxAge)
+	abuseIPDBCachesMu.Lock()
+	cache, ok := abuseIPDBCaches[cacheKey]
+	if !ok {
+		cache = newLookupCache("AbuseIPDB")
+		abuseIPDBCaches[cacheKey] = cache
+	}
+	abuseIPDBCachesMu.Unlock()
+
+	return &abuseIPDBMatcher{key: args[0], threshold: threshold, maxAge: maxAge, cache: cache}, nil
+}
+
+// Match implements Matcher.
+func (m *abuseIPDBMatcher) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	score, ok := m.cache.get(ip.String(), func() (interface{}, time.Duration, error) {
+		score, err := m.lookup(ip)
+		return score, abuseIPDBCacheTTL, err
+	})
+	return ok && score.(int) >= m.threshold, nil
+}
+
+// lookup returns the abuse confidence score of 'ip'.
+func (m *abuseIPDBMatcher) lookup(ip net.IP) (int, error) {
+	query := url.Values{"ipAddress": {ip.String()}, "maxAgeInDays": {strconv.Itoa(m.maxAge)}}
+	req, err := http.NewRequest("GET", abuseIPDBURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Key", m.key)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		// the daily quota is spent, don't retry before it resets.
+		return 0, rateLimited(resp)
+	case resp.StatusCode != http.StatusOK:
+		return 0, errors.New(abuseIPDBURL + " answered " + resp.Status)
+	}
+
+	var check struct {
+		Data struct {
+			Score *int `json:"abuseConfidenceScore"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&check); err != nil {
+		return 0, err
+	}
+	if check.Data.Score == nil {
+		return 0, errors.New("no abuseConfidenceScore in the answer")
+	}
+	return *check.Data.Score, nil
+}
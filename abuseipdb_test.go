@@ -0,0 +1,66 @@
+package ipfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAbuseIPDB(t *testing.T) {
+	var lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		if r.Header.Get("Key") != "test-key" || r.URL.Query().Get("maxAgeInDays") != "30" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		scores := map[string]int{"8.8.8.8": 0, "5.175.96.22": 100, "24.53.192.20": 40}
+		fmt.Fprintf(w, `{"data": {"ipAddress": %q, "abuseConfidenceScore": %d}}`, r.URL.Query().Get("ipAddress"), scores[r.URL.Query().Get("ipAddress")])
+	}))
+	defer server.Close()
+	defer func(saved string) { abuseIPDBURL = saved }(abuseIPDBURL)
+	abuseIPDBURL = server.URL
+	// the scores cached by a previous run would be matched right away.
+	defer func(saved map[string]*lookupCache) { abuseIPDBCaches = saved }(abuseIPDBCaches)
+	abuseIPDBCaches = make(map[string]*lookupCache)
+
+	m, err := NewMatcher(MatcherSpec{Name: "abuseipdb", Args: []string{"test-key", "50", "30"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	match := func(ip string) bool {
+		matched, err := m.Match(context.Background(), net.ParseIP(ip), nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return matched
+	}
+
+	// nothing is known on the first request, it doesn't wait for the lookup.
+	if match("5.175.96.22") {
+		t.Fatal("Expected no match before the lookup")
+	}
+	eventually(t, "a match of 5.175.96.22", func() bool { return match("5.175.96.22") })
+	match("8.8.8.8")
+	match("24.53.192.20")
+	eventually(t, "the lookups of 8.8.8.8 and 24.53.192.20", func() bool { return atomic.LoadInt32(&lookups) == 3 })
+	time.Sleep(50 * time.Millisecond)
+	if match("8.8.8.8") || match("24.53.192.20") {
+		t.Fatal("Expected no match below the threshold")
+	}
+	// the scores are cached.
+	if atomic.LoadInt32(&lookups) != 3 {
+		t.Fatalf("Expected 3 lookups, Got: %d", atomic.LoadInt32(&lookups))
+	}
+
+	for i, args := range [][]string{{"key"}, {"key", "0"}, {"key", "101"}, {"key", "50", "0"}, {"key", "50", "30", "x"}} {
+		if _, err := NewMatcher(MatcherSpec{Name: "abuseipdb", Args: args}); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
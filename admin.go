@@ -0,0 +1,254 @@
+package ipfilter
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminConfig configures the management endpoint of a site.
+type AdminConfig struct {
+	Path  string
+	Token string // if empty, only loopback clients are allowed.
+}
+
+// proxyHeaders are the headers a reverse proxy puts the client in, besides the configured ClientIPHeaders.
+var proxyHeaders = []string{"X-Forwarded-For", "Forwarded", "X-Real-IP"}
+
+// authorized checks the bearer token of the request, or that it comes from a loopback address if there is no token.
+// Behind a local reverse proxy every request comes from a loopback address, so every entry of the forwarding
+// headers, 'headers' or proxyHeaders, must be a loopback address too, whether the proxy is trusted or not.
+func (admin *AdminConfig) authorized(r *http.Request, headers []string) bool {
+	if admin.Token != "" {
+		expected := "Bearer " + admin.Token
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+	}
+
+	ip := remoteIP(r)
+	if ip == nil || !ip.IsLoopback() {
+		return false
+	}
+	for _, name := range append(append([]string(nil), proxyHeaders...), headers...) {
+		var entries []string
+		if strings.EqualFold(name, "Forwarded") {
+			// obfuscated nodes hide the client, they aren't loopback addresses.
+			for _, node := range forwardedNodes(r.Header["Forwarded"]) {
+				entries = append(entries, forwardedNode(node))
+			}
+		} else {
+			for _, value := range r.Header[http.CanonicalHeaderKey(name)] {
+				entries = append(entries, strings.Split(value, ",")...)
+			}
+		}
+		for _, entry := range entries {
+			if ip := net.ParseIP(strings.TrimSpace(entry)); ip == nil || !ip.IsLoopback() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// serveAdmin handles the requests to the management endpoint.
+func (ipf IPFilter) serveAdmin(w http.ResponseWriter, r *http.Request) (int, error) {
+	admin := ipf.Config.Admin
+	if !admin.authorized(r, ipf.Config.ClientIPHeaders) {
+		return http.StatusUnauthorized, errors.New("ipfilter: unauthorized admin request")
+	}
+
+	route := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(admin.Path, "/"))
+	if ipf.Config.Bans == nil && (route == "/ban" || route == "/unban" || route == "/bans") {
+		return http.StatusInternalServerError, errors.New("ipfilter: no ban list configured")
+	}
+
+	if route == "/slots" || strings.HasPrefix(route, "/slots/") {
+		return ipf.serveSlots(w, r, route)
+	}
+
+	switch route {
+	case "/rules":
+		return ipf.serveRules(w, r)
+	case "/threat":
+		return ipf.serveThreat(w, r)
+	case "/maintenance":
+		return ipf.serveMaintenance(w, r)
+	case "/stats":
+		return ipf.serveStats(w, r)
+	case "/counters":
+		return ipf.serveCounters(w, r)
+	case "/summary":
+		return ipf.serveSummary(w, r)
+	case "/lookup":
+		return ipf.serveLookup(w, r)
+	case "/explain":
+		return ipf.serveExplain(w, r)
+	case "/ban":
+		return ipf.serveBan(w, r)
+	case "/pass":
+		return ipf.servePass(w, r)
+	case "/unban":
+		return ipf.serveUnban(w, r)
+	case "/bans":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			return http.StatusMethodNotAllowed, nil
+		}
+		bans, err := ipf.Config.Bans.List()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return writeJSON(w, bans)
+	}
+
+	return http.StatusNotFound, nil
+}
+
+// serveRules returns the current rules on GET and atomically replaces them on PUT or POST.
+func (ipf IPFilter) serveRules(w http.ResponseWriter, r *http.Request) (int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, RulesFromPaths(ipf.Config.Paths))
+	case http.MethodPut, http.MethodPost:
+		if ipf.live == nil {
+			return http.StatusInternalServerError, errors.New("ipfilter: rules can't be updated at runtime")
+		}
+
+		var rs RuleSet
+		if err := json.NewDecoder(r.Body).Decode(&rs); err != nil {
+			return http.StatusBadRequest, err
+		}
+		// the lists are fetched for as long as the admin client waits.
+		paths, err := ipf.Config.rulePaths(r.Context(), rs)
+		if err != nil {
+			counters.ParseErrors.Add(1)
+			return http.StatusBadRequest, err
+		}
+
+		ipf.live.SwapPaths(paths)
+		return writeJSON(w, RulesFromPaths(paths))
+	}
+
+	w.Header().Set("Allow", "GET, PUT, POST")
+	return http.StatusMethodNotAllowed, nil
+}
+
+// banRequest is the body of the ban, unban and pass requests.
+type banRequest struct {
+	IP  string `json:"ip"`
+	TTL string `json:"ttl,omitempty"`
+}
+
+// decodeBanRequest decodes a ban, unban or pass request and parses its IP.
+func decodeBanRequest(r *http.Request) (banRequest, net.IP, error) {
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, nil, err
+	}
+
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		return req, nil, errors.New("ipfilter: Can't parse IP address: " + req.IP)
+	}
+	return req, ip, nil
+}
+
+// serveBan bans an IP, for its 'ttl' or forever.
+func (ipf IPFilter) serveBan(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	req, ip, err := decodeBanRequest(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" {
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return http.StatusBadRequest, errors.New("ipfilter: ttl should be a positive duration, e.g. '1h'")
+		}
+	}
+
+	ban, err := ipf.Config.Bans.Ban(ip, ttl)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return writeJSON(w, ban)
+}
+
+// passResponse is the pass of an approved client, it is valid as the cookie or in the link
+// '?ipfilter_pass=<token>'.
+type passResponse struct {
+	IP      string    `json:"ip"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// servePass approves an IP, for its 'ttl' or the one of the pass_cookie.
+func (ipf IPFilter) servePass(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+	if ipf.Config.PassCookie == nil {
+		return http.StatusInternalServerError, errors.New("ipfilter: no pass_cookie configured")
+	}
+
+	req, ip, err := decodeBanRequest(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ttl := ipf.Config.PassCookie.ttl()
+	if req.TTL != "" {
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return http.StatusBadRequest, errors.New("ipfilter: ttl should be a positive duration, e.g. '1h'")
+		}
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	return writeJSON(w, passResponse{IP: ip.String(), Token: NewPassToken(ipf.Config.PassCookie.Key, ip, expires), Expires: expires})
+}
+
+// serveUnban lifts the ban of an IP.
+func (ipf IPFilter) serveUnban(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	_, ip, err := decodeBanRequest(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	unbanned, err := ipf.Config.Bans.Unban(ip)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !unbanned {
+		return http.StatusNotFound, nil
+	}
+	return writeJSON(w, Ban{IP: ip.String()})
+}
+
+// writeJSON writes 'v' as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, v interface{}) (int, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,312 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// newTestAdminFilter returns an IPFilter with a swappable config and an admin endpoint at '/ipfilter'.
+func newTestAdminFilter(config IPFConfig, token string) IPFilter {
+	config.Admin = &AdminConfig{Path: "/ipfilter", Token: token}
+	config.Bans = NewBanList()
+	return IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		live: newLiveConfig(&config),
+	}
+}
+
+func adminRequest(t *testing.T, ipf IPFilter, method, path, body, remoteAddr, token string) (int, *httptest.ResponseRecorder) {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	status, _ := ipf.ServeHTTP(rec, req)
+	return status, rec
+}
+
+func TestAdminRulesHotSwap(t *testing.T) {
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{
+			{
+				PathScopes: []string{"/"},
+				IsBlock:    true,
+				Ranges: []Range{
+					{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")},
+				},
+			},
+		},
+	}, "")
+
+	status, rec := adminRequest(t, ipf, "GET", "/ipfilter/rules", "", "127.0.0.1:12345", "")
+	if status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	var rs RuleSet
+	if err := json.Unmarshal(rec.Body.Bytes(), &rs); err != nil {
+		t.Fatalf("Could not decode the rules: %v", err)
+	}
+	expected := RuleSet{Paths: []Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"8.8.8.8"}}}}
+	if !reflect.DeepEqual(rs, expected) {
+		t.Fatalf("Expected rules: %+v, Got: %+v", expected, rs)
+	}
+
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "8.8.4.4:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d' before the swap, Got: '%d'", http.StatusOK, status)
+	}
+
+	newRules := `{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.4.0-8.8.4.255"]}]}`
+	if status, _ := adminRequest(t, ipf, "PUT", "/ipfilter/rules", newRules, "127.0.0.1:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "8.8.4.4:12345", ""); status != http.StatusForbidden {
+		t.Fatalf("Expected StatusCode: '%d' after the swap, Got: '%d'", http.StatusForbidden, status)
+	}
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "8.8.8.8:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d' after the swap, Got: '%d'", http.StatusOK, status)
+	}
+}
+
+func TestAdminRulesInvalid(t *testing.T) {
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{
+			{PathScopes: []string{"/"}, Ranges: []Range{{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}}},
+		},
+	}, "")
+
+	tests := []string{
+		`not json`,
+		`{"paths": [{"scopes": ["/"], "rule": "deny", "ips": ["8.8.8.8"]}]}`,
+		`{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["8.8."]}]}`,
+		`{"paths": [{"scopes": ["/"], "rule": "block"}]}`,
+		// no database to look up countries.
+		`{"paths": [{"scopes": ["/"], "rule": "block", "countries": ["US"]}]}`,
+		// as in a Caddyfile, priorities need 'match_mode priority'.
+		`{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"], "priority": 10}]}`,
+		// no pass_cookie to remember the solved challenges.
+		`{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"], "challenge": "js"}]}`,
+		// only the blockpages of the Caddyfile can be served.
+		`{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"], "blockpage": "testdata/supportpage.html"}]}`,
+		// no Anonymous-IP database.
+		`{"paths": [{"scopes": ["/"], "rule": "block", "matchers": [{"name": "is_tor_exit_node"}]}]}`,
+	}
+
+	for i, body := range tests {
+		if status, _ := adminRequest(t, ipf, "PUT", "/ipfilter/rules", body, "127.0.0.1:12345", ""); status != http.StatusBadRequest {
+			t.Errorf("Test %d expected StatusCode: '%d', Got: '%d'", i, http.StatusBadRequest, status)
+		}
+	}
+}
+
+func TestAdminRulesLists(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("8.8.4.0/24\n"))
+	}))
+	dir, err := ioutil.TempDir("", "ipfilter-fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder, err := NewFixtureClient(FixturesRecord, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (IPList{Source: server.URL + "/list.netset"}).Load(recorder); err != nil {
+		t.Fatalf("Could not record the list: %v", err)
+	}
+	server.Close()
+
+	// the list is only reachable through the client of the config.
+	replayer, err := NewFixtureClient(FixturesReplay, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths:      []IPPath{{PathScopes: []string{"/"}, Ranges: []Range{{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}}}},
+		HTTPClient: replayer,
+	}, "")
+	body := `{"paths": [{"scopes": ["/"], "rule": "block", "ip_lists": [{"source": "` + server.URL + `/list.netset"}]}]}`
+	if status, _ := adminRequest(t, ipf, "PUT", "/ipfilter/rules", body, "127.0.0.1:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "8.8.4.4:12345", ""); status != http.StatusForbidden {
+		t.Fatalf("Expected the list to be enforced, Got: '%d'", status)
+	}
+
+	// the fetch stops with the admin request.
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer slow.Close()
+	defer close(hang)
+	ipf = newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{{PathScopes: []string{"/"}, Ranges: []Range{{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}}}},
+	}, "")
+	body = `{"paths": [{"scopes": ["/"], "rule": "block", "ip_lists": [{"source": "` + slow.URL + `/list.netset"}]}]}`
+	req, err := http.NewRequest("PUT", "/ipfilter/rules", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = "127.0.0.1:12345"
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx)); status != http.StatusBadRequest {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusBadRequest, status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the fetch to stop with the request, took %v", elapsed)
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	config := IPFConfig{
+		Paths: []IPPath{
+			{PathScopes: []string{"/"}, Ranges: []Range{{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}}},
+		},
+	}
+
+	tests := []struct {
+		configToken    string
+		remoteAddr     string
+		token          string
+		header         string
+		headerValue    string
+		expectedStatus int
+	}{
+		{"", "127.0.0.1:12345", "", "", "", http.StatusOK},
+		{"", "[::1]:12345", "", "", "", http.StatusOK},
+		{"", "8.8.8.8:12345", "", "", "", http.StatusUnauthorized},
+		{"secret", "8.8.8.8:12345", "secret", "", "", http.StatusOK},
+		{"secret", "8.8.8.8:12345", "wrong", "", "", http.StatusUnauthorized},
+		{"secret", "127.0.0.1:12345", "", "", "", http.StatusUnauthorized},
+		// a local reverse proxy forwarding a remote client.
+		{"", "127.0.0.1:12345", "", "X-Forwarded-For", "8.8.8.8", http.StatusUnauthorized},
+		{"", "127.0.0.1:12345", "", "X-Forwarded-For", "127.0.0.1, 8.8.8.8", http.StatusUnauthorized},
+		{"", "127.0.0.1:12345", "", "Forwarded", "for=8.8.8.8", http.StatusUnauthorized},
+		{"", "127.0.0.1:12345", "", "Forwarded", "for=_hidden", http.StatusUnauthorized},
+		{"", "127.0.0.1:12345", "", "X-Real-IP", "8.8.8.8", http.StatusUnauthorized},
+		{"", "127.0.0.1:12345", "", "X-Forwarded-For", "garbage", http.StatusUnauthorized},
+		{"", "127.0.0.1:12345", "", "X-Forwarded-For", "127.0.0.1, ::1", http.StatusOK},
+		{"secret", "127.0.0.1:12345", "secret", "X-Forwarded-For", "8.8.8.8", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		ipf := newTestAdminFilter(config, test.configToken)
+		req, err := http.NewRequest("GET", "/ipfilter/rules", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if test.header != "" {
+			req.Header.Set(test.header, test.headerValue)
+		}
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != test.expectedStatus {
+			t.Errorf("Test %d expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	// the configured client IP headers are checked too.
+	config.ClientIPHeaders = []string{"CF-Connecting-IP"}
+	ipf := newTestAdminFilter(config, "")
+	req, err := http.NewRequest("GET", "/ipfilter/rules", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.Header.Set("CF-Connecting-IP", "8.8.8.8")
+	if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != http.StatusUnauthorized {
+		t.Errorf("Expected StatusCode: '%d', Got: '%d'", http.StatusUnauthorized, status)
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{
+			{
+				PathScopes: []string{"/private"},
+				IsBlock:    true,
+				Ranges: []Range{
+					{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")},
+				},
+			},
+		},
+	}, "secret")
+
+	// bans apply to every path, even outside of the scopes.
+	for _, reqPath := range []string{"/", "/private"} {
+		if status, _ := adminRequest(t, ipf, "GET", reqPath, "", "9.9.9.9:12345", ""); status != http.StatusOK {
+			t.Fatalf("Expected StatusCode: '%d' for '%s' before the ban, Got: '%d'", http.StatusOK, reqPath, status)
+		}
+	}
+
+	status, _ := adminRequest(t, ipf, "POST", "/ipfilter/ban", `{"ip": "9.9.9.9", "ttl": "1h"}`, "127.0.0.1:12345", "secret")
+	if status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	for _, reqPath := range []string{"/", "/private"} {
+		if status, _ := adminRequest(t, ipf, "GET", reqPath, "", "9.9.9.9:12345", ""); status != http.StatusForbidden {
+			t.Fatalf("Expected StatusCode: '%d' for '%s' after the ban, Got: '%d'", http.StatusForbidden, reqPath, status)
+		}
+	}
+
+	status, rec := adminRequest(t, ipf, "GET", "/ipfilter/bans", "", "127.0.0.1:12345", "secret")
+	if status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	var bans []Ban
+	if err := json.Unmarshal(rec.Body.Bytes(), &bans); err != nil {
+		t.Fatalf("Could not decode the bans: %v", err)
+	}
+	if len(bans) != 1 || bans[0].IP != "9.9.9.9" || bans[0].Expires.IsZero() {
+		t.Fatalf("Expected a single expiring ban of '9.9.9.9', Got: %+v", bans)
+	}
+
+	status, _ = adminRequest(t, ipf, "POST", "/ipfilter/unban", `{"ip": "9.9.9.9"}`, "127.0.0.1:12345", "secret")
+	if status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "9.9.9.9:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d' after the unban, Got: '%d'", http.StatusOK, status)
+	}
+
+	// invalid requests.
+	tests := []struct {
+		method, route, body string
+		expectedStatus      int
+	}{
+		{"GET", "/ipfilter/ban", "", http.StatusMethodNotAllowed},
+		{"POST", "/ipfilter/ban", `{"ip": "9.9.9"}`, http.StatusBadRequest},
+		{"POST", "/ipfilter/ban", `{"ip": "9.9.9.9", "ttl": "soon"}`, http.StatusBadRequest},
+		{"POST", "/ipfilter/ban", `{"ip": "9.9.9.9", "ttl": "-1h"}`, http.StatusBadRequest},
+		{"POST", "/ipfilter/unban", `{"ip": "9.9.9.9"}`, http.StatusNotFound},
+	}
+	for i, test := range tests {
+		if status, _ := adminRequest(t, ipf, test.method, test.route, test.body, "127.0.0.1:12345", "secret"); status != test.expectedStatus {
+			t.Errorf("Test %d expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package ipfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of alert rules.
+const (
+	AlertBlocks        = "blocks"          // more than Threshold requests are blocked in a Window.
+	AlertNewTopCountry = "new_top_country" // the country with the most blocked requests of a Window was never blocked before.
+)
+
+// defaultTopCountryWindow is the window of the new_top_country alerts.
+const defaultTopCountryWindow = time.Hour
+
+// smtpSendMail sends the email alerts.
+var smtpSendMail = smtp.SendMail
+
+// AlertRule raises an alert when the blocked requests of a site meet a condition.
+type AlertRule struct {
+	Kind      string
+	Threshold int // only used with AlertBlocks.
+	Window    time.Duration
+
+	mu        sync.Mutex
+	count     int            // blocked requests in the current window.
+	countries map[string]int // blocked requests per country in the current window.
+	seen      map[string]bool
+	windows   int // windows that ended.
+}
+
+// ParseAlert parses the arguments of 'alert': 'blocks <n> per <window>' or 'new_top_country [per <window>]'.
+func ParseAlert(args []string) (*AlertRule, error) {
+	invalid := errors.New("ipfilter: alert should be 'blocks <n> per <window>' or 'new_top_country [per <window>]'")
+	if len(args) == 0 {
+		return nil, invalid
+	}
+
+	rule := &AlertRule{Kind: args[0], countries: make(map[string]int), seen: make(map[string]bool)}
+	switch {
+	case args[0] == AlertBlocks && len(args) == 4 && args[2] == "per":
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return nil, errors.New("ipfilter: the alert threshold should be a positive number")
+		}
+		rule.Threshold, args = n, args[3:]
+	case args[0] == AlertNewTopCountry && len(args) == 1:
+		rule.Window = defaultTopCountryWindow
+		return rule, nil
+	case args[0] == AlertNewTopCountry && len(args) == 3 && args[1] == "per":
+		args = args[2:]
+	default:
+		return nil, invalid
+	}
+
+	window, err := time.ParseDuration(args[0])
+	if err != nil || window <= 0 {
+		return nil, errors.New("ipfilter: the alert window should be a positive duration, e.g. '1m'")
+	}
+	rule.Window = window
+	return rule, nil
+}
+
+// record counts a blocked request, it returns the alert if it makes the rule go over its threshold.
+func (rule *AlertRule) record(event BlockEvent) string {
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+
+	rule.count++
+	if event.Country != "" {
+		rule.countries[event.Country]++
+	}
+	// a single alert per window.
+	if rule.Kind == AlertBlocks && rule.count == rule.Threshold+1 {
+		return fmt.Sprintf("ipfilter: more than %d requests blocked in %s", rule.Threshold, rule.Window)
+	}
+	return ""
+}
+
+// endWindow starts a new window, it returns the alert of the window that ended if any.
+func (rule *AlertRule) endWindow() string {
+	rule.mu.Lock()
+	defer rule.mu.Unlock()
+
+	var alert string
+	if rule.Kind == AlertNewTopCountry {
+		var top string
+		for country, n := range rule.countries {
+			if n > rule.countries[top] || n == rule.countries[top] && country < top {
+				top = country
+			}
+		}
+		// the first window is the baseline, every country is new then.
+		if top != "" && rule.windows != 0 && !rule.seen[top] {
+			alert = fmt.Sprintf("ipfilter: %s tops the blocked requests with %d of %d in %s, it was never blocked before",
+				top, rule.countries[top], rule.count, rule.Window)
+		}
+		for country := range rule.countries {
+			rule.seen[country] = true
+		}
+	}
+
+	rule.windows++
+	rule.count = 0
+	rule.countries = make(map[string]int)
+	return alert
+}
+
+// Alerts notifies the operators of a site, through Slack or email, when its blocked requests meet one of its rules.
+type Alerts struct {
+	Rules     []*AlertRule
+	notifiers []alertNotifier
+	client    *http.Client
+}
+
+// alertNotifier delivers an alert.
+type alertNotifier func(client *http.Client, alert string) error
+
+// AddNotifier parses the arguments of 'alert_to': 'slack <webhook_url>' or 'email <smtp_url> <from> <to...>',
+// where the SMTP URL is smtp://[user:password@]host:port.
+func (a *Alerts) AddNotifier(args []string) error {
+	if len(args) < 2 {
+		return errors.New("ipfilter: alert_to should be 'slack <webhook_url>' or 'email <smtp_url> <from> <to...>'")
+	}
+
+	switch args[0] {
+	case "slack":
+		if len(args) != 2 {
+			return errors.New("ipfilter: alert_to slack expects a webhook URL")
+		}
+		webhook := args[1]
+		if u, err := url.Parse(webhook); err != nil || u.Scheme != "https" && u.Scheme != "http" {
+			return errors.New("ipfilter: alert_to slack should be an http(s) URL: " + webhook)
+		}
+		a.notifiers = append(a.notifiers, func(client *http.Client, alert string) error {
+			return notifySlack(client, webhook, alert)
+		})
+	case "email":
+		if len(args) < 4 {
+			return errors.New("ipfilter: alert_to email expects an SMTP URL, a sender and recipients")
+		}
+		u, err := url.Parse(args[1])
+		if err != nil || u.Scheme != "smtp" || u.Port() == "" {
+			return errors.New("ipfilter: alert_to email should be an smtp://[user:password@]host:port URL")
+		}
+		from, to := args[2], args[3:]
+		a.notifiers = append(a.notifiers, func(client *http.Client, alert string) error {
+			return notifyEmail(u, from, to, alert)
+		})
+	default:
+		return errors.New("ipfilter: alert_to should be 'slack' or 'email'")
+	}
+	return nil
+}
+
+// check returns an error if the alerts have rules but no notifiers, or the other way around.
+func (a *Alerts) check() error {
+	if len(a.Rules) == 0 {
+		return errors.New("ipfilter: alert_to needs an alert")
+	}
+	if len(a.notifiers) == 0 {
+		return errors.New("ipfilter: alert needs an alert_to")
+	}
+	return nil
+}
+
+// usesCountries returns true if a rule needs the country of the blocked requests.
+func (a *Alerts) usesCountries() bool {
+	for _, rule := range a.Rules {
+		if rule.Kind == AlertNewTopCountry {
+			return true
+		}
+	}
+	return false
+}
+
+// record counts a blocked request, the alerts are sent asynchronously.
+func (a *Alerts) record(event BlockEvent) {
+	if a == nil {
+		return
+	}
+	for _, rule := range a.Rules {
+		if alert := rule.record(event); alert != "" {
+			go a.notify(alert)
+		}
+	}
+}
+
+// run ends the windows of the rules until 'ctx' is done.
+func (a *Alerts) run(ctx context.Context) {
+	for _, rule := range a.Rules {
+		go func(rule *AlertRule) {
+			ticker := time.NewTicker(rule.Window)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if alert := rule.endWindow(); alert != "" {
+						a.notify(alert)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(rule)
+	}
+}
+
+// notify sends 'alert' through every notifier.
+func (a *Alerts) notify(alert string) {
+	log.Printf("[WARNING] %s", alert)
+	client := a.client
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	for _, notifier := range a.notifiers {
+		if err := notifier(client, alert); err != nil {
+			log.Printf("[ERROR] ipfilter: Can't send the alert: %v", err)
+		}
+	}
+}
+
+// notifySlack posts 'alert' to a Slack incoming webhook.
+func notifySlack(client *http.Client, webhook, alert string) error {
+	body, err := json.Marshal(map[string]string{"text": alert})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack answered %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyEmail sends 'alert' through the SMTP server at 'server'.
+func notifyEmail(server *url.URL, from string, to []string, alert string) error {
+	var auth smtp.Auth
+	if server.User != nil {
+		password, _ := server.User.Password()
+		auth = smtp.PlainAuth("", server.User.Username(), password, server.Hostname())
+	}
+	msg := "From: " + from + "\r\nTo: " + strings.Join(to, ", ") + "\r\nSubject: ipfilter alert\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" + alert + "\r\n"
+	return smtpSendMail(server.Host, auth, from, to, []byte(msg))
+}
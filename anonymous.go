@@ -0,0 +1,80 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// AnonymousIP is a record of the GeoIP2 Anonymous-IP database.
+type AnonymousIP struct {
+	IsAnonymous        bool `maxminddb:"is_anonymous"`
+	IsAnonymousVPN     bool `maxminddb:"is_anonymous_vpn"`
+	IsHostingProvider  bool `maxminddb:"is_hosting_provider"`
+	IsPublicProxy      bool `maxminddb:"is_public_proxy"`
+	IsResidentialProxy bool `maxminddb:"is_residential_proxy"`
+	IsTorExitNode      bool `maxminddb:"is_tor_exit_node"`
+}
+
+// anonymousMatchers are the flags of AnonymousIP the matchers of the same name check.
+var anonymousMatchers = map[string]func(AnonymousIP) bool{
+	"is_anonymous":         func(a AnonymousIP) bool { return a.IsAnonymous },
+	"is_anonymous_vpn":     func(a AnonymousIP) bool { return a.IsAnonymousVPN },
+	"is_hosting_provider":  func(a AnonymousIP) bool { return a.IsHostingProvider },
+	"is_public_proxy":      func(a AnonymousIP) bool { return a.IsPublicProxy },
+	"is_residential_proxy": func(a AnonymousIP) bool { return a.IsResidentialProxy },
+	"is_tor_exit_node":     func(a AnonymousIP) bool { return a.IsTorExitNode },
+}
+
+func init() {
+	for name, flag := range anonymousMatchers {
+		flag := flag
+		RegisterMatcher(name, func(args []string) (Matcher, error) {
+			if len(args) != 0 {
+				return nil, errors.New("expected no arguments")
+			}
+			return anonymousMatcher(flag), nil
+		})
+	}
+}
+
+// anonymousMatcher matches the clients the Anonymous-IP database flags, the IPs it doesn't list have no flag.
+type anonymousMatcher func(AnonymousIP) bool
+
+// Match implements Matcher.
+func (m anonymousMatcher) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	lookups := LookupsFromContext(ctx)
+	if lookups == nil {
+		return false, errors.New("ipfilter: Anonymous-IP database is required to look up anonymous IPs")
+	}
+	record, err := lookups.AnonymousIP(ip)
+	if err != nil {
+		return false, err
+	}
+	return m(record), nil
+}
+
+// CheckAnonymousIP returns an error if a path has a matcher of the Anonymous-IP database without the database.
+func (config *IPFConfig) CheckAnonymousIP() error {
+	if config.AnonymousIPHandler != nil {
+		return nil
+	}
+	for _, path := range config.Paths {
+		for _, spec := range matcherSpecs(path.Matchers) {
+			if _, ok := anonymousMatchers[spec.Name]; ok {
+				return errors.New("ipfilter: Anonymous-IP database is required for " + spec.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupAnonymousIP returns the record of 'ip' in the Anonymous-IP database.
+func (ipf IPFilter) lookupAnonymousIP(ip net.IP, cost *requestCost) (AnonymousIP, error) {
+	var result AnonymousIP
+	start := cost.now()
+	err := ipf.Config.AnonymousIPHandler.Lookup(ip, &result)
+	cost.track(CostDBLookup, start)
+	return result, err
+}
@@ -0,0 +1,81 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+// anonymousRecord encodes a record of the Anonymous-IP database with the flags 'names'.
+func anonymousRecord(names ...string) []byte {
+	record := mmdbControl(7, len(names))
+	for _, name := range names {
+		record = append(record, mmdbString(name)...)
+		record = append(record, mmdbControl(14, 1)...)
+	}
+	return record
+}
+
+func TestAnonymousIP(t *testing.T) {
+	dbPath := writeTestMMDB(t, "GeoIP2-Anonymous-IP", map[string][]byte{
+		"185.220.101.0/24": anonymousRecord("is_anonymous", "is_tor_exit_node"),
+		"5.175.96.0/24":    anonymousRecord("is_anonymous", "is_anonymous_vpn", "is_hosting_provider"),
+		"24.53.192.0/24":   anonymousRecord("is_anonymous", "is_public_proxy"),
+	})
+	defer os.RemoveAll(filepath.Dir(dbPath))
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter /login {\nrule block\nanonymous_ip_database "+dbPath+
+		"\nmatch is_tor_exit_node\nmatch is_public_proxy\n}\nipfilter /pay {\nrule block\nmatch is_anonymous_vpn\n}\nipfilter /api {\nrule block\nmatch is_hosting_provider\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer config.AnonymousIPHandler.Close()
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		path           string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"/login", "185.220.101.7:_", http.StatusForbidden},
+		{"/login", "24.53.192.20:_", http.StatusForbidden},
+		{"/login", "5.175.96.22:_", http.StatusOK},
+		{"/pay", "5.175.96.22:_", http.StatusForbidden},
+		{"/pay", "185.220.101.7:_", http.StatusOK},
+		{"/api", "5.175.96.22:_", http.StatusForbidden},
+		// IPs missing from the database have no flag.
+		{"/login", "8.8.8.8:_", http.StatusOK},
+		{"/pay", "8.8.8.8:_", http.StatusOK},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	for i, input := range []string{
+		"ipfilter / {\nrule block\nmatch is_tor_exit_node\n}",
+		"ipfilter / {\nrule block\nanonymous_ip_database " + dbPath + "\nmatch is_tor_exit_node yes\n}",
+		"ipfilter / {\nrule block\nanonymous_ip_database /no/such/file.mmdb\nmatch is_tor_exit_node\n}",
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
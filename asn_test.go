@@ -0,0 +1,234 @@
+package ipfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbNode is a node of the search tree of writeTestASNDB.
+type mmdbNode struct {
+	children [2]*mmdbNode
+	data     int // offset in the data section for leaves, -1 for nodes.
+}
+
+// mmdbControl returns the control byte(s) of a MaxMind DB field, 'size' must be below 29.
+func mmdbControl(typ, size int) []byte {
+	if typ > 7 {
+		return []byte{byte(size), byte(typ - 7)}
+	}
+	return []byte{byte(typ<<5 | size)}
+}
+
+func mmdbString(s string) []byte {
+	return append(mmdbControl(2, len(s)), s...)
+}
+
+func mmdbUint(typ int, n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append(mmdbControl(typ, len(b)), b...)
+}
+
+// writeTestASNDB writes an IPv4 MaxMind DB mapping CIDR networks to ASNs, as in GeoLite2-ASN, and returns its path.
+func writeTestASNDB(t *testing.T, networks map[string]uint) string {
+	records := make(map[string][]byte, len(networks))
+	for cidr, asn := range networks {
+		record := append(mmdbControl(7, 1), mmdbString("autonomous_system_number")...)
+		records[cidr] = append(record, mmdbUint(6, uint64(asn))...)
+	}
+	return writeTestMMDB(t, "Test-ASN", records)
+}
+
+// writeTestMMDB writes an IPv4 MaxMind DB of type 'dbType' mapping CIDR networks to encoded records, and
+// returns its path.
+func writeTestMMDB(t *testing.T, dbType string, records map[string][]byte) string {
+	root := &mmdbNode{data: -1}
+	var data bytes.Buffer
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Invalid network %s: %v", cidr, err)
+		}
+		ones, _ := network.Mask.Size()
+		ip := network.IP.To4()
+
+		leaf := &mmdbNode{data: data.Len()}
+		data.Write(record)
+
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> uint(7-i%8) & 1
+			if i == ones-1 {
+				node.children[bit] = leaf
+				break
+			}
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbNode{data: -1}
+			}
+			node = node.children[bit]
+		}
+	}
+
+	// number the nodes breadth first, the root being 0.
+	var nodes []*mmdbNode
+	index := make(map[*mmdbNode]int)
+	for queue := []*mmdbNode{root}; len(queue) > 0; queue = queue[1:] {
+		node := queue[0]
+		index[node] = len(nodes)
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil && child.data < 0 {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	var db bytes.Buffer
+	nodeCount := len(nodes)
+	for _, node := range nodes {
+		for _, child := range node.children {
+			record := nodeCount // no data.
+			if child != nil && child.data >= 0 {
+				record = nodeCount + 16 + child.data
+			} else if child != nil {
+				record = index[child]
+			}
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(record))
+			db.Write(b[1:]) // 24 bits records.
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	db.Write(mmdbControl(7, 9))
+	db.Write(mmdbString("node_count"))
+	db.Write(mmdbUint(6, uint64(nodeCount)))
+	db.Write(mmdbString("record_size"))
+	db.Write(mmdbUint(5, 24))
+	db.Write(mmdbString("ip_version"))
+	db.Write(mmdbUint(5, 4))
+	db.Write(mmdbString("database_type"))
+	db.Write(mmdbString(dbType))
+	db.Write(mmdbString("languages"))
+	db.Write(mmdbControl(11, 0))
+	db.Write(mmdbString("binary_format_major_version"))
+	db.Write(mmdbUint(5, 2))
+	db.Write(mmdbString("binary_format_minor_version"))
+	db.Write(mmdbUint(5, 0))
+	db.Write(mmdbString("build_epoch"))
+	db.Write(mmdbUint(9, 1500000000))
+	db.Write(mmdbString("description"))
+	db.Write(mmdbControl(7, 0))
+
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatalf("Could not create a temporary directory: %v", err)
+	}
+	path := filepath.Join(dir, "test.mmdb")
+	if err := ioutil.WriteFile(path, db.Bytes(), 0600); err != nil {
+		t.Fatalf("Could not write the database: %v", err)
+	}
+	return path
+}
+
+func TestExceptASN(t *testing.T) {
+	asnPath := writeTestASNDB(t, map[string]uint{
+		"8.8.8.0/24":   15169,
+		"24.53.0.0/16": 6327,
+	})
+	defer os.RemoveAll(filepath.Dir(asnPath))
+
+	db, err := maxminddb.Open(DataBase)
+	if err != nil {
+		t.Fatalf("Error opening the database: %v", err)
+	}
+	defer db.Close()
+	asnDB, err := maxminddb.Open(asnPath)
+	if err != nil {
+		t.Fatalf("Error opening the ASN database: %v", err)
+	}
+	defer asnDB.Close()
+
+	tests := []struct {
+		path           IPPath
+		reqIP          string
+		expectedStatus int
+	}{
+		// allow US, except AS15169.
+		{IPPath{PathScopes: []string{"/"}, CountryCodes: []string{"US"}, ExceptASNs: []uint{15169}}, "8.8.8.8:_", http.StatusForbidden},
+		{IPPath{PathScopes: []string{"/"}, CountryCodes: []string{"US"}, ExceptASNs: []uint{15169}}, "8.8.4.4:_", http.StatusOK},
+		{IPPath{PathScopes: []string{"/"}, CountryCodes: []string{"US"}, ExceptASNs: []uint{6327}}, "8.8.8.8:_", http.StatusOK},
+		// explicit IPs take precedence over carve-outs.
+		{IPPath{PathScopes: []string{"/"}, CountryCodes: []string{"US"}, ExceptASNs: []uint{15169}, Ranges: []Range{{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}}}, "8.8.8.8:_", http.StatusOK},
+		// block CA, except AS6327.
+		{IPPath{PathScopes: []string{"/"}, IsBlock: true, CountryCodes: []string{"CA"}, ExceptASNs: []uint{6327}}, "24.53.192.20:_", http.StatusOK},
+		{IPPath{PathScopes: []string{"/"}, IsBlock: true, CountryCodes: []string{"CA"}}, "24.53.192.20:_", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: IPFConfig{Paths: []IPPath{test.path}, DBHandler: db, ASNHandler: asnDB},
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestExceptASNParse(t *testing.T) {
+	asnPath := writeTestASNDB(t, map[string]uint{"8.8.8.0/24": 15169})
+	defer os.RemoveAll(filepath.Dir(asnPath))
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"ipfilter / {\nrule allow\ndatabase " + DataBase + "\nasn_database " + asnPath + "\ncountry US\nexcept_asn 14061 AS16509\n}", false},
+		{"ipfilter / {\nrule allow\ndatabase " + DataBase + "\ncountry US\nexcept_asn 14061\n}", true},
+		{"ipfilter / {\nrule allow\nasn_database " + asnPath + "\nip 1.1.1.1\nexcept_asn 14061\n}", true},
+		{"ipfilter / {\nrule allow\ndatabase " + DataBase + "\nasn_database " + asnPath + "\ncountry US\nexcept_asn digitalocean\n}", true},
+		{"ipfilter / {\nrule allow\nasn_database /nonexistent.mmdb\nip 1.1.1.1\n}", true},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if asns := config.Paths[0].ExceptASNs; len(asns) != 2 || asns[0] != 14061 || asns[1] != 16509 {
+			t.Fatalf("Test %d: Expected ASNs [14061 16509], Got: %v", i, asns)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package ipfilter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AutoBan bans the clients sending more than Requests requests per Window to the scopes of a block, for
+// BanFor. The requests are counted per client IP in fixed windows starting with the first request, by every
+// instance together if the bans are in a SharedStore.
+type AutoBan struct {
+	Requests int
+	Window   time.Duration
+	BanFor   time.Duration
+
+	counter *rateCounter
+}
+
+// ParseAutoBan parses the arguments of 'autoban', "<n> requests per <window> for <duration>".
+func ParseAutoBan(args []string) (*AutoBan, error) {
+	if len(args) != 6 || args[1] != "requests" || args[2] != "per" || args[4] != "for" {
+		return nil, errors.New("ipfilter: autoban should be '<n> requests per <window> for <duration>'")
+	}
+	requests, err := strconv.Atoi(args[0])
+	if err != nil || requests <= 0 {
+		return nil, errors.New("ipfilter: autoban requests should be a positive number")
+	}
+	window, err := time.ParseDuration(args[3])
+	if err != nil || window <= 0 {
+		return nil, errors.New("ipfilter: autoban window should be a positive duration, e.g. '1m'")
+	}
+	banFor, err := time.ParseDuration(args[5])
+	if err != nil || banFor <= 0 {
+		return nil, errors.New("ipfilter: autoban duration should be a positive duration, e.g. '1h'")
+	}
+	return NewAutoBan(requests, window, banFor), nil
+}
+
+// NewAutoBan returns an AutoBan with its own counters.
+func NewAutoBan(requests int, window, banFor time.Duration) *AutoBan {
+	return &AutoBan{Requests: requests, Window: window, BanFor: banFor, counter: newRateCounter(window)}
+}
+
+// String returns the arguments of 'autoban'.
+func (ab *AutoBan) String() string {
+	return fmt.Sprintf("%d requests per %s for %s", ab.Requests, ab.Window, ab.BanFor)
+}
+
+// record counts a request of 'ip' to the block identified by 'rule' and bans it in 'bans' if it went over the
+// limit, it returns true if 'ip' got banned.
+func (ab *AutoBan) record(ip net.IP, bans *BanList, rule string) bool {
+	if bans == nil || ab.count(ip, bans, rule) <= ab.Requests {
+		return false
+	}
+	if _, err := bans.Ban(ip, ab.BanFor); err != nil {
+		log.Printf("[ERROR] ipfilter: Can't ban %s: %v", ip, err)
+		return false
+	}
+	log.Printf("[INFO] ipfilter: banned %s for %s after more than %d requests in %s", ip, ab.BanFor, ab.Requests, ab.Window)
+	// the shared counter expires with its window, the client is banned until then.
+	ab.counter.reset(ip.String())
+	return true
+}
+
+// count counts a request of 'ip' and returns the count of its window, in the SharedStore of 'bans' if it has
+// one, so that a client spread over the instances isn't let in as many times the limit.
+func (ab *AutoBan) count(ip net.IP, bans *BanList, rule string) int {
+	if bans.shared != nil {
+		n, err := bans.shared.Incr("autoban:"+rule+":"+ip.String(), ab.Window)
+		if err == nil {
+			return int(n)
+		}
+		log.Printf("[ERROR] ipfilter: Can't count the requests of %s in the shared store, counting them locally: %v", ip, err)
+	}
+	return ab.counter.add(ip.String())
+}
+
+// rateCounter counts events per key in fixed windows, the windows that are over are swept at most once
+// per window so that it doesn't grow with the clients that went away.
+type rateCounter struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	counts    map[string]*rateCount
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+// rateCount is the count of a key in the window ending at 'end'.
+type rateCount struct {
+	n   int
+	end time.Time
+}
+
+func newRateCounter(window time.Duration) *rateCounter {
+	return &rateCounter{window: window, counts: make(map[string]*rateCount), now: time.Now}
+}
+
+// add counts an event of 'key' and returns the count of its window.
+func (rc *rateCounter) add(key string) int {
+	now := rc.now()
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if !now.Before(rc.nextSweep) {
+		for k, c := range rc.counts {
+			if !now.Before(c.end) {
+				delete(rc.counts, k)
+			}
+		}
+		rc.nextSweep = now.Add(rc.window)
+	}
+
+	c, ok := rc.counts[key]
+	if !ok || !now.Before(c.end) {
+		c = &rateCount{end: now.Add(rc.window)}
+		rc.counts[key] = c
+	}
+	c.n++
+	return c.n
+}
+
+// reset forgets the count of 'key'.
+func (rc *rateCounter) reset(key string) {
+	rc.mu.Lock()
+	delete(rc.counts, key)
+	rc.mu.Unlock()
+}
@@ -0,0 +1,166 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestAutoBan(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", `ipfilter /login {
+		rule allow
+		ip 8.8.8.8 8.8.4.4
+		autoban 3 requests per 1m for 1h
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		path           string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"/login", "8.8.8.8:_", http.StatusOK},
+		{"/login", "8.8.8.8:_", http.StatusOK},
+		{"/login", "8.8.4.4:_", http.StatusOK},
+		// other scopes aren't counted.
+		{"/", "8.8.8.8:_", http.StatusOK},
+		{"/login", "8.8.8.8:_", http.StatusOK},
+		{"/login", "8.8.8.8:_", http.StatusForbidden},
+		// the ban applies to every path.
+		{"/", "8.8.8.8:_", http.StatusForbidden},
+		{"/login", "8.8.4.4:_", http.StatusOK},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	bans, err := config.Bans.List()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(bans) != 1 || bans[0].IP != "8.8.8.8" || time.Until(bans[0].Expires) < 59*time.Minute {
+		t.Fatalf("Expected a ban of an hour for 8.8.8.8, Got: %v", bans)
+	}
+}
+
+func TestAutoBanWindow(t *testing.T) {
+	now := time.Now()
+	ab := NewAutoBan(2, time.Minute, time.Hour)
+	ab.counter.now = func() time.Time { return now }
+	bans := NewBanList()
+	ip := net.ParseIP("8.8.8.8")
+
+	for i := 0; i < 2; i++ {
+		if ab.record(ip, bans, "") {
+			t.Fatalf("Request %d: Unexpected ban", i)
+		}
+	}
+	// a new window starts over.
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if ab.record(ip, bans, "") {
+			t.Fatalf("Request %d of the second window: Unexpected ban", i)
+		}
+	}
+	if !ab.record(ip, bans, "") || !bans.IsBanned(ip) {
+		t.Fatal("Expected a ban after 3 requests in a window")
+	}
+
+	// the windows that are over are swept.
+	ab.record(net.ParseIP("8.8.4.4"), bans, "")
+	now = now.Add(2 * time.Minute)
+	ab.record(net.ParseIP("24.53.192.20"), bans, "")
+	if len(ab.counter.counts) != 1 {
+		t.Fatalf("Expected the old counts to be swept, Got: %d counts", len(ab.counter.counts))
+	}
+}
+
+func TestAutoBanShared(t *testing.T) {
+	store := newMemoryStore()
+	nodeA, err := NewPersistentBanList(store)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nodeB, err := NewPersistentBanList(store)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// each instance has its own AutoBan, the counts are the store's.
+	abA, abB := NewAutoBan(2, time.Minute, time.Hour), NewAutoBan(2, time.Minute, time.Hour)
+	ip := net.ParseIP("8.8.8.8")
+
+	if abA.record(ip, nodeA, "login") || abB.record(ip, nodeB, "login") {
+		t.Fatal("Unexpected ban within the limit")
+	}
+	// another block counts apart.
+	if abA.record(ip, nodeA, "api") {
+		t.Fatal("Unexpected ban for the requests of another block")
+	}
+	if !abB.record(ip, nodeB, "login") || !nodeA.IsBanned(ip) {
+		t.Fatal("Expected a ban on every instance after 3 requests across them")
+	}
+	if len(abA.counter.counts) != 0 || len(abB.counter.counts) != 0 {
+		t.Errorf("Expected no local counts with a shared store")
+	}
+}
+
+func TestAutoBanParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  string
+		shouldErr bool
+	}{
+		{"autoban 100 requests per 1m for 1h", "100 requests per 1m0s for 1h0m0s", false},
+		{"autoban 100 requests per 1m", "", true},
+		{"autoban 0 requests per 1m for 1h", "", true},
+		{"autoban 100 requests every 1m for 1h", "", true},
+		{"autoban 100 requests per soon for 1h", "", true},
+		{"autoban 100 requests per 1m for -1h", "", true},
+		{"autoban 1 requests per 1m for 1h\nautoban 2 requests per 1m for 1h", "", true},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\n"+test.input+"\n}"))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		rs := RulesFromPaths(config.Paths)
+		if rs.Paths[0].AutoBan != test.expected {
+			t.Fatalf("Test %d: Expected autoban %q in the rule, Got: %q", i, test.expected, rs.Paths[0].AutoBan)
+		}
+		paths, err := rs.ToPaths(false, false)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if paths[0].AutoBan.String() != test.expected {
+			t.Fatalf("Test %d: Expected autoban %q in the path, Got: %q", i, test.expected, paths[0].AutoBan)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package ipfilter
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ban is a single dynamically banned IP.
+type Ban struct {
+	IP      string    `json:"ip"`
+	Expires time.Time `json:"expires,omitempty"` // zero if the ban never expires.
+}
+
+// expired returns true if the ban has an expiry date and it is before 'now'.
+func (b Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !now.Before(b.Expires)
+}
+
+// BanList holds the IPs banned at runtime, e.g. through the admin endpoint.
+type BanList struct {
+	mu    sync.RWMutex
+	bans  map[string]Ban
+	store BanStore // nil if the bans aren't persisted.
+	// shared is set if the store is shared with other instances, it is then the only source of truth.
+	shared SharedStore
+	hooks  *hookDispatcher // receives the lifecycle events of the bans.
+	now    func() time.Time
+	// shares the bans with fail2ban, nil unless 'fail2ban' is set.
+	fail2ban *Fail2Ban
+	// sweeps the expired bans at 'next', the first expiry date, nil if no ban expires.
+	sweeper *time.Timer
+	next    time.Time
+	closed  bool
+}
+
+// NewBanList returns an empty BanList.
+func NewBanList() *BanList {
+	return &BanList{bans: make(map[string]Ban), now: time.Now}
+}
+
+// NewPersistentBanList returns a BanList that saves its bans to 'store', loaded with the bans that didn't expire yet.
+func NewPersistentBanList(store BanStore) (*BanList, error) {
+	bl := NewBanList()
+	bl.store = store
+
+	if shared, ok := store.(SharedStore); ok {
+		bl.shared = shared
+		return bl, nil
+	}
+
+	bans, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	now := bl.now()
+	for _, ban := range bans {
+		if ban.expired(now) {
+			if err := store.Delete(ban.IP); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		bl.bans[ban.IP] = ban
+		bl.schedule(ban.Expires)
+	}
+	return bl, nil
+}
+
+// Ban bans 'ip' for 'ttl', or forever if 'ttl' is zero, replacing any previous ban of the same IP.
+func (bl *BanList) Ban(ip net.IP, ttl time.Duration) (Ban, error) {
+	ban := Ban{IP: ip.String()}
+	if ttl > 0 {
+		ban.Expires = bl.now().Add(ttl)
+	}
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if bl.store != nil {
+		if err := bl.store.Save(ban); err != nil {
+			return ban, err
+		}
+	}
+	bl.bans[ban.IP] = ban
+	bl.schedule(ban.Expires)
+	bl.hooks.banEvent(RuleLoaded, ban)
+	bl.fail2ban.logBan(ban)
+	return ban, nil
+}
+
+// Unban lifts the ban of 'ip', it returns false if 'ip' wasn't banned.
+func (bl *BanList) Unban(ip net.IP) (bool, error) {
+	key := ip.String()
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if bl.shared != nil {
+		banned, err := bl.shared.IsBanned(key)
+		if err != nil || !banned {
+			return false, err
+		}
+		if err := bl.shared.Delete(key); err != nil {
+			return false, err
+		}
+		bl.hooks.banEvent(RuleRemoved, Ban{IP: key})
+		return true, nil
+	}
+
+	ban, ok := bl.bans[key]
+	if !ok {
+		return false, nil
+	}
+	if bl.store != nil {
+		if err := bl.store.Delete(key); err != nil {
+			return false, err
+		}
+	}
+	delete(bl.bans, key)
+	if ban.expired(bl.now()) {
+		bl.hooks.banEvent(RuleExpired, ban)
+		return false, nil
+	}
+	bl.hooks.banEvent(RuleRemoved, ban)
+	return true, nil
+}
+
+// schedule makes sure the bans are swept once 'expires' is reached, the caller holds bl.mu.
+func (bl *BanList) schedule(expires time.Time) {
+	if expires.IsZero() || bl.closed || (bl.sweeper != nil && !expires.Before(bl.next)) {
+		return
+	}
+	if bl.sweeper != nil {
+		bl.sweeper.Stop()
+	}
+	bl.next = expires
+	bl.sweeper = time.AfterFunc(expires.Sub(bl.now()), bl.sweep)
+}
+
+// sweep purges the expired bans and schedules the next sweep, so they don't pile up in memory and in the
+// store until someone lists them.
+func (bl *BanList) sweep() {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if bl.sweeper != nil {
+		bl.sweeper.Stop()
+		bl.sweeper = nil
+	}
+	now := bl.now()
+	bl.purge(now)
+	for _, ban := range bl.bans {
+		// the bans the store failed to delete wait for the next sweep.
+		if !ban.expired(now) {
+			bl.schedule(ban.Expires)
+		}
+	}
+}
+
+// purge deletes the bans expired at 'now', the caller holds bl.mu.
+func (bl *BanList) purge(now time.Time) {
+	for key, ban := range bl.bans {
+		if !ban.expired(now) {
+			continue
+		}
+		// the store is purged on the next load if this fails.
+		if bl.store != nil && bl.store.Delete(key) != nil {
+			continue
+		}
+		delete(bl.bans, key)
+		bl.hooks.banEvent(RuleExpired, ban)
+	}
+}
+
+// Close stops sweeping the expired bans and closes the store of the BanList, if any.
+func (bl *BanList) Close() error {
+	bl.mu.Lock()
+	bl.closed = true
+	if bl.sweeper != nil {
+		bl.sweeper.Stop()
+		bl.sweeper = nil
+	}
+	bl.mu.Unlock()
+
+	if bl.store == nil {
+		return nil
+	}
+	return bl.store.Close()
+}
+
+// IsBanned returns true if 'ip' has a ban that didn't expire yet, or was banned by fail2ban.
+func (bl *BanList) IsBanned(ip net.IP) bool {
+	if bl.fail2ban.Contains(ip) {
+		return true
+	}
+	if bl.shared != nil {
+		banned, err := bl.shared.IsBanned(ip.String())
+		if err != nil {
+			// fail open, the store being unreachable shouldn't take the site down.
+			log.Printf("[ERROR] ipfilter: checking the ban of %s: %v", ip, err)
+		}
+		return banned
+	}
+
+	bl.mu.RLock()
+	ban, ok := bl.bans[ip.String()]
+	bl.mu.RUnlock()
+
+	return ok && !ban.expired(bl.now())
+}
+
+// List returns the active bans sorted by IP, expired bans are purged.
+func (bl *BanList) List() ([]Ban, error) {
+	if bl.shared != nil {
+		bans, err := bl.shared.Load()
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+		return bans, nil
+	}
+
+	now := bl.now()
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.purge(now)
+	bans := make([]Ban, 0, len(bl.bans))
+	for _, ban := range bl.bans {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans, nil
+}
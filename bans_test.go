@@ -0,0 +1,141 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanListExpiry(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	bl := NewBanList()
+	bl.now = func() time.Time { return now }
+
+	bl.Ban(net.ParseIP("1.2.3.4"), time.Hour)
+	bl.Ban(net.ParseIP("5.6.7.8"), 0)
+
+	if !bl.IsBanned(net.ParseIP("1.2.3.4")) || !bl.IsBanned(net.ParseIP("5.6.7.8")) {
+		t.Fatalf("Expected both IPs to be banned")
+	}
+	if bl.IsBanned(net.ParseIP("1.2.3.5")) {
+		t.Fatalf("Expected '1.2.3.5' not to be banned")
+	}
+
+	now = now.Add(time.Hour)
+	if bl.IsBanned(net.ParseIP("1.2.3.4")) {
+		t.Errorf("Expected the ban of '1.2.3.4' to have expired")
+	}
+	if !bl.IsBanned(net.ParseIP("5.6.7.8")) {
+		t.Errorf("Expected the ban of '5.6.7.8' to never expire")
+	}
+
+	bans, _ := bl.List()
+	if len(bans) != 1 || bans[0].IP != "5.6.7.8" {
+		t.Errorf("Expected only the ban of '5.6.7.8' to be listed, got: %+v", bans)
+	}
+	if unbanned, _ := bl.Unban(net.ParseIP("1.2.3.4")); unbanned {
+		t.Errorf("Expected unbanning an expired ban to return false")
+	}
+}
+
+func TestBanListPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter-bans")
+	if err != nil {
+		t.Fatalf("Could not create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bans.db")
+
+	store, err := OpenBoltBanStore(path)
+	if err != nil {
+		t.Fatalf("Could not open the ban store: %v", err)
+	}
+	bl, err := NewPersistentBanList(store)
+	if err != nil {
+		t.Fatalf("Could not load the bans: %v", err)
+	}
+	bl.Ban(net.ParseIP("1.2.3.4"), time.Hour)
+	bl.Ban(net.ParseIP("5.6.7.8"), 0)
+	bl.Ban(net.ParseIP("9.9.9.9"), 0)
+	bl.Unban(net.ParseIP("9.9.9.9"))
+
+	// a reloaded site shares the opened file.
+	reloaded, err := OpenBoltBanStore(path)
+	if err != nil {
+		t.Fatalf("Could not reopen the ban store while in use: %v", err)
+	}
+	if err := reloaded.Close(); err != nil {
+		t.Fatalf("Could not close the reopened ban store: %v", err)
+	}
+	if err := bl.Close(); err != nil {
+		t.Fatalf("Could not close the ban store: %v", err)
+	}
+
+	// restart.
+	store, err = OpenBoltBanStore(path)
+	if err != nil {
+		t.Fatalf("Could not open the ban store after a restart: %v", err)
+	}
+	bl, err = NewPersistentBanList(store)
+	if err != nil {
+		t.Fatalf("Could not load the bans after a restart: %v", err)
+	}
+	defer bl.Close()
+
+	bans, _ := bl.List()
+	if len(bans) != 2 || bans[0].IP != "1.2.3.4" || bans[0].Expires.IsZero() || bans[1].IP != "5.6.7.8" {
+		t.Errorf("Expected the bans of '1.2.3.4' and '5.6.7.8' to survive the restart, got: %+v", bans)
+	}
+}
+
+func TestBanListSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter-bans")
+	if err != nil {
+		t.Fatalf("Could not create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenBoltBanStore(filepath.Join(dir, "bans.db"))
+	if err != nil {
+		t.Fatalf("Could not open the ban store: %v", err)
+	}
+	bl, err := NewPersistentBanList(store)
+	if err != nil {
+		t.Fatalf("Could not load the bans: %v", err)
+	}
+	defer bl.Close()
+
+	recorder := &eventRecorder{ids: map[string]bool{"ban:203.0.113.20": true, "ban:203.0.113.21": true}}
+	defer withRuleHook(recorder)()
+	bl.hooks = &hookDispatcher{}
+
+	bl.Ban(net.ParseIP("203.0.113.20"), 20*time.Millisecond)
+	bl.Ban(net.ParseIP("203.0.113.21"), 0)
+	recorder.take()
+
+	// nothing lists the bans, the expired one is still dropped.
+	size := func() int {
+		bl.mu.RLock()
+		defer bl.mu.RUnlock()
+		return len(bl.bans)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for size() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size() != 1 {
+		t.Fatalf("Expected the expired ban to be swept, %d bans left", size())
+	}
+	if events := recorder.take(); len(events) != 1 || events[0] != "expired ban:203.0.113.20" {
+		t.Errorf("Expected an 'expired' event at expiry, Got: %v", events)
+	}
+	stored, err := store.Load()
+	if err != nil {
+		t.Fatalf("Could not read the ban store: %v", err)
+	}
+	if len(stored) != 1 || stored[0].IP != "203.0.113.21" {
+		t.Errorf("Expected the expired ban to be deleted from the store, Got: %+v", stored)
+	}
+}
@@ -0,0 +1,112 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BanStore persists the dynamic bans of a BanList so they survive restarts.
+type BanStore interface {
+	// Save stores a ban, replacing any previous ban of the same IP.
+	Save(ban Ban) error
+	// Delete removes the ban of 'ip'.
+	Delete(ip string) error
+	// Load returns all the stored bans.
+	Load() ([]Ban, error)
+	// Close releases the store.
+	Close() error
+}
+
+var bansBucket = []byte("bans")
+
+// boltStores keeps the BoltDB files opened by the running sites; BoltDB locks its file,
+// so a site reloaded while the previous instance is still running must share it.
+var (
+	boltStoresMu sync.Mutex
+	boltStores   = make(map[string]*BoltBanStore)
+)
+
+// BoltBanStore is a BanStore backed by a BoltDB file.
+type BoltBanStore struct {
+	db   *bolt.DB
+	path string
+	refs int
+}
+
+// OpenBoltBanStore opens or creates the BoltDB file at 'path', every call must be matched by a Close.
+func OpenBoltBanStore(path string) (*BoltBanStore, error) {
+	boltStoresMu.Lock()
+	defer boltStoresMu.Unlock()
+
+	if store, ok := boltStores[path]; ok {
+		store.refs++
+		return store, nil
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bansBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &BoltBanStore{db: db, path: path, refs: 1}
+	boltStores[path] = store
+	return store, nil
+}
+
+// Save implements BanStore.
+func (bs *BoltBanStore) Save(ban Ban) error {
+	value, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bansBucket).Put([]byte(ban.IP), value)
+	})
+}
+
+// Delete implements BanStore.
+func (bs *BoltBanStore) Delete(ip string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bansBucket).Delete([]byte(ip))
+	})
+}
+
+// Load implements BanStore.
+func (bs *BoltBanStore) Load() ([]Ban, error) {
+	var bans []Ban
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bansBucket).ForEach(func(_, value []byte) error {
+			var ban Ban
+			if err := json.Unmarshal(value, &ban); err != nil {
+				return err
+			}
+			bans = append(bans, ban)
+			return nil
+		})
+	})
+	return bans, err
+}
+
+// Close implements BanStore, the file is closed once every site using it is closed.
+func (bs *BoltBanStore) Close() error {
+	boltStoresMu.Lock()
+	defer boltStoresMu.Unlock()
+
+	bs.refs--
+	if bs.refs > 0 {
+		return nil
+	}
+	delete(boltStores, bs.path)
+	return bs.db.Close()
+}
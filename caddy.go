@@ -0,0 +1,1340 @@
+//go:build !nocaddy
+// +build !nocaddy
+
+package ipfilter
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Init initializes the plugin
+func init() {
+	caseSensitivePath = func() bool { return httpserver.CaseSensitivePath }
+	flag.BoolVar(&validateRemote, "ipfilter-validate-remote", false, "With -validate, check that the feeds of the ipfilter blocks can be fetched")
+	RegisterPlaceholderSetter(func(r *http.Request, name, value string) {
+		if repl, ok := r.Context().Value(httpserver.ReplacerCtxKey).(httpserver.Replacer); ok {
+			repl.Set(name, value)
+		}
+	})
+
+	caddy.RegisterPlugin("ipfilter", caddy.Plugin{
+		ServerType: "http",
+		Action:     Setup,
+	})
+	caddy.RegisterPlugin("ipfilter_set", caddy.Plugin{
+		ServerType: "http",
+		Action:     SetupSet,
+	})
+	// the sets are defined before the ipfilter blocks of every site use them.
+	httpserver.RegisterDevDirective("ipfilter_set", "ipfilter")
+	caddy.RegisterPlugin("ipfilter_global", caddy.Plugin{
+		ServerType: "http",
+		Action:     SetupGlobal,
+	})
+	// the global filter is in front of the ipfilter blocks of the sites, it may use the sets.
+	httpserver.RegisterDevDirective("ipfilter_global", "ipfilter")
+}
+
+// Setup parses the ipfilter configuration and returns the middleware handler.
+func Setup(c *caddy.Controller) error {
+	ifconfig, err := ipfilterParse(c)
+	if err != nil {
+		counters.ParseErrors.Add(1)
+		// the databases opened before the error would stay mapped, caddy keeps running on a failed reload.
+		discardConfig(ifconfig)
+		return err
+	}
+	ipf := setupFilter(c, ifconfig)
+
+	cfg := httpserver.GetConfig(c)
+	// the global filter comes first, the sites listing ipfilter_global already have it.
+	if global := globalFilterOf(c); !global.sites[cfg] {
+		cfg.AddMiddleware(global.middleware)
+	}
+	cfg.AddMiddleware(ipf.middleware)
+	return nil
+}
+
+// setupFilter starts the filter of 'ifconfig' with caddy, the returned filter is the template of the
+// middleware.
+func setupFilter(c *caddy.Controller, ifconfig IPFConfig) *IPFilter {
+	for _, warning := range policyWarnings(ifconfig) {
+		log.Printf("[WARNING] %s", warning)
+	}
+
+	live := newLiveConfig(&ifconfig)
+	c.OnStartup(func() error {
+		startCounting(live)
+		return nil
+	})
+
+	if ifconfig.ProxyProtocol {
+		httpserver.GetConfig(c).AddListenerMiddleware(func(l caddy.Listener) caddy.Listener {
+			// the listener is shared by the sites on the same address, its header is only read once.
+			if _, ok := l.(*ProxyProtocolListener); ok {
+				return l
+			}
+			return NewProxyProtocolListener(l, ifconfig.ProxyProtocolSources)
+		})
+	}
+
+	if ifconfig.Costs != nil {
+		publishCostAccounting()
+	}
+
+	ifconfig.hooks.acquire(ifconfig.Paths)
+
+	if ifconfig.DBDiff != nil {
+		c.OnStartup(func() error {
+			// walking the database takes a while, don't delay the startup.
+			go ifconfig.DBDiff.report(ifconfig.DBHandler)
+			return nil
+		})
+	}
+
+	if providers := monitoringProvidersOf(ifconfig.Paths); len(providers) != 0 {
+		c.OnStartup(func() error {
+			// the probes aren't allowed until their list is fetched.
+			go ifconfig.Monitoring.Refresh(providers...)
+			return nil
+		})
+	}
+
+	if feeds := feedsOf(ifconfig.Paths); len(feeds) != 0 {
+		c.OnStartup(func() error {
+			// no client is in a feed until it is fetched.
+			go ifconfig.Feeds.Refresh(feeds...)
+			return nil
+		})
+	}
+
+	if hostnames := hostnamesOf(ifconfig.Paths); len(hostnames) != 0 {
+		c.OnStartup(func() error {
+			// a hostname that can't be resolved is retried after the refresh, it doesn't prevent the startup.
+			ifconfig.Hostnames.Refresh(hostnames...)
+			return nil
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if ifconfig.RuleSource != nil {
+		c.OnStartup(func() error {
+			go watchRuleSource(ctx, ifconfig.RuleSource, live, ifconfig.ruleVersion)
+			return nil
+		})
+	}
+
+	if ifconfig.Fail2Ban != nil {
+		c.OnStartup(func() error {
+			go watchFail2Ban(ctx, ifconfig.Fail2Ban)
+			return nil
+		})
+	}
+
+	if ifconfig.Webhook != nil {
+		c.OnStartup(func() error {
+			go ifconfig.Webhook.run(ctx)
+			return nil
+		})
+	}
+
+	if ifconfig.Alerts != nil {
+		c.OnStartup(func() error {
+			ifconfig.Alerts.run(ctx)
+			return nil
+		})
+	}
+
+	if ifconfig.Syslog != nil {
+		c.OnStartup(func() error {
+			go ifconfig.Syslog.run(ctx)
+			return nil
+		})
+	}
+
+	if ifconfig.LogFile != nil {
+		c.OnStartup(func() error {
+			go ifconfig.LogFile.run(ctx)
+			return nil
+		})
+	}
+
+	// on a restart, caddy shuts the old instance down once the new one took over and its requests are done.
+	trackFilter(c, live, func() error {
+		cancel()
+		stopCounting(live)
+		live.Close()
+		config := live.Load()
+		config.hooks.release(config.Paths)
+		if config.DecisionHook != nil {
+			config.DecisionHook.Close()
+		}
+		if err := config.closeDatabases(); err != nil {
+			log.Printf("[ERROR] ipfilter: Closing the databases: %v", err)
+		}
+		return config.Bans.Close()
+	})
+
+	return &IPFilter{Config: ifconfig, live: live}
+}
+
+// middleware returns a copy of the filter in front of 'next'.
+func (ipf *IPFilter) middleware(next httpserver.Handler) httpserver.Handler {
+	return &IPFilter{
+		Next:   next,
+		Config: ipf.Config,
+		live:   ipf.live,
+	}
+}
+
+// ParseCaddyfileFragment validates 'fragment', made of ipfilter blocks, without starting caddy, and describes
+// the resulting policy. Like caddy does, it checks the files and servers the blocks refer to, and closes them.
+func ParseCaddyfileFragment(fragment []byte) (*Policy, []Warning, error) {
+	// only ipfilter blocks, the controller of a caddy directive doesn't see the others.
+	c := caddy.NewTestController("http", string(fragment))
+	for c.Next() {
+		if c.Val() != "ipfilter" {
+			return nil, nil, c.Errf("ipfilter: Expected an ipfilter block, got '%s'", c.Val())
+		}
+		c.RemainingArgs()
+		for c.NextBlock() {
+		}
+	}
+
+	config, err := validateParse(caddy.NewTestController("http", string(fragment)), true, false)
+	discardConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	policy := &Policy{
+		Database:       config.dbPath,
+		DatabaseFormat: config.dbFormat,
+		ASNDatabase:    config.asnDBPath,
+		MatchMode:      config.MatchMode,
+		Rules:          RulesFromPaths(config.Paths).Paths,
+	}
+	return policy, policyWarnings(config), nil
+}
+
+// defaultSettings are the settings of an 'ipfilter defaults' block, inherited by the blocks after it.
+var defaultSettings = map[string]bool{"rule": true, "strict": true, "blockpage": true, "challenge": true, "xff_policy": true}
+
+// ipfilterParseSingle parses a single ipfilter {} block from the caddy config, it starts from the settings
+// of the 'defaults' block if there is one.
+func ipfilterParseSingle(config *IPFConfig, c *caddy.Controller) (IPPath, error) {
+	var cPath IPPath
+	if config.defaults != nil {
+		cPath = *config.defaults
+	}
+
+	// Get PathScopes
+	cPath.PathScopes = c.RemainingArgs()
+	if len(cPath.PathScopes) == 0 {
+		return cPath, c.ArgErr()
+	}
+	isDefaults := isDefaultsBlock(cPath)
+
+	// Sort PathScopes by length (the longest is always the most specific so should be tested first)
+	sort.Sort(sort.Reverse(ByLength(cPath.PathScopes)))
+
+	for c.NextBlock() {
+		value := c.Val()
+		if isDefaults && !defaultSettings[value] {
+			return cPath, c.Errf("ipfilter: %s can't be set in the defaults block", value)
+		}
+
+		switch value {
+		case "rule":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+
+			isBlock, err := ParseRuleKind(c.Val())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			cPath.IsBlock = isBlock
+		case "database":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			// Check if a database has already been opened
+			if config.DBHandler != nil || config.CountryDB != nil {
+				return cPath, c.Err("ipfilter: A database is already opened")
+			}
+
+			database := c.Val()
+
+			// Open the database.
+			var err error
+			if config.dbFormat != "" && config.dbFormat != DatabaseMMDB {
+				if config.CountryDB, err = OpenCountryDB(database, config.dbFormat); err != nil {
+					return cPath, c.Err("ipfilter: Can't open database: " + database + ": " + err.Error())
+				}
+			} else {
+				if config.DBHandler, err = maxminddb.Open(database); err != nil {
+					return cPath, c.Err("ipfilter: Can't open database: " + database)
+				}
+				config.dbLayout = detectMMDBLayout(config.DBHandler)
+			}
+			config.dbPath = database
+		case "database_format":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			format := c.Val()
+			if format != DatabaseMMDB && format != DatabaseIP2Location && format != DatabaseCSV {
+				return cPath, c.Err("ipfilter: database_format should be 'mmdb', 'ip2location' or 'csv'")
+			}
+			// the database is opened as soon as it's read.
+			opened := config.dbFormat
+			if opened == "" {
+				opened = DatabaseMMDB
+			}
+			if config.dbPath != "" && format != opened {
+				return cPath, c.Err("ipfilter: database_format should come before database")
+			}
+			config.dbFormat = format
+		case "geo_provider", "maxmind_web_service":
+			args := c.RemainingArgs()
+			// maxmind_web_service is short for 'geo_provider maxmind'.
+			if value == "maxmind_web_service" {
+				if len(args) != 2 {
+					return cPath, c.ArgErr()
+				}
+				args = append([]string{"maxmind"}, args...)
+			}
+			if len(args) == 0 {
+				return cPath, c.ArgErr()
+			}
+			if config.GeoWebService != nil {
+				return cPath, c.Err("ipfilter: A geo provider is already configured")
+			}
+			ws, err := NewGeoWebService(args[0], args[1:], nil)
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.GeoWebService = ws
+		case "blockpage":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+
+			// check if blockpage exists, deepCheck reports it with the other problems.
+			blockpage := c.Val()
+			if _, err := os.Stat(blockpage); os.IsNotExist(err) && !config.validating {
+				return cPath, c.Err("ipfilter: No such file: " + blockpage)
+			}
+			cPath.BlockPage = blockpage
+		case "challenge":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return cPath, c.ArgErr()
+			}
+			var difficulty int
+			if len(args) == 2 {
+				var err error
+				if difficulty, err = strconv.Atoi(args[1]); err != nil || difficulty <= 0 {
+					return cPath, c.Err("ipfilter: challenge difficulty should be a positive number")
+				}
+			}
+			if err := checkChallenge(args[0], difficulty); err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			cPath.Challenge, cPath.ChallengeDifficulty = args[0], difficulty
+		case "autoban":
+			if cPath.AutoBan != nil {
+				return cPath, c.Err("ipfilter: autoban is already configured for this block")
+			}
+			autoBan, err := ParseAutoBan(c.RemainingArgs())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			cPath.AutoBan = autoBan
+		case "country", "ip", "ip_list", "feed", "expr", "dnsbl", "rdns", "hosting", "match", "except":
+			if err := parseCondition(&cPath, c); err != nil {
+				return cPath, err
+			}
+		case "use":
+			names := c.RemainingArgs()
+			if len(names) == 0 {
+				return cPath, c.ArgErr()
+			}
+			for _, name := range names {
+				set, ok := ipfilterSets(c)[name]
+				if !ok {
+					return cPath, c.Err("ipfilter: Unknown ipfilter_set: " + name)
+				}
+				if err := cPath.use(set); err != nil {
+					return cPath, c.Err(err.Error())
+				}
+			}
+		case "strict":
+			args := c.RemainingArgs()
+			switch {
+			case len(args) == 0 || len(args) == 1 && args[0] == "on":
+				cPath.Strict = true
+			case len(args) == 1 && args[0] == "off":
+				cPath.Strict = false
+			default:
+				return cPath, c.Err("ipfilter: strict should be 'on' or 'off'")
+			}
+		case "host":
+			hosts := c.RemainingArgs()
+			if len(hosts) == 0 {
+				return cPath, c.ArgErr()
+			}
+			cPath.Hosts = append(cPath.Hosts, hosts...)
+		case "methods":
+			methods := c.RemainingArgs()
+			if len(methods) == 0 {
+				return cPath, c.ArgErr()
+			}
+			for _, method := range methods {
+				cPath.Methods = append(cPath.Methods, strings.ToUpper(method))
+			}
+		case "header":
+			header, err := parseHeaderCondition(c.RemainingArgs())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			cPath.Headers = append(cPath.Headers, header)
+		case "exclude":
+			excludes := c.RemainingArgs()
+			if len(excludes) == 0 {
+				return cPath, c.ArgErr()
+			}
+			cPath.Excludes = append(cPath.Excludes, excludes...)
+		case "allow_monitoring":
+			providers := c.RemainingArgs()
+			if len(providers) == 0 {
+				return cPath, c.ArgErr()
+			}
+			if err := checkMonitoringProviders(providers); err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			cPath.AllowMonitoring = append(cPath.AllowMonitoring, providers...)
+		case "xff_policy":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if err := checkXFFPolicy(c.Val()); err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			cPath.XFFPolicy = c.Val()
+		case "family":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			switch c.Val() {
+			case FamilyIPv4, FamilyIPv6:
+				cPath.Family = c.Val()
+			default:
+				return cPath, c.Err("ipfilter: family should be 'ipv4' or 'ipv6'")
+			}
+		case "asn_database":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.ASNHandler != nil {
+				return cPath, c.Err("ipfilter: An ASN database is already opened")
+			}
+
+			database := c.Val()
+			var err error
+			config.ASNHandler, err = maxminddb.Open(database)
+			if err != nil {
+				return cPath, c.Err("ipfilter: Can't open ASN database: " + database)
+			}
+			config.asnLayout = detectMMDBLayout(config.ASNHandler)
+			config.asnDBPath = database
+		case "anonymous_ip_database":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.AnonymousIPHandler != nil {
+				return cPath, c.Err("ipfilter: An Anonymous-IP database is already opened")
+			}
+
+			database := c.Val()
+			var err error
+			config.AnonymousIPHandler, err = maxminddb.Open(database)
+			if err != nil {
+				return cPath, c.Err("ipfilter: Can't open Anonymous-IP database: " + database)
+			}
+			config.anonymousDBPath = database
+		case "except_asn":
+			asns := c.RemainingArgs()
+			if len(asns) == 0 {
+				return cPath, c.ArgErr()
+			}
+			for _, asn := range asns {
+				n, err := ParseASN(asn)
+				if err != nil {
+					return cPath, c.Err(err.Error())
+				}
+				cPath.ExceptASNs = append(cPath.ExceptASNs, n)
+			}
+		case "priority":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			priority, err := strconv.Atoi(c.Val())
+			if err != nil {
+				return cPath, c.Err("ipfilter: Invalid priority: " + c.Val())
+			}
+			cPath.Priority = priority
+		case "schedule":
+			schedule, err := ParseSchedule(c.RemainingArgs())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			cPath.Schedules = append(cPath.Schedules, schedule)
+		case "active_from", "active_until":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			t, err := ParseTimestamp(c.Val())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			if value == "active_from" {
+				cPath.ActiveFrom = t
+			} else {
+				cPath.ActiveUntil = t
+			}
+			if err := checkActiveRange(cPath.ActiveFrom, cPath.ActiveUntil); err != nil {
+				return cPath, c.Err(err.Error())
+			}
+		case "sample":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			sample, err := ParseSample(c.Val())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			cPath.Sample = sample
+		case "policy_dir":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.PolicyDir != "" {
+				return cPath, c.Err("ipfilter: A policy_dir is already configured")
+			}
+			config.PolicyDir = c.Val()
+		case "maintenance":
+			args := c.RemainingArgs()
+			if len(args) > 1 {
+				return cPath, c.ArgErr()
+			}
+			switch {
+			case len(args) == 0 || args[0] == "on":
+				config.Maintenance.Set(true, 0)
+			case args[0] == "off":
+				config.Maintenance.Set(false, 0)
+			default:
+				return cPath, c.Err("ipfilter: maintenance should be 'on' or 'off'")
+			}
+		case "maintenance_allow":
+			ips := c.RemainingArgs()
+			if len(ips) == 0 {
+				return cPath, c.ArgErr()
+			}
+			if err := config.Maintenance.AllowIPs(ips); err != nil {
+				return cPath, c.Err(err.Error())
+			}
+		case "maintenance_page":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			page := c.Val()
+			if _, err := os.Stat(page); os.IsNotExist(err) && !config.validating {
+				return cPath, c.Err("ipfilter: No such file: " + page)
+			}
+			config.Maintenance.Page = page
+		case "threat_level":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			level, err := strconv.Atoi(c.Val())
+			if err != nil || level < 0 {
+				return cPath, c.Err("ipfilter: threat_level should be a positive number")
+			}
+			cPath.ThreatLevel = level
+		case "threat_auto":
+			args := c.RemainingArgs()
+			if len(args) != 3 {
+				return cPath, c.ArgErr()
+			}
+			blocks, err := strconv.Atoi(args[0])
+			if err != nil || blocks <= 0 {
+				return cPath, c.Err("ipfilter: threat_auto blocks should be a positive number")
+			}
+			window, err := time.ParseDuration(args[1])
+			if err != nil || window <= 0 {
+				return cPath, c.Err("ipfilter: threat_auto window should be a positive duration, e.g. '1m'")
+			}
+			level, err := strconv.Atoi(args[2])
+			if err != nil || level <= 0 {
+				return cPath, c.Err("ipfilter: threat_auto level should be a positive number")
+			}
+			config.Threat.SetAuto(blocks, window, level)
+		case "decision_hook":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return cPath, c.ArgErr()
+			}
+			if config.DecisionHook != nil {
+				return cPath, c.Err("ipfilter: A decision_hook is already configured")
+			}
+			hook, err := NewDecisionHook(args)
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.DecisionHook = hook
+		case "match_mode":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.MatchMode != "" {
+				return cPath, c.Err("ipfilter: A match_mode is already configured")
+			}
+			switch c.Val() {
+			case MatchLongest, MatchFirst, MatchPriority, MatchAllowOverrides:
+				config.MatchMode = c.Val()
+			default:
+				return cPath, c.Err("ipfilter: match_mode should be 'first', 'longest', 'priority' or 'allow_overrides'")
+			}
+		case "hostname_refresh":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			refresh, err := time.ParseDuration(c.Val())
+			if err != nil || refresh <= 0 {
+				return cPath, c.Err("ipfilter: hostname_refresh should be a positive duration, e.g. '5m'")
+			}
+			config.HostnameRefresh = refresh
+		case "cost_accounting":
+			args := c.RemainingArgs()
+			if len(args) > 1 {
+				return cPath, c.ArgErr()
+			}
+			var budget time.Duration
+			if len(args) == 1 {
+				var err error
+				if budget, err = time.ParseDuration(args[0]); err != nil || budget <= 0 {
+					return cPath, c.Err("ipfilter: cost_accounting budget should be a positive duration, e.g. '2ms'")
+				}
+			}
+			// like the summaries, the budget is shared by the sites.
+			costs.SetBudget(budget)
+			config.Costs = costs
+		case "trusted_proxies":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return cPath, c.ArgErr()
+			}
+			proxies, err := ParseTrustedProxies(args)
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.TrustedProxies = append(config.TrustedProxies, proxies...)
+		case "proxy_protocol":
+			sources, err := ParseTrustedProxies(c.RemainingArgs())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.ProxyProtocol = true
+			config.ProxyProtocolSources = append(config.ProxyProtocolSources, sources...)
+		case "storage":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if err := config.SetStorage(c.Val()); err != nil {
+				return cPath, c.Err(err.Error())
+			}
+		case "client_ip_header":
+			headers := c.RemainingArgs()
+			if len(headers) == 0 {
+				return cPath, c.ArgErr()
+			}
+			config.ClientIPHeaders = append(config.ClientIPHeaders, headers...)
+		case "xff_strategy":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return cPath, c.ArgErr()
+			}
+			var hops int
+			if len(args) == 2 {
+				var err error
+				hops, err = strconv.Atoi(args[1])
+				if err != nil || hops <= 0 {
+					return cPath, c.Err("ipfilter: the number of trusted hops should be a positive number")
+				}
+			}
+			if err := config.SetXFFStrategy(args[0], hops); err != nil {
+				return cPath, c.Err(err.Error())
+			}
+		case "default":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			switch c.Val() {
+			case ActionAllow, ActionBlock:
+				config.DefaultAction = c.Val()
+			default:
+				return cPath, c.Err("ipfilter: default should be 'allow' or 'block'")
+			}
+		case "no_client_ip":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			switch c.Val() {
+			case ActionAllow, ActionBlock:
+				config.NoClientIP = c.Val()
+			default:
+				return cPath, c.Err("ipfilter: no_client_ip should be 'allow' or 'block'")
+			}
+		case "on_error":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			switch c.Val() {
+			case ActionAllow, ActionBlock, OnError500:
+				config.OnError = c.Val()
+			default:
+				return cPath, c.Err("ipfilter: on_error should be 'allow', 'block' or '500'")
+			}
+		case "allow_loopback":
+			config.AllowLoopback = true
+		case "placeholders":
+			config.Placeholders = true
+		case "set_headers":
+			config.SetHeaders = true
+		case "debug":
+			config.Debug = true
+		case "reject_malformed_xff":
+			config.RejectMalformedXFF = true
+		case "geo_stats":
+			if config.GeoStats == nil {
+				config.GeoStats = NewGeoStats()
+			}
+		case "summary":
+			args := c.RemainingArgs()
+			if len(args) > 1 {
+				return cPath, c.ArgErr()
+			}
+			if config.Summary != nil {
+				return cPath, c.Err("ipfilter: summary is already configured")
+			}
+			window := defaultSummaryWindow
+			if len(args) == 1 {
+				var err error
+				if window, err = time.ParseDuration(args[0]); err != nil || window < time.Minute {
+					return cPath, c.Err("ipfilter: the summary window should be a duration of a minute or more, e.g. '1h'")
+				}
+			}
+			config.Summary = NewSummary(window)
+		case "geo_cache":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return cPath, c.ArgErr()
+			}
+			if config.GeoCache != nil {
+				return cPath, c.Err("ipfilter: A geo_cache is already configured")
+			}
+
+			size, err := strconv.Atoi(args[0])
+			if err != nil || size <= 0 {
+				return cPath, c.Err("ipfilter: geo_cache size should be a positive number")
+			}
+
+			v6Prefix := defaultV6CachePrefix
+			if len(args) == 2 {
+				v6Prefix, err = strconv.Atoi(args[1])
+				if err != nil || v6Prefix <= 0 || v6Prefix > 128 {
+					return cPath, c.Err("ipfilter: geo_cache IPv6 prefix length should be between 1 and 128")
+				}
+			}
+
+			config.GeoCache = NewGeoCache(size, v6Prefix)
+		case "admin":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return cPath, c.ArgErr()
+			}
+			if config.Admin != nil {
+				return cPath, c.Err("ipfilter: An admin endpoint is already configured")
+			}
+
+			config.Admin = &AdminConfig{Path: args[0]}
+			if len(args) == 2 {
+				config.Admin.Token = args[1]
+			}
+		case "support_code":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.SupportKey != nil {
+				return cPath, c.Err("ipfilter: A support_code key is already configured")
+			}
+			config.SupportKey = []byte(c.Val())
+		case "pass_cookie":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return cPath, c.ArgErr()
+			}
+			if config.PassCookie != nil {
+				return cPath, c.Err("ipfilter: A pass_cookie key is already configured")
+			}
+
+			config.PassCookie = &PassCookie{Key: []byte(args[0])}
+			if len(args) == 2 {
+				ttl, err := time.ParseDuration(args[1])
+				if err != nil || ttl <= 0 {
+					return cPath, c.Err("ipfilter: pass_cookie ttl should be a positive duration, e.g. '24h'")
+				}
+				config.PassCookie.TTL = ttl
+			}
+		case "captcha":
+			args := c.RemainingArgs()
+			if len(args) != 3 {
+				return cPath, c.ArgErr()
+			}
+			if config.Captcha != nil {
+				return cPath, c.Err("ipfilter: A captcha is already configured")
+			}
+
+			captcha, err := NewCaptcha(args[0], args[1], args[2])
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.Captcha = captcha
+		case "http_fixtures":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return cPath, c.ArgErr()
+			}
+			if config.HTTPClient != nil {
+				return cPath, c.Err("ipfilter: http_fixtures is already configured")
+			}
+
+			client, err := NewFixtureClient(args[0], args[1])
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.HTTPClient = client
+		case "ban_store":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return cPath, c.ArgErr()
+			}
+			if config.Bans != nil && config.Bans.store != nil {
+				return cPath, c.Err("ipfilter: A ban_store is already configured")
+			}
+
+			var store BanStore
+			if args[0] == "redis" {
+				// ban_store redis <addr> [password]
+				if len(args) < 2 || len(args) > 3 {
+					return cPath, c.ArgErr()
+				}
+				var password string
+				if len(args) == 3 {
+					password = args[2]
+				}
+				redisStore := NewRedisStore(args[1], password)
+				if err := redisStore.Ping(); err != nil {
+					redisStore.Close()
+					return cPath, c.Err("ipfilter: Can't connect to redis: " + err.Error())
+				}
+				store = redisStore
+			} else {
+				// ban_store <path>
+				if len(args) != 1 {
+					return cPath, c.ArgErr()
+				}
+				boltStore, err := OpenBoltBanStore(args[0])
+				if err != nil {
+					return cPath, c.Err("ipfilter: Can't open ban_store: " + err.Error())
+				}
+				store = boltStore
+			}
+
+			bans, err := NewPersistentBanList(store)
+			if err != nil {
+				store.Close()
+				return cPath, c.Err("ipfilter: Can't load bans: " + err.Error())
+			}
+			config.Bans = bans
+		case "fail2ban":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return cPath, c.ArgErr()
+			}
+			if config.Fail2Ban != nil {
+				return cPath, c.Err("ipfilter: fail2ban is already configured")
+			}
+
+			var logFile string
+			if len(args) == 2 {
+				logFile = args[1]
+			}
+			f, err := NewFail2Ban(args[0], logFile)
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.Fail2Ban = f
+		case "webhook":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.Webhook != nil {
+				return cPath, c.Err("ipfilter: A webhook is already configured")
+			}
+			wh, err := NewBlockWebhook(c.Val())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.Webhook = wh
+		case "syslog":
+			// syslog local|<udp|tcp|tls|unix>://<addr> [facility]
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return cPath, c.ArgErr()
+			}
+			if config.Syslog != nil {
+				return cPath, c.Err("ipfilter: syslog is already configured")
+			}
+			args = append(args, "")
+			sw, err := NewSyslogWriter(args[0], args[1])
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.Syslog = sw
+		case "log_file":
+			if config.LogFile != nil {
+				return cPath, c.Err("ipfilter: log_file is already configured")
+			}
+			lf, err := ParseLogFile(c.RemainingArgs())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			config.LogFile = lf
+		case "alert":
+			rule, err := ParseAlert(c.RemainingArgs())
+			if err != nil {
+				return cPath, c.Err(err.Error())
+			}
+			if config.Alerts == nil {
+				config.Alerts = &Alerts{}
+			}
+			config.Alerts.Rules = append(config.Alerts.Rules, rule)
+		case "alert_to":
+			if config.Alerts == nil {
+				config.Alerts = &Alerts{}
+			}
+			if err := config.Alerts.AddNotifier(c.RemainingArgs()); err != nil {
+				return cPath, c.Err(err.Error())
+			}
+		case "rule_webhook":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.hooks.webhook != "" {
+				return cPath, c.Err("ipfilter: A rule_webhook is already configured")
+			}
+			config.hooks.webhook = c.Val()
+		case "database_diff":
+			args := c.RemainingArgs()
+			if len(args) > 1 {
+				return cPath, c.ArgErr()
+			}
+			if config.DBDiff != nil {
+				return cPath, c.Err("ipfilter: database_diff is already configured")
+			}
+			config.DBDiff = &DBDiffConfig{}
+			if len(args) == 1 {
+				config.DBDiff.Webhook = args[0]
+			}
+		case "rule_source":
+			// rule_source consul|etcd <addr> <key> [interval]
+			args := c.RemainingArgs()
+			if len(args) != 3 && len(args) != 4 {
+				return cPath, c.ArgErr()
+			}
+			if config.RuleSource != nil {
+				return cPath, c.Err("ipfilter: A rule_source is already configured")
+			}
+
+			interval := defaultRuleSourceInterval
+			if len(args) == 4 {
+				var err error
+				interval, err = time.ParseDuration(args[3])
+				if err != nil || interval <= 0 {
+					return cPath, c.Err("ipfilter: Invalid rule_source interval: " + args[3])
+				}
+			}
+
+			switch args[0] {
+			case "consul":
+				config.RuleSource = &ConsulSource{Addr: args[1], Key: args[2], Wait: interval}
+			case "etcd":
+				config.RuleSource = &EtcdSource{Addr: args[1], Key: args[2], Interval: interval}
+			default:
+				return cPath, c.Err("ipfilter: rule_source should be 'consul' or 'etcd'")
+			}
+		}
+	}
+
+	if len(cPath.negated) != 0 && len(cPath.Ranges) == 0 && len(cPath.lists) == 0 {
+		return cPath, c.Err("ipfilter: The '!' entries of ip need other IPs to be carved out of")
+	}
+
+	return cPath, nil
+}
+
+// parseCondition parses a subdirective deciding which clients a rule applies to, they can be used in an
+// ipfilter block and in an ipfilter_set.
+func parseCondition(cPath *IPPath, c *caddy.Controller) error {
+	switch c.Val() {
+	case "country":
+		countries := c.RemainingArgs()
+		negate := len(countries) != 0 && countries[0] == "not"
+		if negate {
+			countries = countries[1:]
+		}
+		if len(countries) == 0 {
+			return c.ArgErr()
+		}
+		countries, err := ParseCountryCodes(countries)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if len(cPath.CountryCodes) != 0 && cPath.NegateCountries != negate {
+			return c.Err(errCountryNot.Error())
+		}
+		cPath.CountryCodes = append(cPath.CountryCodes, countries...)
+		cPath.NegateCountries = negate
+	case "ip":
+		ips := c.RemainingArgs()
+		if len(ips) == 0 {
+			return c.ArgErr()
+		}
+
+		ranges, negated, hostnames, err := parseIPEntries(ips)
+		if err != nil {
+			return c.Err("ipfilter: " + err.Error())
+		}
+		cPath.Ranges = append(cPath.Ranges, ranges...)
+		cPath.Hostnames = append(cPath.Hostnames, hostnames...)
+		cPath.negated = append(cPath.negated, negated...)
+	case "ip_list":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		lists, err := parseIPLists(args)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		cPath.lists = append(cPath.lists, lists...)
+	case "feed":
+		names := c.RemainingArgs()
+		if len(names) == 0 {
+			return c.ArgErr()
+		}
+		if err := checkFeeds(names); err != nil {
+			return c.Err(err.Error())
+		}
+		cPath.Feeds = append(cPath.Feeds, names...)
+	case "expr":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		m, err := NewMatcher(MatcherSpec{Name: "expr", Args: []string{strings.Join(args, " ")}})
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		cPath.Matchers = append(cPath.Matchers, m)
+	case "dnsbl", "rdns", "hosting":
+		m, err := NewMatcher(MatcherSpec{Name: c.Val(), Args: c.RemainingArgs()})
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		cPath.Matchers = append(cPath.Matchers, m)
+	case "match":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if len(args) == 1 && (args[0] == MatchAllConditions || args[0] == MatchAnyCondition) {
+			cPath.MatchAll = args[0] == MatchAllConditions
+			break
+		}
+		m, err := NewMatcher(MatcherSpec{Name: args[0], Args: args[1:]})
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		cPath.Matchers = append(cPath.Matchers, m)
+	case "except":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "ip":
+			for _, ip := range args[1:] {
+				ranges, err := parseIPs(ip)
+				if err != nil {
+					return c.Err("ipfilter: " + err.Error())
+				}
+				cPath.ExceptRanges = append(cPath.ExceptRanges, ranges...)
+			}
+		case "country":
+			countries, err := ParseCountryCodes(args[1:])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			cPath.ExceptCountries = append(cPath.ExceptCountries, countries...)
+		default:
+			return c.Err("ipfilter: except should be followed by 'ip' or 'country'")
+		}
+	}
+	return nil
+}
+
+// isDefaultsBlock returns true if 'path' was parsed from an 'ipfilter defaults' block.
+func isDefaultsBlock(path IPPath) bool {
+	return len(path.PathScopes) == 1 && path.PathScopes[0] == "defaults"
+}
+
+// ipfilterParse parses all ipfilter {} blocks to an IPFConfig, they are checked in depth under 'caddy -validate'.
+func ipfilterParse(c *caddy.Controller) (IPFConfig, error) {
+	return validateParse(c, deepValidation(), validateRemote)
+}
+
+// validateParse parses the ipfilter blocks, with 'deep' it also checks the files, databases and, with
+// 'remote', the feeds the blocks refer to, and returns all the problems at once.
+func validateParse(c *caddy.Controller, deep, remote bool) (IPFConfig, error) {
+	config, err := parseBlocks(c, deep)
+	if !deep {
+		return config, err
+	}
+	// the blocks parsed before an error are checked as well.
+	problems := config.problems
+	if err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, config.deepCheck(remote && err == nil)...)
+	return config, joinProblems(problems)
+}
+
+// parseBlocks parses all ipfilter {} blocks, with 'validating' the problems that don't stop the parsing are
+// recorded in the config instead of returned.
+func parseBlocks(c *caddy.Controller, validating bool) (IPFConfig, error) {
+	config := IPFConfig{Bans: NewBanList(), Threat: NewThreat(), Maintenance: NewMaintenance(), hooks: &hookDispatcher{}}
+	config.validating = validating
+
+	var hasCountryCodes, hasRanges, hasMatchers, hasFamily, hasExceptASNs, hasHosting bool
+
+	for c.Next() {
+		hadPolicyDir := config.PolicyDir != ""
+		path, err := ipfilterParseSingle(&config, c)
+		if err != nil {
+			return config, err
+		}
+		if isDefaultsBlock(path) {
+			if config.defaults != nil || len(config.Paths) != 0 {
+				return config, c.Err("ipfilter: The defaults block should come once, before the other ipfilter blocks")
+			}
+			path.PathScopes = nil
+			config.defaults = &path
+			continue
+		}
+
+		// a block only declaring the policy_dir has no rule of its own.
+		if !hadPolicyDir && config.PolicyDir != "" &&
+			len(path.CountryCodes) == 0 && len(path.Ranges) == 0 && len(path.lists) == 0 && len(path.Feeds) == 0 &&
+			len(path.Hostnames) == 0 &&
+			len(path.Matchers) == 0 && path.Family == "" {
+			continue
+		}
+
+		if len(path.CountryCodes) != 0 || len(path.ExceptCountries) != 0 {
+			hasCountryCodes = true
+		}
+		if len(path.Ranges) != 0 || len(path.lists) != 0 || len(path.Feeds) != 0 || len(path.Hostnames) != 0 {
+			hasRanges = true
+		}
+		if len(path.Matchers) != 0 {
+			hasMatchers = true
+		}
+		if path.Family != "" {
+			hasFamily = true
+		}
+		if len(path.ExceptASNs) != 0 {
+			if len(path.CountryCodes) == 0 {
+				return config, c.Err("ipfilter: except_asn only applies to country rules")
+			}
+			hasExceptASNs = true
+		}
+		if usesMatcher(path, "hosting") {
+			hasHosting = true
+		}
+
+		config.Paths = append(config.Paths, path)
+	}
+
+	// the rules of policy_dir, rule_source and the admin endpoint can't serve any other file.
+	config.blockPages = make(map[string]bool)
+	if config.defaults != nil && config.defaults.BlockPage != "" {
+		config.blockPages[config.defaults.BlockPage] = true
+	}
+	for _, path := range config.Paths {
+		if path.BlockPage != "" {
+			config.blockPages[path.BlockPage] = true
+		}
+	}
+
+	if config.PolicyDir != "" {
+		if config.RuleSource != nil {
+			return config, c.Err("ipfilter: policy_dir can't be used with rule_source")
+		}
+		rs, err := LoadPolicyDir(config.PolicyDir)
+		if err != nil {
+			return config, c.Err(err.Error())
+		}
+		paths, err := config.rulePaths(context.Background(), rs)
+		if err != nil {
+			return config, c.Err(err.Error())
+		}
+		for _, path := range paths {
+			hasCountryCodes = hasCountryCodes || len(path.CountryCodes) != 0 || len(path.ExceptCountries) != 0
+			hasRanges = hasRanges || len(path.Ranges) != 0 || len(path.Feeds) != 0 || len(path.Hostnames) != 0
+			hasMatchers = hasMatchers || len(path.Matchers) != 0
+			hasFamily = hasFamily || path.Family != ""
+		}
+		config.Paths = append(config.Paths, paths...)
+	}
+
+	if hasExceptASNs && config.ASNHandler == nil {
+		return config, c.Err("ipfilter: ASN database is required for except_asn")
+	}
+	if hasHosting && config.ASNHandler == nil {
+		return config, c.Err("ipfilter: ASN database is required for hosting")
+	}
+	if err := config.CheckAnonymousIP(); err != nil {
+		return config, c.Err(err.Error())
+	}
+
+	// priorities would be silently ignored otherwise.
+	if err := checkPriorities(config.Paths, config.MatchMode); err != nil {
+		return config, c.Err(err.Error())
+	}
+
+	// the rules of the source replace the ones of the ipfilter blocks.
+	if config.RuleSource != nil {
+		if err := config.loadRuleSource(); err != nil {
+			return config, c.Err(err.Error())
+		}
+	}
+
+	// the lists are loaded here as http_fixtures may come after ip_list, the '!' entries of ip apply to them too.
+	for i := range config.Paths {
+		path := &config.Paths[i]
+		if len(path.lists) != 0 && config.validating {
+			// every list is loaded, to report all the invalid ones.
+			for _, l := range path.lists {
+				ranges, err := l.Load(config.httpClient())
+				if err != nil {
+					config.problems = append(config.problems, c.Err(err.Error()))
+				}
+				path.Ranges = append(path.Ranges, ranges...)
+			}
+		} else if len(path.lists) != 0 {
+			ranges, err := loadIPLists(context.Background(), path.lists, config.httpClient())
+			if err != nil {
+				return config, c.Err(err.Error())
+			}
+			path.Ranges = append(path.Ranges, ranges...)
+		}
+		if len(path.negated) != 0 {
+			path.Ranges = subtractRanges(path.Ranges, path.negated)
+		}
+		path.lists, path.negated = nil, nil
+	}
+
+	config.Paths = compactPaths(withRuleIDs(config.Paths), config.Storage)
+	config.scopes = newScopeTrie(config.Paths, config.MatchMode)
+	config.hooks.client = config.httpClient()
+	if config.Webhook != nil {
+		config.Webhook.client = config.httpClient()
+	}
+	if config.Alerts != nil {
+		if err := config.Alerts.check(); err != nil {
+			return config, c.Err(err.Error())
+		}
+		if config.Alerts.usesCountries() && !config.hasCountryLookups() {
+			return config, c.Err("ipfilter: Database is required for the new_top_country alerts")
+		}
+		config.Alerts.client = config.httpClient()
+	}
+	if config.GeoWebService != nil {
+		config.GeoWebService.client = config.httpClient()
+	}
+	config.Monitoring = NewMonitoringLists(config.httpClient())
+	config.Feeds = NewFeedLists(config.httpClient())
+	config.Hostnames = NewHostnameLists(config.HostnameRefresh)
+	config.Bans.hooks = config.hooks
+	config.Bans.fail2ban = config.Fail2Ban
+
+	if config.DBDiff != nil {
+		if config.DBHandler == nil {
+			return config, c.Err("ipfilter: database_diff requires an mmdb database")
+		}
+		config.DBDiff.path = config.dbPath
+		config.DBDiff.layout = config.dbLayout
+		config.DBDiff.client = config.httpClient()
+	}
+
+	if config.GeoStats != nil && !config.hasCountryLookups() {
+		return config, c.Err("ipfilter: geo_stats requires a database")
+	}
+
+	if err := config.CheckChallenges(); err != nil {
+		return config, c.Err(err.Error())
+	}
+
+	if config.RuleSource != nil {
+		// validated by loadRuleSource.
+		return config, nil
+	}
+
+	// having a database is mandatory if you are blocking by country codes.
+	if hasCountryCodes && !config.hasCountryLookups() {
+		return config, c.Err("ipfilter: Database is required to block/allow by country")
+	}
+
+	// needs atleast one of the three.
+	if !hasCountryCodes && !hasRanges && !hasMatchers && !hasFamily {
+		return config, c.Err("ipfilter: No IPs or Country codes has been provided")
+	}
+
+	return config, nil
+}
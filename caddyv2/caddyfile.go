@@ -0,0 +1,513 @@
+package caddyv2
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/pyed/ipfilter"
+)
+
+func init() {
+	httpcaddyfile.RegisterHandlerDirective("ipfilter", parseCaddyfile)
+}
+
+// parseCaddyfile sets up the handler from Caddyfile tokens.
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := new(IPFilter)
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens, the subdirectives of the Caddy 1
+// 'ipfilter' block declare a rule for its scopes, '/' if none, and 'scope' blocks declare more rules:
+//
+//	ipfilter [<scopes...>] {
+//		database   <path>
+//		database_format mmdb|ip2location|csv
+//		asn_database <path>
+//		anonymous_ip_database <path>
+//		maxmind_web_service <account_id> <license_key>
+//		geo_provider <name> [<args...>]
+//		match_mode first|longest|priority|allow_overrides
+//		support_key <key>
+//		pass_cookie <key> [<ttl>]
+//		captcha <provider> <site_key> <secret>
+//		policy_dir <dir>
+//		threat_auto <blocks> <window> <level>
+//		maintenance [on|off]
+//		maintenance_allow <ips...>
+//		maintenance_page <path>
+//		trusted_proxies <cidrs...>
+//		client_ip_header <names...>
+//		xff_strategy all|leftmost|rightmost|rightmost_untrusted [<hops>]
+//		reject_malformed_xff
+//		allow_loopback
+//		placeholders
+//		set_headers
+//		debug
+//		no_client_ip allow|block
+//		on_error   allow|block|500
+//		default    allow|block
+//		storage default|compact
+//
+//		rule       allow|block|allow_only|block_all_except
+//		ip         <ips...>
+//		ip_list    [<format>] <files or urls...>
+//		country    [not] <codes...>
+//		blockpage  <path>
+//		challenge  captcha|js|pow [<difficulty>]
+//		autoban    <n> requests per <window> for <duration>
+//		sample     <n>%
+//		active_from  <timestamp>
+//		active_until <timestamp>
+//		schedule   <HH:MM>-<HH:MM> [<days>] [<timezone>]
+//		strict
+//		exclude    <paths...>
+//		host       <hosts...>
+//		methods    <methods...>
+//		header     <name> <values...>
+//		family     ipv4|ipv6
+//		allow_monitoring <providers...>
+//		feed       <feeds...>
+//		xff_policy any|all|first|last
+//		priority   <n>
+//		threat_level <n>
+//		except_asn <asns...>
+//		except     ip|country <values...>
+//		expr       <expression>
+//		dnsbl      <zones...> [timeout=<duration>] [on_error=skip|match]
+//		rdns       <hostname patterns...> [timeout=<duration>]
+//		hosting    [<asn file>]
+//		match      <name> [<args...>]
+//		match      all|any
+//
+//		scope <scopes...> {
+//			rule allow|block|allow_only|block_all_except
+//			...
+//		}
+//	}
+func (m *IPFilter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		main := ipfilter.Rule{PathScopes: d.RemainingArgs()}
+		if len(main.PathScopes) == 0 {
+			main.PathScopes = []string{"/"}
+		}
+		var hasMain bool
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "database":
+				if !d.Args(&m.Database) {
+					return d.ArgErr()
+				}
+			case "database_format":
+				if !d.Args(&m.DatabaseFormat) {
+					return d.ArgErr()
+				}
+			case "asn_database":
+				if !d.Args(&m.ASNDatabase) {
+					return d.ArgErr()
+				}
+			case "anonymous_ip_database":
+				if !d.Args(&m.AnonymousIPDatabase) {
+					return d.ArgErr()
+				}
+			case "geo_provider":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.GeoProvider = &GeoProvider{Name: args[0], Args: args[1:]}
+			case "maxmind_web_service":
+				ws := new(MaxMindWebService)
+				if !d.Args(&ws.AccountID, &ws.LicenseKey) || d.NextArg() {
+					return d.ArgErr()
+				}
+				m.MaxMindWebService = ws
+			case "match_mode":
+				if !d.Args(&m.MatchMode) {
+					return d.ArgErr()
+				}
+			case "support_key":
+				if !d.Args(&m.SupportKey) {
+					return d.ArgErr()
+				}
+			case "pass_cookie":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				m.PassCookie = &PassCookie{Key: args[0]}
+				if len(args) == 2 {
+					ttl, err := time.ParseDuration(args[1])
+					if err != nil {
+						return d.Errf("ipfilter: Invalid pass_cookie ttl: %s", args[1])
+					}
+					m.PassCookie.TTL = caddy.Duration(ttl)
+				}
+			case "captcha":
+				captcha := new(Captcha)
+				if !d.Args(&captcha.Provider, &captcha.SiteKey, &captcha.Secret) || d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Captcha = captcha
+			case "threat_auto":
+				args := d.RemainingArgs()
+				if len(args) != 3 {
+					return d.ArgErr()
+				}
+				auto := new(ThreatAuto)
+				var err error
+				if auto.Blocks, err = strconv.Atoi(args[0]); err != nil {
+					return d.Errf("ipfilter: Invalid threat_auto blocks: %s", args[0])
+				}
+				window, err := time.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("ipfilter: Invalid threat_auto window: %s", args[1])
+				}
+				auto.Window = caddy.Duration(window)
+				if auto.Level, err = strconv.Atoi(args[2]); err != nil {
+					return d.Errf("ipfilter: Invalid threat_auto level: %s", args[2])
+				}
+				m.ThreatAuto = auto
+			case "maintenance":
+				args := d.RemainingArgs()
+				if len(args) > 1 {
+					return d.ArgErr()
+				}
+				if m.Maintenance == nil {
+					m.Maintenance = new(Maintenance)
+				}
+				switch {
+				case len(args) == 0 || args[0] == "on":
+					m.Maintenance.Enabled = true
+				case args[0] == "off":
+					m.Maintenance.Enabled = false
+				default:
+					return d.Err("ipfilter: maintenance should be 'on' or 'off'")
+				}
+			case "maintenance_allow":
+				ips := d.RemainingArgs()
+				if len(ips) == 0 {
+					return d.ArgErr()
+				}
+				if m.Maintenance == nil {
+					m.Maintenance = new(Maintenance)
+				}
+				m.Maintenance.Allow = append(m.Maintenance.Allow, ips...)
+			case "maintenance_page":
+				if m.Maintenance == nil {
+					m.Maintenance = new(Maintenance)
+				}
+				if !d.Args(&m.Maintenance.Page) {
+					return d.ArgErr()
+				}
+			case "trusted_proxies":
+				proxies := d.RemainingArgs()
+				if len(proxies) == 0 {
+					return d.ArgErr()
+				}
+				m.TrustedProxies = append(m.TrustedProxies, proxies...)
+			case "client_ip_header":
+				headers := d.RemainingArgs()
+				if len(headers) == 0 {
+					return d.ArgErr()
+				}
+				m.ClientIPHeaders = append(m.ClientIPHeaders, headers...)
+			case "xff_strategy":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				m.XFFStrategy = args[0]
+				if len(args) == 2 {
+					hops, err := strconv.Atoi(args[1])
+					if err != nil {
+						return d.Errf("ipfilter: Invalid number of trusted hops: %s", args[1])
+					}
+					m.TrustedHops = hops
+				}
+			case "no_client_ip":
+				if !d.Args(&m.NoClientIP) {
+					return d.ArgErr()
+				}
+			case "on_error":
+				if !d.Args(&m.OnError) {
+					return d.ArgErr()
+				}
+			case "default":
+				if !d.Args(&m.Default) {
+					return d.ArgErr()
+				}
+			case "allow_loopback":
+				m.AllowLoopback = true
+			case "placeholders":
+				m.Placeholders = true
+			case "set_headers":
+				m.SetHeaders = true
+			case "debug":
+				m.Debug = true
+			case "reject_malformed_xff":
+				m.RejectMalformedXFF = true
+			case "storage":
+				if !d.Args(&m.Storage) {
+					return d.ArgErr()
+				}
+			case "policy_dir":
+				if !d.Args(&m.PolicyDir) {
+					return d.ArgErr()
+				}
+			case "scope":
+				rule := ipfilter.Rule{PathScopes: d.RemainingArgs()}
+				if len(rule.PathScopes) == 0 {
+					return d.ArgErr()
+				}
+				for scopeNesting := d.Nesting(); d.NextBlock(scopeNesting); {
+					if err := unmarshalRuleDirective(d, &rule); err != nil {
+						return err
+					}
+				}
+				m.Rules = append(m.Rules, rule)
+			default:
+				if err := unmarshalRuleDirective(d, &main); err != nil {
+					return err
+				}
+				hasMain = true
+			}
+		}
+
+		if hasMain {
+			// keep the declaration order, it matters with 'match_mode first'.
+			m.Rules = append([]ipfilter.Rule{main}, m.Rules...)
+		}
+	}
+	return nil
+}
+
+// unmarshalRuleDirective parses a subdirective of a rule, d.Val() being its name.
+func unmarshalRuleDirective(d *caddyfile.Dispenser, rule *ipfilter.Rule) error {
+	switch d.Val() {
+	case "rule":
+		if !d.Args(&rule.Rule) {
+			return d.ArgErr()
+		}
+		if _, err := ipfilter.ParseRuleKind(rule.Rule); err != nil {
+			return d.Err(err.Error())
+		}
+	case "ip":
+		ips := d.RemainingArgs()
+		if len(ips) == 0 {
+			return d.ArgErr()
+		}
+		rule.IPs = append(rule.IPs, ips...)
+	case "ip_list":
+		args := d.RemainingArgs()
+		var format string
+		for _, name := range ipfilter.ListFormats() {
+			if len(args) != 0 && args[0] == name {
+				format, args = args[0], args[1:]
+			}
+		}
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		for _, source := range args {
+			rule.IPLists = append(rule.IPLists, ipfilter.IPList{Format: format, Source: source})
+		}
+	case "country":
+		countries := d.RemainingArgs()
+		negate := len(countries) != 0 && countries[0] == "not"
+		if negate {
+			countries = countries[1:]
+		}
+		if len(countries) == 0 {
+			return d.ArgErr()
+		}
+		countries, err := ipfilter.ParseCountryCodes(countries)
+		if err != nil {
+			return d.Err(err.Error())
+		}
+		if len(rule.CountryCodes) != 0 && rule.NegateCountries != negate {
+			return d.Err("ipfilter: country and country not can't be combined in a block")
+		}
+		rule.CountryCodes = append(rule.CountryCodes, countries...)
+		rule.NegateCountries = negate
+	case "blockpage":
+		if !d.Args(&rule.BlockPage) {
+			return d.ArgErr()
+		}
+	case "autoban":
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		rule.AutoBan = strings.Join(args, " ")
+	case "schedule":
+		args := d.RemainingArgs()
+		if _, err := ipfilter.ParseSchedule(args); err != nil {
+			return d.Err(err.Error())
+		}
+		rule.Schedules = append(rule.Schedules, strings.Join(args, " "))
+	case "active_from", "active_until":
+		option := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		if _, err := ipfilter.ParseTimestamp(d.Val()); err != nil {
+			return d.Err(err.Error())
+		}
+		if option == "active_from" {
+			rule.ActiveFrom = d.Val()
+		} else {
+			rule.ActiveUntil = d.Val()
+		}
+	case "sample":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		sample, err := ipfilter.ParseSample(d.Val())
+		if err != nil {
+			return d.Err(err.Error())
+		}
+		rule.Sample = sample
+	case "challenge":
+		args := d.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return d.ArgErr()
+		}
+		rule.Challenge = args[0]
+		if len(args) == 2 {
+			difficulty, err := strconv.Atoi(args[1])
+			if err != nil {
+				return d.Errf("ipfilter: Invalid challenge difficulty: %s", args[1])
+			}
+			rule.ChallengeDifficulty = difficulty
+		}
+	case "strict":
+		rule.Strict = true
+	case "family":
+		if !d.Args(&rule.Family) {
+			return d.ArgErr()
+		}
+	case "xff_policy":
+		if !d.Args(&rule.XFFPolicy) {
+			return d.ArgErr()
+		}
+	case "allow_monitoring":
+		providers := d.RemainingArgs()
+		if len(providers) == 0 {
+			return d.ArgErr()
+		}
+		rule.AllowMonitoring = append(rule.AllowMonitoring, providers...)
+	case "host":
+		hosts := d.RemainingArgs()
+		if len(hosts) == 0 {
+			return d.ArgErr()
+		}
+		rule.Hosts = append(rule.Hosts, hosts...)
+	case "methods":
+		methods := d.RemainingArgs()
+		if len(methods) == 0 {
+			return d.ArgErr()
+		}
+		rule.Methods = append(rule.Methods, methods...)
+	case "header":
+		args := d.RemainingArgs()
+		if len(args) < 2 {
+			return d.ArgErr()
+		}
+		rule.Headers = append(rule.Headers, ipfilter.HeaderCondition{Name: args[0], Values: args[1:]})
+	case "exclude":
+		excludes := d.RemainingArgs()
+		if len(excludes) == 0 {
+			return d.ArgErr()
+		}
+		rule.Excludes = append(rule.Excludes, excludes...)
+	case "feed":
+		feeds := d.RemainingArgs()
+		if len(feeds) == 0 {
+			return d.ArgErr()
+		}
+		rule.Feeds = append(rule.Feeds, feeds...)
+	case "dnsbl", "rdns":
+		name := d.Val()
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		rule.Matchers = append(rule.Matchers, ipfilter.MatcherSpec{Name: name, Args: args})
+	case "hosting":
+		rule.Matchers = append(rule.Matchers, ipfilter.MatcherSpec{Name: "hosting", Args: d.RemainingArgs()})
+	case "expr":
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		rule.Matchers = append(rule.Matchers, ipfilter.MatcherSpec{Name: "expr", Args: []string{strings.Join(args, " ")}})
+	case "match":
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		if len(args) == 1 && (args[0] == ipfilter.MatchAllConditions || args[0] == ipfilter.MatchAnyCondition) {
+			rule.MatchAll = args[0] == ipfilter.MatchAllConditions
+			break
+		}
+		rule.Matchers = append(rule.Matchers, ipfilter.MatcherSpec{Name: args[0], Args: args[1:]})
+	case "threat_level":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		level, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Err("ipfilter: Invalid threat_level: " + d.Val())
+		}
+		rule.ThreatLevel = level
+	case "priority":
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		priority, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Err("ipfilter: Invalid priority: " + d.Val())
+		}
+		rule.Priority = priority
+	case "except_asn":
+		asns := d.RemainingArgs()
+		if len(asns) == 0 {
+			return d.ArgErr()
+		}
+		for _, asn := range asns {
+			n, err := ipfilter.ParseASN(asn)
+			if err != nil {
+				return d.Err(err.Error())
+			}
+			rule.ExceptASNs = append(rule.ExceptASNs, n)
+		}
+	case "except":
+		args := d.RemainingArgs()
+		if len(args) < 2 {
+			return d.ArgErr()
+		}
+		switch args[0] {
+		case "ip":
+			rule.ExceptIPs = append(rule.ExceptIPs, args[1:]...)
+		case "country":
+			countries, err := ipfilter.ParseCountryCodes(args[1:])
+			if err != nil {
+				return d.Err(err.Error())
+			}
+			rule.ExceptCountries = append(rule.ExceptCountries, countries...)
+		default:
+			return d.Err("ipfilter: except should be followed by 'ip' or 'country'")
+		}
+	default:
+		return d.Errf("ipfilter: unknown subdirective '%s'", d.Val())
+	}
+	return nil
+}
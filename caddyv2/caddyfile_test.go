@@ -0,0 +1,391 @@
+package caddyv2
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/pyed/ipfilter"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  IPFilter
+	}{
+		{`ipfilter {
+			rule block
+			ip 192.168 10.0.0.1
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"192.168", "10.0.0.1"}}},
+		}},
+		{`ipfilter {
+			placeholders
+			set_headers
+			debug
+			default block
+			on_error allow
+			rule block
+			ip 10.0.0.1
+		}`, false, IPFilter{
+			Placeholders: true,
+			SetHeaders:   true,
+			Debug:        true,
+			Default:      "block",
+			OnError:      "allow",
+			Rules:        []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"10.0.0.1"}}},
+		}},
+		{`ipfilter /notglobal /secret {
+			rule allow
+			database ` + DataBase + `
+			country US JP
+			blockpage default.html
+			strict
+		}`, false, IPFilter{
+			Database: DataBase,
+			Rules: []ipfilter.Rule{{
+				PathScopes:   []string{"/notglobal", "/secret"},
+				Rule:         "allow",
+				CountryCodes: []string{"US", "JP"},
+				BlockPage:    "default.html",
+				Strict:       true,
+			}},
+		}},
+		{`ipfilter {
+			rule allow
+			database ` + DataBase + `
+			country not ru cn
+		}`, false, IPFilter{
+			Database: DataBase,
+			Rules:    []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "allow", CountryCodes: []string{"RU", "CN"}, NegateCountries: true}},
+		}},
+		{`ipfilter {
+			maxmind_web_service 123456 licensekey
+			rule block
+			country RU
+		}`, false, IPFilter{
+			MaxMindWebService: &MaxMindWebService{AccountID: "123456", LicenseKey: "licensekey"},
+			Rules:             []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", CountryCodes: []string{"RU"}}},
+		}},
+		{`ipfilter {
+			match_mode priority
+			support_key secret
+			pass_cookie passes 12h
+			captcha turnstile sitekey secret
+			scope /api {
+				rule block
+				ip 1.1.1.1
+				priority 5
+				challenge captcha
+				sample 10%
+			}
+			scope /admin /internal {
+				rule allow
+				ip 10.0
+				challenge pow 20
+				schedule 09:00-17:00 Mon-Fri UTC
+				schedule 22:00-06:00
+				active_until 2030-01-01T00:00:00Z
+			}
+		}`, false, IPFilter{
+			MatchMode:  "priority",
+			SupportKey: "secret",
+			PassCookie: &PassCookie{Key: "passes", TTL: caddy.Duration(12 * time.Hour)},
+			Captcha:    &Captcha{Provider: "turnstile", SiteKey: "sitekey", Secret: "secret"},
+			Rules: []ipfilter.Rule{
+				{PathScopes: []string{"/api"}, Rule: "block", IPs: []string{"1.1.1.1"}, Priority: 5, Challenge: "captcha", Sample: 10},
+				{PathScopes: []string{"/admin", "/internal"}, Rule: "allow", IPs: []string{"10.0"}, Challenge: "pow", ChallengeDifficulty: 20,
+					Schedules: []string{"09:00-17:00 Mon-Fri UTC", "22:00-06:00"}, ActiveUntil: "2030-01-01T00:00:00Z"},
+			},
+		}},
+		// the rule of the block comes first.
+		{`ipfilter {
+			scope /api {
+				rule block
+				ip 1.1.1.1
+			}
+			rule allow
+			ip 10.0
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{
+				{PathScopes: []string{"/"}, Rule: "allow", IPs: []string{"10.0"}},
+				{PathScopes: []string{"/api"}, Rule: "block", IPs: []string{"1.1.1.1"}},
+			},
+		}},
+		{`ipfilter {
+			rule block
+			match threat_feed internal high
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{
+				PathScopes: []string{"/"},
+				Rule:       "block",
+				Matchers:   []ipfilter.MatcherSpec{{Name: "threat_feed", Args: []string{"internal", "high"}}},
+			}},
+		}},
+		{`ipfilter {
+			rule block
+			expr "path.startsWith('/admin') && method == 'POST'"
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{
+				PathScopes: []string{"/"},
+				Rule:       "block",
+				Matchers:   []ipfilter.MatcherSpec{{Name: "expr", Args: []string{"path.startsWith('/admin') && method == 'POST'"}}},
+			}},
+		}},
+		{`ipfilter {
+			maintenance
+			maintenance_allow 10.0.0.0/8 192.168.1.1
+			maintenance_page /srv/maintenance.html
+			rule block
+			ip 1.1.1.1
+		}`, false, IPFilter{
+			Maintenance: &Maintenance{Enabled: true, Allow: []string{"10.0.0.0/8", "192.168.1.1"}, Page: "/srv/maintenance.html"},
+			Rules:       []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}}},
+		}},
+		{`ipfilter {
+			trusted_proxies 10.0.0.0/8 192.168.1.1
+			rule block
+			ip 1.1.1.1
+		}`, false, IPFilter{
+			TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"},
+			Rules:          []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}}},
+		}},
+		{`ipfilter {
+			rule allow
+			database ` + DataBase + `
+			country US
+			allow_monitoring pingdom uptimerobot
+		}`, false, IPFilter{
+			Database: DataBase,
+			Rules: []ipfilter.Rule{{
+				PathScopes:      []string{"/"},
+				Rule:            "allow",
+				CountryCodes:    []string{"US"},
+				AllowMonitoring: []string{"pingdom", "uptimerobot"},
+			}},
+		}},
+		{`ipfilter {
+			rule block
+			ip_list /etc/caddy/blocklist.netset
+			ip_list firehol https://iplists.firehol.org/files/firehol_level1.netset
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPLists: []ipfilter.IPList{
+				{Source: "/etc/caddy/blocklist.netset"},
+				{Format: "firehol", Source: "https://iplists.firehol.org/files/firehol_level1.netset"},
+			}}},
+		}},
+		{`ipfilter {
+			rule block
+			database ` + DataBase + `
+			country US
+			except ip 203.0.113.0/24
+			except country CA
+		}`, false, IPFilter{
+			Database: DataBase,
+			Rules: []ipfilter.Rule{{
+				PathScopes:      []string{"/"},
+				Rule:            "block",
+				CountryCodes:    []string{"US"},
+				ExceptIPs:       []string{"203.0.113.0/24"},
+				ExceptCountries: []string{"CA"},
+			}},
+		}},
+		{`ipfilter {
+			rule block
+			ip 1.1.1.1
+			except asn 1
+		}`, true, IPFilter{}},
+		{`ipfilter {
+			rule block
+			database ` + DataBase + `
+			country US
+			feed aws
+			match all
+		}`, false, IPFilter{
+			Database: DataBase,
+			Rules:    []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", CountryCodes: []string{"US"}, Feeds: []string{"aws"}, MatchAll: true}},
+		}},
+		{`ipfilter {
+			rule block
+			feed aws gcp
+			feed cloudflare
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", Feeds: []string{"aws", "gcp", "cloudflare"}}},
+		}},
+		{`ipfilter {
+			rule block
+			ip 1.1.1.1
+			exclude /health /static/*
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}, Excludes: []string{"/health", "/static/*"}}},
+		}},
+		{`ipfilter {
+			rule block
+			ip 1.1.1.1
+			host example.com *.example.com
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}, Hosts: []string{"example.com", "*.example.com"}}},
+		}},
+		{`ipfilter {
+			rule block
+			ip 1.1.1.1
+			methods POST DELETE
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}, Methods: []string{"POST", "DELETE"}}},
+		}},
+		{`ipfilter {
+			rule block
+			country RU
+			database ` + DataBase + `
+			header User-Agent *curl* *wget*
+		}`, false, IPFilter{
+			Database: DataBase,
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", CountryCodes: []string{"RU"},
+				Headers: []ipfilter.HeaderCondition{{Name: "User-Agent", Values: []string{"*curl*", "*wget*"}}}}},
+		}},
+		{`ipfilter {
+			rule block
+			family ipv6
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", Family: "ipv6"}},
+		}},
+		{`ipfilter {
+			rule allow
+			ip 1.1.1.1
+			xff_policy all
+		}`, false, IPFilter{
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "allow", IPs: []string{"1.1.1.1"}, XFFPolicy: "all"}},
+		}},
+		{`ipfilter {
+			xff_strategy rightmost_untrusted 2
+			rule block
+			ip 1.1.1.1
+		}`, false, IPFilter{
+			XFFStrategy: "rightmost_untrusted",
+			TrustedHops: 2,
+			Rules:       []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}}},
+		}},
+		{`ipfilter {
+			client_ip_header CF-Connecting-IP
+			client_ip_header True-Client-IP X-Forwarded-For
+			rule block
+			ip 1.1.1.1
+		}`, false, IPFilter{
+			ClientIPHeaders: []string{"CF-Connecting-IP", "True-Client-IP", "X-Forwarded-For"},
+			Rules:           []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}}},
+		}},
+		{"ipfilter {\nclient_ip_header\n}", true, IPFilter{}},
+		{"ipfilter {\nxff_strategy rightmost_untrusted two\n}", true, IPFilter{}},
+		{"ipfilter {\ntrusted_proxies\n}", true, IPFilter{}},
+		{"ipfilter {\nrule deny\n}", true, IPFilter{}},
+		{"ipfilter {\non_error\n}", true, IPFilter{}},
+		{"ipfilter {\nrule allow_only\nip 10.0.0.1\n}", false, IPFilter{
+			Rules: []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "allow_only", IPs: []string{"10.0.0.1"}}},
+		}},
+		{"ipfilter {\nip\n}", true, IPFilter{}},
+		{"ipfilter {\ncountry usa\n}", true, IPFilter{}},
+		{"ipfilter {\nmaxmind_web_service 123456\n}", true, IPFilter{}},
+		{"ipfilter {\ngeo_provider\n}", true, IPFilter{}},
+		{"ipfilter {\ngeo_provider ipinfo token rate=1000/24h\nrule block\nip 1.1.1.1\n}", false, IPFilter{
+			GeoProvider: &GeoProvider{Name: "ipinfo", Args: []string{"token", "rate=1000/24h"}},
+			Rules:       []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}}},
+		}},
+		{"ipfilter {\ndatabase_format\n}", true, IPFilter{}},
+		{"ipfilter {\ndatabase_format ip2location\ndatabase /data/IP2LOCATION-LITE-DB1.IPV6.BIN\nrule block\nip 1.1.1.1\n}", false, IPFilter{
+			Database:       "/data/IP2LOCATION-LITE-DB1.IPV6.BIN",
+			DatabaseFormat: "ip2location",
+			Rules:          []ipfilter.Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}}},
+		}},
+		{"ipfilter {\ncountry not\n}", true, IPFilter{}},
+		{"ipfilter {\ncountry US\ncountry not CA\n}", true, IPFilter{}},
+		{"ipfilter {\nexcept country germany\n}", true, IPFilter{}},
+		{"ipfilter {\npriority high\n}", true, IPFilter{}},
+		{"ipfilter {\nsample 0%\n}", true, IPFilter{}},
+		{"ipfilter {\nschedule 9-17\n}", true, IPFilter{}},
+		{"ipfilter {\nactive_from tomorrow\n}", true, IPFilter{}},
+		{"ipfilter {\nmaintenance maybe\n}", true, IPFilter{}},
+		{"ipfilter {\nscope {\nrule block\n}\n}", true, IPFilter{}},
+		{"ipfilter {\nunknown\n}", true, IPFilter{}},
+	}
+
+	for i, test := range tests {
+		var m IPFilter
+		err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(m, test.expected) {
+			t.Fatalf("Test %d: Expected: %+v, Got: %+v", i, test.expected, m)
+		}
+	}
+}
+
+// TestSchema checks that ipfilter.schema.json documents every JSON field of the handler and of the rules.
+func TestSchema(t *testing.T) {
+	data, err := ioutil.ReadFile("ipfilter.schema.json")
+	if err != nil {
+		t.Fatalf("Could not read the schema: %v", err)
+	}
+	var schema struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("Could not decode the schema: %v", err)
+	}
+	var rules struct {
+		Items struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(schema.Properties["rules"], &rules); err != nil {
+		t.Fatalf("Could not decode the rules schema: %v", err)
+	}
+
+	expected := append(jsonFields(reflect.TypeOf(IPFilter{})), "handler")
+	if got := propertyNames(schema.Properties); !reflect.DeepEqual(sorted(expected), got) {
+		t.Fatalf("Expected handler properties: %v, Got: %v", sorted(expected), got)
+	}
+	expected = jsonFields(reflect.TypeOf(ipfilter.Rule{}))
+	if got := propertyNames(rules.Items.Properties); !reflect.DeepEqual(sorted(expected), got) {
+		t.Fatalf("Expected rule properties: %v, Got: %v", sorted(expected), got)
+	}
+}
+
+// jsonFields returns the JSON names of the fields of a struct.
+func jsonFields(typ reflect.Type) []string {
+	var fields []string
+	for i := 0; i < typ.NumField(); i++ {
+		tag := typ.Field(i).Tag.Get("json")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		fields = append(fields, strings.Split(tag, ",")[0])
+	}
+	return fields
+}
+
+func propertyNames(properties map[string]json.RawMessage) []string {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	return sorted(names)
+}
+
+func sorted(s []string) []string {
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,372 @@
+// Package caddyv2 provides ipfilter as a Caddy 2 HTTP handler module, 'http.handlers.ipfilter',
+// and its 'ipfilter' Caddyfile directive.
+//
+// The rules use the same JSON as the admin endpoint of the Caddy 1 directive,
+// ipfilter.schema.json describes the whole handler:
+//
+//	{
+//		"handler": "ipfilter",
+//		"database": "/data/GeoLite.mmdb",
+//		"match_mode": "longest",
+//		"rules": [
+//			{"scopes": ["/"], "rule": "block", "countries": ["RU", "CN"]}
+//		]
+//	}
+package caddyv2
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pyed/ipfilter"
+)
+
+func init() {
+	caddy.RegisterModule(IPFilter{})
+	ipfilter.RegisterPlaceholderSetter(func(r *http.Request, name, value string) {
+		if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			repl.Set(name, value)
+		}
+	})
+}
+
+// IPFilter filters clients based on their IP or country's ISO code.
+type IPFilter struct {
+	// Rules are evaluated like the ipfilter blocks of a Caddyfile, see MatchMode.
+	Rules []ipfilter.Rule `json:"rules,omitempty"`
+	// Database is the MaxMind database used by country rules.
+	Database string `json:"database,omitempty"`
+	// DatabaseFormat is 'mmdb', the default, 'ip2location' for an IP2Location BIN Database or 'csv', see ipfilter.OpenCSVGeoDB.
+	DatabaseFormat string `json:"database_format,omitempty"`
+	// ASNDatabase is the MaxMind ASN database used by the 'except_asns' of country rules.
+	ASNDatabase string `json:"asn_database,omitempty"`
+	// AnonymousIPDatabase is the GeoIP2 Anonymous-IP database used by the is_* matchers, e.g. is_tor_exit_node.
+	AnonymousIPDatabase string `json:"anonymous_ip_database,omitempty"`
+	// MaxMindWebService looks up the countries the database doesn't have, or all of them without a database.
+	MaxMindWebService *MaxMindWebService `json:"maxmind_web_service,omitempty"`
+	// GeoProvider is any registered provider instead of MaxMindWebService, see ipfilter.RegisterGeoProvider.
+	GeoProvider *GeoProvider `json:"geo_provider,omitempty"`
+	// MatchMode decides which rule applies when several scopes match, see ipfilter.MatchLongest.
+	MatchMode string `json:"match_mode,omitempty"`
+	// SupportKey enables support codes, see ipfilter.NewSupportCode.
+	SupportKey string `json:"support_key,omitempty"`
+	// PassCookie lets the approved clients through the rules, see ipfilter.PassCookie.
+	PassCookie *PassCookie `json:"pass_cookie,omitempty"`
+	// Captcha is served by the rules with 'challenge' captcha, see ipfilter.Captcha.
+	Captcha *Captcha `json:"captcha,omitempty"`
+	// PolicyDir holds rules delegated to files, added to Rules, see ipfilter.LoadPolicyDir.
+	PolicyDir string `json:"policy_dir,omitempty"`
+	// ThreatAuto raises the threat level enabling the rules with a 'threat_level', see ipfilter.Threat.
+	ThreatAuto *ThreatAuto `json:"threat_auto,omitempty"`
+	// Maintenance blocks every client but its allowlist while it is enabled, see ipfilter.Maintenance.
+	Maintenance *Maintenance `json:"maintenance,omitempty"`
+	// TrustedProxies are the CIDRs whose X-Forwarded-For header is honored, every client's if empty.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// ClientIPHeaders hold the client IPs by order of priority, X-Forwarded-For then Forwarded if empty.
+	ClientIPHeaders []string `json:"client_ip_headers,omitempty"`
+	// XFFStrategy selects the X-Forwarded-For entries that are checked, see ipfilter.XFFAll.
+	XFFStrategy string `json:"xff_strategy,omitempty"`
+	// TrustedHops is the number of proxies in front of caddy for the 'rightmost_untrusted' XFFStrategy.
+	TrustedHops int `json:"trusted_hops,omitempty"`
+	// AllowLoopback allows the requests from the host itself, e.g. health checks, whatever the rules.
+	AllowLoopback bool `json:"allow_loopback,omitempty"`
+	// Placeholders sets {ipfilter_country}, {ipfilter_asn}, {ipfilter_action} and {ipfilter_rule} for the next handlers.
+	Placeholders bool `json:"placeholders,omitempty"`
+	// SetHeaders sets X-Client-Country, X-Client-ASN and X-Client-IP-Resolved on the allowed requests, see ipfilter.HeaderClientCountry.
+	SetHeaders bool `json:"set_headers,omitempty"`
+	// Debug describes the decisions in the X-IPFilter header of the responses, e.g. "blocked; rule=3; match=country:RU".
+	Debug bool `json:"debug,omitempty"`
+	// RejectMalformedXFF rejects the requests whose client IP headers are malformed or spoofed.
+	RejectMalformedXFF bool `json:"reject_malformed_xff,omitempty"`
+	// Default is "allow" or "block" for the requests no rule applies to, "allow" if empty.
+	Default string `json:"default,omitempty"`
+	// NoClientIP is "allow" or "block" for the requests without a client IP, e.g. on a unix socket, an error if empty.
+	NoClientIP string `json:"no_client_ip,omitempty"`
+	// OnError is "allow" or "block" for the requests the rules fail on, e.g. a broken database, "500" or empty
+	// fails them.
+	OnError string `json:"on_error,omitempty"`
+	// Storage is how the ranges of the rules are held in memory, see ipfilter.StorageCompact.
+	Storage string `json:"storage,omitempty"`
+
+	filter *ipfilter.IPFilter
+}
+
+// ThreatAuto raises the threat level to Level while at least Blocks requests are blocked per Window.
+type ThreatAuto struct {
+	Blocks int            `json:"blocks"`
+	Window caddy.Duration `json:"window"`
+	Level  int            `json:"level"`
+}
+
+// Maintenance blocks every client but those in Allow while it is Enabled, and serves them Page.
+type Maintenance struct {
+	Enabled bool     `json:"enabled,omitempty"`
+	Allow   []string `json:"allow,omitempty"`
+	Page    string   `json:"page,omitempty"`
+}
+
+// MaxMindWebService is a GeoIP2 Precision web services account, see ipfilter.MaxMindWebService.
+type MaxMindWebService struct {
+	AccountID  string `json:"account_id"`
+	LicenseKey string `json:"license_key"`
+}
+
+// GeoProvider is the registered geo provider Name, created from Args, see ipfilter.NewGeoWebService.
+type GeoProvider struct {
+	Name string   `json:"name"`
+	Args []string `json:"args,omitempty"`
+}
+
+// PassCookie signs the passes of the approved clients with Key, they are valid for TTL, a day by default.
+type PassCookie struct {
+	Key string         `json:"key"`
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+// Captcha is the CAPTCHA of the site at Provider, one of ipfilter.CaptchaProviders.
+type Captcha struct {
+	Provider string `json:"provider"`
+	SiteKey  string `json:"site_key"`
+	Secret   string `json:"secret"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (IPFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.ipfilter",
+		New: func() caddy.Module { return new(IPFilter) },
+	}
+}
+
+// Provision opens the database and compiles the rules.
+func (m *IPFilter) Provision(ctx caddy.Context) error {
+	var db, asnDB, anonymousDB *maxminddb.Reader
+	var countryDB ipfilter.CountryDB
+	switch m.DatabaseFormat {
+	case "", ipfilter.DatabaseMMDB, ipfilter.DatabaseIP2Location, ipfilter.DatabaseCSV:
+	default:
+		return errors.New("ipfilter: database_format should be 'mmdb', 'ip2location' or 'csv'")
+	}
+	if m.Database != "" {
+		var err error
+		if m.DatabaseFormat != "" && m.DatabaseFormat != ipfilter.DatabaseMMDB {
+			if countryDB, err = ipfilter.OpenCountryDB(m.Database, m.DatabaseFormat); err != nil {
+				return errors.New("ipfilter: Can't open database: " + m.Database + ": " + err.Error())
+			}
+		} else if db, err = maxminddb.Open(m.Database); err != nil {
+			return errors.New("ipfilter: Can't open database: " + m.Database)
+		}
+	}
+	if m.ASNDatabase != "" {
+		var err error
+		asnDB, err = maxminddb.Open(m.ASNDatabase)
+		if err != nil {
+			closeDatabases(countryDB, db)
+			return errors.New("ipfilter: Can't open ASN database: " + m.ASNDatabase)
+		}
+	}
+	if m.AnonymousIPDatabase != "" {
+		var err error
+		anonymousDB, err = maxminddb.Open(m.AnonymousIPDatabase)
+		if err != nil {
+			closeDatabases(countryDB, db, asnDB)
+			return errors.New("ipfilter: Can't open Anonymous-IP database: " + m.AnonymousIPDatabase)
+		}
+	}
+
+	rules := m.Rules
+	if m.PolicyDir != "" {
+		delegated, err := ipfilter.LoadPolicyDir(m.PolicyDir)
+		if err != nil {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return err
+		}
+		rules = append(append([]ipfilter.Rule(nil), rules...), delegated.Paths...)
+	}
+
+	lookups := ipfilter.IPFConfig{DBHandler: db, CountryDB: countryDB, ASNHandler: asnDB, MatchMode: m.MatchMode}
+	geo := m.GeoProvider
+	if ws := m.MaxMindWebService; ws != nil {
+		if geo != nil {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return errors.New("ipfilter: maxmind_web_service and geo_provider can't be combined")
+		}
+		geo = &GeoProvider{Name: "maxmind", Args: []string{ws.AccountID, ws.LicenseKey}}
+	}
+	if geo != nil {
+		var err error
+		if lookups.GeoWebService, err = ipfilter.NewGeoWebService(geo.Name, geo.Args, nil); err != nil {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return err
+		}
+	}
+	config, err := ipfilter.NewConfigWithLookups(ipfilter.RuleSet{Paths: rules}, lookups)
+	if err != nil {
+		closeDatabases(countryDB, db, asnDB, anonymousDB)
+		return err
+	}
+	config.AnonymousIPHandler = anonymousDB
+	if err := config.CheckAnonymousIP(); err != nil {
+		closeDatabases(countryDB, db, asnDB, anonymousDB)
+		return err
+	}
+	if auto := m.ThreatAuto; auto != nil {
+		if auto.Blocks <= 0 || auto.Window <= 0 || auto.Level <= 0 {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return errors.New("ipfilter: threat_auto needs positive blocks, window and level")
+		}
+		config.Threat.SetAuto(auto.Blocks, time.Duration(auto.Window), auto.Level)
+	}
+	if mm := m.Maintenance; mm != nil {
+		if err := config.Maintenance.AllowIPs(mm.Allow); err != nil {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return err
+		}
+		config.Maintenance.Page = mm.Page
+		config.Maintenance.Set(mm.Enabled, 0)
+	}
+	if m.SupportKey != "" {
+		config.SupportKey = []byte(m.SupportKey)
+	}
+	if pc := m.PassCookie; pc != nil {
+		if pc.Key == "" || pc.TTL < 0 {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return errors.New("ipfilter: pass_cookie needs a key and a positive ttl")
+		}
+		config.PassCookie = &ipfilter.PassCookie{Key: []byte(pc.Key), TTL: time.Duration(pc.TTL)}
+	}
+	if c := m.Captcha; c != nil {
+		if config.Captcha, err = ipfilter.NewCaptcha(c.Provider, c.SiteKey, c.Secret); err != nil {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return err
+		}
+	}
+	if err := config.CheckChallenges(); err != nil {
+		closeDatabases(countryDB, db, asnDB, anonymousDB)
+		return err
+	}
+	if len(m.TrustedProxies) != 0 {
+		if config.TrustedProxies, err = ipfilter.ParseTrustedProxies(m.TrustedProxies); err != nil {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return err
+		}
+	}
+	config.ClientIPHeaders = m.ClientIPHeaders
+	config.RejectMalformedXFF = m.RejectMalformedXFF
+	config.AllowLoopback = m.AllowLoopback
+	config.Placeholders = m.Placeholders
+	config.SetHeaders = m.SetHeaders
+	config.Debug = m.Debug
+	switch m.Default {
+	case "", ipfilter.ActionAllow, ipfilter.ActionBlock:
+		config.DefaultAction = m.Default
+	default:
+		closeDatabases(countryDB, db, asnDB, anonymousDB)
+		return errors.New("ipfilter: default should be 'allow' or 'block'")
+	}
+	switch m.NoClientIP {
+	case "", ipfilter.ActionAllow, ipfilter.ActionBlock:
+		config.NoClientIP = m.NoClientIP
+	default:
+		closeDatabases(countryDB, db, asnDB, anonymousDB)
+		return errors.New("ipfilter: no_client_ip should be 'allow' or 'block'")
+	}
+	switch m.OnError {
+	case "", ipfilter.ActionAllow, ipfilter.ActionBlock, ipfilter.OnError500:
+		config.OnError = m.OnError
+	default:
+		closeDatabases(countryDB, db, asnDB, anonymousDB)
+		return errors.New("ipfilter: on_error should be 'allow', 'block' or '500'")
+	}
+	if m.XFFStrategy != "" || m.TrustedHops != 0 {
+		strategy := m.XFFStrategy
+		if strategy == "" {
+			strategy = ipfilter.XFFAll
+		}
+		if err := config.SetXFFStrategy(strategy, m.TrustedHops); err != nil {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return err
+		}
+	}
+
+	if m.Storage != "" {
+		if err := config.SetStorage(m.Storage); err != nil {
+			closeDatabases(countryDB, db, asnDB, anonymousDB)
+			return err
+		}
+	}
+
+	m.filter = &ipfilter.IPFilter{Config: config}
+	return nil
+}
+
+// Validate checks the pages and the kinds of the databases, Provision already rejected invalid rules.
+func (m *IPFilter) Validate() error {
+	if m.filter == nil {
+		return errors.New("ipfilter: not provisioned")
+	}
+	return m.filter.Config.Validate()
+}
+
+// Cleanup closes the databases.
+func (m *IPFilter) Cleanup() error {
+	if m.filter == nil {
+		return nil
+	}
+	config := m.filter.Config
+	return closeDatabases(config.CountryDB, config.DBHandler, config.ASNHandler, config.AnonymousIPHandler)
+}
+
+// closeDatabases closes the databases that were opened, 'countryDB' may be nil as well.
+func closeDatabases(countryDB ipfilter.CountryDB, dbs ...*maxminddb.Reader) error {
+	var err error
+	if countryDB != nil {
+		err = countryDB.Close()
+	}
+	for _, db := range dbs {
+		if db != nil {
+			if closeErr := db.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (m *IPFilter) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	var nextCalled bool
+	var nextErr error
+
+	// the Caddy 1 handler calls Next when the request is allowed.
+	filter := *m.filter
+	filter.Next = ipfilter.NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		nextCalled = true
+		nextErr = next.ServeHTTP(w, r)
+		return 0, nextErr
+	})
+
+	status, err := filter.ServeHTTP(w, r)
+	if nextCalled {
+		return nextErr
+	}
+	if status >= 400 {
+		// let Caddy's error handling write the response.
+		return caddyhttp.Error(status, err)
+	}
+	return err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*IPFilter)(nil)
+	_ caddy.Validator             = (*IPFilter)(nil)
+	_ caddy.CleanerUpper          = (*IPFilter)(nil)
+	_ caddyhttp.MiddlewareHandler = (*IPFilter)(nil)
+	_ caddyfile.Unmarshaler       = (*IPFilter)(nil)
+)
@@ -0,0 +1,142 @@
+package caddyv2
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const DataBase = "../testdata/GeoLite2.mmdb"
+
+func TestIPFilterModule(t *testing.T) {
+	tests := []struct {
+		config         string
+		remoteAddr     string
+		path           string
+		expectedStatus int // 0 if the request reaches the next handler.
+	}{
+		{`{"rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`, "8.8.8.8:12345", "/", http.StatusForbidden},
+		{`{"rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`, "8.8.4.4:12345", "/", 0},
+		{`{"rules": [{"scopes": ["/private"], "rule": "allow", "ips": ["10.0.0.0-10.255.255.255"]}]}`, "8.8.8.8:12345", "/", 0},
+		{`{"rules": [{"scopes": ["/private"], "rule": "allow", "ips": ["10.0.0.0-10.255.255.255"]}]}`, "8.8.8.8:12345", "/private/a", http.StatusForbidden},
+		{`{"rules": [{"scopes": ["/private"], "rule": "allow", "ips": ["10.0.0.0-10.255.255.255"]}]}`, "10.1.2.3:12345", "/private/a", 0},
+		{`{"database": "` + DataBase + `", "rules": [{"scopes": ["/"], "rule": "block", "countries": ["US"]}]}`, "8.8.8.8:12345", "/", http.StatusForbidden},
+		{`{"database": "` + DataBase + `", "rules": [{"scopes": ["/"], "rule": "block", "countries": ["US"]}]}`, "5.175.96.22:12345", "/", 0},
+		{`{"database": "../testdata/countries.csv", "database_format": "csv", "rules": [{"scopes": ["/"], "rule": "block", "countries": ["DE"]}]}`, "1.2.3.4:12345", "/", http.StatusForbidden},
+		{`{"database": "../testdata/countries.csv", "database_format": "csv", "rules": [{"scopes": ["/"], "rule": "block", "countries": ["DE"]}]}`, "8.8.8.8:12345", "/", 0},
+	}
+
+	for i, test := range tests {
+		var m IPFilter
+		if err := json.Unmarshal([]byte(test.config), &m); err != nil {
+			t.Fatalf("Test %d: Could not decode the config: %v", i, err)
+		}
+		if err := m.Provision(caddy.NewTestContext()); err != nil {
+			t.Fatalf("Test %d: Provision failed: %v", i, err)
+		}
+		if err := m.Validate(); err != nil {
+			t.Fatalf("Test %d: Validate failed: %v", i, err)
+		}
+
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.remoteAddr
+
+		var nextCalled bool
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			nextCalled = true
+			return nil
+		})
+
+		err = m.ServeHTTP(httptest.NewRecorder(), req, next)
+		if test.expectedStatus == 0 {
+			if err != nil || !nextCalled {
+				t.Fatalf("Test %d: Expected the next handler to be called, Got: %v", i, err)
+			}
+		} else {
+			handlerErr, ok := err.(caddyhttp.HandlerError)
+			if !ok || handlerErr.StatusCode != test.expectedStatus || nextCalled {
+				t.Fatalf("Test %d: Expected StatusCode: '%d', Got: %v", i, test.expectedStatus, err)
+			}
+		}
+
+		if err := m.Cleanup(); err != nil {
+			t.Fatalf("Test %d: Cleanup failed: %v", i, err)
+		}
+	}
+}
+
+func TestIPFilterModuleInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"rules": []}`,
+		`{"rules": [{"scopes": ["/"], "rule": "deny", "ips": ["8.8.8.8"]}]}`,
+		`{"rules": [{"scopes": ["/"], "rule": "block", "countries": ["US"]}]}`,
+		`{"database": "/nonexistent.mmdb", "rules": [{"scopes": ["/"], "rule": "block", "countries": ["US"]}]}`,
+		`{"database": "` + DataBase + `", "database_format": "ip2location", "rules": [{"scopes": ["/"], "rule": "block", "countries": ["US"]}]}`,
+		`{"database": "` + DataBase + `", "database_format": "bin", "rules": [{"scopes": ["/"], "rule": "block", "countries": ["US"]}]}`,
+		`{"rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"], "allow_monitoring": ["nagios"]}]}`,
+		`{"rules": [{"scopes": ["/"], "rule": "block", "feeds": ["oracle"]}]}`,
+		`{"xff_strategy": "middle", "rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`,
+		`{"xff_strategy": "leftmost", "trusted_hops": 1, "rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`,
+		`{"pass_cookie": {"key": ""}, "rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`,
+		`{"captcha": {"provider": "geetest", "site_key": "a", "secret": "b"}, "pass_cookie": {"key": "k"}, "rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`,
+		`{"pass_cookie": {"key": "k"}, "rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"], "challenge": "captcha"}]}`,
+		`{"trusted_proxies": ["10.0.0.0/33"], "rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`,
+		`{"default": "deny", "rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`,
+		`{"on_error": "503", "rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`,
+		`{"asn_database": "` + DataBase + `", "rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`,
+		`{"rules": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"], "blockpage": "../testdata"}]}`,
+	} {
+		var m IPFilter
+		if err := json.Unmarshal([]byte(config), &m); err != nil {
+			t.Fatalf("Could not decode the config: %v", err)
+		}
+		err := m.Provision(caddy.NewTestContext())
+		if err == nil {
+			err = m.Validate()
+			m.Cleanup()
+		}
+		if err == nil {
+			t.Fatalf("Expected an error for %s", config)
+		}
+	}
+}
+
+func TestIPFilterPlaceholders(t *testing.T) {
+	var m IPFilter
+	config := `{"database": "` + DataBase + `", "placeholders": true, "rules": [{"scopes": ["/"], "rule": "block", "countries": ["RU"]}]}`
+	if err := json.Unmarshal([]byte(config), &m); err != nil {
+		t.Fatalf("Could not decode the config: %v", err)
+	}
+	if err := m.Provision(caddy.NewTestContext()); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer m.Cleanup()
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = "8.8.8.8:12345"
+	repl := caddy.NewReplacer()
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return nil
+	})
+	if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for name, expected := range map[string]string{"ipfilter_country": "US", "ipfilter_action": "allow", "ipfilter_rule": "1", "ipfilter_asn": ""} {
+		if value, _ := repl.Get(name); value != expected {
+			t.Errorf("Expected {%s} to be %q, Got: %q", name, expected, value)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CaptchaProvider is a CAPTCHA service: its widget is loaded from Script into an element of class Class, which
+// adds the token of a solved CAPTCHA to the form as Field. The token is checked against VerifyURL, like the
+// siteverify API of reCAPTCHA.
+type CaptchaProvider struct {
+	Script    string
+	Class     string
+	Field     string
+	VerifyURL string
+}
+
+var (
+	captchaProvidersMu sync.RWMutex
+	captchaProviders   = map[string]CaptchaProvider{
+		"hcaptcha": {
+			Script:    "https://js.hcaptcha.com/1/api.js",
+			Class:     "h-captcha",
+			Field:     "h-captcha-response",
+			VerifyURL: "https://api.hcaptcha.com/siteverify",
+		},
+		"recaptcha": {
+			Script:    "https://www.google.com/recaptcha/api.js",
+			Class:     "g-recaptcha",
+			Field:     "g-recaptcha-response",
+			VerifyURL: "https://www.google.com/recaptcha/api/siteverify",
+		},
+		"turnstile": {
+			Script:    "https://challenges.cloudflare.com/turnstile/v0/api.js",
+			Class:     "cf-turnstile",
+			Field:     "cf-turnstile-response",
+			VerifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		},
+	}
+)
+
+// RegisterCaptchaProvider makes 'provider' available as 'captcha <name>', plugins call it from their init
+// function.
+func RegisterCaptchaProvider(name string, provider CaptchaProvider) {
+	captchaProvidersMu.Lock()
+	defer captchaProvidersMu.Unlock()
+
+	if _, ok := captchaProviders[name]; ok {
+		panic("ipfilter: captcha provider " + name + " is already registered")
+	}
+	captchaProviders[name] = provider
+}
+
+// CaptchaProviders returns the names of the providers 'captcha' accepts.
+func CaptchaProviders() []string {
+	captchaProvidersMu.RLock()
+	defer captchaProvidersMu.RUnlock()
+
+	names := make([]string, 0, len(captchaProviders))
+	for name := range captchaProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Captcha is the CAPTCHA of 'challenge captcha', with the keys of the site at its provider.
+type Captcha struct {
+	Provider string
+	SiteKey  string
+	Secret   string
+}
+
+// NewCaptcha returns the CAPTCHA of the provider 'name'.
+func NewCaptcha(name, siteKey, secret string) (*Captcha, error) {
+	c := &Captcha{Provider: name, SiteKey: siteKey, Secret: secret}
+	if _, err := c.provider(); err != nil {
+		return nil, err
+	}
+	if siteKey == "" || secret == "" {
+		return nil, errors.New("ipfilter: captcha needs a site key and a secret")
+	}
+	return c, nil
+}
+
+// provider returns the registered provider of the CAPTCHA.
+func (c *Captcha) provider() (CaptchaProvider, error) {
+	captchaProvidersMu.RLock()
+	provider, ok := captchaProviders[c.Provider]
+	captchaProvidersMu.RUnlock()
+	if !ok {
+		return provider, errors.New("ipfilter: Unknown captcha provider: " + c.Provider + ", expected one of " + strings.Join(CaptchaProviders(), ", "))
+	}
+	return provider, nil
+}
+
+var captchaPage = template.Must(template.New("captcha").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>One more step</title>
+<script src="{{.Script}}" async defer></script>
+</head>
+<body>
+<form method="POST" action="{{.Action}}">
+<p>Please confirm you are not a robot to continue.</p>
+<input type="hidden" name="challenge" value="captcha">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+<div class="{{.Class}}" data-sitekey="{{.SiteKey}}"></div>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// serve writes the CAPTCHA page, its form sends the token to ChallengePath.
+func (c *Captcha) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	provider, err := c.provider()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	err = captchaPage.Execute(w, struct {
+		Script, Class, SiteKey, Action, Redirect string
+	}{provider.Script, provider.Class, c.SiteKey, ChallengePath, r.URL.RequestURI()})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// we wrote the page, return OK.
+	return http.StatusOK, nil
+}
+
+// verify returns true if the provider confirms the token of 'form' was solved by a client with 'ip'.
+func (c *Captcha) verify(client *http.Client, form url.Values, ip net.IP) (bool, error) {
+	provider, err := c.provider()
+	if err != nil {
+		return false, err
+	}
+	token := form.Get(provider.Field)
+	if token == "" {
+		return false, nil
+	}
+
+	resp, err := client.PostForm(provider.VerifyURL, url.Values{
+		"secret":   {c.Secret},
+		"response": {token},
+		"remoteip": {ip.String()},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New(provider.VerifyURL + " answered " + resp.Status)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
@@ -0,0 +1,153 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+// withCaptchaServer verifies the tokens of the provider 'name' with 'handler' until the returned function
+// is called.
+func withCaptchaServer(name string, handler http.HandlerFunc) func() {
+	server := httptest.NewServer(handler)
+	captchaProvidersMu.Lock()
+	saved := captchaProviders[name]
+	provider := saved
+	provider.VerifyURL = server.URL
+	captchaProviders[name] = provider
+	captchaProvidersMu.Unlock()
+
+	return func() {
+		captchaProvidersMu.Lock()
+		captchaProviders[name] = saved
+		captchaProvidersMu.Unlock()
+		server.Close()
+	}
+}
+
+func TestCaptchaChallenge(t *testing.T) {
+	defer withCaptchaServer("hcaptcha", func(w http.ResponseWriter, r *http.Request) {
+		success := r.PostFormValue("secret") == "secret" && r.PostFormValue("response") == "solved" &&
+			r.PostFormValue("remoteip") == "8.8.8.8"
+		fmt.Fprintf(w, `{"success": %t}`, success)
+	})()
+
+	config, err := ipfilterParse(caddy.NewTestController("http", `ipfilter /api {
+		rule block
+		ip 8.8.8.8
+		challenge captcha
+		pass_cookie passes
+		captcha hcaptcha sitekey secret
+	}
+	ipfilter /admin {
+		rule block
+		ip 8.8.8.8
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	request := func(method, target, body string, cookie *http.Cookie) (int, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "8.8.8.8:_"
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		return status, rec
+	}
+
+	// the page is written with a 403.
+	status, rec := request("GET", "/api/users?page=2", "", nil)
+	if status != http.StatusOK || rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected the CAPTCHA page with a 403, Got: '%d' and '%d'", status, rec.Code)
+	}
+	page := rec.Body.String()
+	for _, want := range []string{`class="h-captcha" data-sitekey="sitekey"`, `action="/.ipfilter/challenge"`, `value="/api/users?page=2"`} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("Expected %s in the CAPTCHA page, Got: %s", want, page)
+		}
+	}
+	// blocks without a challenge still block.
+	if status, _ := request("GET", "/admin", "", nil); status != http.StatusForbidden {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusForbidden, status)
+	}
+
+	answer := func(token, redirect string) url.Values {
+		return url.Values{"challenge": {"captcha"}, "redirect": {redirect}, "h-captcha-response": {token}}
+	}
+	tests := []struct {
+		form     url.Values
+		location string
+		passed   bool
+	}{
+		{answer("wrong", "/api/users"), "/api/users", false},
+		{answer("", "/api/users"), "/api/users", false},
+		{answer("solved", "//evil.example"), "/", true},
+		{answer("solved", "https://evil.example/"), "/", true},
+		{answer("solved", "/api/users?page=2"), "/api/users?page=2", true},
+	}
+	for i, test := range tests {
+		status, rec := request("POST", ChallengePath, test.form.Encode(), nil)
+		if status != http.StatusSeeOther || rec.Header().Get("Location") != test.location {
+			t.Fatalf("Test %d: Expected a redirect to %s, Got: '%d' to %s", i, test.location, status, rec.Header().Get("Location"))
+		}
+		if cookies := rec.Result().Cookies(); (len(cookies) == 1) != test.passed {
+			t.Fatalf("Test %d: Expected a pass: %t, Got: %v", i, test.passed, cookies)
+		}
+	}
+
+	_, rec = request("POST", ChallengePath, answer("solved", "/api").Encode(), nil)
+	cookie := rec.Result().Cookies()[0]
+	if status, _ := request("GET", "/api/users", "", cookie); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d' with the pass, Got: '%d'", http.StatusOK, status)
+	}
+	if status, _ := request("GET", ChallengePath, "", nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusMethodNotAllowed, status)
+	}
+}
+
+func TestCaptchaParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"challenge captcha\npass_cookie secret\ncaptcha turnstile sitekey secret", false},
+		{"pass_cookie secret\ncaptcha recaptcha sitekey secret", false},
+		{"challenge captcha\ncaptcha turnstile sitekey secret", true},
+		{"challenge captcha\npass_cookie secret", true},
+		{"challenge puzzle\npass_cookie secret\ncaptcha turnstile sitekey secret", true},
+		{"challenge\npass_cookie secret\ncaptcha turnstile sitekey secret", true},
+		{"pass_cookie secret\ncaptcha geetest sitekey secret", true},
+		{"pass_cookie secret\ncaptcha turnstile sitekey", true},
+		{"pass_cookie secret\ncaptcha turnstile sitekey secret\ncaptcha hcaptcha sitekey secret", true},
+	}
+
+	for i, test := range tests {
+		_, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\n"+test.input+"\n}"))
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+		}
+	}
+}
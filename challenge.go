@@ -0,0 +1,158 @@
+package ipfilter
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Challenges of 'challenge', served instead of blocking the clients a rule denies: the clients solving them
+// get a pass, see PassCookie.
+const (
+	ChallengeCaptcha = "captcha"
+	// ChallengeJS weeds out the clients that don't run JavaScript, e.g. scripts and most crawlers.
+	ChallengeJS = "js"
+	// ChallengePow makes the clients solve a hash puzzle, slowing down the automation that runs JavaScript.
+	ChallengePow = "pow"
+)
+
+// ChallengePath is where the challenge pages send their answers, on every site with a pass_cookie.
+const ChallengePath = "/.ipfilter/challenge"
+
+// maxChallengeForm is the size limit of the answers to the challenges.
+const maxChallengeForm = 64 << 10
+
+// checkChallenge returns an error if 'challenge' isn't one of the challenges, or its difficulty is invalid.
+func checkChallenge(challenge string, difficulty int) error {
+	switch challenge {
+	case "", ChallengeCaptcha, ChallengeJS, ChallengePow:
+	default:
+		return errors.New("ipfilter: challenge should be 'captcha', 'js' or 'pow'")
+	}
+	if difficulty < 0 || difficulty > maxPowDifficulty || (difficulty != 0 && challenge != ChallengePow) {
+		return errors.New("ipfilter: challenge difficulty should be between 1 and 32, and only applies to pow")
+	}
+	return nil
+}
+
+// CheckChallenges returns an error if the challenges of the rules can't be served: they need a pass_cookie
+// and the provider of their challenge.
+func (config *IPFConfig) CheckChallenges() error {
+	for _, path := range config.Paths {
+		if err := checkChallenge(path.Challenge, path.ChallengeDifficulty); err != nil {
+			return err
+		}
+		if path.Challenge == "" {
+			continue
+		}
+		if path.Challenge == ChallengeCaptcha && config.Captcha == nil {
+			return errors.New("ipfilter: challenge captcha requires a captcha")
+		}
+		if config.PassCookie == nil {
+			return errors.New("ipfilter: challenge requires a pass_cookie")
+		}
+	}
+	return nil
+}
+
+// servesChallenge returns true if one of the rules, or the decision hook, serves the challenge the passes of
+// 'kind' are granted for.
+func (config *IPFConfig) servesChallenge(kind string) bool {
+	if kind == ChallengeJS && config.DecisionHook != nil {
+		return true
+	}
+	for _, path := range config.Paths {
+		if path.Challenge != "" && requiredPass(path) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge serves the challenge of 'path' to a client it denies, the client is blocked if it can't be
+// served.
+func (ipf IPFilter) challenge(w http.ResponseWriter, r *http.Request, path IPPath, rule int) (int, error) {
+	switch {
+	case path.Challenge == ChallengeCaptcha && ipf.Config.Captcha != nil:
+		w.Header().Set("Cache-Control", "no-store")
+		ipf.logRequestDecision(r, path, rule, ActionChallenge)
+		return ipf.Config.Captcha.serve(w, r)
+	case path.Challenge == ChallengeJS && ipf.Config.PassCookie != nil:
+		clientIPs, err := ipf.clientIPs(r, path.Strict)
+		if err != nil {
+			break
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		ipf.logRequestDecision(r, path, rule, ActionChallenge)
+		return serveJSChallenge(w, r, ipf.Config.PassCookie, clientIPs[0])
+	case path.Challenge == ChallengePow && ipf.Config.PassCookie != nil:
+		clientIPs, err := ipf.clientIPs(r, path.Strict)
+		if err != nil {
+			break
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		ipf.logRequestDecision(r, path, rule, ActionChallenge)
+		return servePowChallenge(w, r, ipf.Config.PassCookie, clientIPs[0], powDifficulty(path))
+	}
+	return ipf.deny(w, r, path, rule)
+}
+
+// serveChallenge checks an answer to a challenge, the clients that solved it get a pass. Either way, they
+// are sent back to the page they requested.
+func (ipf IPFilter) serveChallenge(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxChallengeForm)
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	redirect := r.PostForm.Get("redirect")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = "/"
+	}
+
+	// the pass is bound to the IP the page it protects sees.
+	scopes := ipf.Config.scopes
+	if scopes == nil {
+		scopes = newScopeTrie(ipf.Config.Paths, ipf.Config.MatchMode)
+	}
+	var strict bool
+	if idx, _ := scopes.match(strings.SplitN(redirect, "?", 2)[0]); idx >= 0 {
+		strict = ipf.Config.Paths[idx].Strict
+	}
+	clientIPs, err := ipf.clientIPs(r, strict)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// the pass is as strong as the challenge, and only for the challenges of the rules.
+	var solved bool
+	var kind string
+	switch r.PostForm.Get("challenge") {
+	case ChallengeCaptcha:
+		if ipf.Config.Captcha != nil {
+			solved, err = ipf.Config.Captcha.verify(ipf.Config.httpClient(), r.PostForm, clientIPs[0])
+		}
+		kind = ChallengeCaptcha
+	case ChallengeJS:
+		solved = verifyJSChallenge(ipf.Config.PassCookie, r.PostForm, clientIPs[0], time.Now())
+		kind = ChallengeJS
+	case ChallengePow:
+		difficulty := verifyPowChallenge(ipf.Config.PassCookie, r.PostForm, clientIPs[0], time.Now())
+		solved, kind = difficulty > 0, passKind(ChallengePow, difficulty)
+	}
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: Can't verify the challenge of %s: %v", clientIPs[0], err)
+	}
+	if solved && ipf.Config.servesChallenge(kind) {
+		ipf.Config.PassCookie.grant(w, r, clientIPs[0], kind)
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+	return http.StatusSeeOther, nil
+}
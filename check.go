@@ -0,0 +1,204 @@
+//go:build !nocaddy
+// +build !nocaddy
+
+package ipfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
+)
+
+// CheckCommand is the caddy subcommand running CheckCaddyfile, e.g.
+// 'caddy ipfilter-check --conf Caddyfile --ip 203.0.113.9 --path /admin'.
+const CheckCommand = "ipfilter-check"
+
+func init() {
+	// caddy stops parsing its flags at the subcommand, and emits the startup event before loading the Caddyfile.
+	caddy.RegisterEventHook(CheckCommand, func(event caddy.EventName, info interface{}) error {
+		if event != caddy.StartupEvent || flag.Arg(0) != CheckCommand {
+			return nil
+		}
+		os.Exit(runCheck(flag.Args()[1:], os.Stdout, os.Stderr))
+		return nil
+	})
+}
+
+// CheckResult is what the ipfilter blocks of a site decide for a client, see CheckCaddyfile.
+type CheckResult struct {
+	Site string `json:"site"` // the addresses of the site, GlobalSite for the ipfilter_global blocks.
+	LookupResult
+	Match string `json:"match,omitempty"` // the condition of the block that matched, as in the debug header.
+}
+
+// GlobalSite is the site of the CheckResult of the ipfilter_global blocks.
+const GlobalSite = "ipfilter_global"
+
+// CheckCaddyfile returns what the ipfilter blocks of every site of the Caddyfile 'input' decide for a client
+// from 'ip' requesting 'path', with its country and ASN, the ipfilter_global blocks first. The sites without
+// ipfilter blocks are left out. The databases and files the blocks refer to are opened and closed right away.
+func CheckCaddyfile(filename string, input io.Reader, ip net.IP, path string) ([]CheckResult, error) {
+	blocks, err := caddyfile.Parse(filename, input, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the sets and the global filter are shared by the sites, like in a caddy instance.
+	c := caddy.NewTestController("http", "")
+	for _, block := range blocks {
+		if tokens, ok := block.Tokens["ipfilter_set"]; ok {
+			c.Dispenser = caddyfile.NewDispenserTokens(filename, tokens)
+			if err := ipfilterSetParse(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var results []CheckResult
+	check := func(site string, tokens []caddyfile.Token) error {
+		c.Dispenser = caddyfile.NewDispenserTokens(filename, tokens)
+		config, err := ipfilterParse(c)
+		defer discardConfig(config)
+		if err != nil {
+			return err
+		}
+		results = append(results, checkIP(IPFilter{Config: config}, site, ip, path))
+		return nil
+	}
+	for _, block := range blocks {
+		// a bare ipfilter_global only puts the global filter in front of the site.
+		if tokens := block.Tokens["ipfilter_global"]; len(tokens) > 1 {
+			if err := check(GlobalSite, tokens); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, block := range blocks {
+		if tokens, ok := block.Tokens["ipfilter"]; ok {
+			if err := check(strings.Join(block.Keys, ", "), tokens); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// checkIP returns the CheckResult of 'ipf' for a client from 'ip' requesting 'path'.
+func checkIP(ipf IPFilter, site string, ip net.IP, path string) CheckResult {
+	result := CheckResult{Site: site, LookupResult: ipf.Lookup(ip, path)}
+	if result.Country == "" && result.Error == "" && ipf.Config.hasCountryLookups() {
+		result.Country = UnknownCountry
+	}
+	if d := result.Decision; d != nil && d.Rule > 0 && !d.Banned {
+		r, err := http.NewRequest(http.MethodGet, path, nil)
+		if err == nil {
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+			result.Match = ipf.matchReason(ipf.Config.Paths[d.Rule-1], r)
+		}
+	}
+	return result
+}
+
+// runCheck runs the CheckCommand with the arguments 'args' and returns its exit code.
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet(CheckCommand, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	conf := flags.String("conf", "", "Caddyfile to check, the one of caddy's -conf or ./Caddyfile by default")
+	ipArg := flags.String("ip", "", "IP of the client")
+	path := flags.String("path", "/", "Path the client requests")
+	asJSON := flags.Bool("json", false, "Print the results as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	ip := net.ParseIP(*ipArg)
+	if ip == nil {
+		fmt.Fprintln(stderr, "ipfilter: --ip should be an IP address")
+		return 2
+	}
+	if *conf == "" {
+		*conf = "Caddyfile"
+		if f := flag.Lookup("conf"); f != nil && f.Value.String() != "" {
+			*conf = f.Value.String()
+		}
+	}
+
+	results, err := checkFile(*conf, ip, *path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *asJSON {
+		if err := json.NewEncoder(stdout).Encode(results); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+	for _, result := range results {
+		fmt.Fprint(stdout, formatCheckResult(result))
+	}
+	return 0
+}
+
+// checkFile runs CheckCaddyfile on the file 'path'.
+func checkFile(path string, ip net.IP, requestPath string) ([]CheckResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	results, err := CheckCaddyfile(path, f, ip, requestPath)
+	if err == nil && len(results) == 0 {
+		err = errors.New("ipfilter: " + path + " has no ipfilter blocks")
+	}
+	return results, err
+}
+
+// formatCheckResult describes 'result' for the CheckCommand, e.g.
+//
+//	example.com: block
+//	  rule 2, scope /admin, match country:RU
+//	  country RU, AS12389
+func formatCheckResult(result CheckResult) string {
+	d := result.Decision
+	if d == nil {
+		return fmt.Sprintf("%s: error: %s\n", result.Site, result.Error)
+	}
+	s := result.Site + ": " + d.Action + "\n"
+	switch {
+	case d.Maintenance:
+		s += "  the maintenance mode blocks every client but its allowlist\n"
+	case d.Rule == 0:
+		s += "  no rule applies, the default action decides\n"
+	case result.Match != "":
+		s += fmt.Sprintf("  rule %d, scope %s, match %s\n", d.Rule, d.Scope, result.Match)
+	default:
+		s += fmt.Sprintf("  rule %d, scope %s\n", d.Rule, d.Scope)
+	}
+
+	var lookups []string
+	if result.Country != "" {
+		lookups = append(lookups, "country "+result.Country)
+	}
+	if result.ASN != 0 {
+		lookups = append(lookups, "AS"+strconv.FormatUint(uint64(result.ASN), 10))
+	}
+	if len(lookups) != 0 {
+		s += "  " + strings.Join(lookups, ", ") + "\n"
+	}
+	if result.Error != "" {
+		s += "  error: " + result.Error + "\n"
+	}
+	return s
+}
@@ -0,0 +1,147 @@
+package ipfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckCaddyfile(t *testing.T) {
+	caddyfile := `
+example.com {
+	ipfilter_set office {
+		ip 10.0.0.0/8
+	}
+	ipfilter_global / {
+		rule block
+		ip 192.0.2.1
+	}
+	ipfilter / {
+		rule block
+		database ` + DataBase + `
+		country US
+	}
+	ipfilter /admin {
+		rule allow
+		use office
+	}
+}
+
+api.example.com www.example.com {
+	ipfilter_global
+	ipfilter /api {
+		rule block
+		ip 5.175.96.0/24
+	}
+}
+
+static.example.com {
+	gzip
+}`
+	tests := []struct {
+		ip       string
+		path     string
+		expected []string
+	}{
+		{"8.8.8.8", "/", []string{
+			"ipfilter_global: allow\n  rule 1, scope /, match none\n",
+			"example.com: block\n  rule 1, scope /, match country:US\n  country US\n",
+			"api.example.com, www.example.com: allow\n  no rule applies, the default action decides\n",
+		}},
+		{"10.1.2.3", "/admin/users", []string{
+			"ipfilter_global: allow\n  rule 1, scope /, match none\n",
+			"example.com: allow\n  rule 2, scope /admin, match ip:10.1.2.3\n  country unknown\n",
+			"api.example.com, www.example.com: allow\n  no rule applies, the default action decides\n",
+		}},
+		{"192.0.2.1", "/api", []string{
+			"ipfilter_global: block\n  rule 1, scope /, match ip:192.0.2.1\n",
+			"example.com: allow\n  rule 1, scope /, match none\n  country unknown\n",
+			"api.example.com, www.example.com: allow\n  rule 1, scope /api, match none\n",
+		}},
+	}
+	for i, test := range tests {
+		results, err := CheckCaddyfile("Caddyfile", strings.NewReader(caddyfile), net.ParseIP(test.ip), test.path)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if len(results) != len(test.expected) {
+			t.Fatalf("Test %d: Expected %d results, Got: %+v", i, len(test.expected), results)
+		}
+		for j, result := range results {
+			if s := formatCheckResult(result); s != test.expected[j] {
+				t.Errorf("Test %d: Expected:\n%s\nGot:\n%s", i, test.expected[j], s)
+			}
+		}
+	}
+
+	if _, err := CheckCaddyfile("Caddyfile", strings.NewReader("example.com {\nipfilter / {\nrule deny\n}\n}"), net.ParseIP("8.8.8.8"), "/"); err == nil {
+		t.Error("Expected the errors of the blocks")
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "Caddyfile")
+	if err := ioutil.WriteFile(conf, []byte("example.com {\nipfilter / {\nrule block\ndatabase "+DataBase+"\ncountry US\n}\n}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the block expired an hour ago, the next one starts in an hour.
+	dated := filepath.Join(dir, "Dated")
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if err := ioutil.WriteFile(dated, []byte("example.com {\nipfilter / {\nrule block\nip 8.8.8.8\nactive_until "+past+"\n}\nipfilter /admin {\nrule block\nip 8.8.8.8\nactive_from "+future+"\n}\n}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	maintenance := filepath.Join(dir, "Maintenance")
+	if err := ioutil.WriteFile(maintenance, []byte("example.com {\nipfilter / {\nrule allow\nip 8.8.8.8\nmaintenance\n}\n}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "Empty")
+	if err := ioutil.WriteFile(empty, []byte("example.com {\ngzip\n}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args         []string
+		expectedCode int
+		expectedOut  string
+	}{
+		{[]string{"--conf", conf, "--ip", "8.8.8.8"}, 0, "example.com: block\n  rule 1, scope /, match country:US\n  country US\n"},
+		{[]string{"--conf", conf, "--ip", "8.8.8.8", "--path", "/admin", "--json"}, 0,
+			`[{"site":"example.com","ip":"8.8.8.8","country":"US","decision":{"action":"block","rule":1,"scope":"/","country":"US"},"match":"country:US"}]` + "\n"},
+		{[]string{"--conf", dated, "--ip", "8.8.8.8"}, 0, "example.com: allow\n  no rule applies, the default action decides\n"},
+		{[]string{"--conf", dated, "--ip", "8.8.8.8", "--path", "/admin"}, 0, "example.com: allow\n  no rule applies, the default action decides\n"},
+		{[]string{"--conf", maintenance, "--ip", "8.8.8.8"}, 0, "example.com: block\n  the maintenance mode blocks every client but its allowlist\n"},
+		{[]string{"--conf", conf, "--ip", "8.8.8"}, 2, ""},
+		{[]string{"--conf", conf, "--ip", "8.8.8.8", "--unknown"}, 2, ""},
+		{[]string{"--conf", filepath.Join(dir, "none"), "--ip", "8.8.8.8"}, 1, ""},
+		{[]string{"--conf", empty, "--ip", "8.8.8.8"}, 1, ""},
+	}
+	for i, test := range tests {
+		var stdout, stderr bytes.Buffer
+		if code := runCheck(test.args, &stdout, &stderr); code != test.expectedCode || stdout.String() != test.expectedOut {
+			t.Errorf("Test %d: Expected %d and:\n%s\nGot %d and:\n%s%s", i, test.expectedCode, test.expectedOut, code, stdout.String(), stderr.String())
+		}
+		if test.expectedCode != 0 && stderr.Len() == 0 {
+			t.Errorf("Test %d: Expected an error message", i)
+		}
+	}
+
+	// the JSON is the one of the lookups.
+	var results []CheckResult
+	var stdout bytes.Buffer
+	runCheck([]string{"--conf", conf, "--ip", "2001:db8::1", "--json"}, &stdout, ioutil.Discard)
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil || len(results) != 1 || results[0].Decision.Action != ActionAllow {
+		t.Errorf("Expected an allowed client, Got: %s, %v", stdout.String(), err)
+	}
+}
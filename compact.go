@@ -0,0 +1,248 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// Storages of IPFConfig.Storage, deciding how the ranges of the IPPaths are held in memory.
+const (
+	StorageDefault = "default" // a slice of Range, scanned on every request.
+	StorageCompact = "compact" // CompactRanges, for lists of millions of ranges.
+)
+
+// compactBlockSize is the number of ranges decoded by a lookup in CompactRanges.
+const compactBlockSize = 32
+
+// SetStorage validates and sets Storage, moving the ranges of Paths to CompactRanges with StorageCompact.
+func (config *IPFConfig) SetStorage(storage string) error {
+	switch storage {
+	case StorageDefault, StorageCompact:
+	default:
+		return errors.New("ipfilter: storage should be 'default' or 'compact'")
+	}
+
+	config.Storage = storage
+	config.Paths = compactPaths(config.Paths, storage)
+	return nil
+}
+
+// compactPaths moves the Ranges of 'paths' to CompactRanges if 'storage' is StorageCompact.
+func compactPaths(paths []IPPath, storage string) []IPPath {
+	if storage != StorageCompact {
+		return paths
+	}
+	for i := range paths {
+		if len(paths[i].Ranges) != 0 {
+			paths[i].CompactRanges = NewCompactRanges(paths[i].Ranges)
+			paths[i].Ranges = nil
+		}
+	}
+	return paths
+}
+
+// hasRanges returns true if the path has ranges, in Ranges or in CompactRanges.
+func (path IPPath) hasRanges() bool {
+	return len(path.Ranges) != 0 || path.CompactRanges.Len() != 0
+}
+
+// ranges returns the Matcher of the ranges of the path.
+func (path IPPath) ranges() Matcher {
+	if path.CompactRanges != nil {
+		return path.CompactRanges
+	}
+	return rangeMatcher(path.Ranges)
+}
+
+// allRanges returns the ranges of the path, the ones of CompactRanges are merged.
+func (path IPPath) allRanges() []Range {
+	if path.CompactRanges != nil {
+		return path.CompactRanges.Ranges()
+	}
+	return path.Ranges
+}
+
+// uint128 is an IP in its 16-byte form, as a number.
+type uint128 struct {
+	hi, lo uint64
+}
+
+// maxUint128 is the last IPv6 address.
+var maxUint128 = uint128{^uint64(0), ^uint64(0)}
+
+func toUint128(ip net.IP) (uint128, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return uint128{}, false
+	}
+	return uint128{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}, true
+}
+
+func (u uint128) ip() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], u.hi)
+	binary.BigEndian.PutUint64(ip[8:], u.lo)
+	return ip
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func (u uint128) add(v uint128) uint128 {
+	lo := u.lo + v.lo
+	hi := u.hi + v.hi
+	if lo < u.lo {
+		hi++
+	}
+	return uint128{hi, lo}
+}
+
+func (u uint128) sub(v uint128) uint128 {
+	lo := u.lo - v.lo
+	hi := u.hi - v.hi
+	if u.lo < v.lo {
+		hi--
+	}
+	return uint128{hi, lo}
+}
+
+// CompactRanges holds ranges sorted and merged, in blocks of compactBlockSize: the start of every block is kept
+// as is and binary searched, the rest of the block is delta-encoded with varints. An IPv4 range takes about
+// 6 bytes instead of about 100 for a Range, at the cost of decoding a block on every lookup.
+type CompactRanges struct {
+	starts  []uint128 // first start of every block.
+	offsets []uint32  // where every block starts in data.
+	data    []byte
+	count   int
+}
+
+// NewCompactRanges returns the CompactRanges of 'ranges'.
+func NewCompactRanges(ranges []Range) *CompactRanges {
+	type span struct{ start, end uint128 }
+	spans := make([]span, 0, len(ranges))
+	for _, rng := range ranges {
+		start, ok1 := toUint128(rng.start)
+		end, ok2 := toUint128(rng.end)
+		if ok1 && ok2 && !end.less(start) {
+			spans = append(spans, span{start, end})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start.less(spans[j].start) })
+
+	// overlapping and adjacent ranges are merged, so that the gaps between them aren't empty.
+	merged := spans[:0]
+	for _, s := range spans {
+		if n := len(merged); n != 0 {
+			last := &merged[n-1]
+			if last.end == maxUint128 || !last.end.add(uint128{0, 1}).less(s.start) {
+				if last.end.less(s.end) {
+					last.end = s.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+
+	cr := &CompactRanges{count: len(merged)}
+	var buf [2 * binary.MaxVarintLen64]byte
+	put := func(u uint128) {
+		n := binary.PutUvarint(buf[:], u.lo)
+		n += binary.PutUvarint(buf[n:], u.hi)
+		cr.data = append(cr.data, buf[:n]...)
+	}
+	for i, s := range merged {
+		if i%compactBlockSize == 0 {
+			cr.starts = append(cr.starts, s.start)
+			cr.offsets = append(cr.offsets, uint32(len(cr.data)))
+		} else {
+			put(s.start.sub(merged[i-1].end))
+		}
+		put(s.end.sub(s.start))
+	}
+	return cr
+}
+
+// Len returns the number of ranges once merged, 0 for nil CompactRanges.
+func (cr *CompactRanges) Len() int {
+	if cr == nil {
+		return 0
+	}
+	return cr.count
+}
+
+// Contains returns true if 'ip' is in one of the ranges.
+func (cr *CompactRanges) Contains(ip net.IP) bool {
+	key, ok := toUint128(ip)
+	if !ok || cr.Len() == 0 {
+		return false
+	}
+
+	// the last block starting at or before the key.
+	block := sort.Search(len(cr.starts), func(i int) bool { return key.less(cr.starts[i]) }) - 1
+	if block < 0 {
+		return false
+	}
+
+	found := false
+	cr.block(block, func(start, end uint128) bool {
+		if key.less(start) {
+			return false
+		}
+		if !end.less(key) {
+			found = true
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// Ranges returns the merged ranges.
+func (cr *CompactRanges) Ranges() []Range {
+	ranges := make([]Range, 0, cr.Len())
+	for block := range cr.starts {
+		cr.block(block, func(start, end uint128) bool {
+			ranges = append(ranges, Range{start.ip(), end.ip()})
+			return true
+		})
+	}
+	return ranges
+}
+
+// block decodes the ranges of 'block' in order, until 'f' returns false.
+func (cr *CompactRanges) block(block int, f func(start, end uint128) bool) {
+	data := cr.data[cr.offsets[block]:]
+	get := func() uint128 {
+		lo, n := binary.Uvarint(data)
+		hi, m := binary.Uvarint(data[n:])
+		data = data[n+m:]
+		return uint128{hi, lo}
+	}
+
+	n := cr.count - block*compactBlockSize
+	if n > compactBlockSize {
+		n = compactBlockSize
+	}
+	start := cr.starts[block]
+	for i := 0; i < n; i++ {
+		if i != 0 {
+			start = start.add(get())
+		}
+		end := start.add(get())
+		if !f(start, end) {
+			return
+		}
+		start = end
+	}
+}
+
+// Match implements Matcher.
+func (cr *CompactRanges) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	return cr.Contains(ip), nil
+}
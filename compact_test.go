@@ -0,0 +1,140 @@
+package ipfilter
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestCompactRanges(t *testing.T) {
+	tests := []struct {
+		ips      []string
+		expected []string
+	}{
+		{[]string{"1.1.1.1"}, []string{"1.1.1.1"}},
+		// overlapping and adjacent ranges are merged.
+		{[]string{"1.1.1.11-20", "1.1.1.5", "1.1.1.1-1.1.1.10"}, []string{"1.1.1.1-1.1.1.20"}},
+		{[]string{"1.1.1.1-10", "1.1.1.12-20"}, []string{"1.1.1.1-1.1.1.10", "1.1.1.12-1.1.1.20"}},
+		{[]string{"10", "10.1.2.3", "192.168"}, []string{"10.0.0.0-10.255.255.255", "192.168.0.0-192.168.255.255"}},
+	}
+
+	for i, test := range tests {
+		var ranges []Range
+		for _, ip := range test.ips {
+			rng, err := parseIP(ip)
+			if err != nil {
+				t.Fatalf("Test %d: Can't parse %s: %v", i, ip, err)
+			}
+			ranges = append(ranges, rng)
+		}
+
+		var got []string
+		for _, rng := range NewCompactRanges(ranges).Ranges() {
+			got = append(got, rng.String())
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Fatalf("Test %d: Expected: %v, Got: %v", i, test.expected, got)
+		}
+	}
+}
+
+// TestCompactRangesMatch checks that CompactRanges matches the same IPs as the ranges it holds.
+func TestCompactRangesMatch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randomIP := func() net.IP {
+		ip := make(net.IP, net.IPv6len)
+		if rnd.Intn(2) == 0 {
+			// IPv4 in a few /16 so that the ranges overlap.
+			copy(ip, net.IPv4(byte(1+rnd.Intn(3)), byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256))))
+			return ip
+		}
+		copy(ip, net.ParseIP("2001:db8::"))
+		ip[13], ip[14], ip[15] = byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256))
+		return ip
+	}
+
+	var ranges []Range
+	var probes []net.IP
+	for i := 0; i < 5000; i++ {
+		start := randomIP()
+		end := append(net.IP(nil), start...)
+		end[15] += byte(rnd.Intn(256 - int(end[15])))
+		if rnd.Intn(10) == 0 {
+			end[14] = 255
+		}
+		ranges = append(ranges, Range{start, end})
+		probes = append(probes, start, end, randomIP())
+	}
+
+	cr := NewCompactRanges(ranges)
+	if cr.Len() == 0 || cr.Len() > len(ranges) || len(cr.starts) < 2 {
+		t.Fatalf("Expected several blocks of merged ranges, Got: %d ranges in %d blocks", cr.Len(), len(cr.starts))
+	}
+	ctx := context.Background()
+	for _, ip := range append(probes, net.ParseIP("0.0.0.0"), net.ParseIP("ffff::1"), nil) {
+		expected, _ := rangeMatcher(ranges).Match(ctx, ip, nil)
+		got, _ := cr.Match(ctx, ip, nil)
+		if got != expected {
+			t.Fatalf("%s: Expected: %v, Got: %v", ip, expected, got)
+		}
+	}
+}
+
+func TestStorageCompact(t *testing.T) {
+	tests := []struct {
+		config         string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"rule block\nip 1.1.1.1 8.8.4", "8.8.4.4:_", http.StatusForbidden},
+		{"rule block\nip 1.1.1.1 8.8.4", "8.8.8.8:_", http.StatusOK},
+		{"rule allow\nip 1.1.1.1 8.8.4", "8.8.8.8:_", http.StatusForbidden},
+		{"rule allow\nip 1.1.1.1-10 8.8.4", "1.1.1.5:_", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nstorage compact\n"+test.config+"\n}"))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if path := config.Paths[0]; len(path.Ranges) != 0 || path.CompactRanges.Len() == 0 {
+			t.Fatalf("Test %d: Expected compact ranges, Got: %d ranges", i, len(path.Ranges))
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nstorage compact\nrule block\nip 1.1.1.1 1.1.1.2\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ips := RulesFromPaths(config.Paths).Paths[0].IPs; !reflect.DeepEqual(ips, []string{"1.1.1.1-1.1.1.2"}) {
+		t.Fatalf("Expected the merged ranges, Got: %v", ips)
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nstorage small\nrule block\nip 1.1.1.1\n}")); err == nil {
+		t.Fatal("Expected an error for an unknown storage")
+	}
+}
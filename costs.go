@@ -0,0 +1,191 @@
+package ipfilter
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Subsystems whose cost is tracked per request.
+const (
+	CostRangeMatch = "range_match"
+	CostDBLookup   = "db_lookup"
+	CostRemote     = "remote"
+	CostCache      = "cache"
+	CostTotal      = "total"
+)
+
+// defaultCostWindow is the number of recent requests kept per subsystem.
+const defaultCostWindow = 4096
+
+// costs is shared by every site that enables 'cost_accounting', it is published as the 'ipfilter_costs' expvar.
+var (
+	costs        = NewCostAccounting(defaultCostWindow)
+	publishCosts sync.Once
+)
+
+// CostAccounting keeps a rolling window of per-request durations for each subsystem.
+type CostAccounting struct {
+	mu      sync.Mutex
+	window  int
+	budget  time.Duration // of a request, see SetBudget.
+	windows map[string]*costWindow
+}
+
+// costWindow is a ring buffer of the latest samples of a single subsystem.
+type costWindow struct {
+	samples []time.Duration
+	next    int
+	count   uint64
+}
+
+// CostSummary describes the cost of a subsystem, durations are in microseconds. Requests counts the requests
+// since the start, the other fields describe the Samples of the current window.
+type CostSummary struct {
+	Requests uint64  `json:"requests"`
+	Samples  int     `json:"samples"`
+	Mean     float64 `json:"mean_us"`
+	P50      float64 `json:"p50_us"`
+	P90      float64 `json:"p90_us"`
+	P99      float64 `json:"p99_us"`
+	Max      float64 `json:"max_us"`
+	Budget   float64 `json:"budget_us,omitempty"` // see SetBudget.
+	// share of the samples over the Budget, from 0 to 1, for the total the requests the filter was too slow on.
+	OverBudget float64 `json:"over_budget,omitempty"`
+}
+
+// NewCostAccounting returns a CostAccounting keeping the last 'window' samples of each subsystem.
+func NewCostAccounting(window int) *CostAccounting {
+	if window <= 0 {
+		window = defaultCostWindow
+	}
+	return &CostAccounting{window: window, windows: make(map[string]*costWindow)}
+}
+
+// SetBudget sets the time the filter may spend on a request, the summaries report the share of their samples
+// over it, zero disables it.
+func (ca *CostAccounting) SetBudget(budget time.Duration) {
+	ca.mu.Lock()
+	ca.budget = budget
+	ca.mu.Unlock()
+}
+
+// Observe records the time a subsystem spent on a single request.
+func (ca *CostAccounting) Observe(subsystem string, d time.Duration) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	cw, ok := ca.windows[subsystem]
+	if !ok {
+		cw = &costWindow{samples: make([]time.Duration, 0, ca.window)}
+		ca.windows[subsystem] = cw
+	}
+	if len(cw.samples) < ca.window {
+		cw.samples = append(cw.samples, d)
+	} else {
+		cw.samples[cw.next] = d
+		cw.next = (cw.next + 1) % ca.window
+	}
+	cw.count++
+}
+
+// Report returns a summary for every subsystem observed so far.
+func (ca *CostAccounting) Report() map[string]CostSummary {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	report := make(map[string]CostSummary, len(ca.windows))
+	for name, cw := range ca.windows {
+		sorted := make([]time.Duration, len(cw.samples))
+		copy(sorted, cw.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		var total time.Duration
+		var over int
+		for _, d := range sorted {
+			total += d
+			if ca.budget > 0 && d > ca.budget {
+				over++
+			}
+		}
+		summary := CostSummary{
+			Requests: cw.count,
+			Samples:  len(sorted),
+			Mean:     micros(total / time.Duration(len(sorted))),
+			P50:      micros(percentile(sorted, 50)),
+			P90:      micros(percentile(sorted, 90)),
+			P99:      micros(percentile(sorted, 99)),
+			Max:      micros(sorted[len(sorted)-1]),
+		}
+		if ca.budget > 0 {
+			summary.Budget = micros(ca.budget)
+			summary.OverBudget = float64(over) / float64(len(sorted))
+		}
+		report[name] = summary
+	}
+	return report
+}
+
+// percentile returns the p-th percentile of an already sorted, non-empty slice.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// requestCost accumulates the time spent in each subsystem while handling one request,
+// a nil *requestCost is valid and records nothing.
+type requestCost struct {
+	start    time.Time
+	spent    map[string]time.Duration
+	reported bool
+}
+
+func newRequestCost() *requestCost {
+	return &requestCost{start: time.Now(), spent: make(map[string]time.Duration)}
+}
+
+// track adds the time elapsed since 'start' to a subsystem.
+func (rc *requestCost) track(subsystem string, start time.Time) {
+	if rc == nil {
+		return
+	}
+	rc.spent[subsystem] += time.Since(start)
+}
+
+// now returns the current time, or the zero time when accounting is disabled.
+func (rc *requestCost) now() time.Time {
+	if rc == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// done reports the request's costs to 'ca', once: it is called before handing the request to the next
+// handler, whose time isn't the filter's, and when the filter answers itself.
+func (rc *requestCost) done(ca *CostAccounting) {
+	if rc == nil || ca == nil || rc.reported {
+		return
+	}
+	rc.reported = true
+	for subsystem, d := range rc.spent {
+		ca.Observe(subsystem, d)
+	}
+	ca.Observe(CostTotal, time.Since(rc.start))
+}
+
+// publishCostAccounting exposes the shared CostAccounting through expvar, only once per process.
+func publishCostAccounting() {
+	publishCosts.Do(func() {
+		expvar.Publish("ipfilter_costs", expvar.Func(func() interface{} {
+			return costs.Report()
+		}))
+	})
+}
@@ -0,0 +1,159 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestCostAccountingReport(t *testing.T) {
+	ca := NewCostAccounting(100)
+	for i := 1; i <= 200; i++ {
+		ca.Observe(CostDBLookup, time.Duration(i)*time.Microsecond)
+	}
+
+	report := ca.Report()
+	summary, ok := report[CostDBLookup]
+	if !ok {
+		t.Fatalf("Expected a summary for '%s', got: %v", CostDBLookup, report)
+	}
+
+	// only the last 100 samples (101..200) are kept, but every request is counted.
+	if summary.Requests != 200 || summary.Samples != 100 {
+		t.Errorf("Expected 200 requests and 100 samples, got: %d and %d", summary.Requests, summary.Samples)
+	}
+	// the mean is the one of the samples, like the percentiles.
+	if summary.Mean != 150.5 {
+		t.Errorf("Expected mean of 150.5us, got: %v", summary.Mean)
+	}
+	if summary.P50 != 150 {
+		t.Errorf("Expected p50 of 150us, got: %v", summary.P50)
+	}
+	if summary.P99 != 199 {
+		t.Errorf("Expected p99 of 199us, got: %v", summary.P99)
+	}
+	if summary.Max != 200 {
+		t.Errorf("Expected max of 200us, got: %v", summary.Max)
+	}
+	if summary.Budget != 0 || summary.OverBudget != 0 {
+		t.Errorf("Expected no budget, got: %v and %v", summary.Budget, summary.OverBudget)
+	}
+
+	ca.SetBudget(180 * time.Microsecond)
+	if summary = ca.Report()[CostDBLookup]; summary.Budget != 180 || summary.OverBudget != 0.2 {
+		t.Errorf("Expected 20%% of the samples over a budget of 180us, got: %v over %vus", summary.OverBudget, summary.Budget)
+	}
+}
+
+func TestCostAccountingParse(t *testing.T) {
+	defer costs.SetBudget(0)
+
+	tests := []struct {
+		input     string
+		budget    time.Duration
+		shouldErr bool
+	}{
+		{"cost_accounting", 0, false},
+		{"cost_accounting 2ms", 2 * time.Millisecond, false},
+		{"cost_accounting soon", 0, true},
+		{"cost_accounting -2ms", 0, true},
+		{"cost_accounting 2ms 3ms", 0, true},
+	}
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\n"+test.input+"\n}"))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if config.Costs != costs || costs.budget != test.budget {
+			t.Errorf("Test %d: Expected the shared accounting with a budget of %v, Got: %v", i, test.budget, costs.budget)
+		}
+	}
+}
+
+func TestCostAccountingServeHTTP(t *testing.T) {
+	ca := NewCostAccounting(10)
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: IPFConfig{
+			Paths: []IPPath{
+				{
+					PathScopes: []string{"/"},
+					IsBlock:    true,
+					Ranges: []Range{
+						{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")},
+					},
+				},
+			},
+			Costs: ca,
+		},
+	}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = "8.8.4.4:12345"
+
+	if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+
+	report := ca.Report()
+	for _, subsystem := range []string{CostRangeMatch, CostTotal} {
+		if report[subsystem].Requests != 1 {
+			t.Errorf("Expected 1 request for '%s', got: %d", subsystem, report[subsystem].Requests)
+		}
+	}
+	if _, ok := report[CostDBLookup]; ok {
+		t.Errorf("Expected no '%s' cost without country codes", CostDBLookup)
+	}
+}
+
+func TestCostAccountingExcludesNext(t *testing.T) {
+	ca := NewCostAccounting(10)
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			time.Sleep(50 * time.Millisecond)
+			return http.StatusOK, nil
+		}),
+		Config: IPFConfig{
+			Paths: []IPPath{
+				{PathScopes: []string{"/api"}, IsBlock: true, Ranges: []Range{{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}}},
+			},
+			Costs:    ca,
+			GeoStats: NewGeoStats(),
+		},
+	}
+
+	// allowed by the block, then by default.
+	for _, path := range []string{"/api", "/"} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "8.8.4.4:12345"
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != http.StatusOK {
+			t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+		}
+	}
+	total := ca.Report()[CostTotal]
+	if total.Requests != 2 {
+		t.Errorf("Expected 2 requests, got: %d", total.Requests)
+	}
+	if total.Max >= micros(50*time.Millisecond) {
+		t.Errorf("Expected the cost to exclude the next handler, got a max of %vus", total.Max)
+	}
+}
@@ -0,0 +1,104 @@
+package ipfilter
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// counters are shared by every site of the process, they are published with the gauges of the running filters
+// as the 'ipfilter' expvar, and served by the '/counters' route of the admin endpoint.
+var counters struct {
+	Lookups      expvar.Int // country lookups in the database.
+	LookupErrors expvar.Int
+	CacheHits    expvar.Int // country lookups answered by the geo_cache.
+	CacheMisses  expvar.Int
+	Blocked      expvar.Int // requests denied, bans included.
+	RuleErrors   expvar.Int // requests the rules failed on, whatever on_error decided.
+	ParseErrors  expvar.Int // invalid ipfilter blocks, and invalid rules from the admin endpoint or a rule_source.
+}
+
+// running are the filters caddy started, their bans and feeds are reported with the counters.
+var running = struct {
+	sync.Mutex
+	filters map[*liveConfig]bool
+}{filters: make(map[*liveConfig]bool)}
+
+func init() {
+	expvar.Publish("ipfilter", expvar.Func(func() interface{} {
+		return countersReport()
+	}))
+}
+
+// CountersReport is the JSON report of the counters.
+type CountersReport struct {
+	Lookups      int64              `json:"lookups"`
+	LookupErrors int64              `json:"lookup_errors"`
+	CacheHits    int64              `json:"cache_hits"`
+	CacheMisses  int64              `json:"cache_misses"`
+	Blocked      int64              `json:"blocked"`
+	RuleErrors   int64              `json:"rule_errors"`
+	ParseErrors  int64              `json:"parse_errors"`
+	BansActive   int                `json:"bans_active"`      // bans of every running filter.
+	FeedAge      map[string]float64 `json:"feed_age_seconds"` // since the oldest successful fetch of each feed, -1 if none succeeded yet.
+}
+
+// countersReport returns the counters, with the bans and feeds of the running filters.
+func countersReport() CountersReport {
+	report := CountersReport{
+		Lookups:      counters.Lookups.Value(),
+		LookupErrors: counters.LookupErrors.Value(),
+		CacheHits:    counters.CacheHits.Value(),
+		CacheMisses:  counters.CacheMisses.Value(),
+		Blocked:      counters.Blocked.Value(),
+		RuleErrors:   counters.RuleErrors.Value(),
+		ParseErrors:  counters.ParseErrors.Value(),
+		FeedAge:      make(map[string]float64),
+	}
+
+	running.Lock()
+	defer running.Unlock()
+
+	now := time.Now()
+	for live := range running.filters {
+		config := live.Load()
+		if config.Bans != nil {
+			// the errors of a shared store are dropped, its bans aren't counted.
+			if bans, err := config.Bans.List(); err == nil {
+				report.BansActive += len(bans)
+			}
+		}
+		for _, name := range feedsOf(config.Paths) {
+			age := config.Feeds.age(name, now)
+			if oldest, ok := report.FeedAge[name]; ok && (oldest < 0 || age >= 0 && oldest > age) {
+				continue
+			}
+			report.FeedAge[name] = age
+		}
+	}
+	return report
+}
+
+// startCounting reports the bans and feeds of 'live' with the counters, until stopCounting.
+func startCounting(live *liveConfig) {
+	running.Lock()
+	defer running.Unlock()
+	running.filters[live] = true
+}
+
+// stopCounting stops reporting the bans and feeds of 'live'.
+func stopCounting(live *liveConfig) {
+	running.Lock()
+	defer running.Unlock()
+	delete(running.filters, live)
+}
+
+// serveCounters returns the counters report.
+func (ipf IPFilter) serveCounters(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return http.StatusMethodNotAllowed, nil
+	}
+	return writeJSON(w, countersReport())
+}
@@ -0,0 +1,73 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestCounters(t *testing.T) {
+	db, err := maxminddb.Open(DataBase)
+	if err != nil {
+		t.Fatalf("Error opening the database: %v", err)
+	}
+	defer db.Close()
+
+	feeds := NewFeedLists(nil)
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{
+			{PathScopes: []string{"/"}, IsBlock: true, CountryCodes: []string{"RU"}},
+			{PathScopes: []string{"/cloud"}, IsBlock: true, Feeds: []string{"aws", "gcp"}},
+		},
+		DBHandler: db,
+		GeoCache:  NewGeoCache(100, defaultV6CachePrefix),
+		Feeds:     feeds,
+	}, "secret")
+	startCounting(ipf.live)
+	defer stopCounting(ipf.live)
+	ipf.live.Load().Bans.Ban(net.ParseIP("8.8.4.4"), time.Hour)
+	feeds.list("aws").fetched = time.Now().Add(-time.Minute)
+
+	// the counters are shared by the tests, only their changes are checked.
+	before := countersReport()
+	for _, reqIP := range []string{"5.175.96.22:_", "5.175.96.22:_", "24.53.192.20:_"} {
+		adminRequest(t, ipf, "GET", "/", "", reqIP, "")
+	}
+
+	status, rec := adminRequest(t, ipf, "GET", "/ipfilter/counters", "", "8.8.8.8:_", "secret")
+	if status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	var report CountersReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Could not decode the report: %v", err)
+	}
+	if report.Lookups-before.Lookups != 2 || report.CacheHits-before.CacheHits != 1 || report.CacheMisses-before.CacheMisses != 2 ||
+		report.Blocked-before.Blocked != 2 || report.BansActive != 1 {
+		t.Errorf("Unexpected counters: %+v, before: %+v", report, before)
+	}
+	if age := report.FeedAge["aws"]; age < 60 || age > 120 {
+		t.Errorf("Expected aws to be a minute old, Got: %v", age)
+	}
+	if age := report.FeedAge["gcp"]; age != -1 {
+		t.Errorf("Expected gcp to never be fetched, Got: %v", age)
+	}
+
+	// the same report is published through expvar.
+	var published CountersReport
+	if err := json.Unmarshal([]byte(expvar.Get("ipfilter").String()), &published); err != nil {
+		t.Fatalf("Could not decode the expvar: %v", err)
+	}
+	if published.Blocked != report.Blocked || published.BansActive != 1 {
+		t.Errorf("Unexpected expvar: %+v", published)
+	}
+
+	if status, _ := adminRequest(t, ipf, "POST", "/ipfilter/counters", "", "8.8.8.8:_", "secret"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusMethodNotAllowed, status)
+	}
+}
@@ -0,0 +1,120 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestParseCountryCodes(t *testing.T) {
+	if len(isoCountries) != 250 {
+		t.Errorf("Expected the 249 ISO 3166-1 codes and XK, Got: %d", len(isoCountries))
+	}
+
+	tests := []struct {
+		input       string
+		expected    []string
+		shouldError bool
+	}{
+		{"country US DE", []string{"US", "DE"}, false},
+		{"country us De", []string{"US", "DE"}, false},
+		{"country XK", []string{"XK"}, false},
+		{"country XX", nil, true},
+		{"country US usa germany", nil, true},
+		{"country U", nil, true},
+		{"except country fr", []string{"FR"}, false},
+		{"except country france", nil, true},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\ndatabase "+DataBase+"\n"+test.input+"\n}"))
+		if test.shouldError != (err != nil) {
+			t.Fatalf("Test %d: Expected error: %v, Got: %v", i, test.shouldError, err)
+		}
+		if err != nil {
+			continue
+		}
+		got := config.Paths[0].CountryCodes
+		if len(got) == 0 {
+			got = config.Paths[0].ExceptCountries
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Test %d: Expected: %v, Got: %v", i, test.expected, got)
+		}
+		config.DBHandler.Close()
+	}
+
+	// the JSON rules are validated as well.
+	rules := RuleSet{Paths: []Rule{{PathScopes: []string{"/"}, Rule: "block", CountryCodes: []string{"ru"}}}}
+	paths, err := rules.ToPaths(true, false)
+	if err != nil || !reflect.DeepEqual(paths[0].CountryCodes, []string{"RU"}) {
+		t.Errorf("Expected RU, Got: %v, %v", paths, err)
+	}
+	rules.Paths[0].ExceptCountries = []string{"russia"}
+	if _, err := rules.ToPaths(true, false); err == nil {
+		t.Errorf("Expected an error for an unknown country")
+	}
+}
+
+func TestCountryNot(t *testing.T) {
+	tests := []struct {
+		input          string
+		reqIP          string
+		expectedStatus int
+		expectedDebug  string
+	}{
+		{"rule allow\ncountry not RU", "8.8.8.8:_", http.StatusOK, "allowed; rule=1; match=country:US"},
+		{"rule allow\ncountry not RU", "5.175.96.22:_", http.StatusForbidden, "blocked; rule=1; match=none"},
+		// no country in the database.
+		{"rule allow\ncountry not RU", "10.0.0.1:_", http.StatusOK, "allowed; rule=1; match=country:unknown"},
+		{"rule block\ncountry not US CA", "8.8.8.8:_", http.StatusOK, "allowed; rule=1; match=none"},
+		{"rule block\ncountry not US CA", "5.175.96.22:_", http.StatusForbidden, "blocked; rule=1; match=country:RU"},
+		{"rule block\ncountry not US\ncountry not RU", "5.175.96.22:_", http.StatusOK, "allowed; rule=1; match=none"},
+		{"rule block\ncountry not RU\nip 5.175.96.0/24", "5.175.96.22:_", http.StatusForbidden, "blocked; rule=1; match=ip:5.175.96.22"},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\ndatabase "+DataBase+"\ndebug\n"+test.input+"\n}"))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		rec := httptest.NewRecorder()
+		if status, _ := ipf.ServeHTTP(rec, req); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+		if got := rec.Header().Get(HeaderDebug); got != test.expectedDebug {
+			t.Errorf("Test %d: Expected: %q, Got: %q", i, test.expectedDebug, got)
+		}
+
+		// the negation survives the JSON rules.
+		paths, err := RulesFromPaths(config.Paths).ToPaths(true, false)
+		if err != nil || paths[0].NegateCountries != config.Paths[0].NegateCountries {
+			t.Errorf("Test %d: Expected the negation to be kept, Got: %+v, %v", i, paths, err)
+		}
+		config.DBHandler.Close()
+	}
+
+	for _, input := range []string{"country not", "country US\ncountry not CA", "country not CA\ncountry US"} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\ndatabase "+DataBase+"\n"+input+"\n}")); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+	rules := RuleSet{Paths: []Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"1.1.1.1"}, NegateCountries: true}}}
+	if _, err := rules.ToPaths(true, false); err == nil {
+		t.Errorf("Expected an error for negate_countries without countries")
+	}
+}
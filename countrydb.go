@@ -0,0 +1,42 @@
+package ipfilter
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Formats of the 'database' directive.
+const (
+	DatabaseMMDB        = "mmdb"
+	DatabaseIP2Location = "ip2location"
+	DatabaseCSV         = "csv"
+)
+
+// CountryDB is a country database of another format than DatabaseMMDB, see OpenCountryDB.
+type CountryDB interface {
+	// Country returns the country's ISO code of 'ip', empty if the database doesn't have one.
+	Country(ip net.IP) (string, error)
+	// Built returns when the data was published, for 'stale_db'.
+	Built() time.Time
+	Close() error
+}
+
+// OpenCountryDB opens the 'database' of 'format', DatabaseIP2Location or DatabaseCSV.
+func OpenCountryDB(path, format string) (CountryDB, error) {
+	switch format {
+	case DatabaseIP2Location:
+		db, err := OpenIP2Location(path)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case DatabaseCSV:
+		db, err := OpenCSVGeoDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+	return nil, errors.New("ipfilter: database_format should be 'mmdb', 'ip2location' or 'csv'")
+}
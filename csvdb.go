@@ -0,0 +1,267 @@
+package ipfilter
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CSVGeoDB is a CSV country database held in memory, for the hosts that can't map an mmdb file.
+type CSVGeoDB struct {
+	ranges []csvRange // sorted, they don't overlap.
+	built  time.Time
+}
+
+// csvRange is a range of the same country, the IPv4 addresses are mapped to IPv6 to compare them.
+type csvRange struct {
+	start, end [16]byte
+	country    [2]byte // zero if unknown.
+}
+
+// OpenCSVGeoDB reads the country database 'path' into memory, either a directory of the GeoLite2 Country or
+// City CSV files, the IPv4 and IPv6 blocks and the English locations, or a file of 'start,end,country' lines
+// like DB-IP's, where start and end are IPs and a first line that isn't is a header. The clients of the
+// countries '-' and 'ZZ' have no country.
+func OpenCSVGeoDB(path string) (*CSVGeoDB, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	db := &CSVGeoDB{built: fi.ModTime()}
+	if fi.IsDir() {
+		err = db.readGeoLite2(path)
+	} else {
+		err = db.readFile(path, db.readRanges)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start[:], db.ranges[j].start[:]) < 0
+	})
+	for i := 1; i < len(db.ranges); i++ {
+		if bytes.Compare(db.ranges[i].start[:], db.ranges[i-1].end[:]) <= 0 {
+			return nil, fmt.Errorf("%s: the ranges of %v and %v overlap", path, net.IP(db.ranges[i-1].start[:]), net.IP(db.ranges[i].start[:]))
+		}
+	}
+	return db, nil
+}
+
+// Built returns when the CSV file, or the GeoLite2 blocks, were last modified.
+func (db *CSVGeoDB) Built() time.Time {
+	return db.built
+}
+
+// Close releases nothing, the database is in memory.
+func (db *CSVGeoDB) Close() error {
+	return nil
+}
+
+// Country returns the country's ISO code of 'ip', empty if the database doesn't have one.
+func (db *CSVGeoDB) Country(ip net.IP) (string, error) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return "", errors.New("invalid IP: " + ip.String())
+	}
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].end[:], ip16) >= 0
+	})
+	if i == len(db.ranges) || bytes.Compare(db.ranges[i].start[:], ip16) > 0 || db.ranges[i].country == [2]byte{} {
+		return "", nil
+	}
+	return string(db.ranges[i].country[:]), nil
+}
+
+// csvFile counts the records of a CSV reader for the errors.
+type csvFile struct {
+	r       *csv.Reader
+	records int
+}
+
+// Read is csv.Reader.Read.
+func (f *csvFile) Read() ([]string, error) {
+	record, err := f.r.Read()
+	if err == nil {
+		f.records++
+	}
+	return record, err
+}
+
+// readFile calls 'read' with the CSV records of 'path', it adds the file and the record to the errors.
+func (db *CSVGeoDB) readFile(path string, read func(f *csvFile) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	f := &csvFile{r: csv.NewReader(file)}
+	f.r.FieldsPerRecord = -1
+	f.r.Comment = '#'
+	f.r.ReuseRecord = true
+	if err := read(f); err != nil {
+		if _, ok := err.(*csv.ParseError); ok {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return fmt.Errorf("%s: record %d: %v", path, f.records, err)
+	}
+	return nil
+}
+
+// readRanges reads 'start,end,country' lines, the other columns are ignored.
+func (db *CSVGeoDB) readRanges(r *csvFile) error {
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 3 {
+			return errors.New("expected start,end,country")
+		}
+		start, end := net.ParseIP(record[0]), net.ParseIP(record[1])
+		if first && start == nil {
+			continue // the header.
+		}
+		if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) || bytes.Compare(start.To16(), end.To16()) > 0 {
+			return errors.New("invalid range " + record[0] + "-" + record[1])
+		}
+		country, err := csvCountry(record[2])
+		if err != nil {
+			return err
+		}
+		rng := csvRange{country: country}
+		copy(rng.start[:], start.To16())
+		copy(rng.end[:], end.To16())
+		db.ranges = append(db.ranges, rng)
+	}
+}
+
+// readGeoLite2 reads the GeoLite2 CSV files in 'dir', the networks get the country of their geoname_id.
+func (db *CSVGeoDB) readGeoLite2(dir string) error {
+	find := func(suffix string) (string, error) {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*-"+suffix))
+		if len(matches) != 1 {
+			return "", errors.New(dir + ": expected one *-" + suffix + " file")
+		}
+		return matches[0], nil
+	}
+
+	locationsPath, err := find("Locations-en.csv")
+	if err != nil {
+		return err
+	}
+	countries := make(map[string][2]byte)
+	err = db.readFile(locationsPath, func(r *csvFile) error {
+		return readCSVColumns(r, []string{"geoname_id", "country_iso_code"}, func(values []string) error {
+			country, err := csvCountry(values[1])
+			countries[values[0]] = country
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{"Blocks-IPv4.csv", "Blocks-IPv6.csv"} {
+		blocksPath, err := find(suffix)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(blocksPath); err == nil {
+			db.built = fi.ModTime()
+		}
+		err = db.readFile(blocksPath, func(r *csvFile) error {
+			return readCSVColumns(r, []string{"network", "geoname_id"}, func(values []string) error {
+				_, network, err := net.ParseCIDR(values[0])
+				if err != nil {
+					return err
+				}
+				// the networks without a geoname_id only have a registered country, like in the mmdb files.
+				rng := csvRange{country: countries[values[1]]}
+				start, end := network.IP.To16(), make(net.IP, net.IPv6len)
+				mask := network.Mask
+				if len(mask) == net.IPv4len {
+					ones, _ := network.Mask.Size()
+					mask = net.CIDRMask(96+ones, net.IPv6len*8)
+				}
+				for i := range end {
+					end[i] = start[i] | ^mask[i]
+				}
+				copy(rng.start[:], start)
+				copy(rng.end[:], end)
+				db.ranges = append(db.ranges, rng)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCSVColumns calls 'read' with the values of the 'columns' of every line, the first line names them.
+func readCSVColumns(r *csvFile, columns []string, read func(values []string) error) error {
+	header, err := r.Read()
+	if err != nil {
+		return err
+	}
+	indexes := make([]int, len(columns))
+	for i, column := range columns {
+		indexes[i] = -1
+		for j, name := range header {
+			if strings.TrimSpace(name) == column {
+				indexes[i] = j
+			}
+		}
+		if indexes[i] < 0 {
+			return errors.New("no " + column + " column")
+		}
+	}
+
+	values := make([]string, len(columns))
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, index := range indexes {
+			if index >= len(record) {
+				return errors.New("no " + columns[i] + " value")
+			}
+			values[i] = record[index]
+		}
+		if err := read(values); err != nil {
+			return err
+		}
+	}
+}
+
+// csvCountry returns the ISO code 'code', zero for the unknown countries.
+func csvCountry(code string) ([2]byte, error) {
+	var country [2]byte
+	code = strings.ToUpper(strings.TrimSpace(code))
+	switch {
+	case code == "" || code == "-" || code == "ZZ":
+		return country, nil
+	case len(code) != 2:
+		return country, errors.New("invalid country code " + code)
+	}
+	copy(country[:], code)
+	return country, nil
+}
@@ -0,0 +1,127 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+const (
+	CountriesCSV = "./testdata/countries.csv"
+	GeoLite2CSV  = "./testdata/GeoLite2-Country-CSV"
+)
+
+func TestCSVGeoDB(t *testing.T) {
+	tests := []struct {
+		path     string
+		ip       string
+		expected string
+	}{
+		{CountriesCSV, "0.0.0.1", ""},
+		{CountriesCSV, "1.2.3.4", "DE"},
+		{CountriesCSV, "1.2.4.4", "FR"},
+		{CountriesCSV, "8.8.8.8", "US"},
+		{CountriesCSV, "9.9.9.9", ""},
+		{CountriesCSV, "2001:db8::1", "NL"},
+		{CountriesCSV, "2001:db9::1", ""},
+		{CountriesCSV, "::ffff:1.2.3.4", "DE"},
+		{GeoLite2CSV, "1.0.255.255", "DE"},
+		{GeoLite2CSV, "1.1.0.0", ""},
+		{GeoLite2CSV, "8.8.8.8", "US"},
+		// only a registered country.
+		{GeoLite2CSV, "9.9.9.9", ""},
+		// a continent.
+		{GeoLite2CSV, "10.0.0.1", ""},
+		{GeoLite2CSV, "2001:db8::1", "DE"},
+		{GeoLite2CSV, "2a00:1450:4001::1", "US"},
+		{GeoLite2CSV, "2a01::1", ""},
+	}
+	dbs := make(map[string]*CSVGeoDB)
+	for i, test := range tests {
+		db, ok := dbs[test.path]
+		if !ok {
+			var err error
+			if db, err = OpenCSVGeoDB(test.path); err != nil {
+				t.Fatalf("Test %d: Unexpected error: %v", i, err)
+			}
+			dbs[test.path] = db
+		}
+		if country, err := db.Country(net.ParseIP(test.ip)); err != nil || country != test.expected {
+			t.Errorf("Test %d: Expected: %q, Got: %q, %v", i, test.expected, country, err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, test := range []struct {
+		content  string
+		expected string
+	}{
+		{"1.0.0.0,1.0.0.255,DE\n1.0.0.128,1.0.1.255,FR\n", "overlap"},
+		{"1.0.0.255,1.0.0.0,DE\n", "record 1: invalid range"},
+		{"start,end,country\n1.0.0.0,2001:db8::,DE\n", "record 2: invalid range"},
+		{"1.0.0.0,1.0.0.255,DEU\n", "invalid country code"},
+		{"1.0.0.0,1.0.0.255\n", "expected start,end,country"},
+		{"1.0.0.0,\"1.0.0.255,DE\n", "extraneous or missing \" in quoted-field"},
+	} {
+		path := filepath.Join(dir, "countries.csv")
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenCSVGeoDB(path); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Test %d: Expected an error with %q, Got: %v", i, test.expected, err)
+		}
+	}
+	// the directories need the three GeoLite2 files.
+	if _, err := OpenCSVGeoDB(dir); err == nil {
+		t.Error("Expected an error for a directory without GeoLite2 files")
+	}
+}
+
+func TestCSVGeoDBParse(t *testing.T) {
+	tests := []struct {
+		input          string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule block\ndatabase_format csv\ndatabase " + CountriesCSV + "\ncountry DE\n}", "1.2.3.4:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\ndatabase_format csv\ndatabase " + CountriesCSV + "\ncountry DE\n}", "8.8.8.8:_", http.StatusOK},
+		{"ipfilter / {\nrule block\ndatabase_format csv\ndatabase " + GeoLite2CSV + "\ncountry US\n}", "8.8.8.8:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\ndatabase_format csv\ndatabase " + GeoLite2CSV + "\ncountry not DE US\n}", "9.9.9.9:_", http.StatusForbidden},
+	}
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+	}
+
+	input := "ipfilter / {\nrule block\ndatabase_format csv\ndatabase " + BlockPage + "\ncountry DE\n}"
+	if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil || !strings.Contains(err.Error(), BlockPage) {
+		t.Errorf("Expected an error naming %s, Got: %v", BlockPage, err)
+	}
+}
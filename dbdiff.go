@@ -0,0 +1,226 @@
+package ipfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// unknownLabel is the label of the addresses a database has no country or ASN for.
+const unknownLabel = "unknown"
+
+// maxLoggedChanges is how many changes of a DBDiff are logged, the webhook gets all of them.
+const maxLoggedChanges = 10
+
+// DBDiffConfig reports what changed between two versions of the database, nil unless 'database_diff' is set.
+type DBDiffConfig struct {
+	Webhook string // URL the DBDiff is POSTed to, if not empty.
+
+	path   string     // file of the database.
+	layout mmdbLayout // of the database.
+	client *http.Client
+}
+
+// DBDiff summarizes the decision-relevant changes of a database update.
+type DBDiff struct {
+	Database string     `json:"database"`
+	OldBuild time.Time  `json:"old_build"`
+	NewBuild time.Time  `json:"new_build"`
+	Changes  []DBChange `json:"changes"` // sorted by IPs, largest first.
+}
+
+// DBChange is a number of IPv4 addresses whose country, or ASN, changed from 'From' to 'To'.
+type DBChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	IPs  uint64 `json:"ips"`
+}
+
+func (dc DBChange) String() string {
+	return fmt.Sprintf("%d IPs moved from %s to %s", dc.IPs, dc.From, dc.To)
+}
+
+// dbLabel returns the label of a record, its country, else its ASN, for both country and ASN databases.
+func dbLabel(country string, asn uint) string {
+	if country != "" {
+		return country
+	}
+	if asn != 0 {
+		return fmt.Sprintf("AS%d", asn)
+	}
+	return unknownLabel
+}
+
+// dbSpan is a range of IPv4 addresses having the same label in a database.
+type dbSpan struct {
+	start, end uint32
+	label      string
+}
+
+// dbSpans returns the IPv4 addresses of 'db' as sorted spans, adjacent networks with the same label are merged.
+func dbSpans(db *maxminddb.Reader, layout mmdbLayout) ([]dbSpan, error) {
+	var spans []dbSpan
+
+	all := &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	networks := db.NetworksWithin(all, maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var network *net.IPNet
+		country, asn, err := layout.decode(func(result interface{}) error {
+			var err error
+			network, err = networks.Network(result)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		ip := network.IP.To4()
+		if ip == nil {
+			continue
+		}
+		ones, _ := network.Mask.Size()
+		start := binary.BigEndian.Uint32(ip)
+		end := start | uint32(uint64(1)<<uint(32-ones)-1)
+		label := dbLabel(country, asn)
+
+		if n := len(spans); n > 0 && spans[n-1].label == label && spans[n-1].end+1 == start {
+			spans[n-1].end = end
+			continue
+		}
+		spans = append(spans, dbSpan{start: start, end: end, label: label})
+	}
+	return spans, networks.Err()
+}
+
+// diffSpans counts the addresses whose label differs between 'old' and 'new'.
+func diffSpans(old, new []dbSpan) []DBChange {
+	counts := make(map[[2]string]uint64)
+
+	// labelAt returns the label of 'pos' and the last address having it, skipping the spans before 'pos'.
+	labelAt := func(spans []dbSpan, i *int, pos uint64) (string, uint64) {
+		for *i < len(spans) && uint64(spans[*i].end) < pos {
+			*i++
+		}
+		if *i == len(spans) {
+			return unknownLabel, 1<<32 - 1
+		}
+		if span := spans[*i]; uint64(span.start) <= pos {
+			return span.label, uint64(span.end)
+		}
+		return unknownLabel, uint64(spans[*i].start) - 1
+	}
+
+	var i, j int
+	for pos := uint64(0); pos < 1<<32; {
+		oldLabel, oldEnd := labelAt(old, &i, pos)
+		newLabel, newEnd := labelAt(new, &j, pos)
+		end := oldEnd
+		if newEnd < end {
+			end = newEnd
+		}
+		if oldLabel != newLabel {
+			counts[[2]string{oldLabel, newLabel}] += end - pos + 1
+		}
+		pos = end + 1
+	}
+
+	changes := make([]DBChange, 0, len(counts))
+	for labels, ips := range counts {
+		changes = append(changes, DBChange{From: labels[0], To: labels[1], IPs: ips})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].IPs != changes[j].IPs {
+			return changes[i].IPs > changes[j].IPs
+		}
+		if changes[i].From != changes[j].From {
+			return changes[i].From < changes[j].From
+		}
+		return changes[i].To < changes[j].To
+	})
+	return changes
+}
+
+// dbSnapshot is the content of a database when it was last opened.
+type dbSnapshot struct {
+	build uint // Metadata.BuildEpoch
+	spans []dbSpan
+}
+
+// dbSnapshots keeps the last opened version of every database with 'database_diff' set,
+// so a reload that opens an updated file can be compared against it.
+var dbSnapshots = struct {
+	sync.Mutex
+	m map[string]dbSnapshot
+}{m: make(map[string]dbSnapshot)}
+
+// update records the current version of 'db' and returns the diff against the previous one,
+// nil if it is the first version seen or the same build.
+func (dc *DBDiffConfig) update(db *maxminddb.Reader) (*DBDiff, error) {
+	spans, err := dbSpans(db, dc.layout)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := dbSnapshot{build: db.Metadata.BuildEpoch, spans: spans}
+
+	dbSnapshots.Lock()
+	prev, ok := dbSnapshots.m[dc.path]
+	dbSnapshots.m[dc.path] = snapshot
+	dbSnapshots.Unlock()
+
+	if !ok || prev.build == snapshot.build {
+		return nil, nil
+	}
+	return &DBDiff{
+		Database: dc.path,
+		OldBuild: time.Unix(int64(prev.build), 0).UTC(),
+		NewBuild: time.Unix(int64(snapshot.build), 0).UTC(),
+		Changes:  diffSpans(prev.spans, snapshot.spans),
+	}, nil
+}
+
+// report computes the diff of 'db' against its previous version, logs it and sends it to the webhook.
+func (dc *DBDiffConfig) report(db *maxminddb.Reader) {
+	diff, err := dc.update(db)
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: diffing %s: %v", dc.path, err)
+		return
+	}
+	if diff == nil {
+		return
+	}
+
+	log.Printf("[INFO] ipfilter: %s updated from the %s build to the %s build, %d changes",
+		dc.path, diff.OldBuild.Format("2006-01-02"), diff.NewBuild.Format("2006-01-02"), len(diff.Changes))
+	for i, change := range diff.Changes {
+		if i == maxLoggedChanges {
+			log.Printf("[INFO] ipfilter: ... and %d more", len(diff.Changes)-i)
+			break
+		}
+		log.Printf("[INFO] ipfilter: %v", change)
+	}
+
+	if dc.Webhook == "" {
+		return
+	}
+	body, err := json.Marshal(diff)
+	if err != nil {
+		return
+	}
+	resp, err := dc.client.Post(dc.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: database_diff webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[ERROR] ipfilter: database_diff webhook: unexpected status %s", resp.Status)
+	}
+}
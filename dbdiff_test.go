@@ -0,0 +1,134 @@
+package ipfilter
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func ipv4ToUint(ip string) uint32 {
+	return binary.BigEndian.Uint32(net.ParseIP(ip).To4())
+}
+
+func TestDiffSpans(t *testing.T) {
+	tests := []struct {
+		old, new []dbSpan
+		expected []DBChange
+	}{
+		// identical.
+		{
+			[]dbSpan{{ipv4ToUint("1.0.0.0"), ipv4ToUint("1.0.0.255"), "DE"}},
+			[]dbSpan{{ipv4ToUint("1.0.0.0"), ipv4ToUint("1.0.0.255"), "DE"}},
+			[]DBChange{},
+		},
+		// half a /24 moved, the other half disappeared.
+		{
+			[]dbSpan{{ipv4ToUint("1.0.0.0"), ipv4ToUint("1.0.0.255"), "DE"}},
+			[]dbSpan{{ipv4ToUint("1.0.0.0"), ipv4ToUint("1.0.0.127"), "FR"}},
+			[]DBChange{{"DE", "FR", 128}, {"DE", unknownLabel, 128}},
+		},
+		// new addresses, an ASN change, and the whole address space edges.
+		{
+			[]dbSpan{
+				{0, ipv4ToUint("0.0.0.255"), "AS1"},
+				{ipv4ToUint("8.8.8.0"), ipv4ToUint("8.8.8.255"), "US"},
+			},
+			[]dbSpan{
+				{0, ipv4ToUint("0.0.0.255"), "AS2"},
+				{ipv4ToUint("8.8.8.0"), ipv4ToUint("8.8.8.255"), "US"},
+				{ipv4ToUint("255.255.255.0"), ipv4ToUint("255.255.255.255"), "ZZ"},
+			},
+			[]DBChange{{"AS1", "AS2", 256}, {unknownLabel, "ZZ", 256}},
+		},
+	}
+
+	for i, test := range tests {
+		changes := diffSpans(test.old, test.new)
+		if !reflect.DeepEqual(changes, test.expected) {
+			t.Fatalf("Test %d: Expected changes: %v, Got: %v", i, test.expected, changes)
+		}
+	}
+}
+
+func TestDBSpans(t *testing.T) {
+	db, err := maxminddb.Open(DataBase)
+	if err != nil {
+		t.Fatalf("Could not open the database: %v", err)
+	}
+	defer db.Close()
+
+	spans, err := dbSpans(db, mmdbLayout{})
+	if err != nil {
+		t.Fatalf("dbSpans failed: %v", err)
+	}
+	if len(spans) == 0 {
+		t.Fatal("Expected some spans")
+	}
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start <= spans[i-1].end {
+			t.Fatalf("Spans are not sorted: %+v, %+v", spans[i-1], spans[i])
+		}
+	}
+
+	// the spans agree with lookups.
+	for _, ip := range []string{"8.8.8.8", "5.175.96.22", "2.36.255.255"} {
+		country, asn, err := mmdbLayout{}.lookup(db, net.ParseIP(ip))
+		if err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+		n := ipv4ToUint(ip)
+		label := unknownLabel
+		for _, span := range spans {
+			if span.start <= n && n <= span.end {
+				label = span.label
+				break
+			}
+		}
+		if expected := dbLabel(country, asn); label != expected {
+			t.Fatalf("%s: Expected label: '%s', Got: '%s'", ip, expected, label)
+		}
+	}
+
+	// no changes against itself, a second snapshot of the same build doesn't report anything.
+	if changes := diffSpans(spans, spans); len(changes) != 0 {
+		t.Fatalf("Expected no changes, Got: %v", changes)
+	}
+	dc := &DBDiffConfig{path: DataBase}
+	for i := 0; i < 2; i++ {
+		if diff, err := dc.update(db); err != nil || diff != nil {
+			t.Fatalf("Expected no diff, Got: %+v (%v)", diff, err)
+		}
+	}
+}
+
+func TestDBDiffParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"ipfilter / {\nrule block\ndatabase " + DataBase + "\ncountry US\ndatabase_diff\n}", false},
+		{"ipfilter / {\nrule block\ndatabase_diff https://example.com/hook\ndatabase " + DataBase + "\ncountry US\n}", false},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\ndatabase_diff\n}", true},
+		{"ipfilter / {\nrule block\ndatabase " + DataBase + "\ncountry US\ndatabase_diff a b\n}", true},
+	}
+
+	for _, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Expected an error for:\n%s", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if config.DBDiff == nil || config.DBDiff.path != DataBase {
+			t.Fatalf("Expected database_diff to be set for %s, Got: %+v", DataBase, config.DBDiff)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package ipfilter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HeaderDebug is the response header describing the decision on a request when 'debug' is set,
+// e.g. "blocked; rule=3; match=country:RU".
+const HeaderDebug = "X-IPFilter"
+
+// Reasons of the decisions that aren't conditions of a block.
+const (
+	reasonBan          = "ban"
+	reasonAutoBan      = "auto_ban"
+	reasonPassCookie   = "pass_cookie"
+	reasonDecisionHook = "decision_hook"
+	reasonError        = "error"
+)
+
+// debugActions are the words of the actions in the debug header.
+var debugActions = map[string]string{
+	ActionAllow:     "allowed",
+	ActionBlock:     "blocked",
+	ActionChallenge: "challenged",
+	ActionLogOnly:   "logged",
+}
+
+// setDebugHeader describes the decision on the request, 'rule' is the 1-based position of the block that
+// decided, BanRule, DefaultRule or 0 if no block applies. 'match' is the reason, it is left out if empty.
+func (ipf IPFilter) setDebugHeader(w http.ResponseWriter, action string, rule int, match string) {
+	if !ipf.Config.Debug {
+		return
+	}
+	value := debugActions[action] + "; rule="
+	switch {
+	case match == reasonBan || match == reasonAutoBan:
+		value += "ban"
+	case rule == 0 || rule == DefaultRule:
+		value += "none"
+	default:
+		value += strconv.Itoa(rule)
+	}
+	if match != "" {
+		value += "; match=" + match
+	}
+	w.Header().Set(HeaderDebug, value)
+}
+
+// debugDecision sets the debug header of the decision of 'rule', a block, the reason is the condition of the
+// block that matched if empty.
+func (ipf IPFilter) debugDecision(w http.ResponseWriter, r *http.Request, path IPPath, rule int, action, reason string) {
+	if !ipf.Config.Debug {
+		return
+	}
+	if reason == "" && rule > 0 && rule != DefaultRule {
+		reason = ipf.matchReason(path, r)
+	}
+	ipf.setDebugHeader(w, action, rule, reason)
+}
+
+// matchReason returns the condition of 'path' a client of 'r' matches, e.g. "country:RU", "ip:8.8.8.8",
+// "feed:aws", "hostname:example.com" or the name of a matcher, "none" if nothing matches. With MatchAll, the
+// conditions are joined with commas. The conditions are evaluated again, it is only used to debug.
+func (ipf IPFilter) matchReason(path IPPath, r *http.Request) string {
+	clientIPs, err := ipf.clientIPs(r, path.Strict)
+	if err != nil {
+		return "none"
+	}
+	if path.Family != "" {
+		var sameFamily []net.IP
+		for _, clientIP := range clientIPs {
+			if ipFamily(clientIP) == path.Family {
+				sameFamily = append(sameFamily, clientIP)
+			}
+		}
+		if len(sameFamily) == 0 {
+			return "none"
+		}
+		if len(path.CountryCodes) == 0 && !path.hasRanges() && len(path.Feeds) == 0 && len(path.Hostnames) == 0 && len(path.Matchers) == 0 {
+			return "family:" + path.Family
+		}
+		clientIPs = sameFamily
+	}
+
+	ctx := context.WithValue(r.Context(), lookupsKey{}, filterLookups{ipf: ipf})
+	var reasons []string
+	for _, clientIP := range clientIPs {
+		reasons = reasons[:0]
+		if len(path.CountryCodes) != 0 {
+			countries := countryMatcher{ipf: ipf, path: path}
+			if matched, _ := countries.Match(ctx, clientIP, r); matched {
+				country := countries.country
+				if country == "" {
+					// only with 'country not'.
+					country = UnknownCountry
+				}
+				reasons = append(reasons, "country:"+country)
+			}
+		}
+		if reason := ipf.rangeReason(ctx, path, clientIP, r); reason != "" {
+			reasons = append(reasons, reason)
+		}
+		for _, m := range path.Matchers {
+			if matched, _ := m.Match(ctx, clientIP, r); matched {
+				reasons = append(reasons, matcherName(m))
+			}
+		}
+
+		if path.MatchAll && len(reasons) != 0 && len(reasons) == conditionKinds(path) {
+			return strings.Join(reasons, ",")
+		}
+		if !path.MatchAll && len(reasons) != 0 {
+			return reasons[0]
+		}
+	}
+	return "none"
+}
+
+// rangeReason returns the range, feed or hostname of 'path' that 'ip' is in, they are a single condition.
+func (ipf IPFilter) rangeReason(ctx context.Context, path IPPath, ip net.IP, r *http.Request) string {
+	if matched, _ := path.ranges().Match(ctx, ip, r); matched {
+		return "ip:" + ip.String()
+	}
+	for _, name := range path.Feeds {
+		if ipf.Config.Feeds.contains([]string{name}, []net.IP{ip}) {
+			return "feed:" + name
+		}
+	}
+	for _, name := range path.Hostnames {
+		if ipf.Config.Hostnames.contains([]string{name}, []net.IP{ip}) {
+			return "hostname:" + name
+		}
+	}
+	return ""
+}
+
+// matcherName returns the name of 'm', "matcher" if it wasn't made by NewMatcher.
+func matcherName(m Matcher) string {
+	if named, ok := m.(namedMatcher); ok {
+		return named.spec.Name
+	}
+	return "matcher"
+}
+
+// conditionKinds returns the number of conditions a client must match with MatchAll: countries, ranges,
+// feeds and hostnames count as one, see matchesAll, and every matcher as one.
+func conditionKinds(path IPPath) int {
+	n := len(path.Matchers)
+	if len(path.CountryCodes) != 0 {
+		n++
+	}
+	if path.hasRanges() || len(path.Feeds) != 0 || len(path.Hostnames) != 0 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,77 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestDebugHeader(t *testing.T) {
+	tests := []struct {
+		input    string
+		reqIP    string
+		reqPath  string
+		expected string
+	}{
+		{"ipfilter / {\nrule block\ncountry RU\ndatabase " + DataBase + "\ndebug\n}", "5.175.96.22:_", "/", "blocked; rule=1; match=country:RU"},
+		{"ipfilter / {\nrule block\ncountry RU\ndatabase " + DataBase + "\ndebug\n}", "8.8.8.8:_", "/", "allowed; rule=1; match=none"},
+		{"ipfilter / {\nrule allow\nip 10.0.0.0/8\ndebug\n}", "10.1.2.3:_", "/", "allowed; rule=1; match=ip:10.1.2.3"},
+		{"ipfilter / {\nrule allow\nip 10.0.0.0/8\ndebug\n}", "8.8.8.8:_", "/", "blocked; rule=1; match=none"},
+		{"ipfilter /private {\nrule block\nip 8.8.8.8\n}\nipfilter / {\nrule block\nip 8.8.4.4\nchallenge js\npass_cookie secret\ndebug\n}",
+			"8.8.4.4:_", "/", "challenged; rule=2; match=ip:8.8.4.4"},
+		{"ipfilter / {\nrule block\ncountry RU\ndatabase " + DataBase + "\nip 8.8.8.8\nmatch all\ndebug\n}", "5.175.96.22:_", "/", "allowed; rule=1; match=none"},
+		{"ipfilter / {\nrule block\ncountry US\ndatabase " + DataBase + "\nip 8.8.8.8\nmatch all\ndebug\n}", "8.8.8.8:_", "/", "blocked; rule=1; match=country:US,ip:8.8.8.8"},
+		{"ipfilter /private {\nrule block\nip 8.8.8.8\ndebug\n}", "8.8.8.8:_", "/", "allowed; rule=none"},
+		{"ipfilter / {\nrule block\nip 8.8.8.8\n}", "8.8.8.8:_", "/", ""},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", test.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		rec := httptest.NewRecorder()
+		ipf.ServeHTTP(rec, req)
+		if config.DBHandler != nil {
+			config.DBHandler.Close()
+		}
+		if got := rec.Header().Get(HeaderDebug); got != test.expected {
+			t.Errorf("Test %d: Expected: %q, Got: %q", i, test.expected, got)
+		}
+	}
+}
+
+func TestDebugHeaderBan(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\ndebug\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	config.Bans.Ban(net.ParseIP("8.8.4.4"), time.Hour)
+	ipf := IPFilter{Config: config}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = "8.8.4.4:_"
+	rec := httptest.NewRecorder()
+	ipf.ServeHTTP(rec, req)
+	if got := rec.Header().Get(HeaderDebug); got != "blocked; rule=ban; match=ban" {
+		t.Errorf("Unexpected header: %q", got)
+	}
+}
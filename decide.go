@@ -0,0 +1,163 @@
+package ipfilter
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Actions of a Decision, the same words as the 'rule' directive.
+const (
+	ActionAllow = "allow"
+	ActionBlock = "block"
+)
+
+// Decision is what the rules decide for a client.
+type Decision struct {
+	Action  string `json:"action"`            // ActionAllow or ActionBlock.
+	Rule    int    `json:"rule"`              // 1-based position of the IPPath that applied, 0 if none did, see DefaultAction.
+	Scope   string `json:"scope,omitempty"`   // scope of that IPPath matching the request.
+	Banned  bool   `json:"banned,omitempty"`  // the client is banned at runtime, on every path.
+	Country string `json:"country,omitempty"` // ISO code of the client, empty unless the IPPath has country codes.
+	Err     error  `json:"-"`                 // the lookup failed, the client is blocked as caddy answers '500'.
+	// the maintenance mode blocks the client, whatever the rules, see Maintenance.
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+// New returns an IPFilter enforcing 'cfg', it has no Next handler: use Decide, or Handler to filter requests.
+// 'cfg' is checked like an ipfilter block: countries need a DBHandler or a GeoWebService, ExceptASNs an ASNHandler.
+func New(cfg Config) (*IPFilter, error) {
+	switch cfg.MatchMode {
+	case "", MatchLongest, MatchFirst, MatchPriority, MatchAllowOverrides:
+	default:
+		return nil, errors.New("ipfilter: match_mode should be 'first', 'longest', 'priority' or 'allow_overrides'")
+	}
+	switch cfg.Storage {
+	case "", StorageDefault, StorageCompact:
+	default:
+		return nil, errors.New("ipfilter: storage should be 'default' or 'compact'")
+	}
+	if len(cfg.Paths) == 0 {
+		return nil, errors.New("ipfilter: No IPs or Country codes has been provided")
+	}
+
+	for _, path := range cfg.Paths {
+		if len(path.PathScopes) == 0 {
+			return nil, errors.New("ipfilter: Every rule needs at least one scope")
+		}
+		if len(path.CountryCodes) == 0 && !path.hasRanges() && len(path.Feeds) == 0 && len(path.Hostnames) == 0 && len(path.Matchers) == 0 && path.Family == "" {
+			return nil, errors.New("ipfilter: No IPs or Country codes has been provided")
+		}
+		if (len(path.CountryCodes) != 0 || len(path.ExceptCountries) != 0) && !cfg.hasCountryLookups() {
+			return nil, errors.New("ipfilter: Database is required to block/allow by country")
+		}
+		if len(path.ExceptASNs) != 0 {
+			if len(path.CountryCodes) == 0 {
+				return nil, errors.New("ipfilter: except_asn only applies to country rules")
+			}
+			if cfg.ASNHandler == nil {
+				return nil, errors.New("ipfilter: ASN database is required for except_asn")
+			}
+		}
+		switch path.Family {
+		case "", FamilyIPv4, FamilyIPv6:
+		default:
+			return nil, errors.New("ipfilter: family should be 'ipv4' or 'ipv6'")
+		}
+		if err := checkMonitoringProviders(path.AllowMonitoring); err != nil {
+			return nil, err
+		}
+		if err := checkXFFPolicy(path.XFFPolicy); err != nil {
+			return nil, err
+		}
+		if err := checkFeeds(path.Feeds); err != nil {
+			return nil, err
+		}
+		if path.Priority != 0 && cfg.MatchMode != MatchPriority {
+			return nil, errors.New("ipfilter: priority requires 'match_mode priority'")
+		}
+	}
+
+	// don't touch the caller's paths when setting their IDs.
+	cfg.Paths = compactPaths(withRuleIDs(append([]IPPath(nil), cfg.Paths...)), cfg.Storage)
+	if cfg.Threat == nil {
+		cfg.Threat = NewThreat()
+	}
+	if cfg.Monitoring == nil {
+		cfg.Monitoring = NewMonitoringLists(cfg.httpClient())
+	}
+	if cfg.Feeds == nil {
+		cfg.Feeds = NewFeedLists(cfg.httpClient())
+	}
+	if cfg.Hostnames == nil {
+		cfg.Hostnames = NewHostnameLists(cfg.HostnameRefresh)
+	}
+	if cfg.hooks == nil {
+		cfg.hooks = &hookDispatcher{client: cfg.httpClient()}
+	}
+	cfg.detectLayouts()
+	cfg.scopes = newScopeTrie(cfg.Paths, cfg.MatchMode)
+	return &IPFilter{Config: cfg}, nil
+}
+
+// Decide returns what the rules decide for a client connecting from 'ip' and requesting 'path' now,
+// X-Forwarded-For doesn't apply since 'ip' is the client. Without a request, the blocks apply to any host,
+// method and headers, but only during their schedules and dates. Like ServeHTTP, the maintenance mode blocks
+// every client but its allowlist before the rules.
+func (ipf IPFilter) Decide(ip net.IP, path string) Decision {
+	ip = normalizeIP(ip)
+	if ipf.live != nil {
+		ipf.Config = *ipf.live.Load()
+	}
+	if m := ipf.Config.Maintenance; m.Enabled() && !m.allows(ip) {
+		return Decision{Action: ActionBlock, Maintenance: true}
+	}
+	scopes := ipf.Config.scopes
+	if scopes == nil {
+		scopes = newScopeTrie(ipf.Config.Paths, ipf.Config.MatchMode)
+	}
+
+	now := time.Now()
+	active := func(i int) bool { return ipf.Config.Paths[i].activeAt(now) }
+	idx, scope := scopes.at(ipf.Config.Threat.Level()).matchIf(path, active)
+	excluded := idx >= 0 && ipf.Config.Paths[idx].excludes(path)
+	if excluded {
+		idx, scope = -1, ""
+	}
+	if idx >= 0 && ipf.Config.MatchMode == MatchAllowOverrides && ipf.Config.Paths[idx].IsBlock {
+		allows := func(p IPPath) bool {
+			allow, _, err := ipf.evaluateIPs(p, []net.IP{ip}, nil, nil)
+			return err == nil && allow
+		}
+		if i := ipf.allowOverride(path, ipf.Config.Threat.Level(), active, allows); i >= 0 {
+			idx, scope = i, ipf.Config.Paths[i].scopeOf(path)
+		}
+	}
+	d := Decision{Action: ActionAllow, Rule: idx + 1, Scope: scope}
+
+	if ipf.Config.Bans != nil && ipf.Config.Bans.IsBanned(ip) {
+		d.Action = ActionBlock
+		d.Banned = true
+		return d
+	}
+	if ipf.Config.AllowLoopback && ip.IsLoopback() {
+		return d
+	}
+	if idx < 0 {
+		if ipf.Config.DefaultAction == ActionBlock && !excluded {
+			d.Action = ActionBlock
+		}
+		return d
+	}
+
+	allow, country, err := ipf.evaluateIPs(ipf.Config.Paths[idx], []net.IP{ip}, nil, nil)
+	d.Country = country
+	if err != nil {
+		d.Err = err
+		allow = false
+	}
+	if !allow {
+		d.Action = ActionBlock
+	}
+	return d
+}
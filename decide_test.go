@@ -0,0 +1,164 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestDecide(t *testing.T) {
+	db, err := maxminddb.Open(DataBase)
+	if err != nil {
+		t.Fatalf("Error opening the database: %v", err)
+	}
+	defer db.Close()
+
+	ipf, err := New(Config{
+		Paths: []IPPath{
+			{PathScopes: []string{"/"}, IsBlock: true, CountryCodes: []string{"RU"}},
+			{PathScopes: []string{"/private"}, Ranges: []Range{{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1")}}},
+		},
+		DBHandler: db,
+		Bans:      NewBanList(),
+	})
+	if err != nil {
+		t.Fatalf("Could not create the filter: %v", err)
+	}
+	if _, err := ipf.Config.Bans.Ban(net.ParseIP("8.8.4.4"), 0); err != nil {
+		t.Fatalf("Could not ban: %v", err)
+	}
+
+	tests := []struct {
+		ip       string
+		path     string
+		expected Decision
+	}{
+		{"5.175.96.22", "/", Decision{Action: ActionBlock, Rule: 1, Scope: "/", Country: "RU"}},
+		{"8.8.8.8", "/page", Decision{Action: ActionAllow, Rule: 1, Scope: "/", Country: "US"}},
+		{"8.8.8.8", "/private/page", Decision{Action: ActionBlock, Rule: 2, Scope: "/private"}},
+		{"10.0.0.1", "/private", Decision{Action: ActionAllow, Rule: 2, Scope: "/private"}},
+		{"8.8.4.4", "/", Decision{Action: ActionBlock, Rule: 1, Scope: "/", Banned: true}},
+	}
+
+	for i, test := range tests {
+		if d := ipf.Decide(net.ParseIP(test.ip), test.path); d != test.expected {
+			t.Fatalf("Test %d: Expected: %+v, Got: %+v", i, test.expected, d)
+		}
+		// the 4-byte form of IPv4 addresses gets the same decision.
+		if ip4 := net.ParseIP(test.ip).To4(); ip4 != nil {
+			if d := ipf.Decide(ip4, test.path); d != test.expected {
+				t.Fatalf("Test %d: Expected: %+v, Got: %+v for %d bytes", i, test.expected, d, len(ip4))
+			}
+		}
+	}
+
+	// without rules for a path, everyone is allowed.
+	ipf, err = New(Config{Paths: []IPPath{{PathScopes: []string{"/private"}, Ranges: []Range{{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1")}}}}})
+	if err != nil {
+		t.Fatalf("Could not create the filter: %v", err)
+	}
+	if d := ipf.Decide(net.ParseIP("8.8.8.8"), "/"); d != (Decision{Action: ActionAllow}) {
+		t.Fatalf("Expected an allow without rule, Got: %+v", d)
+	}
+}
+
+func TestDecideInactive(t *testing.T) {
+	ip := []Range{{net.ParseIP("1.2.3.4"), net.ParseIP("1.2.3.4")}}
+	// no day of the week.
+	never := Schedule{Start: 0, End: 24 * 60, Location: time.UTC}
+
+	tests := []struct {
+		paths    []IPPath
+		expected Decision
+	}{
+		{[]IPPath{{PathScopes: []string{"/"}, IsBlock: true, Ranges: ip, ActiveUntil: time.Now().Add(-time.Hour)}}, Decision{Action: ActionAllow}},
+		{[]IPPath{{PathScopes: []string{"/"}, IsBlock: true, Ranges: ip, ActiveFrom: time.Now().Add(time.Hour)}}, Decision{Action: ActionAllow}},
+		{[]IPPath{{PathScopes: []string{"/"}, IsBlock: true, Ranges: ip, Schedules: []Schedule{never}}}, Decision{Action: ActionAllow}},
+		{[]IPPath{{PathScopes: []string{"/"}, IsBlock: true, Ranges: ip, ActiveUntil: time.Now().Add(time.Hour)}}, Decision{Action: ActionBlock, Rule: 1, Scope: "/"}},
+		// the less specific block applies instead.
+		{[]IPPath{
+			{PathScopes: []string{"/"}, IsBlock: true, Ranges: ip},
+			{PathScopes: []string{"/api"}, Ranges: ip, ActiveUntil: time.Now().Add(-time.Hour)},
+		}, Decision{Action: ActionBlock, Rule: 1, Scope: "/"}},
+	}
+	for i, test := range tests {
+		ipf, err := New(Config{Paths: test.paths})
+		if err != nil {
+			t.Fatalf("Test %d: Could not create the filter: %v", i, err)
+		}
+		if d := ipf.Decide(net.ParseIP("1.2.3.4"), "/api"); d != test.expected {
+			t.Errorf("Test %d: Expected: %+v, Got: %+v", i, test.expected, d)
+		}
+	}
+}
+
+func TestDecideMaintenance(t *testing.T) {
+	ip := []Range{{net.ParseIP("1.2.3.4"), net.ParseIP("1.2.3.4")}}
+	ipf, err := New(Config{
+		Paths:       []IPPath{{PathScopes: []string{"/"}, Ranges: ip}},
+		Maintenance: NewMaintenance(),
+	})
+	if err != nil {
+		t.Fatalf("Could not create the filter: %v", err)
+	}
+	ipf.Config.Maintenance.Set(true, 0)
+	if err := ipf.Config.Maintenance.AllowIPs([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip       string
+		expected Decision
+	}{
+		// the rules would let it in.
+		{"1.2.3.4", Decision{Action: ActionBlock, Maintenance: true}},
+		{"8.8.8.8", Decision{Action: ActionBlock, Maintenance: true}},
+		// the allowlist goes through the rules.
+		{"10.0.0.1", Decision{Action: ActionBlock, Rule: 1, Scope: "/"}},
+	}
+	for i, test := range tests {
+		if d := ipf.Decide(net.ParseIP(test.ip), "/"); d != test.expected {
+			t.Errorf("Test %d: Expected: %+v, Got: %+v", i, test.expected, d)
+		}
+		// the admin /lookup route answers the same.
+		if result := ipf.Lookup(net.ParseIP(test.ip), "/"); result.Decision == nil || *result.Decision != test.expected {
+			t.Errorf("Test %d: Expected the lookup to decide %+v, Got: %+v", i, test.expected, result.Decision)
+		}
+	}
+
+	ipf.Config.Maintenance.Set(false, 0)
+	if d := ipf.Decide(net.ParseIP("1.2.3.4"), "/"); d != (Decision{Action: ActionAllow, Rule: 1, Scope: "/"}) {
+		t.Errorf("Expected the rules to decide after the maintenance, Got: %+v", d)
+	}
+}
+
+func TestNew(t *testing.T) {
+	ip := []Range{{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1")}}
+	tests := []struct {
+		cfg       Config
+		shouldErr bool
+	}{
+		{Config{Paths: []IPPath{{PathScopes: []string{"/"}, Ranges: ip}}}, false},
+		{Config{Paths: []IPPath{{PathScopes: []string{"/"}, Ranges: ip, Priority: 1}}, MatchMode: MatchPriority}, false},
+		{Config{Paths: []IPPath{{PathScopes: []string{"/"}, Family: FamilyIPv6}}}, false},
+		{Config{}, true},
+		{Config{Paths: []IPPath{{PathScopes: []string{"/"}, Family: "ipv5"}}}, true},
+		{Config{Paths: []IPPath{{Ranges: ip}}}, true},
+		{Config{Paths: []IPPath{{PathScopes: []string{"/"}}}}, true},
+		{Config{Paths: []IPPath{{PathScopes: []string{"/"}, CountryCodes: []string{"US"}}}}, true},
+		{Config{Paths: []IPPath{{PathScopes: []string{"/"}, Ranges: ip, Priority: 1}}}, true},
+		{Config{Paths: []IPPath{{PathScopes: []string{"/"}, Ranges: ip}}, MatchMode: "best"}, true},
+	}
+
+	for i, test := range tests {
+		_, err := New(test.cfg)
+		if test.shouldErr && err == nil {
+			t.Fatalf("Test %d: Expected an error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+	}
+}
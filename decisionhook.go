@@ -0,0 +1,266 @@
+package ipfilter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// defaultDecisionHookTimeout is how long a request waits for the decision hook, its turn included.
+const defaultDecisionHookTimeout = 100 * time.Millisecond
+
+// How long the command isn't restarted after failing, doubling with every failure in a row up to the max.
+const (
+	decisionHookBackoff    = 100 * time.Millisecond
+	decisionHookMaxBackoff = 30 * time.Second
+)
+
+// ActionChallenge is an answer of decision hooks, the client is served the challenge of the block, or the
+// js challenge if it has none.
+const ActionChallenge = "challenge"
+
+// errDecisionHookDown is returned while the command waits to be restarted after a failure.
+var errDecisionHookDown = errors.New("ipfilter: decision_hook: waiting to restart the command")
+
+// HookRequest is what a decision hook receives for every request, along with the decision of the rules.
+type HookRequest struct {
+	IP      string            `json:"ip"`
+	Host    string            `json:"host"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Country string            `json:"country,omitempty"` // empty without a database.
+	ASN     uint              `json:"asn,omitempty"`     // 0 without an ASN database.
+	Action  string            `json:"action"`            // the decision of the rules.
+	Rule    int               `json:"rule"`              // 1-based position of the block that applied, 0 if none did.
+}
+
+// HookResponse is the answer of a decision hook, an empty Action keeps the decision of the rules.
+type HookResponse struct {
+	Action string `json:"action,omitempty"`
+}
+
+// DecisionHook runs a long-lived command that can override the decisions of the rules, e.g. a Lua script
+// for one-off business rules. The command reads a JSON HookRequest per line on its standard input and writes
+// a JSON HookResponse per line on its standard output, in order, one request at a time. If it fails or doesn't
+// answer in time, the decision of the rules applies and the command is restarted, backing off while it keeps failing.
+type DecisionHook struct {
+	Command []string
+	Timeout time.Duration // defaultDecisionHookTimeout if zero.
+
+	once     sync.Once
+	turn     chan struct{} // held by the request talking to the command, a lock that can time out.
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	answers  chan hookAnswer
+	failures int       // in a row.
+	retryAt  time.Time // the command isn't restarted before.
+}
+
+type hookAnswer struct {
+	line []byte
+	err  error
+}
+
+// NewDecisionHook returns a DecisionHook running 'command', which is started on the first request.
+func NewDecisionHook(command []string) (*DecisionHook, error) {
+	if len(command) == 0 {
+		return nil, errors.New("ipfilter: decision_hook needs a command")
+	}
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return nil, errors.New("ipfilter: decision_hook: " + err.Error())
+	}
+	return &DecisionHook{Command: command}, nil
+}
+
+// Decide sends 'req' to the command and returns its action, empty to keep the decision of the rules.
+// The Timeout bounds the whole call, waiting for the requests before included.
+func (h *DecisionHook) Decide(req HookRequest) (string, error) {
+	line, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultDecisionHookTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	h.once.Do(h.init)
+	select {
+	case h.turn <- struct{}{}:
+		defer func() { <-h.turn }()
+	case <-timer.C:
+		return "", errors.New("ipfilter: decision_hook: no turn after " + timeout.String())
+	}
+
+	if h.cmd == nil {
+		if time.Now().Before(h.retryAt) {
+			return "", errDecisionHookDown
+		}
+		if err := h.start(); err != nil {
+			h.fail()
+			return "", err
+		}
+	}
+	if _, err := h.stdin.Write(append(line, '\n')); err != nil {
+		h.fail()
+		return "", errors.New("ipfilter: decision_hook: " + err.Error())
+	}
+
+	select {
+	case answer := <-h.answers:
+		if answer.err != nil {
+			h.fail()
+			return "", errors.New("ipfilter: decision_hook: " + answer.err.Error())
+		}
+		h.failures = 0
+		var resp HookResponse
+		if err := json.Unmarshal(answer.line, &resp); err != nil {
+			return "", errors.New("ipfilter: decision_hook: invalid answer: " + err.Error())
+		}
+		switch resp.Action {
+		case "", ActionAllow, ActionBlock, ActionChallenge:
+			return resp.Action, nil
+		}
+		return "", errors.New("ipfilter: decision_hook: unknown action " + resp.Action)
+	case <-timer.C:
+		// the late answer would be taken for the next request's.
+		h.fail()
+		return "", errors.New("ipfilter: decision_hook: no answer after " + timeout.String())
+	}
+}
+
+func (h *DecisionHook) init() {
+	h.turn = make(chan struct{}, 1)
+}
+
+// fail stops the command and delays its restart, the turn must be held.
+func (h *DecisionHook) fail() {
+	h.stop()
+	backoff := decisionHookMaxBackoff
+	if h.failures < 16 && decisionHookBackoff<<uint(h.failures) < decisionHookMaxBackoff {
+		backoff = decisionHookBackoff << uint(h.failures)
+	}
+	h.failures++
+	h.retryAt = time.Now().Add(backoff)
+}
+
+// start runs the command, the turn must be held.
+func (h *DecisionHook) start() error {
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.New("ipfilter: decision_hook: " + err.Error())
+	}
+
+	answers := make(chan hookAnswer, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			answers <- hookAnswer{line: append([]byte(nil), scanner.Bytes()...)}
+		}
+		err := scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		answers <- hookAnswer{err: err}
+		close(answers)
+	}()
+
+	h.cmd, h.stdin, h.answers = cmd, stdin, answers
+	return nil
+}
+
+// stop kills the command, the turn must be held.
+func (h *DecisionHook) stop() {
+	if h.cmd == nil {
+		return
+	}
+	h.stdin.Close()
+	h.cmd.Process.Kill()
+	// drain the answers so the reader exits.
+	go func(answers chan hookAnswer) {
+		for range answers {
+		}
+	}(h.answers)
+	h.cmd.Wait()
+	h.cmd, h.stdin, h.answers = nil, nil, nil
+}
+
+// Close stops the command, once the request talking to it is done.
+func (h *DecisionHook) Close() error {
+	h.once.Do(h.init)
+	h.turn <- struct{}{}
+	defer func() { <-h.turn }()
+
+	h.stop()
+	return nil
+}
+
+// hookDecision returns the action on the request, ActionAllow, ActionBlock or ActionChallenge, after the decision
+// hook got the decision of the rules, 'idx' being the index of the IPPath that applied.
+func (ipf IPFilter) hookDecision(r *http.Request, path IPPath, idx int, allow bool, cost *requestCost) string {
+	rules := ActionBlock
+	if allow {
+		rules = ActionAllow
+	}
+	req := HookRequest{
+		Host:    r.Host,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Headers: make(map[string]string, len(r.Header)),
+		Action:  rules,
+		Rule:    idx + 1,
+	}
+	for name := range r.Header {
+		req.Headers[name] = r.Header.Get(name)
+	}
+
+	clientIPs, err := ipf.clientIPs(r, path.Strict)
+	if err != nil {
+		return rules
+	}
+	ip := clientIPs[0]
+	req.IP = ip.String()
+	if ipf.Config.hasCountryLookups() {
+		if req.Country, err = ipf.lookupCountry(ip, cost); err != nil {
+			log.Printf("[ERROR] ipfilter: looking up the country of %s for the decision hook: %v", ip, err)
+		}
+	}
+	if ipf.Config.ASNHandler != nil {
+		if req.ASN, err = ipf.lookupASN(ip, cost); err != nil {
+			log.Printf("[ERROR] ipfilter: looking up the ASN of %s for the decision hook: %v", ip, err)
+		}
+	}
+
+	start := cost.now()
+	action, err := ipf.Config.DecisionHook.Decide(req)
+	cost.track(CostRemote, start)
+	if err != nil {
+		// a failing command is logged once, not on every request until it is restarted.
+		if err != errDecisionHookDown {
+			log.Printf("[ERROR] %v", err)
+		}
+		return rules
+	}
+	if action == "" {
+		return rules
+	}
+	return action
+}
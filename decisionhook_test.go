@@ -0,0 +1,172 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// writeHookScript writes a shell decision hook and returns its path.
+func writeHookScript(t *testing.T, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("decision hooks are tested with shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatalf("Could not create a temporary directory: %v", err)
+	}
+	path := filepath.Join(dir, "hook.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("Could not write the hook: %v", err)
+	}
+	return path
+}
+
+func TestDecisionHook(t *testing.T) {
+	script := writeHookScript(t, `while read -r line; do
+	case "$line" in
+	*'/block"'*) echo '{"action": "block"}' ;;
+	*'/challenge"'*) echo '{"action": "challenge"}' ;;
+	*'"X-Partner":"acme"'*) echo '{"action": "allow"}' ;;
+	*'/slow"'*) sleep 1; echo '{}' ;;
+	*'/crash"'*) exit 1 ;;
+	*) echo '{}' ;;
+	esac
+done
+`)
+	defer os.RemoveAll(filepath.Dir(script))
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter /private {\nrule allow\nip 10.0.0.1\ndecision_hook "+script+"\npass_cookie secret\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	config.DecisionHook.Timeout = 200 * time.Millisecond
+	defer config.DecisionHook.Close()
+
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		reqIP          string
+		reqPath        string
+		partner        bool
+		retry          bool // don't wait for the backoff of the previous failure.
+		expectedStatus int
+		expectedCode   int // written by the challenge page.
+	}{
+		// out of the scopes, the hook isn't asked.
+		{"8.8.8.8:_", "/block", false, false, http.StatusOK, http.StatusOK},
+		{"8.8.8.8:_", "/private/block", false, false, http.StatusForbidden, http.StatusOK},
+		{"10.0.0.1:_", "/private/challenge", false, false, http.StatusOK, http.StatusForbidden},
+		{"8.8.8.8:_", "/private", false, false, http.StatusForbidden, http.StatusOK},
+		{"8.8.8.8:_", "/private", true, false, http.StatusOK, http.StatusOK},
+		{"10.0.0.1:_", "/private", false, false, http.StatusOK, http.StatusOK},
+		// failures keep the decision of the rules, and the hook is restarted once the backoff is over.
+		{"10.0.0.1:_", "/private/slow", false, false, http.StatusOK, http.StatusOK},
+		{"10.0.0.1:_", "/private/block", false, false, http.StatusOK, http.StatusOK},
+		{"10.0.0.1:_", "/private/block", false, true, http.StatusForbidden, http.StatusOK},
+		{"8.8.8.8:_", "/private/crash", false, false, http.StatusForbidden, http.StatusOK},
+		{"8.8.8.8:_", "/private", true, false, http.StatusForbidden, http.StatusOK},
+		{"8.8.8.8:_", "/private", true, true, http.StatusOK, http.StatusOK},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.partner {
+			req.Header.Set("X-Partner", "acme")
+		}
+		if test.retry {
+			config.DecisionHook.retryAt = time.Time{}
+		}
+
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		if status != test.expectedStatus || rec.Code != test.expectedCode {
+			t.Fatalf("Test %d: Expected StatusCode: '%d' and '%d', Got: '%d' and '%d'", i, test.expectedStatus, test.expectedCode, status, rec.Code)
+		}
+		if test.expectedCode == http.StatusForbidden && !strings.Contains(rec.Body.String(), ChallengePath) {
+			t.Fatalf("Test %d: Expected the js challenge, Got: %s", i, rec.Body.String())
+		}
+	}
+}
+
+func TestDecisionHookTimeout(t *testing.T) {
+	script := writeHookScript(t, `while read -r line; do sleep 5; done`)
+	defer os.RemoveAll(filepath.Dir(script))
+
+	hook, err := NewDecisionHook([]string{script})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hook.Timeout = 100 * time.Millisecond
+	defer hook.Close()
+
+	// the requests waiting for their turn don't wait longer than the timeout either.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := hook.Decide(HookRequest{IP: "8.8.8.8"}); err == nil {
+				t.Errorf("Expected the hook to fail")
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected every request to give up after the timeout, took %v", elapsed)
+	}
+
+	// the command isn't restarted for every request after it failed.
+	if hook.failures != 1 || hook.retryAt.IsZero() {
+		t.Errorf("Expected a single failure and a backoff, Got: %d failures", hook.failures)
+	}
+}
+
+func TestDecisionHookRequest(t *testing.T) {
+	script := writeHookScript(t, `read -r line; echo "$line" > "$0.req"; echo '{}'; sleep 5`)
+	defer os.RemoveAll(filepath.Dir(script))
+
+	hook, err := NewDecisionHook([]string{script})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer hook.Close()
+
+	req := HookRequest{IP: net.ParseIP("8.8.8.8").String(), Method: "GET", Path: "/", Country: "US", Action: ActionAllow, Rule: 1}
+	if action, err := hook.Decide(req); err != nil || action != "" {
+		t.Fatalf("Expected no action, Got: %q, %v", action, err)
+	}
+	got, err := ioutil.ReadFile(script + ".req")
+	if err != nil {
+		t.Fatalf("Could not read the request: %v", err)
+	}
+	expected := `{"ip":"8.8.8.8","host":"","method":"GET","path":"/","country":"US","action":"allow","rule":1}` + "\n"
+	if string(got) != expected {
+		t.Fatalf("Expected: %s, Got: %s", expected, got)
+	}
+
+	if _, err := NewDecisionHook([]string{"/nonexistent/hook"}); err == nil {
+		t.Fatalf("Expected an error for a missing command")
+	}
+}
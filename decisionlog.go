@@ -0,0 +1,75 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// DecisionRecord is the record of a request the rules decided on, sent to the decision logs.
+type DecisionRecord struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"` // ActionAllow, ActionBlock, ActionChallenge or ActionLogOnly.
+	IP      string    `json:"ip"`
+	Country string    `json:"country,omitempty"`
+	ASN     uint      `json:"asn,omitempty"`
+	Host    string    `json:"host"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Scope   string    `json:"scope,omitempty"`   // of the ipfilter block, empty for bans outside of the blocks.
+	Rule    int       `json:"rule"`              // the 1-based position of the ipfilter block, BanRule or DefaultRule.
+	RuleID  string    `json:"rule_id,omitempty"` // see RuleEvent, empty for bans and the default.
+}
+
+// decision returns the record of the decision of 'rule' on 'r', the country and the ASN are only looked up
+// with their databases.
+func (ipf IPFilter) decision(r *http.Request, path IPPath, rule int, action string, clientIP net.IP) DecisionRecord {
+	d := DecisionRecord{Time: time.Now(), Action: action, Host: r.Host, Method: r.Method, Path: r.URL.Path, Rule: rule,
+		Scope: path.scopeOf(r.URL.Path)}
+	if clientIP != nil {
+		d.IP = clientIP.String()
+		if ipf.Config.hasCountryLookups() {
+			d.Country, _ = ipf.lookupCountry(clientIP, nil)
+		}
+		if ipf.Config.ASNHandler != nil {
+			d.ASN, _ = ipf.lookupASN(clientIP, nil)
+		}
+	}
+	if rule != BanRule && rule != DefaultRule {
+		d.RuleID = ruleID(path)
+	}
+	return d
+}
+
+// logsDecisions returns true if the decisions are logged somewhere, or set as placeholders.
+func (ipf IPFilter) logsDecisions() bool {
+	return ipf.Config.Syslog != nil || ipf.Config.LogFile != nil || ipf.Config.Summary != nil || ipf.Config.Placeholders
+}
+
+// logDecision sends 'd', the decision on 'r', to the decision logs and the placeholders of 'r'.
+func (ipf IPFilter) logDecision(r *http.Request, d DecisionRecord) {
+	if ipf.Config.Placeholders {
+		setPlaceholders(r, d)
+	}
+	if ipf.Config.Syslog != nil {
+		ipf.Config.Syslog.send(d)
+	}
+	if ipf.Config.LogFile != nil {
+		ipf.Config.LogFile.send(d)
+	}
+	if ipf.Config.Summary != nil {
+		ipf.Config.Summary.Record(d)
+	}
+}
+
+// logRequestDecision logs the decision of 'rule' on 'r' if the decisions are logged.
+func (ipf IPFilter) logRequestDecision(r *http.Request, path IPPath, rule int, action string) {
+	if !ipf.logsDecisions() {
+		return
+	}
+	var clientIP net.IP
+	if clientIPs, err := ipf.clientIPs(r, path.Strict); err == nil {
+		clientIP = clientIPs[0]
+	}
+	ipf.logDecision(r, ipf.decision(r, path, rule, action, clientIP))
+}
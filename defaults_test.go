@@ -0,0 +1,108 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestDefaultsBlock(t *testing.T) {
+	tests := []struct {
+		input       string
+		expected    []IPPath // only the inherited settings are compared.
+		shouldError bool
+	}{
+		{"ipfilter defaults {\nrule block\nstrict\nblockpage " + BlockPage + "\n}\nipfilter /a {\nip 8.8.8.8\n}\nipfilter /b {\nip 8.8.4.4\n}",
+			[]IPPath{{IsBlock: true, Strict: true, BlockPage: BlockPage}, {IsBlock: true, Strict: true, BlockPage: BlockPage}}, false},
+		// the blocks override the defaults.
+		{"ipfilter defaults {\nrule block\nstrict\nxff_policy all\n}\nipfilter /a {\nrule allow\nstrict off\nip 8.8.8.8\n}\nipfilter /b {\nip 8.8.4.4\nxff_policy last\n}",
+			[]IPPath{{XFFPolicy: XFFPolicyAll}, {IsBlock: true, Strict: true, XFFPolicy: XFFPolicyLast}}, false},
+		{"ipfilter /a {\nip 8.8.8.8\n}", []IPPath{{}}, false},
+		// only the settings of a rule, no conditions.
+		{"ipfilter defaults {\nrule block\ncountry RU\n}\nipfilter /a {\nip 8.8.8.8\n}", nil, true},
+		{"ipfilter /a {\nip 8.8.8.8\n}\nipfilter defaults {\nrule block\n}", nil, true},
+		{"ipfilter defaults {\nrule block\n}\nipfilter defaults {\nstrict\n}\nipfilter /a {\nip 8.8.8.8\n}", nil, true},
+		{"ipfilter /a {\nip 8.8.8.8\nstrict maybe\n}", nil, true},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldError != (err != nil) {
+			t.Fatalf("Test %d: Expected error: %v, Got: %v", i, test.shouldError, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(config.Paths) != len(test.expected) {
+			t.Fatalf("Test %d: Expected %d paths, Got: %d", i, len(test.expected), len(config.Paths))
+		}
+		for j, path := range config.Paths {
+			expected := test.expected[j]
+			if path.IsBlock != expected.IsBlock || path.Strict != expected.Strict || path.BlockPage != expected.BlockPage ||
+				path.XFFPolicy != expected.XFFPolicy {
+				t.Errorf("Test %d: Expected path %d: %+v, Got: %+v", i, j, expected, path)
+			}
+		}
+	}
+}
+
+func TestDefaultAction(t *testing.T) {
+	tests := []struct {
+		input          string
+		reqIP          string
+		reqPath        string
+		expectedStatus int
+		expectedDebug  string
+	}{
+		{"ipfilter /api {\nrule allow\nip 10.0.0.0/8\ndefault block\ndebug\n}", "10.0.0.1:_", "/api", http.StatusOK, "allowed; rule=1; match=ip:10.0.0.1"},
+		{"ipfilter /api {\nrule allow\nip 10.0.0.0/8\ndefault block\ndebug\n}", "10.0.0.1:_", "/", http.StatusForbidden, "blocked; rule=none"},
+		{"ipfilter /api {\nrule allow\nip 10.0.0.0/8\ndefault allow\ndebug\n}", "10.0.0.1:_", "/", http.StatusOK, "allowed; rule=none"},
+		{"ipfilter /api {\nrule allow\nip 10.0.0.0/8\ndebug\n}", "10.0.0.1:_", "/", http.StatusOK, "allowed; rule=none"},
+		// the excluded paths are explicitly open.
+		{"ipfilter / {\nrule allow\nip 10.0.0.0/8\nexclude /public\ndefault block\n}", "8.8.8.8:_", "/public", http.StatusOK, ""},
+		{"ipfilter /api {\nrule allow\nip 10.0.0.0/8\ndefault block\nallow_loopback\n}", "127.0.0.1:_", "/", http.StatusOK, ""},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", test.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		rec := httptest.NewRecorder()
+		if status, _ := ipf.ServeHTTP(rec, req); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+		if got := rec.Header().Get(HeaderDebug); got != test.expectedDebug {
+			t.Errorf("Test %d: Expected: %q, Got: %q", i, test.expectedDebug, got)
+		}
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nip 8.8.8.8\ndefault deny\n}")); err == nil {
+		t.Errorf("Expected an error for 'default deny'")
+	}
+
+	ipf, err := New(Config{
+		Paths:         []IPPath{{PathScopes: []string{"/api"}, Ranges: []Range{{net.ParseIP("10.0.0.0"), net.ParseIP("10.255.255.255")}}}},
+		DefaultAction: ActionBlock,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if d := ipf.Decide(net.ParseIP("10.0.0.1"), "/"); d.Action != ActionBlock || d.Rule != 0 {
+		t.Errorf("Expected the default to block, Got: %+v", d)
+	}
+}
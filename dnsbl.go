@@ -0,0 +1,152 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterMatcher("dnsbl", newDNSBLMatcher)
+}
+
+// Defaults of the dnsbl matcher.
+const (
+	defaultDNSBLTimeout = 500 * time.Millisecond
+	dnsblListedTTL      = time.Hour
+	dnsblNotListedTTL   = 15 * time.Minute // the negative cache, lists are updated often.
+)
+
+// Policies of the dnsbl matcher when a zone can't be queried.
+const (
+	DNSBLErrorSkip  = "skip"  // the client isn't matched by the zone.
+	DNSBLErrorMatch = "match" // the client is matched as if it were listed.
+)
+
+// dnsblLookupHost resolves the queries of the dnsbl matchers.
+var dnsblLookupHost = net.DefaultResolver.LookupHost
+
+// dnsblMatcher matches the clients listed in any of its zones, the DNS-based block lists such as
+// zen.spamhaus.org. The zones are queried in parallel and the answers cached, a query that takes longer
+// than the timeout is a lookup failure.
+type dnsblMatcher struct {
+	zones   []string
+	timeout time.Duration
+	onError string
+	cache   *ttlCache // listed by "<ip> <zone>".
+}
+
+// newDNSBLMatcher creates the matcher of 'dnsbl <zones...> [timeout=<duration>] [on_error=skip|match]'.
+func newDNSBLMatcher(args []string) (Matcher, error) {
+	m := &dnsblMatcher{timeout: defaultDNSBLTimeout, onError: DNSBLErrorSkip, cache: newTTLCache()}
+	for _, arg := range args {
+		i := strings.IndexByte(arg, '=')
+		if i < 0 {
+			m.zones = append(m.zones, strings.TrimSuffix(arg, "."))
+			continue
+		}
+		switch key, value := arg[:i], arg[i+1:]; key {
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return nil, errors.New("the timeout should be a positive duration, e.g. '500ms'")
+			}
+			m.timeout = timeout
+		case "on_error":
+			if value != DNSBLErrorSkip && value != DNSBLErrorMatch {
+				return nil, errors.New("on_error should be 'skip' or 'match'")
+			}
+			m.onError = value
+		default:
+			return nil, errors.New("unknown option " + key + ", expected 'timeout' or 'on_error'")
+		}
+	}
+	if len(m.zones) == 0 {
+		return nil, errors.New("expected zones")
+	}
+	return m, nil
+}
+
+// Match implements Matcher.
+func (m *dnsblMatcher) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	listed := make(chan bool, len(m.zones))
+	for _, zone := range m.zones {
+		go func(zone string) {
+			listed <- m.listed(ctx, ip, zone)
+		}(zone)
+	}
+	for range m.zones {
+		if <-listed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// listed returns true if 'ip' is listed in 'zone', or if the lookup failed with DNSBLErrorMatch.
+func (m *dnsblMatcher) listed(ctx context.Context, ip net.IP, zone string) bool {
+	key := ip.String() + " " + zone
+	if listed, ok := m.cache.get(key); ok {
+		return listed.(bool)
+	}
+
+	listed, err := dnsblQuery(ctx, ip, zone)
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: dnsbl lookup of %s in %s: %v", ip, zone, err)
+		return m.onError == DNSBLErrorMatch
+	}
+
+	ttl := dnsblNotListedTTL
+	if listed {
+		ttl = dnsblListedTTL
+	}
+	m.cache.set(key, listed, ttl)
+	return listed
+}
+
+// dnsblQuery looks up 'ip' in 'zone': a listed IP has an A record in 127.0.0.0/8, e.g. 4.3.2.1.zone for
+// 1.2.3.4. The answers in 127.255.255.0/24 are errors of the zone, e.g. for queries through public
+// resolvers.
+func dnsblQuery(ctx context.Context, ip net.IP, zone string) (bool, error) {
+	addrs, err := dnsblLookupHost(ctx, reverseIP(ip)+"."+zone)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.IsTimeout && !dnsErr.Temporary() {
+			// NXDOMAIN, not listed.
+			return false, nil
+		}
+		return false, err
+	}
+	for _, addr := range addrs {
+		a := net.ParseIP(addr).To4()
+		if a == nil || a[0] != 127 {
+			continue
+		}
+		if a[1] == 255 && a[2] == 255 {
+			return false, fmt.Errorf("the zone answered %s", addr)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// reverseIP returns the labels of 'ip' in reverse order, its octets for IPv4 and its nibbles for IPv6.
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hex = "0123456789abcdef"
+	labels := make([]byte, 0, 64)
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		labels = append(labels, hex[ip[i]&0xf], '.', hex[ip[i]>>4], '.')
+	}
+	return string(labels[:len(labels)-1])
+}
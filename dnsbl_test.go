@@ -0,0 +1,110 @@
+package ipfilter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestReverseIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"1.2.3.4", "4.3.2.1"},
+		{"::ffff:1.2.3.4", "4.3.2.1"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"},
+	}
+	for i, test := range tests {
+		if got := reverseIP(net.ParseIP(test.ip)); got != test.expected {
+			t.Errorf("Test %d: Expected %s, Got: %s", i, test.expected, got)
+		}
+	}
+}
+
+func TestDNSBL(t *testing.T) {
+	var queries int32
+	defer func(saved func(context.Context, string) ([]string, error)) { dnsblLookupHost = saved }(dnsblLookupHost)
+	dnsblLookupHost = func(ctx context.Context, host string) ([]string, error) {
+		atomic.AddInt32(&queries, 1)
+		switch host {
+		case "22.96.175.5.zen.example":
+			return []string{"127.0.0.2"}, nil
+		case "20.192.53.24.bl.example":
+			return []string{"127.0.0.4"}, nil
+		case "4.4.8.8.zen.example":
+			return []string{"127.255.255.254"}, nil
+		case "4.4.8.8.bl.example", "1.1.1.1.zen.example":
+			return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+		case "1.1.1.1.slow.example":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\ndnsbl zen.example bl.example.\n}\nipfilter /strict {\nrule block\ndnsbl zen.example slow.example timeout=50ms on_error=match\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		path           string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"/", "5.175.96.22:_", http.StatusForbidden},
+		{"/", "24.53.192.20:_", http.StatusForbidden},
+		{"/", "8.8.8.8:_", http.StatusOK},
+		// failures are skipped.
+		{"/", "8.8.4.4:_", http.StatusOK},
+		// or match.
+		{"/strict", "1.1.1.1:_", http.StatusForbidden},
+		{"/strict", "8.8.8.8:_", http.StatusOK},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		start := time.Now()
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("Test %d: Expected the lookups to time out", i)
+		}
+	}
+
+	// the answers are cached, the failures aren't.
+	before := atomic.LoadInt32(&queries)
+	for _, reqIP := range []string{"5.175.96.22:_", "8.8.8.8:_"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = reqIP
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if got := atomic.LoadInt32(&queries) - before; got != 0 {
+		t.Fatalf("Expected the answers to be cached, Got: %d queries", got)
+	}
+
+	for i, args := range [][]string{{}, {"timeout=1s"}, {"zen.example", "timeout=soon"}, {"zen.example", "on_error=block"}, {"zen.example", "retries=2"}} {
+		if _, err := NewMatcher(MatcherSpec{Name: "dnsbl", Args: args}); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package ipfilter
+
+import (
+	"net"
+)
+
+// excepted returns true if every client IP is exempted from the action of 'path' by its ExceptRanges or
+// ExceptCountries, a single IP of the chain isn't enough as it might have been added by the client.
+func (ipf IPFilter) excepted(path IPPath, clientIPs []net.IP, cost *requestCost) bool {
+	if len(path.ExceptRanges) == 0 && len(path.ExceptCountries) == 0 {
+		return false
+	}
+
+	for _, clientIP := range clientIPs {
+		if !ipf.exceptedIP(path, clientIP, cost) {
+			return false
+		}
+	}
+	return true
+}
+
+// exceptedIP returns true if 'ip' is in one of the ExceptRanges or ExceptCountries of 'path', a failed
+// lookup doesn't except the client.
+func (ipf IPFilter) exceptedIP(path IPPath, ip net.IP, cost *requestCost) bool {
+	for _, rng := range path.ExceptRanges {
+		if rng.InRange(&ip) {
+			return true
+		}
+	}
+
+	if len(path.ExceptCountries) == 0 {
+		return false
+	}
+	country, err := ipf.lookupCountry(ip, cost)
+	if err != nil {
+		return false
+	}
+	for _, c := range path.ExceptCountries {
+		if country == c {
+			return true
+		}
+	}
+	return false
+}
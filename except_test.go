@@ -0,0 +1,109 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestExcept(t *testing.T) {
+	tests := []struct {
+		input          string
+		shouldErr      bool
+		reqIP          string
+		fwdFor         string
+		expectedStatus int
+	}{
+		// block US except our office.
+		{"rule block\ncountry US\nexcept ip 8.8.4.0/24", false, "8.8.4.4:_", "", http.StatusOK},
+		{"rule block\ncountry US\nexcept ip 8.8.4.0/24", false, "8.8.8.8:_", "", http.StatusForbidden},
+		{"rule block\ncountry US\nexcept ip 8.8.4.0/24", false, "5.175.96.22:_", "", http.StatusOK},
+		// every IP of the chain must be excepted.
+		{"rule block\ncountry US\nexcept ip 8.8.4.0/24", false, "10.0.0.1:_", "8.8.8.8, 8.8.4.4", http.StatusForbidden},
+		{"rule block\ncountry US\nexcept ip 8.8.4.0/24 10", false, "10.0.0.1:_", "8.8.4.4", http.StatusOK},
+		{"rule block\nip 5 24\nexcept country CA", false, "24.53.192.20:_", "", http.StatusOK},
+		{"rule block\nip 5 24\nexcept country CA", false, "5.175.96.22:_", "", http.StatusForbidden},
+		// an excepted client of an allow rule isn't allowed.
+		{"rule allow\ncountry US CA\nexcept ip 8.8.8.8\nexcept country CA", false, "8.8.8.8:_", "", http.StatusForbidden},
+		{"rule allow\ncountry US CA\nexcept ip 8.8.8.8\nexcept country CA", false, "24.53.192.20:_", "", http.StatusForbidden},
+		{"rule allow\ncountry US CA\nexcept ip 8.8.8.8\nexcept country CA", false, "8.8.4.4:_", "", http.StatusOK},
+		{"rule block\ncountry US\nexcept asn 15169", true, "", "", 0},
+		{"rule block\ncountry US\nexcept ip", true, "", "", 0},
+		{"rule block\ncountry US\nexcept ip 8.8.4.0/33", true, "", "", 0},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\ndatabase "+DataBase+"\n"+test.input+"\n}"))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", test.fwdFor)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 5\nexcept country CA\n}")); err == nil {
+		t.Fatal("Expected an error for except country without a database")
+	}
+}
+
+func TestExceptRules(t *testing.T) {
+	rs := RuleSet{Paths: []Rule{{
+		PathScopes:      []string{"/"},
+		Rule:            "block",
+		IPs:             []string{"8"},
+		ExceptIPs:       []string{"8.8.4.0/24"},
+		ExceptCountries: []string{"CA"},
+	}}}
+	paths, err := rs.ToPaths(true, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	back := RulesFromPaths(paths).Paths[0]
+	if !reflect.DeepEqual(back.ExceptIPs, []string{"8.8.4.0-8.8.4.255"}) || !reflect.DeepEqual(back.ExceptCountries, []string{"CA"}) {
+		t.Fatalf("Expected the exceptions back, Got: %v %v", back.ExceptIPs, back.ExceptCountries)
+	}
+
+	if _, err := rs.ToPaths(false, false); err == nil {
+		t.Fatal("Expected an error for except_countries without a database")
+	}
+
+	ipf, err := New(Config{Paths: []IPPath{{PathScopes: []string{"/"}, IsBlock: true, Ranges: paths[0].Ranges, ExceptRanges: paths[0].ExceptRanges}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if d := ipf.Decide(net.ParseIP("8.8.4.4"), "/"); d.Action != ActionAllow {
+		t.Fatalf("Expected 8.8.4.4 to be excepted, Got: %v", d)
+	}
+	if d := ipf.Decide(net.ParseIP("8.8.8.8"), "/"); d.Action != ActionBlock {
+		t.Fatalf("Expected 8.8.8.8 to be blocked, Got: %v", d)
+	}
+}
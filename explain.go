@@ -0,0 +1,132 @@
+package ipfilter
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Reasons a RuleTrace wasn't evaluated.
+const (
+	skippedScope       = "scope"        // the path isn't in the scopes of the block.
+	skippedExcluded    = "excluded"     // the path is in the excludes of the block.
+	skippedInactive    = "inactive"     // the block is outside of its schedules or dates.
+	skippedThreatLevel = "threat_level" // the block is only enforced from a higher threat level.
+)
+
+// RuleTrace is how a block of the rules was evaluated for a client, see Explain.
+type RuleTrace struct {
+	Rule     int    `json:"rule"`               // 1-based position of the block.
+	ID       string `json:"id"`                 // identifies the block, as in the lifecycle events.
+	Action   string `json:"action"`             // of the block, ActionAllow or ActionBlock.
+	Scope    string `json:"scope,omitempty"`    // most specific scope of the block the path is in.
+	Skipped  string `json:"skipped,omitempty"`  // why the block wasn't evaluated, "scope", "excluded", "inactive" or "threat_level".
+	Matched  bool   `json:"matched"`            // the client meets the conditions of the block.
+	Match    string `json:"match,omitempty"`    // the condition it meets, as in the debug header, or "monitoring".
+	Excepted bool   `json:"excepted,omitempty"` // the client is exempted from the action, see excepted.
+	Result   string `json:"result,omitempty"`   // what the block alone decides, ActionAllow or ActionBlock.
+	Applied  bool   `json:"applied,omitempty"`  // the block is the one that decided, see Decision.Rule.
+	Error    string `json:"error,omitempty"`    // a lookup failed, the block blocks the client.
+}
+
+// Explanation is the LookupResult of a client with the trace of every block of the rules.
+type Explanation struct {
+	LookupResult
+	Path        string      `json:"path"`
+	Maintenance bool        `json:"maintenance,omitempty"` // the maintenance mode blocks the client before the rules.
+	Rules       []RuleTrace `json:"rules"`
+}
+
+// Explain returns the Lookup of a client from 'ip' requesting 'path' now, with how each block was evaluated:
+// the active blocks in scope are all evaluated, the one of the Decision applied. Like Decide, the blocks apply
+// to any host, method and headers. If the maintenance mode blocks the client, so does the Decision, whatever
+// the blocks decide.
+func (ipf IPFilter) Explain(ip net.IP, path string) Explanation {
+	if ipf.live != nil {
+		ipf.Config = *ipf.live.Load()
+	}
+	ip = normalizeIP(ip)
+	e := Explanation{LookupResult: ipf.Lookup(ip, path), Path: path}
+	if m := ipf.Config.Maintenance; m.Enabled() && !m.allows(ip) {
+		e.Maintenance = true
+		e.Decision = &Decision{Action: ActionBlock, Maintenance: true}
+	}
+
+	// matchReason needs a request.
+	r, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		r, _ = http.NewRequest(http.MethodGet, "/", nil)
+	}
+	r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+
+	level, now := ipf.Config.Threat.Level(), time.Now()
+	e.Rules = make([]RuleTrace, len(ipf.Config.Paths))
+	for i, p := range ipf.Config.Paths {
+		trace := RuleTrace{Rule: i + 1, ID: ruleID(p), Action: ActionAllow, Scope: p.scopeOf(path)}
+		if p.IsBlock {
+			trace.Action = ActionBlock
+		}
+		switch {
+		case trace.Scope == "":
+			trace.Skipped = skippedScope
+		case p.excludes(path):
+			trace.Skipped = skippedExcluded
+		case !p.activeAt(now):
+			trace.Skipped = skippedInactive
+		case p.ThreatLevel > level:
+			trace.Skipped = skippedThreatLevel
+		default:
+			ipf.traceRule(&trace, p, ip, r)
+		}
+		trace.Applied = e.Decision != nil && e.Decision.Rule == i+1 && !e.Decision.Banned
+		e.Rules[i] = trace
+	}
+	return e
+}
+
+// traceRule evaluates 'path' for a client from 'ip' like evaluateIPs, without its side effects.
+func (ipf IPFilter) traceRule(trace *RuleTrace, path IPPath, ip net.IP, r *http.Request) {
+	clientIPs := []net.IP{ip}
+	if ipf.Config.Monitoring.allows(path.AllowMonitoring, clientIPs) {
+		trace.Matched, trace.Match, trace.Result = true, "monitoring", ActionAllow
+		return
+	}
+
+	matched, _, err := ipf.match(path, clientIPs, nil, nil)
+	if err != nil {
+		trace.Error = err.Error()
+		trace.Result = ActionBlock
+		return
+	}
+	trace.Matched = matched
+	if matched {
+		trace.Match = ipf.matchReason(path, r)
+		trace.Excepted = ipf.excepted(path, clientIPs, nil)
+	}
+	// a block the client matches applies its action, else the opposite one.
+	if (matched && !trace.Excepted) == path.IsBlock {
+		trace.Result = ActionBlock
+	} else {
+		trace.Result = ActionAllow
+	}
+}
+
+// serveExplain answers the Explanation of the 'ip' query parameter requesting 'path', "/" by default.
+func (ipf IPFilter) serveExplain(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	query := r.URL.Query()
+	ip := net.ParseIP(query.Get("ip"))
+	if ip == nil {
+		return http.StatusBadRequest, errors.New("ipfilter: Can't parse IP address: " + query.Get("ip"))
+	}
+	path := query.Get("path")
+	if path == "" {
+		path = "/"
+	}
+	return writeJSON(w, ipf.Explain(ip, path))
+}
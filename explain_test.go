@@ -0,0 +1,186 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestAdminExplain(t *testing.T) {
+	db, err := maxminddb.Open(DataBase)
+	if err != nil {
+		t.Fatalf("Error opening the database: %v", err)
+	}
+	defer db.Close()
+
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{
+			{PathScopes: []string{"/"}, IsBlock: true, CountryCodes: []string{"RU"}},
+			{PathScopes: []string{"/api"}, CountryCodes: []string{"US"}},
+			{PathScopes: []string{"/static"}, IsBlock: true, CountryCodes: []string{"US"}, Excludes: []string{"/static/img"}},
+			{PathScopes: []string{"/api"}, IsBlock: true, Ranges: []Range{{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}}, ThreatLevel: 2},
+		},
+		DBHandler: db,
+	}, "secret")
+
+	tests := []struct {
+		path     string
+		expected Explanation
+	}{
+		{"/ipfilter/explain?ip=8.8.8.8&path=/api/users", Explanation{
+			LookupResult: LookupResult{IP: "8.8.8.8", Country: "US", Decision: &Decision{Action: ActionAllow, Rule: 2, Scope: "/api", Country: "US"}},
+			Path:         "/api/users",
+			Rules: []RuleTrace{
+				{Rule: 1, Action: ActionBlock, Scope: "/", Result: ActionAllow},
+				{Rule: 2, Action: ActionAllow, Scope: "/api", Matched: true, Match: "country:US", Result: ActionAllow, Applied: true},
+				{Rule: 3, Action: ActionBlock, Skipped: skippedScope},
+				{Rule: 4, Action: ActionBlock, Scope: "/api", Skipped: skippedThreatLevel},
+			},
+		}},
+		{"/ipfilter/explain?ip=5.175.96.22&path=/api", Explanation{
+			LookupResult: LookupResult{IP: "5.175.96.22", Country: "RU", Decision: &Decision{Action: ActionBlock, Rule: 2, Scope: "/api", Country: "RU"}},
+			Path:         "/api",
+			Rules: []RuleTrace{
+				{Rule: 1, Action: ActionBlock, Scope: "/", Matched: true, Match: "country:RU", Result: ActionBlock},
+				{Rule: 2, Action: ActionAllow, Scope: "/api", Result: ActionBlock, Applied: true},
+				{Rule: 3, Action: ActionBlock, Skipped: skippedScope},
+				{Rule: 4, Action: ActionBlock, Scope: "/api", Skipped: skippedThreatLevel},
+			},
+		}},
+		// the excluded path passes through, no block applies.
+		{"/ipfilter/explain?ip=8.8.8.8&path=/static/img/logo.png", Explanation{
+			LookupResult: LookupResult{IP: "8.8.8.8", Country: "US", Decision: &Decision{Action: ActionAllow}},
+			Path:         "/static/img/logo.png",
+			Rules: []RuleTrace{
+				{Rule: 1, Action: ActionBlock, Scope: "/", Result: ActionAllow},
+				{Rule: 2, Action: ActionAllow, Skipped: skippedScope},
+				{Rule: 3, Action: ActionBlock, Scope: "/static", Skipped: skippedExcluded},
+				{Rule: 4, Action: ActionBlock, Skipped: skippedScope},
+			},
+		}},
+		{"/ipfilter/explain?ip=8.8.8.8", Explanation{
+			LookupResult: LookupResult{IP: "8.8.8.8", Country: "US", Decision: &Decision{Action: ActionAllow, Rule: 1, Scope: "/", Country: "US"}},
+			Path:         "/",
+			Rules: []RuleTrace{
+				{Rule: 1, Action: ActionBlock, Scope: "/", Result: ActionAllow, Applied: true},
+				{Rule: 2, Action: ActionAllow, Skipped: skippedScope},
+				{Rule: 3, Action: ActionBlock, Skipped: skippedScope},
+				{Rule: 4, Action: ActionBlock, Skipped: skippedScope},
+			},
+		}},
+	}
+
+	for i, test := range tests {
+		status, rec := adminRequest(t, ipf, "GET", test.path, "", "8.8.8.8:_", "secret")
+		if status != http.StatusOK {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, http.StatusOK, status)
+		}
+		var e Explanation
+		if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+			t.Fatalf("Test %d: Could not decode the explanation: %v", i, err)
+		}
+		// the IDs are hashes of the rules.
+		for j := range e.Rules {
+			if e.Rules[j].ID == "" {
+				t.Errorf("Test %d: Rule %d has no ID", i, j+1)
+			}
+			e.Rules[j].ID = ""
+		}
+		if !reflect.DeepEqual(e, test.expected) {
+			t.Fatalf("Test %d: Expected: %+v, Got: %+v", i, test.expected, e)
+		}
+	}
+
+	errorTests := []struct {
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		{"GET", "/ipfilter/explain?ip=8.8.8.8", "", http.StatusUnauthorized},
+		{"POST", "/ipfilter/explain?ip=8.8.8.8", "secret", http.StatusMethodNotAllowed},
+		{"GET", "/ipfilter/explain?path=/api", "secret", http.StatusBadRequest},
+		{"GET", "/ipfilter/explain?ip=nope", "secret", http.StatusBadRequest},
+	}
+	for i, test := range errorTests {
+		if status, _ := adminRequest(t, ipf, test.method, test.path, "", "8.8.8.8:_", test.token); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestExplainExcepted(t *testing.T) {
+	ipf := IPFilter{Config: IPFConfig{
+		Paths: []IPPath{
+			{
+				PathScopes:   []string{"/"},
+				IsBlock:      true,
+				Ranges:       []Range{{net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.255")}},
+				ExceptRanges: []Range{{net.ParseIP("10.0.0.7"), net.ParseIP("10.0.0.7")}},
+			},
+		},
+	}}
+
+	tests := []struct {
+		ip       string
+		expected RuleTrace
+	}{
+		{"10.0.0.1", RuleTrace{Rule: 1, Action: ActionBlock, Scope: "/", Matched: true, Match: "ip:10.0.0.1", Result: ActionBlock, Applied: true}},
+		{"10.0.0.7", RuleTrace{Rule: 1, Action: ActionBlock, Scope: "/", Matched: true, Match: "ip:10.0.0.7", Excepted: true, Result: ActionAllow, Applied: true}},
+	}
+	for i, test := range tests {
+		e := ipf.Explain(net.ParseIP(test.ip), "/")
+		trace := e.Rules[0]
+		trace.ID = ""
+		if !reflect.DeepEqual(trace, test.expected) {
+			t.Errorf("Test %d: Expected: %+v, Got: %+v", i, test.expected, trace)
+		}
+		if e.Decision.Action != trace.Result {
+			t.Errorf("Test %d: Expected the decision to be %s, Got: %s", i, trace.Result, e.Decision.Action)
+		}
+	}
+}
+
+func TestExplainInactive(t *testing.T) {
+	ip := []Range{{net.ParseIP("1.2.3.4"), net.ParseIP("1.2.3.4")}}
+	ipf, err := New(Config{
+		Paths: []IPPath{
+			{PathScopes: []string{"/"}, Ranges: ip},
+			{PathScopes: []string{"/api"}, IsBlock: true, Ranges: ip, ActiveUntil: time.Now().Add(-time.Hour)},
+		},
+		Maintenance: NewMaintenance(),
+	})
+	if err != nil {
+		t.Fatalf("Could not create the filter: %v", err)
+	}
+
+	e := ipf.Explain(net.ParseIP("1.2.3.4"), "/api")
+	expected := []RuleTrace{
+		{Rule: 1, Action: ActionAllow, Scope: "/", Matched: true, Match: "ip:1.2.3.4", Result: ActionAllow, Applied: true},
+		{Rule: 2, Action: ActionBlock, Scope: "/api", Skipped: skippedInactive},
+	}
+	for i := range e.Rules {
+		e.Rules[i].ID = ""
+	}
+	if *e.Decision != (Decision{Action: ActionAllow, Rule: 1, Scope: "/"}) || e.Maintenance || !reflect.DeepEqual(e.Rules, expected) {
+		t.Errorf("Expected the first block to apply, Got: %+v %+v", e.Decision, e.Rules)
+	}
+
+	// the maintenance mode blocks the client before the blocks.
+	ipf.Config.Maintenance.Set(true, 0)
+	e = ipf.Explain(net.ParseIP("1.2.3.4"), "/api")
+	if *e.Decision != (Decision{Action: ActionBlock, Maintenance: true}) || !e.Maintenance || e.Rules[0].Applied || e.Rules[0].Result != ActionAllow {
+		t.Errorf("Expected the maintenance mode to block, Got: %+v %+v", e.Decision, e.Rules)
+	}
+	if err := ipf.Config.Maintenance.AllowIPs([]string{"1.2.3.4"}); err != nil {
+		t.Fatal(err)
+	}
+	if e = ipf.Explain(net.ParseIP("1.2.3.4"), "/api"); e.Maintenance || e.Decision.Action != ActionAllow {
+		t.Errorf("Expected the allowlist to pass the maintenance, Got: %+v", e.Decision)
+	}
+}
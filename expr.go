@@ -0,0 +1,628 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterMatcher("expr", func(args []string) (Matcher, error) {
+		if len(args) == 0 {
+			return nil, errors.New("expected an expression")
+		}
+		return CompileExpr(strings.Join(args, " "))
+	})
+}
+
+// exprType is the static type of an expression.
+type exprType int
+
+const (
+	typeBool exprType = iota
+	typeString
+	typeInt
+	typeStringList
+	typeIntList
+)
+
+func (t exprType) String() string {
+	return [...]string{"bool", "string", "int", "list(string)", "list(int)"}[t]
+}
+
+// exprEnv holds what the variables of an expression are evaluated from.
+type exprEnv struct {
+	ip      net.IP
+	r       *http.Request // nil if the decision isn't about a request.
+	lookups Lookups       // nil outside of an ipfilter block.
+}
+
+// exprNode is a node of a compiled expression, eval returns a value of its type:
+// bool, string, int64, []string or []int64.
+type exprNode interface {
+	typ() exprType
+	eval(env *exprEnv) (interface{}, error)
+}
+
+// Expr is a compiled expression, a subset of CEL (https://github.com/google/cel-spec) over the variables
+//
+//	ip       string, the client IP, e.g. "1.2.3.4"
+//	country  string, its ISO country code, requires a database
+//	asn      int, its autonomous system number, requires an ASN database
+//	path     string, the path of the request
+//	method   string, the method of the request
+//
+// and the function header(name), the value of a request header. Expressions combine them with
+// '&&', '||', '!', '==', '!=', '<', '<=', '>', '>=', 'in' on list literals, parentheses, and the
+// string methods startsWith, endsWith, contains and matches, e.g.
+//
+//	country != 'DE' && path.startsWith('/admin') && method == 'POST'
+//
+// Outside of a request, path, method and headers are empty strings.
+type Expr struct {
+	source string
+	root   exprNode
+}
+
+// CompileExpr parses and type checks 'source', a boolean expression.
+func CompileExpr(source string) (*Expr, error) {
+	p := &exprParser{source: source}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected '%s'", p.tokens[p.pos].text)
+	}
+	if root.typ() != typeBool {
+		return nil, fmt.Errorf("ipfilter: expr: %s is a %s, not a bool", source, root.typ())
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Match implements Matcher, the databases are looked up through the Lookups of 'ctx'.
+func (e *Expr) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	v, err := e.root.eval(&exprEnv{ip: ip, r: r, lookups: LookupsFromContext(ctx)})
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// exprToken is a token of an expression, 'kind' is one of the tok constants.
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+const (
+	tokIdent = iota
+	tokString
+	tokInt
+	tokOp
+)
+
+type exprParser struct {
+	source string
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	at := len(p.source)
+	if p.pos < len(p.tokens) {
+		at = p.tokens[p.pos].pos
+	}
+	return fmt.Errorf("ipfilter: expr: %s at position %d of: %s", fmt.Sprintf(format, args...), at+1, p.source)
+}
+
+// lex splits the source into tokens, string literals are unquoted.
+func (p *exprParser) lex() error {
+	s := p.source
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			p.tokens = append(p.tokens, exprToken{tokIdent, s[i:j], i})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			p.tokens = append(p.tokens, exprToken{tokInt, s[i:j], i})
+			i = j
+		case c == '\'' || c == '"':
+			var text strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				text.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return fmt.Errorf("ipfilter: expr: unterminated string at position %d of: %s", i+1, s)
+			}
+			p.tokens = append(p.tokens, exprToken{tokString, text.String(), i})
+			i = j + 1
+		default:
+			op := s[i : i+1]
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					op = two
+				}
+			}
+			switch op {
+			case "&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", ".":
+			default:
+				return fmt.Errorf("ipfilter: expr: unexpected '%s' at position %d of: %s", op, i+1, s)
+			}
+			p.tokens = append(p.tokens, exprToken{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+// accept consumes the next token if it is the operator 'op'.
+func (p *exprParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokOp && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		if p.pos < len(p.tokens) {
+			return p.errorf("expected '%s', got '%s'", op, p.tokens[p.pos].text)
+		}
+		return p.errorf("expected '%s'", op)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseLogical("&&", p.parseUnary)
+}
+
+func (p *exprParser) parseLogical(op string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(op) {
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if left.typ() != typeBool || right.typ() != typeBool {
+			return nil, p.errorf("'%s' needs bools, got %s and %s", op, left.typ(), right.typ())
+		}
+		left = logicalNode{op == "&&", left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("!") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if x.typ() != typeBool {
+			return nil, p.errorf("'!' needs a bool, got %s", x.typ())
+		}
+		return notNode{x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokIdent && p.tokens[p.pos].text == "in" {
+		p.pos++
+		list, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if !(left.typ() == typeString && list.typ() == typeStringList || left.typ() == typeInt && list.typ() == typeIntList) {
+			return nil, p.errorf("'in' needs a string or an int and a list of the same type, got %s and %s", left.typ(), list.typ())
+		}
+		return inNode{left, list}, nil
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if !p.accept(op) {
+			continue
+		}
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if left.typ() != right.typ() || left.typ() == typeStringList || left.typ() == typeIntList {
+			return nil, p.errorf("can't compare %s and %s", left.typ(), right.typ())
+		}
+		if left.typ() == typeBool && op != "==" && op != "!=" {
+			return nil, p.errorf("bools can't be ordered")
+		}
+		return compareNode{op, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, p.errorf("unexpected end")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	var node exprNode
+	switch {
+	case tok.kind == tokString:
+		node = literalNode{tok.text, typeString}
+	case tok.kind == tokInt:
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid int %s", tok.text)
+		}
+		node = literalNode{n, typeInt}
+	case tok.kind == tokIdent && (tok.text == "true" || tok.text == "false"):
+		node = literalNode{tok.text == "true", typeBool}
+	case tok.kind == tokIdent && tok.text == "header":
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokString {
+			return nil, p.errorf("header() needs a string literal")
+		}
+		node = headerNode{http.CanonicalHeaderKey(p.tokens[p.pos].text)}
+		p.pos++
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	case tok.kind == tokIdent:
+		t, ok := exprVariables[tok.text]
+		if !ok {
+			p.pos--
+			return nil, p.errorf("unknown variable '%s'", tok.text)
+		}
+		node = variableNode{tok.text, t}
+	case tok.kind == tokOp && tok.text == "(":
+		var err error
+		if node, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	case tok.kind == tokOp && tok.text == "[":
+		var err error
+		if node, err = p.parseList(); err != nil {
+			return nil, err
+		}
+	default:
+		p.pos--
+		return nil, p.errorf("unexpected '%s'", tok.text)
+	}
+
+	// string methods, e.g. path.startsWith('/admin').
+	for p.accept(".") {
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokIdent {
+			return nil, p.errorf("expected a method")
+		}
+		method := p.tokens[p.pos].text
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if node.typ() != typeString || arg.typ() != typeString {
+			return nil, p.errorf("%s needs strings, got %s and %s", method, node.typ(), arg.typ())
+		}
+
+		switch method {
+		case "startsWith", "endsWith", "contains":
+			node = methodNode{method, node, arg}
+		case "matches":
+			lit, ok := arg.(literalNode)
+			if !ok {
+				return nil, p.errorf("matches needs a string literal")
+			}
+			re, err := regexp.Compile(lit.v.(string))
+			if err != nil {
+				return nil, p.errorf("invalid regexp: %v", err)
+			}
+			node = matchesNode{node, re}
+		default:
+			return nil, p.errorf("unknown method '%s'", method)
+		}
+	}
+	return node, nil
+}
+
+// parseList parses the elements of a list literal, after its '['.
+func (p *exprParser) parseList() (exprNode, error) {
+	var strs []string
+	var ints []int64
+	for !p.accept("]") {
+		if len(strs)+len(ints) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		if p.pos >= len(p.tokens) {
+			return nil, p.errorf("expected ']'")
+		}
+		tok := p.tokens[p.pos]
+		switch {
+		case tok.kind == tokString && ints == nil:
+			strs = append(strs, tok.text)
+		case tok.kind == tokInt && strs == nil:
+			n, err := strconv.ParseInt(tok.text, 10, 64)
+			if err != nil {
+				return nil, p.errorf("invalid int %s", tok.text)
+			}
+			ints = append(ints, n)
+		default:
+			return nil, p.errorf("lists hold string or int literals of a single type")
+		}
+		p.pos++
+	}
+	if ints != nil {
+		return literalNode{ints, typeIntList}, nil
+	}
+	return literalNode{strs, typeStringList}, nil
+}
+
+var exprVariables = map[string]exprType{
+	"ip":      typeString,
+	"country": typeString,
+	"asn":     typeInt,
+	"path":    typeString,
+	"method":  typeString,
+}
+
+type literalNode struct {
+	v interface{}
+	t exprType
+}
+
+func (n literalNode) typ() exprType                      { return n.t }
+func (n literalNode) eval(*exprEnv) (interface{}, error) { return n.v, nil }
+
+type variableNode struct {
+	name string
+	t    exprType
+}
+
+func (n variableNode) typ() exprType { return n.t }
+
+func (n variableNode) eval(env *exprEnv) (interface{}, error) {
+	switch n.name {
+	case "ip":
+		return env.ip.String(), nil
+	case "country", "asn":
+		if env.lookups == nil {
+			return nil, errors.New("ipfilter: expr: " + n.name + " can only be looked up in an ipfilter block")
+		}
+		if n.name == "country" {
+			return env.lookups.Country(env.ip)
+		}
+		asn, err := env.lookups.ASN(env.ip)
+		return int64(asn), err
+	case "path":
+		if env.r == nil {
+			return "", nil
+		}
+		return env.r.URL.Path, nil
+	default: // method.
+		if env.r == nil {
+			return "", nil
+		}
+		return env.r.Method, nil
+	}
+}
+
+type headerNode struct {
+	name string
+}
+
+func (n headerNode) typ() exprType { return typeString }
+
+func (n headerNode) eval(env *exprEnv) (interface{}, error) {
+	if env.r == nil {
+		return "", nil
+	}
+	return env.r.Header.Get(n.name), nil
+}
+
+type notNode struct {
+	x exprNode
+}
+
+func (n notNode) typ() exprType { return typeBool }
+
+func (n notNode) eval(env *exprEnv) (interface{}, error) {
+	v, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return !v.(bool), nil
+}
+
+// logicalNode is '&&' if 'and' is set, '||' otherwise, the right side is only evaluated if needed.
+type logicalNode struct {
+	and         bool
+	left, right exprNode
+}
+
+func (n logicalNode) typ() exprType { return typeBool }
+
+func (n logicalNode) eval(env *exprEnv) (interface{}, error) {
+	v, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if v.(bool) != n.and {
+		return v, nil
+	}
+	return n.right.eval(env)
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n compareNode) typ() exprType { return typeBool }
+
+func (n compareNode) eval(env *exprEnv) (interface{}, error) {
+	l, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmp int
+	switch l := l.(type) {
+	case string:
+		cmp = strings.Compare(l, r.(string))
+	case int64:
+		if l < r.(int64) {
+			cmp = -1
+		} else if l > r.(int64) {
+			cmp = 1
+		}
+	case bool:
+		if l != r.(bool) {
+			cmp = 1
+		}
+	}
+
+	switch n.op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+type inNode struct {
+	x, list exprNode
+}
+
+func (n inNode) typ() exprType { return typeBool }
+
+func (n inNode) eval(env *exprEnv) (interface{}, error) {
+	v, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	list, _ := n.list.eval(env)
+	switch v := v.(type) {
+	case string:
+		for _, s := range list.([]string) {
+			if s == v {
+				return true, nil
+			}
+		}
+	case int64:
+		for _, i := range list.([]int64) {
+			if i == v {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+type methodNode struct {
+	method    string
+	recv, arg exprNode
+}
+
+func (n methodNode) typ() exprType { return typeBool }
+
+func (n methodNode) eval(env *exprEnv) (interface{}, error) {
+	recv, err := n.recv.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	arg, err := n.arg.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.method {
+	case "startsWith":
+		return strings.HasPrefix(recv.(string), arg.(string)), nil
+	case "endsWith":
+		return strings.HasSuffix(recv.(string), arg.(string)), nil
+	default: // contains.
+		return strings.Contains(recv.(string), arg.(string)), nil
+	}
+}
+
+type matchesNode struct {
+	recv exprNode
+	re   *regexp.Regexp
+}
+
+func (n matchesNode) typ() exprType { return typeBool }
+
+func (n matchesNode) eval(env *exprEnv) (interface{}, error) {
+	recv, err := n.recv.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return n.re.MatchString(recv.(string)), nil
+}
@@ -0,0 +1,146 @@
+package ipfilter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// staticLookups answers every lookup with the same country and ASN.
+type staticLookups struct {
+	country string
+	asn     uint
+}
+
+func (l staticLookups) Country(net.IP) (string, error) { return l.country, nil }
+func (l staticLookups) ASN(net.IP) (uint, error)       { return l.asn, nil }
+func (l staticLookups) AnonymousIP(net.IP) (AnonymousIP, error) {
+	return AnonymousIP{}, nil
+}
+
+func TestExpr(t *testing.T) {
+	tests := []struct {
+		expr     string
+		method   string
+		path     string
+		expected bool
+	}{
+		{"country != 'DE' && path.startsWith('/admin') && method == 'POST'", "POST", "/admin/users", true},
+		{"country != 'DE' && path.startsWith('/admin') && method == 'POST'", "GET", "/admin/users", false},
+		{`country in ["FR", "DE"] || asn == 64500`, "GET", "/", true},
+		{"asn in [1, 2] || asn > 64000 && asn <= 64500", "GET", "/", true},
+		{"!(asn < 64500)", "GET", "/", true},
+		{"header('x-debug') == 'on'", "GET", "/", true},
+		{"header('X-Other') == ''", "GET", "/", true},
+		{"ip == '1.2.3.4' && ip.startsWith('1.2.')", "GET", "/", true},
+		{"path.matches('^/v[0-9]+/') && !path.endsWith('.js') && path.contains('api')", "GET", "/v2/api/x", true},
+		{"path.matches('^/v[0-9]+/')", "GET", "/api", false},
+		{"true && (false || method == \"GET\")", "GET", "/", true},
+	}
+
+	ctx := context.WithValue(context.Background(), lookupsKey{}, staticLookups{"FR", 64500})
+	for i, test := range tests {
+		e, err := CompileExpr(test.expr)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		req, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.Header.Set("X-Debug", "on")
+
+		matched, err := e.Match(ctx, net.ParseIP("1.2.3.4"), req)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if matched != test.expected {
+			t.Fatalf("Test %d: %s: Expected: %v, Got: %v", i, test.expr, test.expected, matched)
+		}
+	}
+
+	// outside of an ipfilter block, the databases can't be looked up.
+	e, _ := CompileExpr("country == 'FR'")
+	if _, err := e.Match(context.Background(), net.ParseIP("1.2.3.4"), nil); err == nil {
+		t.Fatalf("Expected an error without lookups")
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	for i, expr := range []string{
+		"",
+		"country",
+		"country == 1",
+		"asn == 'AS1'",
+		"city == 'Paris'",
+		"path.startsWith(1)",
+		"path.lower()",
+		"path.matches(header('X'))",
+		"path.matches('[')",
+		"country in ['FR', 1]",
+		"country in [1, 2]",
+		"true < false",
+		"method == 'GET' &",
+		"method = 'GET'",
+		"(method == 'GET'",
+		"method == 'GET",
+		"method == 'GET' method",
+		"header(X) == ''",
+	} {
+		if _, err := CompileExpr(expr); err == nil {
+			t.Fatalf("Test %d: Expected an error for: %s", i, expr)
+		}
+	}
+}
+
+func TestExprDirective(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", `ipfilter /admin {
+		rule block
+		database `+DataBase+`
+		expr "country != 'US' || method == 'DELETE'"
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := RulesFromPaths(config.Paths).Paths[0].Matchers; len(got) != 1 || got[0].Args[0] != "country != 'US' || method == 'DELETE'" {
+		t.Fatalf("Unexpected matchers: %+v", got)
+	}
+
+	tests := []struct {
+		reqIP          string
+		method         string
+		expectedStatus int
+	}{
+		{"8.8.8.8:_", "GET", http.StatusOK},
+		{"8.8.8.8:_", "DELETE", http.StatusForbidden},
+		{"5.175.96.22:_", "GET", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest(test.method, "/admin", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nexpr method ==\n}")); err == nil {
+		t.Fatalf("Expected an error for an invalid expression")
+	}
+}
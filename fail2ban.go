@@ -0,0 +1,134 @@
+package ipfilter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fail2banPoll is how often the ban file of fail2ban is checked for changes.
+const fail2banPoll = 5 * time.Second
+
+// Fail2Ban shares the bans with fail2ban: the IPs of BanFile, kept by a fail2ban action, are banned from
+// every path like the bans of the BanList, and the bans of the BanList are appended to LogFile for a
+// fail2ban jail to pick up. Only the files are used, the socket of fail2ban speaks Python pickle.
+type Fail2Ban struct {
+	BanFile string
+	LogFile string // no log if empty.
+
+	mu      sync.RWMutex
+	ranges  *CompactRanges
+	modTime time.Time // of the file read into ranges.
+	size    int64
+
+	logMu sync.Mutex
+}
+
+// NewFail2Ban returns a Fail2Ban with the IPs of 'banFile', 'logFile' may be empty.
+func NewFail2Ban(banFile, logFile string) (*Fail2Ban, error) {
+	f := &Fail2Ban{BanFile: banFile, LogFile: logFile}
+	if err := f.Load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Load reads the ban file again if it changed. Each line holds an IP or a CIDR, optionally after a
+// "<daemon>:" like the hosts.deny file of the hostsdeny action, '#' starts a comment and invalid entries
+// are skipped. A missing file bans nobody, fail2ban may not have banned anyone yet.
+func (f *Fail2Ban) Load() error {
+	info, err := os.Stat(f.BanFile)
+	if os.IsNotExist(err) {
+		f.mu.Lock()
+		f.ranges, f.modTime, f.size = nil, time.Time{}, 0
+		f.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ipfilter: Can't read the fail2ban file: %v", err)
+	}
+
+	f.mu.RLock()
+	unchanged := info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(f.BanFile)
+	if err != nil {
+		return fmt.Errorf("ipfilter: Can't read the fail2ban file: %v", err)
+	}
+	var ranges []Range
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		entry := strings.Trim(fields[len(fields)-1], "[]")
+		if network, ok := parseNetwork(entry); ok {
+			ranges = append(ranges, networkRange(network))
+		}
+	}
+
+	f.mu.Lock()
+	f.ranges, f.modTime, f.size = NewCompactRanges(ranges), info.ModTime(), info.Size()
+	f.mu.Unlock()
+	return nil
+}
+
+// Contains returns true if 'ip' is in the ban file, false for a nil Fail2Ban.
+func (f *Fail2Ban) Contains(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	ranges := f.ranges
+	f.mu.RUnlock()
+	return ranges.Contains(ip)
+}
+
+// logBan appends 'ban' to the log file, e.g. "2024-05-01 12:00:00 ipfilter: Ban 1.2.3.4".
+func (f *Fail2Ban) logBan(ban Ban) {
+	if f == nil || f.LogFile == "" {
+		return
+	}
+
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+
+	file, err := os.OpenFile(f.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: Can't open the fail2ban log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s ipfilter: Ban %s\n", time.Now().Format("2006-01-02 15:04:05"), ban.IP); err != nil {
+		log.Printf("[ERROR] ipfilter: Can't write the fail2ban log: %v", err)
+	}
+}
+
+// watchFail2Ban reloads the ban file of 'f' when it changes, until 'ctx' is done.
+func watchFail2Ban(ctx context.Context, f *Fail2Ban) {
+	ticker := time.NewTicker(fail2banPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.Load(); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+		}
+	}
+}
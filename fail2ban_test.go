@@ -0,0 +1,90 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestFail2Ban(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter-fail2ban")
+	if err != nil {
+		t.Fatalf("Could not create the directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	banFile, logFile := filepath.Join(dir, "banned"), filepath.Join(dir, "ipfilter.log")
+
+	if err := ioutil.WriteFile(banFile, []byte("# banned by fail2ban\n8.8.8.8\nALL: 24.53.192.0/24\nsshd: [2001:db8::1]\nnot an ip\n"), 0644); err != nil {
+		t.Fatalf("Could not write the ban file: %v", err)
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 5.175.96.22\nfail2ban "+banFile+" "+logFile+"\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+	check := func(reqIP string, expectedStatus int) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = reqIP
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != expectedStatus {
+			t.Fatalf("%s: Expected StatusCode: '%d', Got: '%d'", reqIP, expectedStatus, status)
+		}
+	}
+
+	check("8.8.8.8:_", http.StatusForbidden)
+	check("24.53.192.20:_", http.StatusForbidden)
+	check("[2001:db8::1]:_", http.StatusForbidden)
+	check("8.8.4.4:_", http.StatusOK)
+
+	// fail2ban unbans 8.8.8.8 and bans 8.8.4.4.
+	if err := ioutil.WriteFile(banFile, []byte("8.8.4.4\n"), 0644); err != nil {
+		t.Fatalf("Could not write the ban file: %v", err)
+	}
+	if err := config.Fail2Ban.Load(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check("8.8.8.8:_", http.StatusOK)
+	check("8.8.4.4:_", http.StatusForbidden)
+
+	// the file being removed lifts the bans.
+	os.Remove(banFile)
+	if err := config.Fail2Ban.Load(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check("8.8.4.4:_", http.StatusOK)
+
+	// the bans of ipfilter are logged for fail2ban.
+	if _, err := config.Bans.Ban(net.ParseIP("9.9.9.9"), time.Hour); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Could not read the log: %v", err)
+	}
+	if !regexp.MustCompile(`^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d ipfilter: Ban 9\.9\.9\.9\n$`).Match(data) {
+		t.Fatalf("Expected the ban in the log, Got: %q", data)
+	}
+
+	for i, input := range []string{"fail2ban", "fail2ban a b c", "fail2ban a\nfail2ban b"} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\n"+input+"\n}")); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// feedRetry is how long to wait before fetching a feed again after an error.
+const feedRetry = 5 * time.Minute
+
+// feedSource is where a feed is published: the networks are read from every URL with 'parse', and fetched
+// again after 'refresh'. With 'follow', the URL is a page linking to the list, whose address changes with
+// every release.
+type feedSource struct {
+	urls    []string
+	follow  *regexp.Regexp
+	parse   func(io.Reader) ([]*net.IPNet, error)
+	refresh time.Duration
+}
+
+// feedSources are the feeds 'feed' accepts.
+var feedSources = map[string]feedSource{
+	"aws": {
+		urls:    []string{"https://ip-ranges.amazonaws.com/ip-ranges.json"},
+		parse:   parseAWSRanges,
+		refresh: 24 * time.Hour,
+	},
+	"gcp": {
+		urls:    []string{"https://www.gstatic.com/ipranges/cloud.json"},
+		parse:   parseGCPRanges,
+		refresh: 24 * time.Hour,
+	},
+	"azure": {
+		urls:    []string{"https://www.microsoft.com/en-us/download/confirmation.aspx?id=56519"},
+		follow:  regexp.MustCompile(`https://download\.microsoft\.com/download/[^"'\s]*ServiceTags_Public_[0-9]+\.json`),
+		parse:   parseAzureRanges,
+		refresh: 24 * time.Hour,
+	},
+	"cloudflare": {
+		urls:    []string{"https://www.cloudflare.com/ips-v4", "https://www.cloudflare.com/ips-v6"},
+		parse:   parseNetworkLines,
+		refresh: 24 * time.Hour,
+	},
+	// the exit relays change through the day.
+	"tor_exits": {
+		urls:    []string{"https://check.torproject.org/torbulkexitlist"},
+		parse:   parseNetworkLines,
+		refresh: time.Hour,
+	},
+}
+
+// Feeds returns the names of the feeds 'feed' accepts.
+func Feeds() []string {
+	names := make([]string, 0, len(feedSources))
+	for name := range feedSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkFeeds returns an error if one of 'names' isn't a known feed.
+func checkFeeds(names []string) error {
+	for _, name := range names {
+		if _, ok := feedSources[name]; !ok {
+			return errors.New("ipfilter: Unknown feed: " + name + ", expected one of " + strings.Join(Feeds(), ", "))
+		}
+	}
+	return nil
+}
+
+// feedsOf returns the feeds used by 'paths'.
+func feedsOf(paths []IPPath) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, path := range paths {
+		for _, name := range path.Feeds {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// FeedLists holds the ranges of the feeds used by a site, they are kept as CompactRanges since the clouds
+// publish thousands of prefixes. A feed is fetched the first time it is needed, and refreshed in the
+// background once it is older than the refresh of its source; until it is fetched, no client is in it.
+type FeedLists struct {
+	client *http.Client
+
+	mu    sync.Mutex
+	feeds map[string]*feedList
+}
+
+// feedList is the list of a single feed.
+type feedList struct {
+	mu       sync.Mutex
+	ranges   *CompactRanges
+	next     time.Time // when to fetch the feed again.
+	fetched  time.Time // when the feed was last fetched successfully.
+	fetching bool
+}
+
+// NewFeedLists returns FeedLists fetching the feeds with 'client'.
+func NewFeedLists(client *http.Client) *FeedLists {
+	return &FeedLists{client: client, feeds: make(map[string]*feedList)}
+}
+
+// list returns the list of the feed 'name', creating it if needed.
+func (fl *FeedLists) list(name string) *feedList {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	l, ok := fl.feeds[name]
+	if !ok {
+		l = &feedList{}
+		fl.feeds[name] = l
+	}
+	return l
+}
+
+// Contains returns true if 'ip' is in the feed 'name', it starts fetching the feed if it is due.
+func (fl *FeedLists) Contains(name string, ip net.IP) bool {
+	l := fl.list(name)
+
+	l.mu.Lock()
+	if !l.fetching && !time.Now().Before(l.next) {
+		l.fetching = true
+		go fl.fetch(name, l)
+	}
+	ranges := l.ranges
+	l.mu.Unlock()
+
+	return ranges.Contains(ip)
+}
+
+// contains returns true if one of the client IPs is in one of the feeds 'names'.
+func (fl *FeedLists) contains(names []string, clientIPs []net.IP) bool {
+	if fl == nil {
+		return false
+	}
+
+	for _, name := range names {
+		for _, clientIP := range clientIPs {
+			if fl.Contains(name, clientIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Refresh fetches the feeds 'names' now, and returns the first error.
+func (fl *FeedLists) Refresh(names ...string) error {
+	var firstErr error
+	for _, name := range names {
+		l := fl.list(name)
+		l.mu.Lock()
+		l.fetching = true
+		l.mu.Unlock()
+
+		if err := fl.fetch(name, l); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// fetch replaces the list of the feed 'name' with the one it publishes, the list is kept as is on errors.
+func (fl *FeedLists) fetch(name string, l *feedList) error {
+	source := feedSources[name]
+	var ranges []Range
+	var err error
+	for _, url := range source.urls {
+		var nets []*net.IPNet
+		if nets, err = fl.fetchURL(source, url); err != nil {
+			break
+		}
+		for _, network := range nets {
+			ranges = append(ranges, networkRange(network))
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.fetching = false
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: Can't fetch the feed %s: %v", name, err)
+		l.next = time.Now().Add(feedRetry)
+		return err
+	}
+	l.ranges = NewCompactRanges(ranges)
+	l.fetched = time.Now()
+	l.next = l.fetched.Add(source.refresh)
+	return nil
+}
+
+// age returns the seconds since the feed 'name' was fetched at 'now', or -1 if it never was.
+func (fl *FeedLists) age(name string, now time.Time) float64 {
+	if fl == nil {
+		return -1
+	}
+	l := fl.list(name)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fetched.IsZero() {
+		return -1
+	}
+	return now.Sub(l.fetched).Seconds()
+}
+
+// fetchURL reads the networks at 'url', or at the link of 'url' the source follows.
+func (fl *FeedLists) fetchURL(source feedSource, url string) ([]*net.IPNet, error) {
+	if source.follow != nil {
+		page, err := fl.get(url)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(page)
+		page.Close()
+		if err != nil {
+			return nil, err
+		}
+		link := source.follow.Find(data)
+		if link == nil {
+			return nil, errors.New(url + " has no link to the list")
+		}
+		url = string(link)
+	}
+
+	body, err := fl.get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	nets, err := source.parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	if len(nets) == 0 {
+		return nil, errors.New(url + " has no IPs")
+	}
+	return nets, nil
+}
+
+// get returns the body of 'url', an error unless it is answered with a 200.
+func (fl *FeedLists) get(url string) (io.ReadCloser, error) {
+	resp, err := fl.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// parseAWSRanges reads https://ip-ranges.amazonaws.com/ip-ranges.json.
+func parseAWSRanges(r io.Reader) ([]*net.IPNet, error) {
+	var ranges struct {
+		Prefixes []struct {
+			Prefix string `json:"ip_prefix"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			Prefix string `json:"ipv6_prefix"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&ranges); err != nil {
+		return nil, err
+	}
+
+	var prefixes []string
+	for _, p := range ranges.Prefixes {
+		prefixes = append(prefixes, p.Prefix)
+	}
+	for _, p := range ranges.IPv6Prefixes {
+		prefixes = append(prefixes, p.Prefix)
+	}
+	return parsePrefixes(prefixes), nil
+}
+
+// parseGCPRanges reads https://www.gstatic.com/ipranges/cloud.json.
+func parseGCPRanges(r io.Reader) ([]*net.IPNet, error) {
+	var ranges struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&ranges); err != nil {
+		return nil, err
+	}
+
+	var prefixes []string
+	for _, p := range ranges.Prefixes {
+		prefixes = append(prefixes, p.IPv4Prefix, p.IPv6Prefix)
+	}
+	return parsePrefixes(prefixes), nil
+}
+
+// parseAzureRanges reads the ServiceTags_Public JSON of Azure, every service tag is included.
+func parseAzureRanges(r io.Reader) ([]*net.IPNet, error) {
+	var tags struct {
+		Values []struct {
+			Properties struct {
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&tags); err != nil {
+		return nil, err
+	}
+
+	var prefixes []string
+	for _, tag := range tags.Values {
+		prefixes = append(prefixes, tag.Properties.AddressPrefixes...)
+	}
+	return parsePrefixes(prefixes), nil
+}
+
+// parsePrefixes returns the networks of 'prefixes', the invalid ones are skipped.
+func parsePrefixes(prefixes []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, prefix := range prefixes {
+		if network, ok := parseNetwork(strings.TrimSpace(prefix)); ok {
+			nets = append(nets, network)
+		}
+	}
+	return nets
+}
@@ -0,0 +1,187 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// withFeedServer serves the feeds from 'handler' until the returned function is called.
+func withFeedServer(handler http.HandlerFunc) func() {
+	server := httptest.NewServer(handler)
+	saved := feedSources
+	feedSources = map[string]feedSource{}
+	for name, source := range saved {
+		source.urls = []string{server.URL + "/" + name}
+		if source.follow != nil {
+			source.follow = regexp.MustCompile(regexp.QuoteMeta(server.URL) + `/azure/ServiceTags_Public_[0-9]+\.json`)
+		}
+		if name == "cloudflare" {
+			source.urls = append(source.urls, server.URL+"/cloudflare/ipv6")
+		}
+		feedSources[name] = source
+	}
+	return func() {
+		feedSources = saved
+		server.Close()
+	}
+}
+
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/aws":
+		fmt.Fprint(w, `{"prefixes": [{"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "AMAZON"}],
+			"ipv6_prefixes": [{"ipv6_prefix": "2600:1f00::/24", "region": "us-east-1", "service": "AMAZON"}]}`)
+	case "/gcp":
+		fmt.Fprint(w, `{"prefixes": [{"ipv4Prefix": "34.1.208.0/20", "service": "Google Cloud"}, {"ipv6Prefix": "2600:1900::/35"}]}`)
+	case "/azure":
+		fmt.Fprintf(w, `<html><a href="http://%s/azure/ServiceTags_Public_20240101.json">download</a></html>`, r.Host)
+	case "/azure/ServiceTags_Public_20240101.json":
+		fmt.Fprint(w, `{"values": [{"name": "AzureCloud", "properties": {"addressPrefixes": ["13.64.0.0/16", "2603:1000::/40"]}},
+			{"name": "AzureFrontDoor", "properties": {"addressPrefixes": ["13.64.1.0/24"]}}]}`)
+	case "/cloudflare":
+		fmt.Fprint(w, "173.245.48.0/20\n103.21.244.0/22\n")
+	case "/cloudflare/ipv6":
+		fmt.Fprint(w, "2400:cb00::/32\n")
+	case "/tor_exits":
+		fmt.Fprint(w, "185.220.101.1\n185.220.101.2\n")
+	default:
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	defer withFeedServer(feedHandler)()
+
+	tests := []struct {
+		input          string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule block\nfeed aws\n}", "3.5.141.1:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfeed aws\n}", "[2600:1f00::1]:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfeed aws\n}", "3.5.144.1:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nfeed gcp\n}", "34.1.210.3:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfeed gcp\n}", "[2600:1900::5]:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfeed azure\n}", "13.64.200.1:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfeed azure\n}", "13.65.0.1:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nfeed cloudflare\n}", "103.21.245.9:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nfeed cloudflare\n}", "[2400:cb00::1]:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nfeed cloudflare\n}", "8.8.8.8:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfeed aws gcp\n}", "34.1.210.3:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfeed tor_exits\n}", "185.220.101.2:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfeed tor_exits\n}", "185.220.101.3:_", http.StatusOK},
+		// feeds add up with the other conditions.
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nfeed aws\n}", "8.8.8.8:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nfeed aws\n}", "3.5.141.1:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfamily ipv4\nfeed aws\n}", "[2600:1f00::1]:_", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if err := config.Feeds.Refresh(feedsOf(config.Paths)...); err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestFeedListsFetch(t *testing.T) {
+	defer withFeedServer(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gcp":
+			fmt.Fprint(w, `{"prefixes": []}`)
+		case "/aws":
+			fmt.Fprint(w, "<html>maintenance</html>")
+		case "/azure":
+			fmt.Fprint(w, "<html>moved</html>")
+		default:
+			feedHandler(w, r)
+		}
+	})()
+
+	fl := NewFeedLists(defaultHTTPClient)
+	ip := net.ParseIP("173.245.48.1")
+
+	// the first lookup starts fetching the feed.
+	deadline := time.Now().Add(5 * time.Second)
+	for !fl.Contains("cloudflare", ip) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The feed of cloudflare wasn't fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, name := range []string{"aws", "gcp", "azure"} {
+		if err := fl.Refresh(name); err == nil {
+			t.Fatalf("Expected an error for the feed %s", name)
+		}
+		if fl.Contains(name, ip) {
+			t.Fatalf("Expected an empty feed for %s", name)
+		}
+	}
+}
+
+func TestFeedParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"ipfilter / {\nrule block\nfeed aws gcp azure cloudflare tor_exits\n}", false},
+		{"ipfilter / {\nrule block\nfeed oracle\n}", true},
+		{"ipfilter / {\nrule block\nfeed\n}", true},
+	}
+
+	for i, test := range tests {
+		_, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr && err == nil {
+			t.Fatalf("Test %d: Expected an error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nfeed aws gcp\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rs := RulesFromPaths(config.Paths)
+	if !reflect.DeepEqual(rs.Paths[0].Feeds, []string{"aws", "gcp"}) {
+		t.Fatalf("Expected the feeds in the rule, Got: %v", rs.Paths[0].Feeds)
+	}
+	paths, err := rs.ToPaths(false, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(paths[0].Feeds, []string{"aws", "gcp"}) {
+		t.Fatalf("Expected the feeds in the path, Got: %v", paths[0].Feeds)
+	}
+}
@@ -0,0 +1,131 @@
+package ipfilter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultHTTPClient is used by every external integration (feeds, reputation APIs, database downloads)
+// unless 'http_fixtures' is set.
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Fixture modes of a FixtureTransport.
+const (
+	FixturesRecord = "record"
+	FixturesReplay = "replay"
+)
+
+// FixtureTransport records HTTP responses to a directory, or replays them from it without touching the network;
+// so integration tests and staging environments can run offline and deterministically.
+type FixtureTransport struct {
+	Mode string // FixturesRecord or FixturesReplay.
+	Dir  string
+	Next http.RoundTripper // used when recording, http.DefaultTransport if nil.
+}
+
+// fixture is a recorded response, stored as JSON.
+type fixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// NewFixtureClient returns an HTTP client that records to or replays from 'dir'.
+func NewFixtureClient(mode, dir string) (*http.Client, error) {
+	if mode != FixturesRecord && mode != FixturesReplay {
+		return nil, errors.New("ipfilter: http_fixtures mode should be 'record' or 'replay'")
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, errors.New("ipfilter: No such directory: " + dir)
+	}
+
+	return &http.Client{
+		Timeout:   defaultHTTPClient.Timeout,
+		Transport: &FixtureTransport{Mode: mode, Dir: dir},
+	}, nil
+}
+
+// path returns the file of the fixture of 'req', named after its method and URL.
+func (ft *FixtureTransport) path(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String()))
+	return filepath.Join(ft.Dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// RoundTrip implements http.RoundTripper.
+func (ft *FixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ft.Mode == FixturesReplay {
+		return ft.replay(req)
+	}
+	return ft.record(req)
+}
+
+func (ft *FixtureTransport) replay(req *http.Request) (*http.Response, error) {
+	data, err := ioutil.ReadFile(ft.path(req))
+	if os.IsNotExist(err) {
+		return nil, errors.New("ipfilter: no recorded fixture for " + req.Method + " " + req.URL.String())
+	} else if err != nil {
+		return nil, err
+	}
+
+	var fx fixture
+	if err := json.Unmarshal(data, &fx); err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(fx.Status),
+		StatusCode:    fx.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        fx.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(fx.Body)),
+		ContentLength: int64(len(fx.Body)),
+		Request:       req,
+	}, nil
+}
+
+func (ft *FixtureTransport) record(req *http.Request) (*http.Response, error) {
+	next := ft.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(fixture{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   body,
+	}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(ft.path(req), data, 0644); err != nil {
+		return nil, err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
@@ -0,0 +1,83 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestFixtureRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter-fixtures")
+	if err != nil {
+		t.Fatalf("Could not create the fixtures directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("1.2.3.0/24\n"))
+	}))
+	feedURL := ts.URL + "/feed.netset"
+
+	recorder, err := NewFixtureClient(FixturesRecord, dir)
+	if err != nil {
+		t.Fatalf("Could not create the recording client: %v", err)
+	}
+	resp, err := recorder.Get(feedURL)
+	if err != nil {
+		t.Fatalf("Could not record: %v", err)
+	}
+	resp.Body.Close()
+
+	// replaying doesn't touch the network anymore.
+	ts.Close()
+
+	replayer, err := NewFixtureClient(FixturesReplay, dir)
+	if err != nil {
+		t.Fatalf("Could not create the replaying client: %v", err)
+	}
+	resp, err = replayer.Get(feedURL)
+	if err != nil {
+		t.Fatalf("Could not replay: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "1.2.3.0/24\n" {
+		t.Errorf("Expected the recorded response, got: %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the recorded headers, got: %v", resp.Header)
+	}
+
+	if _, err := replayer.Get(ts.URL + "/unknown"); err == nil {
+		t.Errorf("Expected an error replaying a request that wasn't recorded")
+	}
+}
+
+func TestNewFixtureClientErrors(t *testing.T) {
+	if _, err := NewFixtureClient("rewind", "./testdata"); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+	if _, err := NewFixtureClient(FixturesReplay, "./testdata/nonexistent"); err == nil {
+		t.Errorf("Expected an error for a missing directory")
+	}
+}
+
+func TestFixturesParse(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", `ipfilter / {
+		rule block
+		ip 8.8.8.8
+		http_fixtures replay ./testdata
+	}`))
+	if err != nil {
+		t.Fatalf("Could not parse the config: %v", err)
+	}
+	if _, ok := config.httpClient().Transport.(*FixtureTransport); !ok {
+		t.Errorf("Expected the HTTP client to replay fixtures")
+	}
+}
@@ -0,0 +1,193 @@
+package ipfilter
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultClientIPHeaders are read when no ClientIPHeaders are configured.
+var defaultClientIPHeaders = []string{"X-Forwarded-For", "Forwarded"}
+
+// privateNets are the networks that aren't reachable from the public internet, besides loopback and link-local.
+var privateNets = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"), // carrier-grade NAT.
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// isPrivate returns true if 'ip' isn't a public address.
+func isPrivate(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedIPs returns the unparsed client IPs of the first of 'headers' the request has, in order, the RFC 7239
+// Forwarded header is parsed as such and the others as comma separated lists of IPs.
+func forwardedIPs(r *http.Request, headers []string) []string {
+	if len(headers) == 0 {
+		headers = defaultClientIPHeaders
+	}
+
+	for _, name := range headers {
+		var ips []string
+		if strings.EqualFold(name, "Forwarded") {
+			ips = parseForwarded(r.Header["Forwarded"])
+		} else if value := r.Header.Get(name); value != "" {
+			ips = strings.Split(value, ",")
+		}
+		if len(ips) != 0 {
+			return ips
+		}
+	}
+	return nil
+}
+
+// parseForwarded returns the 'for' addresses of Forwarded header values, in order and without their port,
+// obfuscated identifiers such as 'unknown' or '_hidden' are skipped since they aren't IPs.
+func parseForwarded(values []string) []string {
+	var ips []string
+	for _, node := range forwardedNodes(values) {
+		if ip := forwardedNode(node); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// forwardedNodes returns the raw 'for' nodes of Forwarded header values, in order.
+func forwardedNodes(values []string) []string {
+	var nodes []string
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			for _, pair := range splitQuoted(element, ';') {
+				eq := strings.IndexByte(pair, '=')
+				if eq < 0 || !strings.EqualFold(strings.TrimSpace(pair[:eq]), "for") {
+					continue
+				}
+				nodes = append(nodes, strings.TrimSpace(pair[eq+1:]))
+			}
+		}
+	}
+	return nodes
+}
+
+// checkForwarded returns a 400 status if an entry of the first of 'headers' the request has isn't an IP,
+// or a 403 status if it is a private address while the request comes from the public internet, which
+// no proxy would have seen. Obfuscated identifiers of the Forwarded header are fine. It returns 0 otherwise.
+func checkForwarded(r *http.Request, headers []string) (int, error) {
+	if len(headers) == 0 {
+		headers = defaultClientIPHeaders
+	}
+
+	var name string
+	var ips []string
+	for _, name = range headers {
+		if strings.EqualFold(name, "Forwarded") {
+			for _, node := range forwardedNodes(r.Header["Forwarded"]) {
+				ip := forwardedNode(node)
+				if ip == "" && !obfuscatedNode(node) {
+					return http.StatusBadRequest, errors.New("ipfilter: malformed Forwarded node: " + node)
+				}
+				if ip != "" {
+					ips = append(ips, ip)
+				}
+			}
+			if len(ips) != 0 {
+				break
+			}
+		} else if value := r.Header.Get(name); value != "" {
+			for _, entry := range strings.Split(value, ",") {
+				if ip := strings.TrimSpace(entry); net.ParseIP(ip) == nil {
+					return http.StatusBadRequest, errors.New("ipfilter: malformed " + name + " entry: " + entry)
+				}
+				ips = append(ips, strings.TrimSpace(entry))
+			}
+			break
+		}
+	}
+	if len(ips) == 0 {
+		return 0, nil
+	}
+
+	remote := remoteIP(r)
+	if remote == nil || isPrivate(remote) {
+		return 0, nil
+	}
+	for _, ip := range ips {
+		if isPrivate(net.ParseIP(ip)) {
+			return http.StatusForbidden, errors.New("ipfilter: private " + name + " address " + ip + " from " + remote.String())
+		}
+	}
+	return 0, nil
+}
+
+// obfuscatedNode returns true if a Forwarded node hides the address, e.g. 'unknown' or '_hidden'.
+func obfuscatedNode(node string) bool {
+	node = strings.Trim(node, `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return node == "unknown" || strings.HasPrefix(node, "_")
+}
+
+// forwardedNode returns the IP of a 'for' node, e.g. '192.0.2.43:47011' or '"[2001:db8:cafe::17]:4711"',
+// empty if it is obfuscated.
+func forwardedNode(node string) string {
+	if len(node) >= 2 && node[0] == '"' && node[len(node)-1] == '"' {
+		node = strings.Replace(node[1:len(node)-1], `\`, "", -1)
+	}
+
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return ""
+		}
+		node = node[1:end]
+	} else if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+
+	if net.ParseIP(node) == nil {
+		return ""
+	}
+	return node
+}
+
+// splitQuoted splits 's' on 'sep', except within quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
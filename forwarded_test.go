@@ -0,0 +1,192 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected []string
+	}{
+		{[]string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, []string{"192.0.2.60"}},
+		{[]string{`For="[2001:db8:cafe::17]:4711"`}, []string{"2001:db8:cafe::17"}},
+		{[]string{"for=192.0.2.43, for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{[]string{"for=192.0.2.43", "for=198.51.100.17;by=10.0.0.1"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{[]string{`for="192.0.2.43:47011"`}, []string{"192.0.2.43"}},
+		{[]string{"for=unknown, for=_hidden, for=192.0.2.43"}, []string{"192.0.2.43"}},
+		{[]string{`by=10.0.0.1;host="a,b;c";for=192.0.2.43`}, []string{"192.0.2.43"}},
+		{[]string{"proto=https"}, nil},
+		{[]string{`for="[2001:db8::1"`}, nil},
+		{nil, nil},
+	}
+
+	for i, test := range tests {
+		if ips := parseForwarded(test.values); !reflect.DeepEqual(ips, test.expected) {
+			t.Fatalf("Test %d: Expected: %v, Got: %v", i, test.expected, ips)
+		}
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	tests := []struct {
+		config         string
+		reqIP          string
+		fwdFor         string
+		forwarded      string
+		expectedStatus int
+	}{
+		// 1.1.1.1 is blocked.
+		{"", "8.8.8.8:_", "", "for=1.1.1.1", http.StatusForbidden},
+		{"", "8.8.8.8:_", "", `for="[2001:db8::1]:80", for=1.1.1.1`, http.StatusForbidden},
+		{"", "1.1.1.1:_", "", "for=unknown", http.StatusForbidden},
+		{"", "8.8.8.8:_", "", "for=_hidden", http.StatusOK},
+		// X-Forwarded-For takes precedence.
+		{"", "8.8.8.8:_", "8.8.4.4", "for=1.1.1.1", http.StatusOK},
+		{"strict", "8.8.8.8:_", "", "for=1.1.1.1", http.StatusOK},
+		{"trusted_proxies 10.0.0.0/8", "8.8.8.8:_", "", "for=1.1.1.1", http.StatusOK},
+		{"trusted_proxies 10.0.0.0/8", "10.0.0.1:_", "", "for=1.1.1.1", http.StatusForbidden},
+		{"xff_strategy rightmost", "8.8.8.8:_", "", "for=1.1.1.1, for=8.8.4.4", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		input := "ipfilter / {\nrule block\nip 1.1.1.1\n" + test.config + "\n}"
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", test.fwdFor)
+		}
+		req.Header.Set("Forwarded", test.forwarded)
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestClientIPHeader(t *testing.T) {
+	tests := []struct {
+		config         string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		// 1.1.1.1 is blocked, the remote address is 8.8.8.8.
+		{"client_ip_header CF-Connecting-IP", map[string]string{"Cf-Connecting-Ip": "1.1.1.1"}, http.StatusForbidden},
+		{"client_ip_header CF-Connecting-IP", map[string]string{"X-Forwarded-For": "1.1.1.1"}, http.StatusOK},
+		{"client_ip_header CF-Connecting-IP", map[string]string{}, http.StatusOK},
+		{"client_ip_header CF-Connecting-IP True-Client-IP", map[string]string{"True-Client-IP": "1.1.1.1"}, http.StatusForbidden},
+		{"client_ip_header CF-Connecting-IP\nclient_ip_header True-Client-IP", map[string]string{"CF-Connecting-IP": "8.8.4.4", "True-Client-IP": "1.1.1.1"}, http.StatusOK},
+		{"client_ip_header True-Client-IP Forwarded", map[string]string{"Forwarded": "for=1.1.1.1"}, http.StatusForbidden},
+		{"client_ip_header True-Client-IP\nstrict", map[string]string{"True-Client-IP": "1.1.1.1"}, http.StatusOK},
+		{"client_ip_header True-Client-IP\ntrusted_proxies 10.0.0.0/8", map[string]string{"True-Client-IP": "1.1.1.1"}, http.StatusOK},
+	}
+
+	for i, test := range tests {
+		input := "ipfilter / {\nrule block\nip 1.1.1.1\n" + test.config + "\n}"
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "8.8.8.8:_"
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 1.1.1.1\nclient_ip_header\n}")); err == nil {
+		t.Fatalf("Expected an error for client_ip_header without a name")
+	}
+}
+
+func TestRejectMalformedXFF(t *testing.T) {
+	tests := []struct {
+		config         string
+		reqIP          string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		// 1.1.1.1 is blocked.
+		{"", "8.8.8.8:_", map[string]string{"X-Forwarded-For": "8.8.4.4, 10.0.0.1"}, http.StatusForbidden},
+		{"", "8.8.8.8:_", map[string]string{"X-Forwarded-For": "8.8.4.4, fe80::1"}, http.StatusForbidden},
+		{"", "8.8.8.8:_", map[string]string{"X-Forwarded-For": "8.8.4.4, nonsense"}, http.StatusBadRequest},
+		{"", "8.8.8.8:_", map[string]string{"X-Forwarded-For": "8.8.4.4,"}, http.StatusBadRequest},
+		{"", "8.8.8.8:_", map[string]string{"X-Forwarded-For": "8.8.4.4, 9.9.9.9"}, http.StatusOK},
+		{"", "8.8.8.8:_", map[string]string{"X-Forwarded-For": "1.1.1.1"}, http.StatusForbidden},
+		// private addresses are fine from a private network.
+		{"", "10.0.0.2:_", map[string]string{"X-Forwarded-For": "8.8.4.4, 10.0.0.1"}, http.StatusOK},
+		{"", "8.8.8.8:_", map[string]string{"Forwarded": "for=_hidden, for=unknown, for=8.8.4.4"}, http.StatusOK},
+		{"", "8.8.8.8:_", map[string]string{"Forwarded": `for="[fd00::1]:80"`}, http.StatusForbidden},
+		{"", "8.8.8.8:_", map[string]string{"Forwarded": "for=nonsense"}, http.StatusBadRequest},
+		{"", "8.8.8.8:_", map[string]string{}, http.StatusOK},
+		// the headers that aren't read aren't checked.
+		{"client_ip_header CF-Connecting-IP", "8.8.8.8:_", map[string]string{"X-Forwarded-For": "nonsense"}, http.StatusOK},
+		{"client_ip_header CF-Connecting-IP", "8.8.8.8:_", map[string]string{"CF-Connecting-IP": "192.168.1.1"}, http.StatusForbidden},
+		{"trusted_proxies 10.0.0.0/8", "8.8.8.8:_", map[string]string{"X-Forwarded-For": "nonsense"}, http.StatusOK},
+		{"strict", "8.8.8.8:_", map[string]string{"X-Forwarded-For": "nonsense"}, http.StatusOK},
+	}
+
+	for i, test := range tests {
+		input := "ipfilter / {\nrule block\nip 1.1.1.1\nreject_malformed_xff\n" + test.config + "\n}"
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
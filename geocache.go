@@ -0,0 +1,84 @@
+package ipfilter
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+// defaultV6CachePrefix is the IPv6 prefix length geo lookups are cached by,
+// geolocation data is never more precise than a /64.
+const defaultV6CachePrefix = 64
+
+// GeoCache is a fixed size LRU cache of country lookups,
+// IPv4 addresses are cached individually while IPv6 addresses are cached by prefix.
+type GeoCache struct {
+	mu      sync.Mutex
+	size    int
+	v6Mask  net.IPMask
+	entries map[string]*list.Element
+	order   *list.List // most recently used at the front.
+}
+
+type geoCacheEntry struct {
+	key     string
+	country string
+}
+
+// NewGeoCache returns a GeoCache holding up to 'size' entries, caching IPv6 addresses by their 'v6Prefix' bits.
+func NewGeoCache(size, v6Prefix int) *GeoCache {
+	return &GeoCache{
+		size:    size,
+		v6Mask:  net.CIDRMask(v6Prefix, 8*net.IPv6len),
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// key returns the cache key of 'ip'.
+func (gc *GeoCache) key(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(ip.To16().Mask(gc.v6Mask))
+}
+
+// Get returns the cached country of 'ip'.
+func (gc *GeoCache) Get(ip net.IP) (string, bool) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	elem, ok := gc.entries[gc.key(ip)]
+	if !ok {
+		return "", false
+	}
+	gc.order.MoveToFront(elem)
+	return elem.Value.(*geoCacheEntry).country, true
+}
+
+// Add caches the country of 'ip', evicting the least recently used entry if the cache is full.
+func (gc *GeoCache) Add(ip net.IP, country string) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	key := gc.key(ip)
+	if elem, ok := gc.entries[key]; ok {
+		elem.Value.(*geoCacheEntry).country = country
+		gc.order.MoveToFront(elem)
+		return
+	}
+
+	if gc.order.Len() >= gc.size {
+		oldest := gc.order.Back()
+		gc.order.Remove(oldest)
+		delete(gc.entries, oldest.Value.(*geoCacheEntry).key)
+	}
+	gc.entries[key] = gc.order.PushFront(&geoCacheEntry{key, country})
+}
+
+// Len returns the number of cached entries.
+func (gc *GeoCache) Len() int {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.order.Len()
+}
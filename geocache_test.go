@@ -0,0 +1,95 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestGeoCache(t *testing.T) {
+	gc := NewGeoCache(2, 64)
+
+	gc.Add(net.ParseIP("2001:db8:1:2::1"), "DE")
+	// same /64, different host.
+	if country, ok := gc.Get(net.ParseIP("2001:db8:1:2:ffff::7")); !ok || country != "DE" {
+		t.Errorf("Expected a cache hit with 'DE' for the same /64, got: (%s, %t)", country, ok)
+	}
+	if _, ok := gc.Get(net.ParseIP("2001:db8:1:3::1")); ok {
+		t.Errorf("Expected a cache miss for a different /64")
+	}
+
+	// IPv4 addresses are cached individually.
+	gc.Add(net.ParseIP("8.8.8.8"), "US")
+	if _, ok := gc.Get(net.ParseIP("8.8.8.9")); ok {
+		t.Errorf("Expected a cache miss for a different IPv4 address")
+	}
+
+	// '2001:db8:1:2::/64' is the least recently used and gets evicted.
+	gc.Get(net.ParseIP("8.8.8.8"))
+	gc.Add(net.ParseIP("5.4.9.3"), "DE")
+	if _, ok := gc.Get(net.ParseIP("2001:db8:1:2::1")); ok {
+		t.Errorf("Expected the least recently used entry to be evicted")
+	}
+	if gc.Len() != 2 {
+		t.Errorf("Expected 2 entries, got: %d", gc.Len())
+	}
+}
+
+func TestGeoCachePrefixLength(t *testing.T) {
+	gc := NewGeoCache(10, 48)
+
+	gc.Add(net.ParseIP("2001:db8:1:2::1"), "JP")
+	if _, ok := gc.Get(net.ParseIP("2001:db8:1:ff::1")); !ok {
+		t.Errorf("Expected a cache hit within the same /48")
+	}
+}
+
+func TestGeoCacheParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{`ipfilter / {
+			rule block
+			ip 8.8.8.8
+			geo_cache 1000
+		}`, false},
+		{`ipfilter / {
+			rule block
+			ip 8.8.8.8
+			geo_cache 1000 56
+		}`, false},
+		{`ipfilter / {
+			rule block
+			ip 8.8.8.8
+			geo_cache -1
+		}`, true},
+		{`ipfilter / {
+			rule block
+			ip 8.8.8.8
+			geo_cache 1000 129
+		}`, true},
+		{`ipfilter / {
+			rule block
+			ip 8.8.8.8
+			geo_cache 1000
+		}
+		ipfilter /private {
+			rule block
+			ip 8.8.8.8
+			geo_cache 1000
+		}`, true},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got: '%v'", i, err)
+		} else if err == nil && config.GeoCache == nil {
+			t.Errorf("Test %d expected a GeoCache", i)
+		}
+	}
+}
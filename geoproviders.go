@@ -0,0 +1,209 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func init() {
+	RegisterGeoProvider("maxmind", newMaxMindProvider)
+	RegisterGeoProvider("ip-api", newIPAPIProvider)
+	RegisterGeoProvider("ipinfo", newIPInfoProvider)
+}
+
+// Endpoints of the built-in geo providers.
+var (
+	maxMindWebServiceURL = "https://geoip.maxmind.com/geoip/v2.1/country/"
+	ipAPIURL             = "http://ip-api.com/json/" // the free endpoint has no TLS.
+	ipAPIProURL          = "https://pro.ip-api.com/json/"
+	ipInfoURL            = "https://ipinfo.io/"
+)
+
+// getJSON queries 'url' and decodes the answer into 'v', the error bodies only as far as they are JSON.
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		return resp, err
+	}
+	// the error bodies are small.
+	json.NewDecoder(resp.Body).Decode(v)
+	return resp, nil
+}
+
+// maxMindProvider queries the GeoIP2 Precision web services with an account ID and a license key.
+type maxMindProvider struct {
+	accountID  string
+	licenseKey string
+}
+
+// newMaxMindProvider creates the provider of 'geo_provider maxmind <account_id> <license_key>'.
+func newMaxMindProvider(args []string) (GeoProvider, error) {
+	if len(args) != 2 {
+		return nil, errors.New("expected an account ID and a license key")
+	}
+	return maxMindProvider{accountID: args[0], licenseKey: args[1]}, nil
+}
+
+// maxMindAnswer is the part of the answers, or of the errors, of the web services ipfilter uses.
+type maxMindAnswer struct {
+	Country struct {
+		ISOCode string `json:"iso_code"`
+	} `json:"country"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// Country implements GeoProvider.
+func (p maxMindProvider) Country(ctx context.Context, client *http.Client, ip net.IP) (string, error) {
+	header := make(http.Header)
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(p.accountID+":"+p.licenseKey)))
+
+	var answer maxMindAnswer
+	resp, err := getJSON(ctx, client, maxMindWebServiceURL+ip.String(), &answer, header)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return answer.Country.ISOCode, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "", rateLimited(resp)
+	case answer.Code == "IP_ADDRESS_NOT_FOUND" || answer.Code == "IP_ADDRESS_RESERVED":
+		return "", nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusPaymentRequired ||
+		resp.StatusCode == http.StatusForbidden:
+		// the account can't query, e.g. a wrong license key or no queries left, retrying won't help.
+		return "", pauseError{until: time.Now().Add(webServicePause), err: errors.New(resp.Status + " " + answer.Code + ": " + answer.Error)}
+	}
+	return "", errors.New(resp.Status + " " + answer.Code + ": " + answer.Error)
+}
+
+// ipAPIProvider queries ip-api.com, the free endpoint without a key and the pro one with it.
+type ipAPIProvider struct {
+	key string
+}
+
+// newIPAPIProvider creates the provider of 'geo_provider ip-api [<key>]'.
+func newIPAPIProvider(args []string) (GeoProvider, error) {
+	if len(args) > 1 {
+		return nil, errors.New("expected an optional key")
+	}
+	p := ipAPIProvider{}
+	if len(args) == 1 {
+		p.key = args[0]
+	}
+	return p, nil
+}
+
+// ipAPIAnswer is the part of the answers of ip-api.com ipfilter uses.
+type ipAPIAnswer struct {
+	Status      string `json:"status"` // "success" or "fail".
+	Message     string `json:"message"`
+	CountryCode string `json:"countryCode"`
+}
+
+// Country implements GeoProvider.
+func (p ipAPIProvider) Country(ctx context.Context, client *http.Client, ip net.IP) (string, error) {
+	url := ipAPIURL + ip.String() + "?fields=status,message,countryCode"
+	if p.key != "" {
+		url = ipAPIProURL + ip.String() + "?fields=status,message,countryCode&key=" + p.key
+	}
+
+	var answer ipAPIAnswer
+	resp, err := getJSON(ctx, client, url, &answer, nil)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		// the free endpoint tells when its window ends in X-Ttl.
+		if ttl, _ := strconv.Atoi(resp.Header.Get("X-Ttl")); ttl > 0 {
+			until := time.Now().Add(time.Duration(ttl) * time.Second)
+			return "", pauseError{until: until, err: errors.New("rate limited until " + until.Format(time.RFC3339))}
+		}
+		return "", rateLimited(resp)
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return "", pauseError{until: time.Now().Add(webServicePause), err: errors.New(resp.Status)}
+	default:
+		return "", errors.New(resp.Status)
+	}
+	if answer.Status != "success" {
+		// e.g. "reserved range", the other failures are errors.
+		if answer.Message == "reserved range" || answer.Message == "private range" {
+			return "", nil
+		}
+		return "", errors.New(answer.Message)
+	}
+	return answer.CountryCode, nil
+}
+
+// ipInfoProvider queries ipinfo.io, with an optional token.
+type ipInfoProvider struct {
+	token string
+}
+
+// newIPInfoProvider creates the provider of 'geo_provider ipinfo [<token>]'.
+func newIPInfoProvider(args []string) (GeoProvider, error) {
+	if len(args) > 1 {
+		return nil, errors.New("expected an optional token")
+	}
+	p := ipInfoProvider{}
+	if len(args) == 1 {
+		p.token = args[0]
+	}
+	return p, nil
+}
+
+// ipInfoAnswer is the part of the answers of ipinfo.io ipfilter uses.
+type ipInfoAnswer struct {
+	Country string `json:"country"`
+	Bogon   bool   `json:"bogon"` // a reserved address, without a country.
+}
+
+// Country implements GeoProvider.
+func (p ipInfoProvider) Country(ctx context.Context, client *http.Client, ip net.IP) (string, error) {
+	header := make(http.Header)
+	if p.token != "" {
+		header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	var answer ipInfoAnswer
+	resp, err := getJSON(ctx, client, ipInfoURL+ip.String()+"/json", &answer, header)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return answer.Country, nil
+	case http.StatusNotFound:
+		return "", nil
+	case http.StatusTooManyRequests:
+		return "", rateLimited(resp)
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return "", pauseError{until: time.Now().Add(webServicePause), err: errors.New(resp.Status)}
+	}
+	return "", errors.New(resp.Status)
+}
@@ -0,0 +1,77 @@
+package ipfilter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGeoProviders(t *testing.T) {
+	tests := []struct {
+		provider        string
+		args            []string
+		status          int
+		header          map[string]string
+		body            string
+		expectedCountry string
+		expectedPause   bool
+		shouldError     bool
+	}{
+		{"ip-api", nil, http.StatusOK, nil, `{"status": "success", "countryCode": "DE"}`, "DE", false, false},
+		{"ip-api", nil, http.StatusOK, nil, `{"status": "fail", "message": "reserved range"}`, "", false, false},
+		{"ip-api", nil, http.StatusOK, nil, `{"status": "fail", "message": "invalid query"}`, "", false, true},
+		{"ip-api", nil, http.StatusTooManyRequests, map[string]string{"X-Ttl": "30"}, ``, "", true, true},
+		{"ip-api", []string{"key"}, http.StatusForbidden, nil, ``, "", true, true},
+		{"ipinfo", []string{"token"}, http.StatusOK, nil, `{"ip": "1.2.3.4", "country": "FR"}`, "FR", false, false},
+		{"ipinfo", nil, http.StatusOK, nil, `{"ip": "1.2.3.4", "bogon": true}`, "", false, false},
+		{"ipinfo", nil, http.StatusTooManyRequests, map[string]string{"Retry-After": "60"}, ``, "", true, true},
+		{"ipinfo", nil, http.StatusInternalServerError, nil, ``, "", false, true},
+	}
+
+	for i, test := range tests {
+		var gotAuth, gotPath string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotAuth, gotPath = r.Header.Get("Authorization"), r.URL.RequestURI()
+			for name, value := range test.header {
+				w.Header().Set(name, value)
+			}
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		oldIPAPI, oldIPAPIPro, oldIPInfo := ipAPIURL, ipAPIProURL, ipInfoURL
+		ipAPIURL, ipAPIProURL, ipInfoURL = server.URL+"/free/", server.URL+"/pro/", server.URL+"/"
+
+		geoProvidersMu.RLock()
+		factory := geoProviders[test.provider]
+		geoProvidersMu.RUnlock()
+		provider, err := factory(test.args)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		country, err := provider.Country(context.Background(), defaultHTTPClient, net.ParseIP("1.2.3.4"))
+		ipAPIURL, ipAPIProURL, ipInfoURL = oldIPAPI, oldIPAPIPro, oldIPInfo
+		server.Close()
+
+		if test.shouldError != (err != nil) {
+			t.Fatalf("Test %d: Expected error: %v, Got: %v", i, test.shouldError, err)
+		}
+		if country != test.expectedCountry {
+			t.Errorf("Test %d: Expected: %q, Got: %q", i, test.expectedCountry, country)
+		}
+		if pause, ok := err.(pauseError); ok != test.expectedPause || ok && !pause.until.After(time.Now()) {
+			t.Errorf("Test %d: Expected a pause: %v, Got: %v", i, test.expectedPause, err)
+		}
+
+		switch {
+		case test.provider == "ip-api" && len(test.args) == 0 && gotPath != "/free/1.2.3.4?fields=status,message,countryCode":
+			t.Errorf("Test %d: Unexpected query: %s", i, gotPath)
+		case test.provider == "ip-api" && len(test.args) == 1 && gotPath != "/pro/1.2.3.4?fields=status,message,countryCode&key=key":
+			t.Errorf("Test %d: Unexpected query: %s", i, gotPath)
+		case test.provider == "ipinfo" && len(test.args) == 1 && gotAuth != "Bearer token":
+			t.Errorf("Test %d: Unexpected authorization: %q", i, gotAuth)
+		}
+	}
+}
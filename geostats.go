@@ -0,0 +1,147 @@
+package ipfilter
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// UnknownCountry is the key of the GeoStats of clients without a country in the database.
+const UnknownCountry = "unknown"
+
+// GeoStats aggregates anonymous statistics of the allowed traffic per country, no IP is kept.
+type GeoStats struct {
+	mu        sync.Mutex
+	countries map[string]*CountryStats
+}
+
+// CountryStats describes the allowed traffic of a country.
+type CountryStats struct {
+	Requests uint64            `json:"requests"`
+	Bytes    uint64            `json:"bytes"`  // of the response bodies.
+	Status   map[string]uint64 `json:"status"` // requests per status class, e.g. "2xx".
+}
+
+// NewGeoStats returns an empty GeoStats.
+func NewGeoStats() *GeoStats {
+	return &GeoStats{countries: make(map[string]*CountryStats)}
+}
+
+// Record counts a response of 'bytes' with 'status' to a client from 'country'.
+func (gs *GeoStats) Record(country string, status int, bytes int64) {
+	if country == "" {
+		country = UnknownCountry
+	}
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	cs, ok := gs.countries[country]
+	if !ok {
+		cs = &CountryStats{Status: make(map[string]uint64)}
+		gs.countries[country] = cs
+	}
+	cs.Requests++
+	cs.Bytes += uint64(bytes)
+	cs.Status[strconv.Itoa(status/100)+"xx"]++
+}
+
+// Report returns a copy of the statistics of every country seen so far.
+func (gs *GeoStats) Report() map[string]CountryStats {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	report := make(map[string]CountryStats, len(gs.countries))
+	for country, cs := range gs.countries {
+		status := make(map[string]uint64, len(cs.Status))
+		for class, n := range cs.Status {
+			status[class] = n
+		}
+		report[country] = CountryStats{Requests: cs.Requests, Bytes: cs.Bytes, Status: status}
+	}
+	return report
+}
+
+// statsWriter records the status and the size of a response.
+type statsWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statsWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statsWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher if the underlying writer does.
+func (sw *statsWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying writer does.
+func (sw *statsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := sw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("ipfilter: the response writer doesn't support hijacking")
+}
+
+// next passes an allowed request to the next handler, with the client headers and recording it in GeoStats if enabled.
+func (ipf IPFilter) next(w http.ResponseWriter, r *http.Request, strict bool, cost *requestCost) (int, error) {
+	if ipf.Config.SetHeaders {
+		ipf.setClientHeaders(r, strict, cost)
+	}
+	cost.done(ipf.Config.Costs)
+	if ipf.Config.GeoStats == nil {
+		return ipf.Next.ServeHTTP(w, r)
+	}
+
+	sw := &statsWriter{ResponseWriter: w}
+	status, err := ipf.Next.ServeHTTP(sw, r)
+
+	// the status the next handler returned is written by caddy if it didn't write anything.
+	written := sw.status
+	if written == 0 {
+		written = status
+	}
+	if written == 0 {
+		written = http.StatusOK
+	}
+
+	var country string
+	if clientIPs, ipErr := ipf.clientIPs(r, strict); ipErr == nil && ipf.Config.hasCountryLookups() {
+		// the error is dropped, the request is counted as UnknownCountry.
+		country, _ = ipf.lookupCountry(clientIPs[0], cost)
+	}
+	ipf.Config.GeoStats.Record(country, written, sw.bytes)
+	return status, err
+}
+
+// serveStats returns the GeoStats report.
+func (ipf IPFilter) serveStats(w http.ResponseWriter, r *http.Request) (int, error) {
+	if ipf.Config.GeoStats == nil {
+		return http.StatusInternalServerError, errors.New("ipfilter: no geo_stats configured")
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return http.StatusMethodNotAllowed, nil
+	}
+	return writeJSON(w, ipf.Config.GeoStats.Report())
+}
@@ -0,0 +1,101 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestGeoStats(t *testing.T) {
+	db, err := maxminddb.Open(DataBase)
+	if err != nil {
+		t.Fatalf("Error opening the database: %v", err)
+	}
+	defer db.Close()
+
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{
+			{PathScopes: []string{"/"}, IsBlock: true, CountryCodes: []string{"RU"}},
+		},
+		DBHandler: db,
+		GeoStats:  NewGeoStats(),
+	}, "secret")
+	ipf.Next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if r.URL.Path == "/missing" {
+			return http.StatusNotFound, nil
+		}
+		w.Write([]byte("hello"))
+		return http.StatusOK, nil
+	})
+
+	tests := []struct {
+		reqIP          string
+		reqPath        string
+		expectedStatus int
+	}{
+		{"8.8.8.8:_", "/", http.StatusOK},
+		{"8.8.4.4:_", "/", http.StatusOK},
+		{"8.8.8.8:_", "/missing", http.StatusNotFound},
+		{"24.53.192.20:_", "/", http.StatusOK},
+		{"5.175.96.22:_", "/", http.StatusForbidden}, // blocked requests are not counted.
+		{"10.0.0.1:_", "/", http.StatusOK},
+	}
+	for i, test := range tests {
+		status, _ := adminRequest(t, ipf, "GET", test.reqPath, "", test.reqIP, "")
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	status, rec := adminRequest(t, ipf, "GET", "/ipfilter/stats", "", "8.8.8.8:_", "secret")
+	if status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	var report map[string]CountryStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Could not decode the report: %v", err)
+	}
+	expected := map[string]CountryStats{
+		"US":           {Requests: 3, Bytes: 10, Status: map[string]uint64{"2xx": 2, "4xx": 1}},
+		"CA":           {Requests: 1, Bytes: 5, Status: map[string]uint64{"2xx": 1}},
+		UnknownCountry: {Requests: 1, Bytes: 5, Status: map[string]uint64{"2xx": 1}},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("Expected: %v, Got: %v", expected, report)
+	}
+
+	if status, _ := adminRequest(t, ipf, "POST", "/ipfilter/stats", "", "8.8.8.8:_", "secret"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusMethodNotAllowed, status)
+	}
+}
+
+func TestGeoStatsParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"ipfilter / {\nrule block\ndatabase " + DataBase + "\ncountry RU\ngeo_stats\n}", false},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\ngeo_stats\n}", true},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if config.GeoStats == nil {
+			t.Fatalf("Test %d: Expected geo stats", i)
+		}
+	}
+}
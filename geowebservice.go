@@ -0,0 +1,204 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of a GeoWebService.
+const (
+	defaultWebServiceTimeout = 2 * time.Second
+	webServiceTTL            = 24 * time.Hour
+	webServicePause          = time.Hour // after the account was refused.
+)
+
+// GeoProvider looks up the countries online, see RegisterGeoProvider.
+type GeoProvider interface {
+	// Country returns the ISO code of 'ip', empty if the provider doesn't know it. A pauseError stops
+	// the queries until its time, e.g. when the provider is rate limiting.
+	Country(ctx context.Context, client *http.Client, ip net.IP) (string, error)
+}
+
+// GeoProviderFactory creates a GeoProvider from the arguments of a 'geo_provider <name> [args...]' directive.
+type GeoProviderFactory func(args []string) (GeoProvider, error)
+
+var (
+	geoProvidersMu sync.RWMutex
+	geoProviders   = make(map[string]GeoProviderFactory)
+)
+
+// RegisterGeoProvider makes the providers of 'factory' available as 'geo_provider <name>', plugins call it
+// from their init function.
+func RegisterGeoProvider(name string, factory GeoProviderFactory) {
+	geoProvidersMu.Lock()
+	defer geoProvidersMu.Unlock()
+
+	if _, ok := geoProviders[name]; ok {
+		panic("ipfilter: geo provider " + name + " is already registered")
+	}
+	geoProviders[name] = factory
+}
+
+// GeoWebService looks up the countries with a GeoProvider, for the sites without a database, the IPs it has
+// no country for, or every IP once it is older than StaleDB. The requests wait on it, up to Timeout, and
+// every answer is cached for a day since the queries are often billed or limited.
+type GeoWebService struct {
+	Name       string // of the provider.
+	Provider   GeoProvider
+	Timeout    time.Duration // defaultWebServiceTimeout if 0.
+	Rate       int           // queries per RateWindow at most, unlimited if 0.
+	RateWindow time.Duration
+	StaleDB    time.Duration // the provider answers first once the database is that old, never if 0.
+
+	client  *http.Client
+	cache   *ttlCache // countries by IP.
+	mu      sync.Mutex
+	paused  time.Time // no query until then, e.g. when the service is rate limiting.
+	window  time.Time // start of the current RateWindow.
+	queries int       // in the current RateWindow.
+}
+
+// NewGeoWebService creates the registered provider 'name' from 'args', the 'timeout=<duration>',
+// 'rate=<n>/<duration>' and 'stale_db=<duration>' arguments set up the service itself. It queries with
+// 'client', defaultHTTPClient if nil.
+func NewGeoWebService(name string, args []string, client *http.Client) (*GeoWebService, error) {
+	geoProvidersMu.RLock()
+	factory, ok := geoProviders[name]
+	geoProvidersMu.RUnlock()
+	if !ok {
+		return nil, errors.New("ipfilter: Unknown geo provider: " + name)
+	}
+	if client == nil {
+		client = defaultHTTPClient
+	}
+
+	ws := &GeoWebService{Name: name, client: client, cache: newTTLCache()}
+	var providerArgs []string
+	for _, arg := range args {
+		var err error
+		switch {
+		case strings.HasPrefix(arg, "timeout="):
+			ws.Timeout, err = time.ParseDuration(strings.TrimPrefix(arg, "timeout="))
+			if err != nil || ws.Timeout <= 0 {
+				return nil, errors.New("ipfilter: geo provider timeout should be a positive duration, e.g. '2s'")
+			}
+		case strings.HasPrefix(arg, "rate="):
+			if ws.Rate, ws.RateWindow, err = parseRate(strings.TrimPrefix(arg, "rate=")); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(arg, "stale_db="):
+			ws.StaleDB, err = time.ParseDuration(strings.TrimPrefix(arg, "stale_db="))
+			if err != nil || ws.StaleDB <= 0 {
+				return nil, errors.New("ipfilter: geo provider stale_db should be a positive duration, e.g. '720h'")
+			}
+		default:
+			providerArgs = append(providerArgs, arg)
+		}
+	}
+
+	provider, err := factory(providerArgs)
+	if err != nil {
+		return nil, errors.New("ipfilter: geo provider " + name + ": " + err.Error())
+	}
+	ws.Provider = provider
+	return ws, nil
+}
+
+// parseRate parses '<n>/<duration>', e.g. '45/1m'.
+func parseRate(rate string) (int, time.Duration, error) {
+	parts := strings.SplitN(rate, "/", 2)
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[0])
+		window, werr := time.ParseDuration(parts[1])
+		if err == nil && werr == nil && n > 0 && window > 0 {
+			return n, window, nil
+		}
+	}
+	return 0, 0, errors.New("ipfilter: geo provider rate should be '<n>/<duration>', e.g. '45/1m'")
+}
+
+// Country returns the ISO code of 'ip', empty if the provider doesn't know it or it isn't a public address.
+func (ws *GeoWebService) Country(ip net.IP) (string, error) {
+	if isPrivate(ip) {
+		return "", nil
+	}
+	key := ip.String()
+	if country, ok := ws.cache.get(key); ok {
+		return country.(string), nil
+	}
+	if err := ws.reserve(); err != nil {
+		return "", errors.New("ipfilter: " + ws.Name + " lookup of " + key + ": " + err.Error())
+	}
+
+	timeout := ws.Timeout
+	if timeout == 0 {
+		timeout = defaultWebServiceTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	country, err := ws.Provider.Country(ctx, ws.client, ip)
+	if err != nil {
+		if pause, ok := err.(pauseError); ok {
+			ws.mu.Lock()
+			ws.paused = pause.until
+			ws.mu.Unlock()
+		}
+		return "", errors.New("ipfilter: " + ws.Name + " lookup of " + key + ": " + err.Error())
+	}
+	ws.cache.set(key, country, webServiceTTL)
+	return country, nil
+}
+
+// reserve returns an error if the service is paused or out of queries for the current RateWindow.
+func (ws *GeoWebService) reserve() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(ws.paused) {
+		return errors.New("paused until " + ws.paused.Format(time.RFC3339))
+	}
+	if ws.Rate == 0 {
+		return nil
+	}
+	if now.Sub(ws.window) >= ws.RateWindow {
+		ws.window, ws.queries = now, 0
+	}
+	if ws.queries >= ws.Rate {
+		return errors.New("rate limited to " + strconv.Itoa(ws.Rate) + " queries per " + ws.RateWindow.String())
+	}
+	ws.queries++
+	return nil
+}
+
+// stale returns true if the database 'built' then is older than StaleDB, never without a database.
+func (ws *GeoWebService) stale(built time.Time) bool {
+	if ws.StaleDB == 0 || built.IsZero() {
+		return false
+	}
+	return time.Since(built) > ws.StaleDB
+}
+
+// dbBuilt returns when the country database was built, zero without one.
+func (config *IPFConfig) dbBuilt() time.Time {
+	switch {
+	case config.CountryDB != nil:
+		return config.CountryDB.Built()
+	case config.DBHandler != nil:
+		return time.Unix(int64(config.DBHandler.Metadata.BuildEpoch), 0)
+	}
+	return time.Time{}
+}
+
+// hasCountryLookups returns true if the countries of the clients can be looked up, from the database or
+// the web service.
+func (config *IPFConfig) hasCountryLookups() bool {
+	return config.DBHandler != nil || config.CountryDB != nil || config.GeoWebService != nil
+}
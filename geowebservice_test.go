@@ -0,0 +1,203 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// newMaxMindServer answers the country queries of the account 42 from 'countries', the other IPs aren't found,
+// until the returned function is called.
+func newMaxMindServer(countries map[string]string, queries *int32) func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(queries, 1)
+		if account, key, ok := r.BasicAuth(); !ok || account != "42" || key != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code": "AUTHORIZATION_INVALID", "error": "invalid license key"}`))
+			return
+		}
+		ip := strings.TrimPrefix(r.URL.Path, "/geoip/v2.1/country/")
+		country, ok := countries[ip]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code": "IP_ADDRESS_NOT_FOUND", "error": "not found"}`))
+			return
+		}
+		w.Write([]byte(`{"country": {"iso_code": "` + country + `"}, "traits": {"ip_address": "` + ip + `"}}`))
+	}))
+	old := maxMindWebServiceURL
+	maxMindWebServiceURL = server.URL + "/geoip/v2.1/country/"
+	return func() {
+		maxMindWebServiceURL = old
+		server.Close()
+	}
+}
+
+func TestMaxMindWebService(t *testing.T) {
+	var queries int32
+	defer newMaxMindServer(map[string]string{"1.2.3.4": "DE"}, &queries)()
+
+	ws, err := NewGeoWebService("maxmind", []string{"42", "secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip              string
+		expectedCountry string
+		expectedQueries int32
+	}{
+		{"1.2.3.4", "DE", 1},
+		// cached.
+		{"1.2.3.4", "DE", 1},
+		{"1.2.3.5", "", 2},
+		{"1.2.3.5", "", 2},
+		// never queried.
+		{"10.0.0.1", "", 2},
+		{"127.0.0.1", "", 2},
+	}
+	for i, test := range tests {
+		country, err := ws.Country(net.ParseIP(test.ip))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if country != test.expectedCountry || atomic.LoadInt32(&queries) != test.expectedQueries {
+			t.Errorf("Test %d: Expected %q after %d queries, Got: %q after %d", i, test.expectedCountry, test.expectedQueries,
+				country, atomic.LoadInt32(&queries))
+		}
+	}
+
+	// a refused account stops querying for a while.
+	if ws, err = NewGeoWebService("maxmind", []string{"42", "wrong"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.Country(net.ParseIP("1.2.3.4")); err == nil {
+		t.Fatal("Expected an error for a wrong license key")
+	}
+	if _, err := ws.Country(net.ParseIP("1.2.3.4")); err == nil || !strings.Contains(err.Error(), "paused") {
+		t.Errorf("Expected the web service to be paused, Got: %v", err)
+	}
+	if got := atomic.LoadInt32(&queries); got != 3 {
+		t.Errorf("Expected 3 queries, Got: %d", got)
+	}
+	if time.Until(ws.paused) < 59*time.Minute {
+		t.Errorf("Expected a pause of an hour, Got: %v", time.Until(ws.paused))
+	}
+}
+
+func TestGeoWebServiceArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		shouldError bool
+	}{
+		{"maxmind", []string{"42", "secret", "timeout=1s", "rate=100/1h", "stale_db=720h"}, false},
+		{"ip-api", nil, false},
+		{"ip-api", []string{"key", "rate=45/1m"}, false},
+		{"ipinfo", []string{"token"}, false},
+		{"maxmind", []string{"42"}, true},
+		{"ip-api", []string{"key", "other"}, true},
+		{"ipinfo", []string{"rate=45"}, true},
+		{"ipinfo", []string{"rate=0/1m"}, true},
+		{"ipinfo", []string{"timeout=0s"}, true},
+		{"ipinfo", []string{"stale_db=30d"}, true},
+		{"nowhere", nil, true},
+	}
+	for i, test := range tests {
+		_, err := NewGeoWebService(test.name, test.args, nil)
+		if test.shouldError != (err != nil) {
+			t.Errorf("Test %d: Expected error: %v, Got: %v", i, test.shouldError, err)
+		}
+	}
+}
+
+func TestGeoWebServiceRate(t *testing.T) {
+	var queries int32
+	defer newMaxMindServer(map[string]string{"1.2.3.4": "DE", "1.2.3.5": "FR", "1.2.3.6": "IT"}, &queries)()
+
+	ws, err := NewGeoWebService("maxmind", []string{"42", "secret", "rate=2/1h"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"1.2.3.4", "1.2.3.5", "1.2.3.4"} {
+		if _, err := ws.Country(net.ParseIP(ip)); err != nil {
+			t.Fatalf("Unexpected error for %s: %v", ip, err)
+		}
+	}
+	if _, err := ws.Country(net.ParseIP("1.2.3.6")); err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Errorf("Expected the third query to be rate limited, Got: %v", err)
+	}
+	if got := atomic.LoadInt32(&queries); got != 2 {
+		t.Errorf("Expected 2 queries, Got: %d", got)
+	}
+	// a new window.
+	ws.window = ws.window.Add(-time.Hour)
+	if country, err := ws.Country(net.ParseIP("1.2.3.6")); err != nil || country != "IT" {
+		t.Errorf("Expected IT, Got: %q, %v", country, err)
+	}
+}
+
+func TestMaxMindWebServiceParse(t *testing.T) {
+	var queries int32
+	defer newMaxMindServer(map[string]string{"1.2.3.4": "DE", "8.8.8.8": "DE", "2001:db8::1": "DE"}, &queries)()
+
+	tests := []struct {
+		input           string
+		reqIP           string
+		expectedStatus  int
+		expectedQueries int32
+	}{
+		// no database, every country comes from the web service.
+		{"ipfilter / {\nrule block\nmaxmind_web_service 42 secret\ncountry DE\n}", "1.2.3.4:_", http.StatusForbidden, 1},
+		{"ipfilter / {\nrule block\nmaxmind_web_service 42 secret\ncountry DE\n}", "1.2.3.5:_", http.StatusOK, 1},
+		// the database answers first, 8.8.8.8 is in the US, and has no country for 2001:db8::1.
+		{"ipfilter / {\nrule block\ndatabase " + DataBase + "\nmaxmind_web_service 42 secret\ncountry DE\n}", "8.8.8.8:_", http.StatusOK, 0},
+		{"ipfilter / {\nrule block\ndatabase " + DataBase + "\nmaxmind_web_service 42 secret\ncountry DE\n}", "[2001:db8::1]:_", http.StatusForbidden, 1},
+		// the database is older than a day, the web service answers first.
+		{"ipfilter / {\nrule block\ndatabase " + DataBase + "\ngeo_provider maxmind 42 secret stale_db=24h\ncountry DE\n}", "8.8.8.8:_", http.StatusForbidden, 1},
+	}
+	for i, test := range tests {
+		atomic.StoreInt32(&queries, 0)
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+		if got := atomic.LoadInt32(&queries); got != test.expectedQueries {
+			t.Errorf("Test %d: Expected %d queries, Got: %d", i, test.expectedQueries, got)
+		}
+		if config.DBHandler != nil {
+			config.DBHandler.Close()
+		}
+	}
+
+	for _, input := range []string{
+		"ipfilter / {\nrule block\nmaxmind_web_service 42\ncountry DE\n}",
+		"ipfilter / {\nrule block\nmaxmind_web_service 42 secret\ngeo_provider ip-api\ncountry DE\n}",
+		"ipfilter / {\nrule block\ngeo_provider nowhere\ncountry DE\n}",
+		"ipfilter / {\nrule block\ngeo_provider\ncountry DE\n}",
+		"ipfilter / {\nrule block\ncountry DE\n}",
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+//go:build !nocaddy
+// +build !nocaddy
+
+package ipfilter
+
+import (
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// globalKey is the key of the global filter in the storage of the caddy instance.
+type globalKey struct{}
+
+// globalFilter is the filter of the ipfilter_global blocks, it is in front of the ipfilter blocks of every
+// site, and of the sites only listing ipfilter_global.
+type globalFilter struct {
+	ipf   *IPFilter // nil until a site defines it.
+	sites map[*httpserver.SiteConfig]bool
+}
+
+// globalFilterOf returns the global filter of the caddy instance.
+func globalFilterOf(c *caddy.Controller) *globalFilter {
+	global, _ := c.Get(globalKey{}).(*globalFilter)
+	if global == nil {
+		global = &globalFilter{sites: make(map[*httpserver.SiteConfig]bool)}
+		c.Set(globalKey{}, global)
+	}
+	return global
+}
+
+// SetupGlobal parses the ipfilter_global blocks, they have the syntax of the ipfilter blocks and filter every
+// site. A bare 'ipfilter_global' puts the global filter in front of a site without ipfilter blocks.
+func SetupGlobal(c *caddy.Controller) error {
+	global := globalFilterOf(c)
+
+	// look ahead for scopes, without them the site only uses the global filter.
+	peek := c.Dispenser
+	peek.Next()
+	if peek.NextArg() {
+		// a site with several addresses runs its directives for each of them.
+		err := c.OncePerServerBlock(func() error {
+			if global.ipf != nil {
+				return c.Err("ipfilter: ipfilter_global is already defined")
+			}
+			ifconfig, err := ipfilterParse(c)
+			if err != nil {
+				discardConfig(ifconfig)
+				return err
+			}
+			global.ipf = setupFilter(c, ifconfig)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		for c.Next() {
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+		}
+		c.OnStartup(func() error {
+			if global.ipf == nil {
+				return c.Err("ipfilter: ipfilter_global is used but never defined")
+			}
+			return nil
+		})
+	}
+
+	cfg := httpserver.GetConfig(c)
+	if !global.sites[cfg] {
+		global.sites[cfg] = true
+		cfg.AddMiddleware(global.middleware)
+	}
+	return nil
+}
+
+// middleware puts the global filter in front of 'next', if one is defined.
+func (global *globalFilter) middleware(next httpserver.Handler) httpserver.Handler {
+	if global.ipf == nil {
+		return next
+	}
+	return global.ipf.middleware(next)
+}
@@ -0,0 +1,73 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestGlobal(t *testing.T) {
+	gc := caddy.NewTestController("http", "ipfilter_global / {\nrule block\nip 8.8.8.8 5.175.96.22\n}")
+	if err := SetupGlobal(gc); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	global := globalFilterOf(gc)
+	if global.ipf == nil {
+		t.Fatal("Expected the global filter to be defined")
+	}
+
+	// another site, sharing the storage of the instance.
+	c := caddy.NewTestController("http", "ipfilter_global")
+	c.Set(globalKey{}, global)
+	if err := SetupGlobal(c); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dc := caddy.NewTestController("http", "ipfilter_global / {\nrule block\nip 8.8.4.4\n}")
+	dc.Set(globalKey{}, global)
+	if err := SetupGlobal(dc); err == nil {
+		t.Fatal("Expected an error for a second definition")
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter /admin {\nrule allow\nip 5.175.96.22 8.8.4.4\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusOK, nil
+	})
+	site := global.middleware((&IPFilter{Config: config}).middleware(next))
+
+	tests := []struct {
+		path           string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"/", "8.8.8.8:_", http.StatusForbidden},
+		{"/", "8.8.4.4:_", http.StatusOK},
+		{"/admin", "8.8.4.4:_", http.StatusOK},
+		{"/admin", "24.53.192.20:_", http.StatusForbidden},
+		// the global filter applies first.
+		{"/admin", "5.175.96.22:_", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := site.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	// without a definition, the sites are left as is.
+	if _, ok := (&globalFilter{}).middleware(next).(*IPFilter); ok {
+		t.Fatal("Expected the next handler")
+	}
+}
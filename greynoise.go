@@ -0,0 +1,138 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterMatcher("greynoise", newGreyNoiseMatcher)
+}
+
+// greyNoiseURL is the IP endpoint of the GreyNoise community API.
+var greyNoiseURL = "https://api.greynoise.io/v3/community/"
+
+// greyNoiseCacheTTL is how long the classification of an IP is kept.
+const greyNoiseCacheTTL = 24 * time.Hour
+
+// Classes of the greynoise matcher.
+const (
+	GreyNoiseNoise     = "noise"     // seen scanning the internet.
+	GreyNoiseRIOT      = "riot"      // a common business service, e.g. a CDN or an update server.
+	GreyNoiseBenign    = "benign"    // a known good scanner, e.g. a search engine or a security company.
+	GreyNoiseMalicious = "malicious" // seen doing malicious things.
+	GreyNoiseUnknown   = "unknown"   // scanning, but not known to be benign or malicious.
+)
+
+var greyNoiseClasses = []string{GreyNoiseNoise, GreyNoiseRIOT, GreyNoiseBenign, GreyNoiseMalicious, GreyNoiseUnknown}
+
+// greyNoiseCaches are the caches of the classifications by API key, shared by the blocks using them.
+var (
+	greyNoiseCachesMu sync.Mutex
+	greyNoiseCaches   = make(map[string]*lookupCache)
+)
+
+// greyNoiseResult is what GreyNoise knows about an IP.
+type greyNoiseResult struct {
+	Noise          bool   `json:"noise"`
+	RIOT           bool   `json:"riot"`
+	Classification string `json:"classification"`
+}
+
+// is returns true if the IP is in 'class'.
+func (res greyNoiseResult) is(class string) bool {
+	switch class {
+	case GreyNoiseNoise:
+		return res.Noise
+	case GreyNoiseRIOT:
+		return res.RIOT
+	}
+	return res.Classification == class
+}
+
+// greyNoiseMatcher matches the clients in any of its classes. The classifications are looked up in the
+// background, see lookupCache: a client isn't matched until its classification is known.
+type greyNoiseMatcher struct {
+	key     string
+	classes []string
+	cache   *lookupCache
+}
+
+// newGreyNoiseMatcher creates the matcher of 'match greynoise <api_key> <classes...>'.
+func newGreyNoiseMatcher(args []string) (Matcher, error) {
+	if len(args) < 2 {
+		return nil, errors.New("expected an API key and classes")
+	}
+	for _, class := range args[1:] {
+		var ok bool
+		for _, c := range greyNoiseClasses {
+			ok = ok || class == c
+		}
+		if !ok {
+			return nil, errors.New("unknown class " + class + ", expected one of " + strings.Join(greyNoiseClasses, ", "))
+		}
+	}
+
+	greyNoiseCachesMu.Lock()
+	cache, ok := greyNoiseCaches[args[0]]
+	if !ok {
+		cache = newLookupCache("GreyNoise")
+		greyNoiseCaches[args[0]] = cache
+	}
+	greyNoiseCachesMu.Unlock()
+
+	return &greyNoiseMatcher{key: args[0], classes: args[1:], cache: cache}, nil
+}
+
+// Match implements Matcher.
+func (m *greyNoiseMatcher) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	value, ok := m.cache.get(ip.String(), func() (interface{}, time.Duration, error) {
+		res, err := m.lookup(ip)
+		return res, greyNoiseCacheTTL, err
+	})
+	if !ok {
+		return false, nil
+	}
+	for _, class := range m.classes {
+		if value.(greyNoiseResult).is(class) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lookup returns the classification of 'ip', the IPs GreyNoise never saw are neither noise nor RIOT.
+func (m *greyNoiseMatcher) lookup(ip net.IP) (greyNoiseResult, error) {
+	var res greyNoiseResult
+	req, err := http.NewRequest("GET", greyNoiseURL+ip.String(), nil)
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("key", m.key)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return res, nil
+	case http.StatusTooManyRequests:
+		return res, rateLimited(resp)
+	default:
+		return res, errors.New(greyNoiseURL + " answered " + resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
@@ -0,0 +1,81 @@
+package ipfilter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGreyNoise(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("key") != "test-key" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/") {
+		case "5.175.96.22":
+			w.Write([]byte(`{"ip": "5.175.96.22", "noise": true, "riot": false, "classification": "malicious"}`))
+		case "8.8.8.8":
+			w.Write([]byte(`{"ip": "8.8.8.8", "noise": false, "riot": true, "classification": "benign", "name": "Google Public DNS"}`))
+		case "24.53.192.20":
+			w.Write([]byte(`{"ip": "24.53.192.20", "noise": true, "riot": false, "classification": "benign"}`))
+		default:
+			http.Error(w, `{"message": "IP not observed scanning the internet or contained in RIOT data set."}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	defer func(saved string) { greyNoiseURL = saved }(greyNoiseURL)
+	greyNoiseURL = server.URL + "/"
+
+	tests := []struct {
+		classes  []string
+		ip       string
+		expected bool
+	}{
+		{[]string{"noise"}, "5.175.96.22", true},
+		{[]string{"noise"}, "24.53.192.20", true},
+		{[]string{"noise"}, "8.8.8.8", false},
+		{[]string{"noise"}, "8.8.4.4", false},
+		{[]string{"riot"}, "8.8.8.8", true},
+		{[]string{"riot"}, "5.175.96.22", false},
+		{[]string{"malicious"}, "5.175.96.22", true},
+		{[]string{"malicious"}, "24.53.192.20", false},
+		{[]string{"benign", "riot"}, "24.53.192.20", true},
+		{[]string{"unknown"}, "8.8.4.4", false},
+	}
+	for i, test := range tests {
+		m, err := NewMatcher(MatcherSpec{Name: "greynoise", Args: append([]string{"test-key"}, test.classes...)})
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ip := net.ParseIP(test.ip)
+		matched := func() bool {
+			matched, err := m.Match(context.Background(), ip, nil)
+			if err != nil {
+				t.Fatalf("Test %d: Unexpected error: %v", i, err)
+			}
+			return matched
+		}
+		// the first request of a client starts the lookup.
+		matched()
+		cache := m.(namedMatcher).Matcher.(*greyNoiseMatcher).cache
+		eventually(t, "the lookup of "+test.ip, func() bool {
+			cache.mu.Lock()
+			defer cache.mu.Unlock()
+			_, ok := cache.entries[test.ip]
+			return ok
+		})
+		if matched() != test.expected {
+			t.Fatalf("Test %d: Expected a match of %s: %t", i, test.ip, test.expected)
+		}
+	}
+
+	for i, args := range [][]string{{"test-key"}, {"test-key", "bots"}} {
+		if _, err := NewMatcher(MatcherSpec{Name: "greynoise", Args: args}); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
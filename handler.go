@@ -0,0 +1,31 @@
+package ipfilter
+
+import (
+	"log"
+	"net/http"
+)
+
+// Config is the configuration of Handler, see NewConfig.
+type Config = IPFConfig
+
+// Handler returns a net/http middleware filtering the requests to 'next' with 'cfg', the same way the
+// caddy plugin does, blocked requests without a blockpage get a plain '403 Forbidden'.
+// Build with '-tags nocaddy' to leave the caddy tree out.
+func Handler(next http.Handler, cfg Config) http.Handler {
+	ipf := IPFilter{
+		Config: cfg,
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			next.ServeHTTP(w, r)
+			return 0, nil
+		}),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, err := ipf.ServeHTTP(w, r)
+		if err != nil {
+			log.Printf("[ERROR] ipfilter: %v", err)
+		}
+		if status >= 400 {
+			http.Error(w, http.StatusText(status), status)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	cfg, err := NewConfig(RuleSet{Paths: []Rule{
+		{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"192.168"}},
+		{PathScopes: []string{"/private"}, Rule: "allow", IPs: []string{"10.0.0.1"}},
+	}}, nil, nil, "")
+	if err != nil {
+		t.Fatalf("Could not create the config: %v", err)
+	}
+
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}), cfg)
+
+	tests := []struct {
+		reqIP          string
+		reqPath        string
+		expectedStatus int
+	}{
+		{"192.168.1.1:_", "/", http.StatusForbidden},
+		{"8.8.8.8:_", "/", http.StatusTeapot},
+		{"8.8.8.8:_", "/private", http.StatusForbidden},
+		{"10.0.0.1:_", "/PRIVATE/page", http.StatusTeapot},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package ipfilter
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// HeaderCondition restricts a block to the requests whose header 'Name' has one of the 'Values', and none of
+// the ones starting with '!'. The values are case-insensitive and '*' matches any characters, a missing
+// header is an empty value.
+type HeaderCondition struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// parseHeaderCondition returns the condition of the arguments of 'header'.
+func parseHeaderCondition(args []string) (HeaderCondition, error) {
+	if len(args) < 2 {
+		return HeaderCondition{}, errors.New("ipfilter: header needs a name and values")
+	}
+	for _, value := range args[1:] {
+		if value == "!" {
+			return HeaderCondition{}, errors.New("ipfilter: header value '!' excludes nothing")
+		}
+	}
+	return HeaderCondition{Name: http.CanonicalHeaderKey(args[0]), Values: args[1:]}, nil
+}
+
+// matches returns true if the header of 'r' meets the condition.
+func (hc HeaderCondition) matches(r *http.Request) bool {
+	values := r.Header[http.CanonicalHeaderKey(hc.Name)]
+	if len(values) == 0 {
+		values = []string{""}
+	}
+
+	included, hasIncluded := false, false
+	for _, pattern := range hc.Values {
+		excluded := strings.HasPrefix(pattern, "!")
+		if excluded {
+			pattern = pattern[1:]
+		} else {
+			hasIncluded = true
+		}
+		for _, value := range values {
+			if !wildcardMatch(strings.ToLower(pattern), strings.ToLower(value)) {
+				continue
+			}
+			if excluded {
+				return false
+			}
+			included = true
+		}
+	}
+	return included || !hasIncluded
+}
+
+// wildcardMatch returns true if 's' matches 'pattern', where '*' matches any characters, including '/'
+// unlike path.Match.
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
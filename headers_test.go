@@ -0,0 +1,91 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		s        string
+		expected bool
+	}{
+		{"curl", "curl", true},
+		{"curl", "curl/8.4.0", false},
+		{"curl*", "curl/8.4.0", true},
+		{"*curl*", "curl/8.4.0", true},
+		{"*curl*", "python-requests/2.31", false},
+		{"*", "", true},
+		{"mozilla/*firefox/*", "mozilla/5.0 (x11; linux x86_64) gecko/20100101 firefox/121.0", true},
+		{"mozilla/*firefox/*", "mozilla/5.0 (x11; linux x86_64) chrome/120.0", false},
+		{"*a*a", "aa", true},
+		{"*a*a", "a", false},
+	}
+
+	for i, test := range tests {
+		if got := wildcardMatch(test.pattern, test.s); got != test.expected {
+			t.Errorf("Test %d: Expected %v for %q against %q, got: %v", i, test.expected, test.s, test.pattern, got)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		input          string
+		shouldErr      bool
+		userAgent      string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"header User-Agent *curl* *wget*", false, "curl/8.4.0", "8.8.8.8:_", http.StatusForbidden},
+		{"header User-Agent *curl* *wget*", false, "Wget/1.21", "8.8.8.8:_", http.StatusForbidden},
+		{"header User-Agent *curl* *wget*", false, "Mozilla/5.0", "8.8.8.8:_", http.StatusOK},
+		{"header User-Agent *curl* *wget*", false, "curl/8.4.0", "24.53.192.20:_", http.StatusOK},
+		// '!' values exclude the requests, a missing header is empty.
+		{"header user-agent !*Mozilla*", false, "curl/8.4.0", "8.8.8.8:_", http.StatusForbidden},
+		{"header user-agent !*Mozilla*", false, "Mozilla/5.0", "8.8.8.8:_", http.StatusOK},
+		{"header user-agent !*Mozilla*", false, "", "8.8.8.8:_", http.StatusForbidden},
+		{"header User-Agent *curl*", false, "", "8.8.8.8:_", http.StatusOK},
+		{"header User-Agent *curl*\nheader Accept-Language !fr*", false, "curl/8.4.0", "8.8.8.8:_", http.StatusForbidden},
+		{"header User-Agent", true, "", "", 0},
+		{"header User-Agent !", true, "", "", 0},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\ncountry US\ndatabase "+DataBase+"\n"+test.input+"\n}"))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.userAgent != "" {
+			req.Header.Set("User-Agent", test.userAgent)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package ipfilter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Rule lifecycle event types.
+const (
+	RuleLoaded     = "loaded"      // the rule, or ban, is enforced by at least one site.
+	RuleFirstMatch = "first_match" // a request matched the rule for the first time.
+	RuleExpired    = "expired"     // the ban reached its expiry date.
+	RuleRemoved    = "removed"     // no site enforces the rule, or ban, anymore.
+)
+
+// RuleEvent describes a change in the life of a rule or of a dynamic ban.
+type RuleEvent struct {
+	Type   string    `json:"type"`
+	RuleID string    `json:"rule_id"`
+	Rule   *Rule     `json:"rule,omitempty"`
+	Ban    *Ban      `json:"ban,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// RuleHook receives rule lifecycle events, e.g. to track policies in a ticketing system or a CMDB.
+type RuleHook interface {
+	HandleRuleEvent(event RuleEvent)
+}
+
+// RuleHookFunc is a function implementing RuleHook.
+type RuleHookFunc func(event RuleEvent)
+
+// HandleRuleEvent implements RuleHook.
+func (f RuleHookFunc) HandleRuleEvent(event RuleEvent) { f(event) }
+
+var (
+	ruleHooksMu sync.RWMutex
+	ruleHooks   []RuleHook
+)
+
+// RegisterRuleHook registers a hook that receives the lifecycle events of every site, it must not block.
+func RegisterRuleHook(hook RuleHook) {
+	ruleHooksMu.Lock()
+	ruleHooks = append(ruleHooks, hook)
+	ruleHooksMu.Unlock()
+}
+
+// ruleRegistry tracks the rules enforced by the running sites, so reloading a site
+// with the same rules doesn't emit 'removed' and 'loaded' events again.
+var ruleRegistry = struct {
+	sync.RWMutex
+	refs    map[string]int
+	matched map[string]bool
+}{refs: make(map[string]int), matched: make(map[string]bool)}
+
+// ruleID returns an identifier of the rule derived from its content, stable across reloads.
+func ruleID(path IPPath) string {
+	if path.id != "" {
+		return path.id
+	}
+	rule, _ := json.Marshal(RulesFromPaths([]IPPath{path}).Paths[0])
+	sum := sha256.Sum256(rule)
+	return hex.EncodeToString(sum[:6])
+}
+
+// withRuleIDs sets the id of every path, so it isn't computed on every request.
+func withRuleIDs(paths []IPPath) []IPPath {
+	for i := range paths {
+		paths[i].id = ruleID(paths[i])
+	}
+	return paths
+}
+
+// hookDispatcher sends the lifecycle events of a site to the registered hooks and its webhook.
+type hookDispatcher struct {
+	webhook string // URL the events are POSTed to, if not empty.
+	client  *http.Client
+}
+
+// emit sends 'event' to every hook, the webhook is called asynchronously.
+func (hd *hookDispatcher) emit(event RuleEvent) {
+	if hd == nil {
+		return
+	}
+	event.Time = time.Now()
+
+	ruleHooksMu.RLock()
+	for _, hook := range ruleHooks {
+		hook.HandleRuleEvent(event)
+	}
+	ruleHooksMu.RUnlock()
+
+	if hd.webhook != "" {
+		go hd.post(event)
+	}
+}
+
+func (hd *hookDispatcher) post(event RuleEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	resp, err := hd.client.Post(hd.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: rule webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[ERROR] ipfilter: rule webhook: unexpected status %s", resp.Status)
+	}
+}
+
+// acquire registers 'paths' as enforced, emitting 'loaded' for the ones that weren't enforced by any site yet.
+func (hd *hookDispatcher) acquire(paths []IPPath) {
+	ruleRegistry.Lock()
+	defer ruleRegistry.Unlock()
+
+	for _, path := range paths {
+		id := ruleID(path)
+		ruleRegistry.refs[id]++
+		if ruleRegistry.refs[id] == 1 {
+			rule := RulesFromPaths([]IPPath{path}).Paths[0]
+			hd.emit(RuleEvent{Type: RuleLoaded, RuleID: id, Rule: &rule})
+		}
+	}
+}
+
+// release is the opposite of acquire, emitting 'removed' for the rules no site enforces anymore.
+func (hd *hookDispatcher) release(paths []IPPath) {
+	ruleRegistry.Lock()
+	defer ruleRegistry.Unlock()
+
+	for _, path := range paths {
+		id := ruleID(path)
+		ruleRegistry.refs[id]--
+		if ruleRegistry.refs[id] <= 0 {
+			delete(ruleRegistry.refs, id)
+			delete(ruleRegistry.matched, id)
+			rule := RulesFromPaths([]IPPath{path}).Paths[0]
+			hd.emit(RuleEvent{Type: RuleRemoved, RuleID: id, Rule: &rule})
+		}
+	}
+}
+
+// matched emits 'first_match' the first time a request matches the rule.
+func (hd *hookDispatcher) matched(path IPPath) {
+	if hd == nil {
+		return
+	}
+	id := ruleID(path)
+
+	ruleRegistry.RLock()
+	first := !ruleRegistry.matched[id]
+	ruleRegistry.RUnlock()
+	if !first {
+		return
+	}
+
+	ruleRegistry.Lock()
+	first = !ruleRegistry.matched[id]
+	ruleRegistry.matched[id] = true
+	ruleRegistry.Unlock()
+
+	if first {
+		rule := RulesFromPaths([]IPPath{path}).Paths[0]
+		hd.emit(RuleEvent{Type: RuleFirstMatch, RuleID: id, Rule: &rule})
+	}
+}
+
+// banEvent emits an event about a dynamic ban.
+func (hd *hookDispatcher) banEvent(eventType string, ban Ban) {
+	hd.emit(RuleEvent{Type: eventType, RuleID: "ban:" + ban.IP, Ban: &ban})
+}
@@ -0,0 +1,146 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// eventRecorder records the events of the rules it's interested in.
+type eventRecorder struct {
+	mu     sync.Mutex
+	ids    map[string]bool
+	events []string
+}
+
+func (er *eventRecorder) HandleRuleEvent(event RuleEvent) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	if er.ids[event.RuleID] {
+		er.events = append(er.events, event.Type+" "+event.RuleID)
+	}
+}
+
+func (er *eventRecorder) take() []string {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	events := er.events
+	er.events = nil
+	return events
+}
+
+// withRuleHook registers 'hook' alone, on an empty rule registry, the returned func restores the hooks and
+// the registry of the process.
+func withRuleHook(hook RuleHook) func() {
+	ruleHooksMu.Lock()
+	hooks := ruleHooks
+	ruleHooks = nil
+	ruleHooksMu.Unlock()
+	RegisterRuleHook(hook)
+
+	ruleRegistry.Lock()
+	refs, matched := ruleRegistry.refs, ruleRegistry.matched
+	ruleRegistry.refs, ruleRegistry.matched = make(map[string]int), make(map[string]bool)
+	ruleRegistry.Unlock()
+
+	return func() {
+		ruleHooksMu.Lock()
+		ruleHooks = hooks
+		ruleHooksMu.Unlock()
+
+		ruleRegistry.Lock()
+		ruleRegistry.refs, ruleRegistry.matched = refs, matched
+		ruleRegistry.Unlock()
+	}
+}
+
+func TestRuleLifecycleHooks(t *testing.T) {
+	first := withRuleIDs([]IPPath{{
+		PathScopes: []string{"/hooks"},
+		IsBlock:    true,
+		Ranges:     []Range{{net.ParseIP("203.0.113.1"), net.ParseIP("203.0.113.1")}},
+	}})
+	second := withRuleIDs([]IPPath{{
+		PathScopes: []string{"/hooks"},
+		IsBlock:    true,
+		Ranges:     []Range{{net.ParseIP("203.0.113.2"), net.ParseIP("203.0.113.2")}},
+	}})
+	firstID, secondID := first[0].id, second[0].id
+
+	recorder := &eventRecorder{ids: map[string]bool{firstID: true, secondID: true, "ban:203.0.113.9": true}}
+	defer withRuleHook(recorder)()
+
+	hooks := &hookDispatcher{}
+	config := IPFConfig{Paths: first, Bans: NewBanList(), hooks: hooks}
+	config.Bans.hooks = hooks
+	live := newLiveConfig(&config)
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		live: live,
+	}
+	request := func(ip string) {
+		req, _ := http.NewRequest("GET", "/hooks", nil)
+		req.RemoteAddr = ip + ":12345"
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	hooks.acquire(first)
+	// a reload with the same rules acquires them again before the old instance releases them.
+	hooks.acquire(first)
+	hooks.release(first)
+	request("203.0.113.5")
+	request("203.0.113.1")
+	request("203.0.113.1")
+	live.SwapPaths(second)
+
+	config.Bans.Ban(net.ParseIP("203.0.113.9"), 0)
+	config.Bans.Unban(net.ParseIP("203.0.113.9"))
+
+	expected := []string{
+		"loaded " + firstID,
+		"first_match " + firstID,
+		"loaded " + secondID,
+		"removed " + firstID,
+		"loaded ban:203.0.113.9",
+		"removed ban:203.0.113.9",
+	}
+	events := recorder.take()
+	if len(events) != len(expected) {
+		t.Fatalf("Expected events: %v, Got: %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Expected events: %v, Got: %v", expected, events)
+		}
+	}
+}
+
+func TestRuleWebhook(t *testing.T) {
+	received := make(chan RuleEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event RuleEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer ts.Close()
+
+	hooks := &hookDispatcher{webhook: ts.URL, client: ts.Client()}
+	hooks.banEvent(RuleExpired, Ban{IP: "203.0.113.10"})
+
+	select {
+	case event := <-received:
+		if event.Type != RuleExpired || event.RuleID != "ban:203.0.113.10" || event.Ban == nil {
+			t.Errorf("Expected an 'expired' event for '203.0.113.10', Got: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The webhook wasn't called")
+	}
+}
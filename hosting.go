@@ -0,0 +1,113 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	RegisterMatcher("hosting", newHostingMatcher)
+}
+
+// hostingASNs are the autonomous systems of the largest clouds, hosting providers and server farms, the
+// networks with almost no residential clients.
+var hostingASNs = map[uint]string{
+	8075:   "Microsoft",
+	9009:   "M247",
+	12876:  "Scaleway",
+	14061:  "DigitalOcean",
+	14618:  "Amazon",
+	15169:  "Google",
+	16276:  "OVH",
+	16509:  "Amazon",
+	19318:  "Interserver",
+	20473:  "Vultr",
+	24940:  "Hetzner",
+	26496:  "GoDaddy",
+	28753:  "Leaseweb",
+	30633:  "Leaseweb",
+	31898:  "Oracle",
+	36352:  "ColoCrossing",
+	37963:  "Alibaba",
+	45090:  "Tencent",
+	45102:  "Alibaba",
+	46606:  "Unified Layer",
+	51167:  "Contabo",
+	53667:  "FranTech",
+	60781:  "Leaseweb",
+	62567:  "DigitalOcean",
+	63949:  "Linode",
+	132203: "Tencent",
+	141995: "Contabo",
+	213230: "Hetzner",
+	393406: "DigitalOcean",
+	396982: "Google Cloud",
+	398101: "GoDaddy",
+}
+
+// hostingMatcher matches the clients of the hosting ASNs, it needs an ASN database.
+type hostingMatcher map[uint]bool
+
+// newHostingMatcher creates the matcher of 'hosting [<file>]', the file replaces hostingASNs.
+func newHostingMatcher(args []string) (Matcher, error) {
+	m := make(hostingMatcher)
+	switch len(args) {
+	case 0:
+		for asn := range hostingASNs {
+			m[asn] = true
+		}
+	case 1:
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return nil, errors.New("can't read " + args[0])
+		}
+		if err := m.parse(data); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", args[0], err)
+		}
+	default:
+		return nil, errors.New("expected at most a file")
+	}
+	return m, nil
+}
+
+// parse reads the ASNs of a file: one per line, followed by anything such as the name of its owner, '#'
+// starts a comment.
+func (m hostingMatcher) parse(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.IndexByte(entry, '#'); i >= 0 {
+			entry = entry[:i]
+		}
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		asn, err := ParseASN(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid ASN %q", line, fields[0])
+		}
+		m[asn] = true
+	}
+	return scanner.Err()
+}
+
+// Match implements Matcher.
+func (m hostingMatcher) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	lookups := LookupsFromContext(ctx)
+	if lookups == nil {
+		return false, errors.New("ipfilter: ASN database is required to look up ASNs")
+	}
+	asn, err := lookups.ASN(ip)
+	if err != nil {
+		return false, err
+	}
+	return m[asn], nil
+}
@@ -0,0 +1,94 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestHosting(t *testing.T) {
+	asnPath := writeTestASNDB(t, map[string]uint{
+		"8.8.8.0/24":    15169,
+		"24.53.0.0/16":  6327,
+		"5.175.96.0/24": 64500,
+	})
+	dir := filepath.Dir(asnPath)
+	defer os.RemoveAll(dir)
+
+	listPath := filepath.Join(dir, "hosting.txt")
+	if err := ioutil.WriteFile(listPath, []byte("# our own table\nAS64500 Example Hosting\n\n64501\n"), 0600); err != nil {
+		t.Fatalf("Could not write the list: %v", err)
+	}
+	badPath := filepath.Join(dir, "bad.txt")
+	if err := ioutil.WriteFile(badPath, []byte("AS64500\nExample\n"), 0600); err != nil {
+		t.Fatalf("Could not write the list: %v", err)
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter /login {\nrule block\nasn_database "+asnPath+
+		"\nhosting\n}\nipfilter /api {\nrule block\nhosting "+listPath+"\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer config.ASNHandler.Close()
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		path           string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"/login", "8.8.8.8:_", http.StatusForbidden},
+		{"/login", "24.53.192.20:_", http.StatusOK},
+		{"/login", "5.175.96.22:_", http.StatusOK},
+		// the file replaces the embedded table.
+		{"/api", "5.175.96.22:_", http.StatusForbidden},
+		{"/api", "8.8.8.8:_", http.StatusOK},
+		// IPs missing from the database have no ASN.
+		{"/login", "1.1.1.1:_", http.StatusOK},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	for i, input := range []string{
+		"ipfilter / {\nrule block\nhosting\n}",
+		"ipfilter / {\nrule block\nasn_database " + asnPath + "\nhosting " + badPath + "\n}",
+		"ipfilter / {\nrule block\nasn_database " + asnPath + "\nhosting /no/such/file\n}",
+		"ipfilter / {\nrule block\nasn_database " + asnPath + "\nhosting " + listPath + " " + listPath + "\n}",
+	} {
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if config.ASNHandler != nil {
+			config.ASNHandler.Close()
+		}
+		if err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+
+	rs := RuleSet{Paths: []Rule{{PathScopes: []string{"/"}, Rule: "block", Matchers: []MatcherSpec{{Name: "hosting"}}}}}
+	if _, err := rs.ToPaths(false, false); err == nil {
+		t.Errorf("Expected an error without an ASN database")
+	}
+	if _, err := rs.ToPaths(false, true); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
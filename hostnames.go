@@ -0,0 +1,173 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the resolution of the hostnames of 'ip'.
+const (
+	defaultHostnameRefresh = 5 * time.Minute
+	hostnameLookupTimeout  = 5 * time.Second
+)
+
+// hostnameLookupIPAddr resolves the hostnames of 'ip'.
+var hostnameLookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// isHostname returns true if the entry of 'ip' is a DNS name rather than an IP, a range or a keyword: its
+// last label has a letter, unlike the partial IPs such as 192.168.
+func isHostname(entry string) bool {
+	if _, ok := ipKeywords[entry]; ok || strings.ContainsAny(entry, ":/") {
+		return false
+	}
+	name := strings.TrimSuffix(entry, ".")
+	tld := name[strings.LastIndexByte(name, '.')+1:]
+	return strings.IndexFunc(tld, func(r rune) bool { return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' }) >= 0
+}
+
+// parseHostname validates a hostname of 'ip'.
+func parseHostname(entry string) (string, error) {
+	name := normalizeHostname(entry)
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' ||
+			strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return "", errors.New("Can't parse hostname: " + entry)
+		}
+	}
+	return name, nil
+}
+
+// hostnamesOf returns the hostnames used by 'paths'.
+func hostnamesOf(paths []IPPath) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, path := range paths {
+		for _, name := range path.Hostnames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// HostnameLists holds the addresses of the hostnames of 'ip', e.g. the dynamic DNS names of home offices.
+// They are resolved at startup and again in the background once they are older than the refresh, a name
+// that can't be resolved keeps its previous addresses, and matches no client until it is first resolved.
+type HostnameLists struct {
+	refresh time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostnameList
+}
+
+// hostnameList is the addresses of a single hostname.
+type hostnameList struct {
+	mu        sync.Mutex
+	ips       []net.IP
+	next      time.Time // when to resolve the name again.
+	resolving bool
+}
+
+// NewHostnameLists returns HostnameLists resolving the hostnames again after 'refresh',
+// defaultHostnameRefresh if 0.
+func NewHostnameLists(refresh time.Duration) *HostnameLists {
+	if refresh == 0 {
+		refresh = defaultHostnameRefresh
+	}
+	return &HostnameLists{refresh: refresh, hosts: make(map[string]*hostnameList)}
+}
+
+// list returns the list of the hostname 'name', creating it if needed.
+func (hl *HostnameLists) list(name string) *hostnameList {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+
+	l, ok := hl.hosts[name]
+	if !ok {
+		l = &hostnameList{}
+		hl.hosts[name] = l
+	}
+	return l
+}
+
+// Contains returns true if 'name' resolves to 'ip', it starts resolving the name again if it is due.
+func (hl *HostnameLists) Contains(name string, ip net.IP) bool {
+	l := hl.list(name)
+
+	l.mu.Lock()
+	if !l.resolving && !time.Now().Before(l.next) {
+		l.resolving = true
+		go hl.resolve(name, l)
+	}
+	ips := l.ips
+	l.mu.Unlock()
+
+	for _, addr := range ips {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns true if one of the client IPs is an address of one of the hostnames 'names'.
+func (hl *HostnameLists) contains(names []string, clientIPs []net.IP) bool {
+	if hl == nil {
+		return false
+	}
+
+	for _, name := range names {
+		for _, clientIP := range clientIPs {
+			if hl.Contains(name, clientIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Refresh resolves the hostnames 'names' now, and returns the first error.
+func (hl *HostnameLists) Refresh(names ...string) error {
+	var firstErr error
+	for _, name := range names {
+		l := hl.list(name)
+		l.mu.Lock()
+		l.resolving = true
+		l.mu.Unlock()
+
+		if err := hl.resolve(name, l); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// resolve replaces the addresses of the hostname 'name', they are kept as is on errors.
+func (hl *HostnameLists) resolve(name string, l *hostnameList) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hostnameLookupTimeout)
+	defer cancel()
+	addrs, err := hostnameLookupIPAddr(ctx, name)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.resolving = false
+	l.next = time.Now().Add(hl.refresh)
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: Can't resolve the hostname %s: %v", name, err)
+		return err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	l.ips = ips
+	return nil
+}
@@ -0,0 +1,120 @@
+package ipfilter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestHostnames(t *testing.T) {
+	var mu sync.Mutex
+	answers := map[string][]net.IPAddr{
+		"office.example.dyndns.org": {{IP: net.ParseIP("24.53.192.20")}, {IP: net.ParseIP("2001:db8::1")}},
+	}
+	defer func(saved func(context.Context, string) ([]net.IPAddr, error)) { hostnameLookupIPAddr = saved }(hostnameLookupIPAddr)
+	hostnameLookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if addrs, ok := answers[host]; ok {
+			return addrs, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule allow\nip 8.8.8.8 Office.Example.DynDNS.org.\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(config.Paths[0].Hostnames, []string{"office.example.dyndns.org"}) {
+		t.Fatalf("Expected the hostname in the path, Got: %v", config.Paths[0].Hostnames)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+	check := func(what, reqIP string, expectedStatus int) {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = reqIP
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != expectedStatus {
+			t.Fatalf("%s: Expected StatusCode: '%d', Got: '%d'", what, expectedStatus, status)
+		}
+	}
+
+	if err := config.Hostnames.Refresh(hostnamesOf(config.Paths)...); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check("IP", "8.8.8.8:_", http.StatusOK)
+	check("Resolved", "24.53.192.20:_", http.StatusOK)
+	check("Resolved IPv6", "[2001:db8::1]:_", http.StatusOK)
+	check("Other", "5.175.96.22:_", http.StatusForbidden)
+
+	// the office moved.
+	mu.Lock()
+	answers["office.example.dyndns.org"] = []net.IPAddr{{IP: net.ParseIP("5.175.96.22")}}
+	mu.Unlock()
+	if err := config.Hostnames.Refresh("office.example.dyndns.org"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check("Moved", "5.175.96.22:_", http.StatusOK)
+	check("Previous", "24.53.192.20:_", http.StatusForbidden)
+
+	// a failure keeps the addresses.
+	mu.Lock()
+	delete(answers, "office.example.dyndns.org")
+	mu.Unlock()
+	if err := config.Hostnames.Refresh("office.example.dyndns.org"); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	check("Failure", "5.175.96.22:_", http.StatusOK)
+}
+
+func TestHostnamesParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"ipfilter / {\nrule allow\nip office.example.org 192.168 private\n}", false},
+		{"ipfilter / {\nrule allow\nip localhost\n}", false},
+		{"ipfilter / {\nrule allow\nip office.example.org\nhostname_refresh 1m\n}", false},
+		{"ipfilter / {\nrule allow\nip 10.0.0.0/8 !office.example.org\n}", true},
+		{"ipfilter / {\nrule allow\nip office_1.example.org\n}", true},
+		{"ipfilter / {\nrule allow\nip office..example.org\n}", true},
+		{"ipfilter / {\nrule allow\nip office.example.org\nhostname_refresh soon\n}", true},
+	}
+	for i, test := range tests {
+		_, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr && err == nil {
+			t.Fatalf("Test %d: Expected an error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule allow\nip 8.8.8.8 office.example.org\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rs := RulesFromPaths(config.Paths)
+	if !reflect.DeepEqual(rs.Paths[0].IPs, []string{"8.8.8.8", "office.example.org"}) {
+		t.Fatalf("Expected the hostname in the rule, Got: %v", rs.Paths[0].IPs)
+	}
+	paths, err := rs.ToPaths(false, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(paths[0].Hostnames, []string{"office.example.org"}) {
+		t.Fatalf("Expected the hostname in the path, Got: %v", paths[0].Hostnames)
+	}
+}
@@ -0,0 +1,211 @@
+package ipfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// IP2LocationDB reads an IP2Location BIN database, DB1 and up for the countries, DB3 and up for the regions
+// and cities as well, the LITE editions included.
+type IP2LocationDB struct {
+	f *os.File
+
+	dbType     uint8
+	built      time.Time
+	v4Count    uint32 // rows of the IPv4 table.
+	v4Addr     uint32 // 1-based offset of the IPv4 table.
+	v6Count    uint32
+	v6Addr     uint32
+	v4Index    uint32 // 1-based offset of the IPv4 index, 0 without one.
+	v6Index    uint32
+	v4RowSize  uint32
+	v6RowSize  uint32
+	columnSize uint8 // columns per row, the first is the start of the range.
+}
+
+// IP2LocationRecord is what an IP2Location database knows of an IP, the region and the city are empty
+// before DB3.
+type IP2LocationRecord struct {
+	Country string // ISO 3166-1 alpha-2 code, empty for the reserved ranges.
+	Region  string
+	City    string
+}
+
+// OpenIP2Location opens the IP2Location BIN database 'path', it is read from the file as it's queried.
+func OpenIP2Location(path string) (*IP2LocationDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var header [30]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		f.Close()
+		return nil, errors.New("not an IP2Location BIN database")
+	}
+
+	le := binary.LittleEndian
+	db := &IP2LocationDB{
+		f:          f,
+		dbType:     header[0],
+		columnSize: header[1],
+		built:      time.Date(2000+int(header[2]), time.Month(header[3]), int(header[4]), 0, 0, 0, 0, time.UTC),
+		v4Count:    le.Uint32(header[5:]),
+		v4Addr:     le.Uint32(header[9:]),
+		v6Count:    le.Uint32(header[13:]),
+		v6Addr:     le.Uint32(header[17:]),
+		v4Index:    le.Uint32(header[21:]),
+		v6Index:    le.Uint32(header[25:]),
+	}
+	// the product code is 1 for IP2Location since 2021, 2 is IP2Proxy.
+	product := header[29]
+	columns := uint8(2)
+	if db.dbType >= 3 {
+		columns = 4 // the region and the city as well.
+	}
+	if db.dbType == 0 || db.dbType > 26 || db.columnSize < columns || db.v4Addr == 0 || product != 1 && (product != 0 || header[2] >= 21) {
+		f.Close()
+		return nil, errors.New("not an IP2Location BIN database")
+	}
+	db.v4RowSize = uint32(db.columnSize) * 4
+	db.v6RowSize = 16 + uint32(db.columnSize-1)*4
+	return db, nil
+}
+
+// Built returns the day the database was published.
+func (db *IP2LocationDB) Built() time.Time {
+	return db.built
+}
+
+// Close closes the database file, a nil database is already closed.
+func (db *IP2LocationDB) Close() error {
+	if db == nil {
+		return nil
+	}
+	return db.f.Close()
+}
+
+// Country returns the country's ISO code of 'ip', empty if the database doesn't have one.
+func (db *IP2LocationDB) Country(ip net.IP) (string, error) {
+	record, err := db.lookup(ip, false)
+	return record.Country, err
+}
+
+// Lookup returns the record of 'ip', empty if the database doesn't have one.
+func (db *IP2LocationDB) Lookup(ip net.IP) (IP2LocationRecord, error) {
+	return db.lookup(ip, true)
+}
+
+// lookup binary searches the table of the family of 'ip', in the part of it the index has for its first 16 bits.
+func (db *IP2LocationDB) lookup(ip net.IP, full bool) (IP2LocationRecord, error) {
+	var record IP2LocationRecord
+
+	// the ranges of a table are kept as big-endian 16 bytes to compare them, the IPv4 ones in the last 4.
+	var key [16]byte
+	var base, count, index, rowSize, fromSize uint32
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key[12:], ip4)
+		base, count, rowSize, fromSize = db.v4Addr, db.v4Count, db.v4RowSize, 4
+		if db.v4Index > 0 {
+			index = db.v4Index + uint32(binary.BigEndian.Uint16(ip4))*8
+		}
+	} else if ip16 := ip.To16(); ip16 != nil {
+		copy(key[:], ip16)
+		base, count, rowSize, fromSize = db.v6Addr, db.v6Count, db.v6RowSize, 16
+		if db.v6Index > 0 {
+			index = db.v6Index + uint32(binary.BigEndian.Uint16(ip16))*8
+		}
+	} else {
+		return record, errors.New("invalid IP: " + ip.String())
+	}
+	if count == 0 {
+		// e.g. an IPv6 address in an IPv4 only database.
+		return record, nil
+	}
+	// the last address is the end of the last range.
+	if bytes.Equal(key[16-fromSize:], bytes.Repeat([]byte{0xff}, int(fromSize))) {
+		key[15] = 0xfe
+	}
+
+	low, high := int64(0), int64(count)
+	if index > 0 {
+		var bounds [8]byte
+		if err := db.read(index, bounds[:]); err != nil {
+			return record, err
+		}
+		low, high = int64(binary.LittleEndian.Uint32(bounds[:])), int64(binary.LittleEndian.Uint32(bounds[4:]))
+	}
+
+	row := make([]byte, rowSize+fromSize)
+	for low <= high {
+		mid := (low + high) / 2
+		offset := base + uint32(mid)*rowSize
+		// the row and the start of the next one, the end of its range.
+		if err := db.read(offset, row); err != nil {
+			return record, err
+		}
+		from := rangeStart(row[:fromSize])
+		to := rangeStart(row[rowSize:])
+		switch {
+		case bytes.Compare(key[:], from[:]) < 0:
+			high = mid - 1
+		case bytes.Compare(key[:], to[:]) >= 0:
+			low = mid + 1
+		default:
+			return db.record(row[fromSize:rowSize], full)
+		}
+	}
+	return record, nil
+}
+
+// rangeStart returns the little-endian start of a range 'b' as the big-endian 16 bytes of the lookups.
+func rangeStart(b []byte) [16]byte {
+	var start [16]byte
+	for i := range b {
+		start[15-i] = b[i]
+	}
+	return start
+}
+
+// record reads the strings the 'columns' of a row point to, the country is always the first.
+func (db *IP2LocationDB) record(columns []byte, full bool) (IP2LocationRecord, error) {
+	var record IP2LocationRecord
+	var err error
+	if record.Country, err = db.readString(binary.LittleEndian.Uint32(columns)); err != nil {
+		return record, err
+	}
+	if full && db.dbType >= 3 {
+		if record.Region, err = db.readString(binary.LittleEndian.Uint32(columns[4:])); err != nil {
+			return record, err
+		}
+		if record.City, err = db.readString(binary.LittleEndian.Uint32(columns[8:])); err != nil {
+			return record, err
+		}
+	}
+	return record, nil
+}
+
+// readString reads the string of length-prefixed 'pos', '-' is IP2Location's empty string.
+func (db *IP2LocationDB) readString(pos uint32) (string, error) {
+	var length [1]byte
+	if _, err := db.f.ReadAt(length[:], int64(pos)); err != nil {
+		return "", err
+	}
+	s := make([]byte, length[0])
+	if _, err := db.f.ReadAt(s, int64(pos)+1); err != nil {
+		return "", err
+	}
+	if string(s) == "-" {
+		return "", nil
+	}
+	return string(s), nil
+}
+
+// read fills 'b' from the 1-based offset 'pos' of the database.
+func (db *IP2LocationDB) read(pos uint32, b []byte) error {
+	_, err := db.f.ReadAt(b, int64(pos)-1)
+	return err
+}
@@ -0,0 +1,290 @@
+package ipfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+// ip2Row is a range of an IP2Location database, from its start to the start of the next row.
+type ip2Row struct {
+	from                  string
+	country, region, city string
+}
+
+// writeIP2Location writes an IP2Location BIN database of 'dbType' in 'dir', with the indexes if 'indexed'.
+func writeIP2Location(t *testing.T, dir string, dbType uint8, indexed bool, v4, v6 []ip2Row) string {
+	columns := uint8(2)
+	if dbType >= 3 {
+		columns = 4
+	}
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 64))
+	le := binary.LittleEndian
+
+	strs := map[string]uint32{}
+	str := func(s string) uint32 {
+		if s == "" {
+			s = "-"
+		}
+		if pos, ok := strs[s]; ok {
+			return pos
+		}
+		strs[s] = uint32(buf.Len())
+		buf.WriteByte(byte(len(s)))
+		buf.WriteString(s)
+		return strs[s]
+	}
+	for _, rows := range [][]ip2Row{v4, v6} {
+		for _, row := range rows {
+			str(row.country)
+			str(row.region)
+			str(row.city)
+		}
+	}
+
+	// writeTable writes the rows and the one closing the last range, returning the 1-based offset of the table.
+	writeTable := func(rows []ip2Row, size int) uint32 {
+		addr := uint32(buf.Len() + 1)
+		for _, row := range append(rows, ip2Row{from: ""}) {
+			from := make([]byte, size)
+			if row.from == "" {
+				for i := range from {
+					from[i] = 0xff
+				}
+			} else {
+				ip := net.ParseIP(row.from)
+				if size == 4 {
+					ip = ip.To4()
+				}
+				for i := range from {
+					from[i] = ip[size-1-i]
+				}
+			}
+			buf.Write(from)
+			var column [4]byte
+			for _, s := range []string{row.country, row.region, row.city}[:columns-1] {
+				le.PutUint32(column[:], str(s))
+				buf.Write(column[:])
+			}
+		}
+		return addr
+	}
+	// writeIndex writes the first and last rows of every 16 bits prefix.
+	writeIndex := func(rows []ip2Row, size int) uint32 {
+		addr := uint32(buf.Len() + 1)
+		var froms []net.IP
+		for _, row := range rows {
+			from := net.ParseIP(row.from)
+			if size == 4 {
+				from = from.To4()
+			}
+			froms = append(froms, from)
+		}
+		start, end := make([]byte, size), make([]byte, size)
+		for i := 2; i < size; i++ {
+			end[i] = 0xff
+		}
+		for p := 0; p < 1<<16; p++ {
+			binary.BigEndian.PutUint16(start, uint16(p))
+			binary.BigEndian.PutUint16(end, uint16(p))
+			var bounds [8]byte
+			for i, from := range froms {
+				if bytes.Compare(from, start) <= 0 {
+					le.PutUint32(bounds[:], uint32(i))
+				}
+				if bytes.Compare(from, end) <= 0 {
+					le.PutUint32(bounds[4:], uint32(i))
+				}
+			}
+			buf.Write(bounds[:])
+		}
+		return addr
+	}
+
+	header := make([]byte, 30)
+	header[0], header[1], header[2], header[3], header[4] = dbType, columns, 24, 1, 15
+	header[29] = 1
+	le.PutUint32(header[5:], uint32(len(v4)))
+	le.PutUint32(header[9:], writeTable(v4, 4))
+	if len(v6) != 0 {
+		le.PutUint32(header[13:], uint32(len(v6)))
+		le.PutUint32(header[17:], writeTable(v6, 16))
+	}
+	if indexed {
+		le.PutUint32(header[21:], writeIndex(v4, 4))
+		if len(v6) != 0 {
+			le.PutUint32(header[25:], writeIndex(v6, 16))
+		}
+	}
+
+	b := buf.Bytes()
+	copy(b, header)
+	path := filepath.Join(dir, "IP2LOCATION.BIN")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var (
+	ip2V4 = []ip2Row{
+		{"0.0.0.0", "", "", ""},
+		{"1.0.0.0", "DE", "Berlin", "Berlin"},
+		{"1.2.4.0", "FR", "Ile-de-France", "Paris"},
+		{"8.0.0.0", "US", "California", "Mountain View"},
+		{"9.0.0.0", "", "", ""},
+		{"200.0.0.0", "BR", "Sao Paulo", "Sao Paulo"},
+	}
+	ip2V6 = []ip2Row{
+		{"::", "", "", ""},
+		{"2001:db8::", "NL", "Noord-Holland", "Amsterdam"},
+		{"2001:db9::", "", "", ""},
+		{"2a00::", "GB", "England", "London"},
+	}
+)
+
+func TestIP2Location(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		ip       string
+		expected IP2LocationRecord
+	}{
+		{"0.0.0.1", IP2LocationRecord{}},
+		{"1.2.3.4", IP2LocationRecord{"DE", "Berlin", "Berlin"}},
+		{"1.2.4.0", IP2LocationRecord{"FR", "Ile-de-France", "Paris"}},
+		{"8.8.8.8", IP2LocationRecord{"US", "California", "Mountain View"}},
+		{"10.0.0.1", IP2LocationRecord{}},
+		{"255.255.255.255", IP2LocationRecord{"BR", "Sao Paulo", "Sao Paulo"}},
+		{"::ffff:1.2.3.4", IP2LocationRecord{"DE", "Berlin", "Berlin"}},
+		{"2001:db8::1", IP2LocationRecord{"NL", "Noord-Holland", "Amsterdam"}},
+		{"2001:db9::1", IP2LocationRecord{}},
+		{"2a00:1450::1", IP2LocationRecord{"GB", "England", "London"}},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", IP2LocationRecord{"GB", "England", "London"}},
+	}
+	for _, dbType := range []uint8{1, 3, 11} {
+		for _, indexed := range []bool{false, true} {
+			db, err := OpenIP2Location(writeIP2Location(t, dir, dbType, indexed, ip2V4, ip2V6))
+			if err != nil {
+				t.Fatalf("DB%d: Unexpected error: %v", dbType, err)
+			}
+			for i, test := range tests {
+				expected := test.expected
+				if dbType < 3 {
+					expected.Region, expected.City = "", ""
+				}
+				record, err := db.Lookup(net.ParseIP(test.ip))
+				if err != nil || record != expected {
+					t.Errorf("DB%d, indexed %v, test %d: Expected: %+v, Got: %+v, %v", dbType, indexed, i, expected, record, err)
+				}
+				if country, err := db.Country(net.ParseIP(test.ip)); err != nil || country != expected.Country {
+					t.Errorf("DB%d, indexed %v, test %d: Expected: %q, Got: %q, %v", dbType, indexed, i, expected.Country, country, err)
+				}
+			}
+			if built := db.Built().Format("2006-01-02"); built != "2024-01-15" {
+				t.Errorf("DB%d: Expected to be built on 2024-01-15, Got: %s", dbType, built)
+			}
+			db.Close()
+		}
+	}
+
+	// an IPv4 only database.
+	db, err := OpenIP2Location(writeIP2Location(t, dir, 1, true, ip2V4, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if country, err := db.Country(net.ParseIP("2001:db8::1")); err != nil || country != "" {
+		t.Errorf("Expected no country, Got: %q, %v", country, err)
+	}
+	db.Close()
+
+	short := filepath.Join(dir, "short.BIN")
+	if err := ioutil.WriteFile(short, []byte{1, 2, 24}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{DataBase, short, filepath.Join(dir, "nonexistent.BIN")} {
+		if _, err := OpenIP2Location(path); err == nil {
+			t.Errorf("Expected an error for %s", path)
+		}
+	}
+}
+
+func TestIP2LocationParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	database := writeIP2Location(t, dir, 1, true, ip2V4, ip2V6)
+
+	tests := []struct {
+		input          string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule block\ndatabase_format ip2location\ndatabase " + database + "\ncountry DE NL\n}", "1.2.3.4:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\ndatabase_format ip2location\ndatabase " + database + "\ncountry DE NL\n}", "[2001:db8::1]:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\ndatabase_format ip2location\ndatabase " + database + "\ncountry DE NL\n}", "8.8.8.8:_", http.StatusOK},
+		{"ipfilter / {\nrule block\ndatabase_format ip2location\ndatabase " + database + "\ncountry not US\n}", "8.8.8.8:_", http.StatusOK},
+		{"ipfilter / {\nrule block\ndatabase_format ip2location\ndatabase " + database + "\ncountry not US\n}", "10.0.0.1:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\ndatabase_format mmdb\ndatabase " + DataBase + "\ncountry US\n}", "8.8.8.8:_", http.StatusForbidden},
+	}
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+		if config.CountryDB != nil {
+			config.CountryDB.Close()
+		}
+		if config.DBHandler != nil {
+			config.DBHandler.Close()
+		}
+	}
+
+	for _, input := range []string{
+		"ipfilter / {\nrule block\ndatabase_format ip2location\ndatabase " + DataBase + "\ncountry US\n}",
+		"ipfilter / {\nrule block\ndatabase " + database + "\ncountry US\n}",
+		"ipfilter / {\nrule block\ndatabase " + DataBase + "\ndatabase_format ip2location\ncountry US\n}",
+		"ipfilter / {\nrule block\ndatabase_format bin\ncountry US\n}",
+		"ipfilter / {\nrule block\ndatabase_format ip2location\ndatabase " + database + "\ndatabase_diff\ncountry US\n}",
+	} {
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+		if config.CountryDB != nil {
+			config.CountryDB.Close()
+		}
+		if config.DBHandler != nil {
+			config.DBHandler.Close()
+		}
+	}
+}
@@ -2,39 +2,207 @@ package ipfilter
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"os"
-	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/mholt/caddy"
-	"github.com/mholt/caddy/caddyhttp/httpserver"
 	"github.com/oschwald/maxminddb-golang"
 )
 
 // IPFilter is a middleware for filtering clients based on their ip or country's ISO code.
 type IPFilter struct {
-	Next   httpserver.Handler
+	Next   NextHandler
 	Config IPFConfig
+
+	live *liveConfig // if set, overrides Config and allows swapping it at runtime.
+}
+
+// NextHandler handles the requests an IPFilter allows, it has the signature of caddy's httpserver.Handler:
+// a status >= 400 is returned instead of written.
+type NextHandler interface {
+	ServeHTTP(http.ResponseWriter, *http.Request) (int, error)
+}
+
+// NextFunc is a function implementing NextHandler.
+type NextFunc func(http.ResponseWriter, *http.Request) (int, error)
+
+// ServeHTTP implements NextHandler.
+func (f NextFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	return f(w, r)
 }
 
 // IPPath holds the configuration of a single ipfilter block.
 type IPPath struct {
-	PathScopes   []string
-	BlockPage    string
-	CountryCodes []string
-	Ranges       []Range
-	IsBlock      bool
-	Strict       bool
+	PathScopes      []string
+	BlockPage       string
+	CountryCodes    []string
+	Ranges          []Range
+	CompactRanges   *CompactRanges // Ranges with StorageCompact, Ranges is empty then.
+	IsBlock         bool
+	Strict          bool
+	Priority        int               // only used with MatchPriority.
+	ThreatLevel     int               // the block is only enforced from this threat level, see Threat.
+	ExceptASNs      []uint            // clients of these ASNs don't match CountryCodes.
+	NegateCountries bool              // CountryCodes are the countries not matching, the clients of any other, or of none, match.
+	ExceptRanges    []Range           // clients in these ranges are exempted from the action, see excepted.
+	ExceptCountries []string          // clients of these countries are exempted from the action, see excepted.
+	Matchers        []Matcher         // custom conditions, see RegisterMatcher.
+	Family          string            // FamilyIPv4 or FamilyIPv6 restricts the block to the clients of that family, any if empty.
+	AllowMonitoring []string          // the probes of these monitoring providers are always allowed, see MonitoringLists.
+	XFFPolicy       string            // how the IPs of a forwarding chain are evaluated, XFFPolicyAny if empty.
+	Feeds           []string          // clients in the ranges of these feeds match, see FeedLists.
+	Hostnames       []string          // clients at the addresses of these hostnames match, see HostnameLists.
+	MatchAll        bool              // a client IP has to match every kind of condition, instead of any, see matchAll.
+	Excludes        []string          // requests to these paths aren't filtered by the block, see excludes.
+	Hosts           []string          // the block only applies to the requests for these hosts, any if empty.
+	Methods         []string          // the block only applies to the requests with these methods, any if empty.
+	Headers         []HeaderCondition // the block only applies to the requests meeting all of them.
+	Schedules       []Schedule        // the block only applies during one of them, always if empty.
+	ActiveFrom      time.Time         // the block only applies from then, if set.
+	ActiveUntil     time.Time         // the block doesn't apply from then, if set.
+	Challenge       string            // the denied clients are challenged instead, see ChallengeCaptcha.
+	AutoBan         *AutoBan          // bans the clients going over a request rate, nil unless 'autoban' is set.
+	Sample          int               // percentage of the clients the block is enforced on, the others are only logged, all if 0.
+	// leading zero bits of the ChallengePow puzzle, defaultPowDifficulty if 0.
+	ChallengeDifficulty int
+
+	id      string   // identifies the rule in lifecycle events, see ruleID.
+	lists   []IPList // 'ip_list' lists, added to Ranges once the whole block is parsed, see loadIPLists.
+	negated []Range  // '!' entries of 'ip', removed from Ranges once the whole block is parsed.
+}
+
+// Address families of IPPath.Family.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// ipFamily returns the address family of 'ip', IPv4-mapped IPv6 addresses are FamilyIPv4.
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
 }
 
 // IPFConfig holds the configuration for the ipfilter middleware.
 type IPFConfig struct {
-	Paths     []IPPath
-	DBHandler *maxminddb.Reader // Database's handler if it gets opened.
+	Paths      []IPPath
+	DBHandler  *maxminddb.Reader // Database's handler if it gets opened.
+	ASNHandler *maxminddb.Reader // ASN database's handler, nil unless 'asn_database' is set.
+	Costs      *CostAccounting   // Per-subsystem cost accounting, nil unless 'cost_accounting' is enabled.
+	GeoCache   *GeoCache         // Country lookups cache, nil unless 'geo_cache' is set.
+	Admin      *AdminConfig      // Management endpoint, nil unless 'admin' is set.
+	Bans       *BanList          // IPs banned at runtime through the admin endpoint.
+	Fail2Ban   *Fail2Ban         // Bans shared with fail2ban, nil unless 'fail2ban' is set.
+	SupportKey []byte            // HMAC key of the support codes, nil unless 'support_code' is set.
+	PassCookie *PassCookie       // Lets the approved clients through, nil unless 'pass_cookie' is set.
+	Captcha    *Captcha          // CAPTCHA of the 'challenge captcha' rules, nil unless 'captcha' is set.
+	Webhook    *BlockWebhook     // Receives the block events, nil unless 'webhook' is set.
+	Alerts     *Alerts           // Notifies of the block thresholds, nil unless 'alert' is set.
+	Syslog     *SyslogWriter     // Receives the decisions, nil unless 'syslog' is set.
+	LogFile    *LogFile          // Receives the decisions, nil unless 'log_file' is set.
+	Summary    *Summary          // Summarizes the recent decisions, nil unless 'summary' is set.
+	HTTPClient *http.Client      // Used by external integrations, defaultHTTPClient if nil.
+	RuleSource RuleSource        // Where Paths are read and watched from, nil unless 'rule_source' is set.
+	DBDiff     *DBDiffConfig     // Reports the changes of database updates, nil unless 'database_diff' is set.
+	MatchMode  string            // Which IPPath applies when several scopes match, MatchLongest if empty.
+	PolicyDir  string            // Directory of delegated rules, see LoadPolicyDir, empty unless 'policy_dir' is set.
+	Threat     *Threat           // Runtime threat level, enabling the IPPaths with a ThreatLevel.
+	// Looks up the countries the database doesn't have, or all of them without a database, nil unless
+	// 'geo_provider' or 'maxmind_web_service' is set.
+	GeoWebService *GeoWebService
+	// Blocks every client but an allowlist while it is switched on, whatever the IPPaths.
+	Maintenance *Maintenance
+	// External command overriding the decisions, nil unless 'decision_hook' is set.
+	DecisionHook *DecisionHook
+	GeoStats     *GeoStats // Per-country statistics of the allowed traffic, nil unless 'geo_stats' is set.
+	Placeholders bool      // Sets the placeholders of the decisions, e.g. {ipfilter_country}, if 'placeholders' is set.
+	SetHeaders   bool      // Sets the client headers of the allowed requests, e.g. HeaderClientCountry, if 'set_headers' is set.
+	Debug        bool      // Describes the decisions in the HeaderDebug of the responses if 'debug' is set.
+	// Proxies whose X-Forwarded-For header is honored, every client's if empty.
+	TrustedProxies []*net.IPNet
+	XFFStrategy    string // Which X-Forwarded-For entries are checked, XFFAll if empty.
+	TrustedHops    int    // Proxies in front of caddy for XFFRightmostUntrusted, TrustedProxies are skipped if 0.
+	// Headers holding the client IPs, the first one a request has is used, X-Forwarded-For then Forwarded if empty.
+	ClientIPHeaders []string
+	Monitoring      *MonitoringLists // Probe IPs of the providers of IPPath.AllowMonitoring.
+	Feeds           *FeedLists       // Ranges of the feeds of IPPath.Feeds.
+	Hostnames       *HostnameLists   // Addresses of the hostnames of IPPath.Hostnames.
+	HostnameRefresh time.Duration    // How often the hostnames are resolved again, defaultHostnameRefresh if 0.
+	// Whether requests with malformed or spoofed client IP headers are rejected, see checkForwarded.
+	RejectMalformedXFF bool
+	// ActionAllow or ActionBlock for the requests no IPPath applies to, ActionAllow if empty.
+	DefaultAction string
+	// ActionAllow or ActionBlock for the requests without a client IP, e.g. on a unix socket, an error if empty.
+	NoClientIP string
+	// ActionAllow or ActionBlock for the requests the rules fail on, e.g. a broken database or client IP header,
+	// OnError500 or empty to fail them with a 500.
+	OnError string
+	// Whether the requests from the host itself, e.g. health checks, are allowed whatever the rules.
+	AllowLoopback bool
+	// Whether the connections start with a PROXY protocol header, see ProxyProtocolListener.
+	ProxyProtocol        bool
+	ProxyProtocolSources []*net.IPNet // Load balancers sending the header, every client if empty.
+	Storage              string       // How the ranges are held in memory, StorageDefault if empty.
+	// Anonymous-IP database's handler, nil unless 'anonymous_ip_database' is set.
+	AnonymousIPHandler *maxminddb.Reader
+	// Database's handler instead of DBHandler with 'database_format ip2location' or 'csv'.
+	CountryDB CountryDB
+
+	scopes          *scopeTrie      // built from Paths by ipfilterParse.
+	defaults        *IPPath         // settings of the 'ipfilter defaults' block, the start of the other blocks.
+	blockPages      map[string]bool // of the Caddyfile blocks, the only ones the rules of rulePaths may name.
+	hooks           *hookDispatcher // sends the rule lifecycle events.
+	ruleVersion     string          // version of the rules read from RuleSource.
+	dbPath          string          // file of DBHandler or CountryDB.
+	dbFormat        string          // of the 'database', DatabaseMMDB if empty.
+	dbLayout        mmdbLayout      // of DBHandler, set by detectLayouts.
+	asnLayout       mmdbLayout      // of ASNHandler.
+	asnDBPath       string          // file of ASNHandler.
+	anonymousDBPath string          // file of AnonymousIPHandler.
+	validating      bool            // set under 'caddy -validate', see deepCheck.
+	problems        []error         // found while validating, reported with the ones of deepCheck.
+}
+
+// httpClient returns the client external integrations should use.
+func (config *IPFConfig) httpClient() *http.Client {
+	if config.HTTPClient != nil {
+		return config.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+// closeDatabases closes the handlers of the databases and unmaps their files, the config can't look up
+// anything after. It returns the first error.
+func (config *IPFConfig) closeDatabases() error {
+	var errs []error
+	if config.DBHandler != nil {
+		errs = append(errs, config.DBHandler.Close())
+	}
+	if config.CountryDB != nil {
+		errs = append(errs, config.CountryDB.Close())
+	}
+	if config.ASNHandler != nil {
+		errs = append(errs, config.ASNHandler.Close())
+	}
+	if config.AnonymousIPHandler != nil {
+		errs = append(errs, config.AnonymousIPHandler.Close())
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Range is a pair of two 'net.IP'.
@@ -45,12 +213,27 @@ type Range struct {
 
 // InRange is a method of 'Range' takes a pointer to net.IP, returns true if in range, false otherwise.
 func (rng Range) InRange(ip *net.IP) bool {
-	if bytes.Compare(*ip, rng.start) >= 0 && bytes.Compare(*ip, rng.end) <= 0 {
+	canonical := normalizeIP(*ip)
+	if bytes.Compare(canonical, rng.start) >= 0 && bytes.Compare(canonical, rng.end) <= 0 {
 		return true
 	}
 	return false
 }
 
+// normalizeIP returns the 16-byte form of 'ip', so that an IPv4 address compares the same whether it was
+// parsed from "203.0.113.7" or "::ffff:203.0.113.7" or built as a 4-byte slice, nil if 'ip' is invalid.
+func normalizeIP(ip net.IP) net.IP {
+	return ip.To16()
+}
+
+// String returns the range in the form parseIP accepts, e.g. "1.1.1.1" or "1.1.1.1-1.1.2.255".
+func (rng Range) String() string {
+	if rng.start.Equal(rng.end) {
+		return rng.start.String()
+	}
+	return rng.start.String() + "-" + rng.end.String()
+}
+
 // OnlyCountry is used to fetch only the country's code from 'mmdb'.
 type OnlyCountry struct {
 	Country struct {
@@ -58,18 +241,23 @@ type OnlyCountry struct {
 	} `maxminddb:"country"`
 }
 
+// OnlyASN is used to fetch only the autonomous system number from an ASN 'mmdb'.
+type OnlyASN struct {
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
 // Status is used to keep track of the status of the request.
 type Status struct {
-	countryMatch, inRange bool
+	countryMatch, inRange, matcherMatch bool
 }
 
-// Any returns 'true' if we have a match on a country code or an IP in range.
+// Any returns 'true' if we have a match on a country code, an IP in range or a matcher.
 func (s *Status) Any() bool {
-	return s.countryMatch || s.inRange
+	return s.countryMatch || s.inRange || s.matcherMatch
 }
 
-// block will take care of blocking
-func block(blockPage string, w *http.ResponseWriter) (int, error) {
+// block will take care of blocking, 'placeholders' e.g. {support_code} are replaced in the blockpage.
+func block(blockPage string, placeholders map[string]string, w *http.ResponseWriter) (int, error) {
 	if blockPage != "" {
 		bp, err := os.Open(blockPage)
 		if err != nil {
@@ -77,10 +265,25 @@ func block(blockPage string, w *http.ResponseWriter) (int, error) {
 		}
 		defer bp.Close()
 
-		if _, err := io.Copy(*w, bp); err != nil {
+		if len(placeholders) == 0 {
+			if _, err := io.Copy(*w, bp); err != nil {
+				return http.StatusInternalServerError, err
+			}
+			// we wrote the blockpage, return OK.
+			return http.StatusOK, nil
+		}
+
+		page, err := ioutil.ReadAll(bp)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		oldnew := make([]string, 0, 2*len(placeholders))
+		for placeholder, value := range placeholders {
+			oldnew = append(oldnew, placeholder, value)
+		}
+		if _, err := strings.NewReplacer(oldnew...).WriteString(*w, string(page)); err != nil {
 			return http.StatusInternalServerError, err
 		}
-		// we wrote the blockpage, return OK.
 		return http.StatusOK, nil
 	}
 
@@ -88,167 +291,742 @@ func block(blockPage string, w *http.ResponseWriter) (int, error) {
 	return http.StatusForbidden, nil
 }
 
-// Init initializes the plugin
-func init() {
-	caddy.RegisterPlugin("ipfilter", caddy.Plugin{
-		ServerType: "http",
-		Action:     Setup,
-	})
-}
+// OnError500 fails the requests the rules fail on, see IPFConfig.OnError.
+const OnError500 = "500"
 
-// Setup parses the ipfilter configuration and returns the middleware handler.
-func Setup(c *caddy.Controller) error {
-	ifconfig, err := ipfilterParse(c)
-	if err != nil {
-		return err
-	}
+// errNoClientIP is returned when a request has no client IP, see IPFConfig.NoClientIP.
+var errNoClientIP = errors.New("ipfilter: unable to determine the client IP")
 
-	// Create new middleware
-	newMiddleWare := func(next httpserver.Handler) httpserver.Handler {
-		return &IPFilter{
-			Next:   next,
-			Config: ifconfig,
-		}
+// remoteHost returns the host of the remote address of 'r', which has no port on unix sockets and some listeners.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return strings.TrimSuffix(strings.TrimPrefix(r.RemoteAddr, "["), "]")
 	}
-	// Add middleware
-	cfg := httpserver.GetConfig(c)
-	cfg.AddMiddleware(newMiddleWare)
+	return host
+}
 
-	return nil
+// remoteIP returns the IP of the remote address of 'r', nil if it isn't an IP, e.g. on a unix socket.
+func remoteIP(r *http.Request) net.IP {
+	return normalizeIP(net.ParseIP(remoteHost(r)))
 }
 
-func getClientIPs(r *http.Request, strict bool) ([]net.IP, error) {
+// getClientIPs returns the client IPs of 'r' and whether they come from one of 'headers' rather than
+// the remote address, see forwardedIPs, the headers are ignored if 'strict'.
+func getClientIPs(r *http.Request, strict bool, headers []string) ([]net.IP, bool, error) {
 	var ips []string
 
-	// Use the client ip(s) from the 'X-Forwarded-For' header, if available.
-	if fwdFor := r.Header.Get("X-Forwarded-For"); fwdFor != "" && !strict {
-		ips = strings.Split(fwdFor, ",")
-	} else {
+	// Use the client ip(s) from the 'X-Forwarded-For' or 'Forwarded' header, or the configured ones, if available.
+	if !strict {
+		ips = forwardedIPs(r, headers)
+	}
+	forwarded := len(ips) != 0
+	if !forwarded {
 		// Otherwise, get the client ip from the request remote address.
-		var err error
-		var ip string
-		ip, _, err = net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			return nil, err
-		}
-		ips = []string{ip}
+		ips = []string{remoteHost(r)}
 	}
 
 	// Parse each ip address string into a net.IP.
 	var parsedIPs = make([]net.IP, len(ips))
 	var count = 0
 	for _, ip := range ips {
-		parsedIP := net.ParseIP(strings.TrimSpace(ip))
+		parsedIP := normalizeIP(net.ParseIP(strings.TrimSpace(ip)))
 		if parsedIP != nil {
 			parsedIPs[count] = parsedIP
 			count++
 		}
 	}
 	if count == 0 {
-		return nil, errors.New("unable to parse address")
+		return nil, forwarded, errNoClientIP
 	}
 
-	return parsedIPs, nil
+	return parsedIPs[:count], forwarded, nil
 }
 
 // ShouldAllow takes a path and a request and decides if it should be allowed
 func (ipf IPFilter) ShouldAllow(path IPPath, r *http.Request) (bool, string, error) {
-	allow := true
-	scopeMatched := ""
+	return ipf.shouldAllow(path, r, nil)
+}
 
+func (ipf IPFilter) shouldAllow(path IPPath, r *http.Request, cost *requestCost) (bool, string, error) {
 	// check if we are in one of our scopes.
 	for _, scope := range path.PathScopes {
-		if httpserver.Path(r.URL.Path).Matches(scope) {
-			// extract the client IP(s) and parse them.
-			clientIPs, err := getClientIPs(r, path.Strict)
-			if err != nil {
-				return false, scope, err
+		if pathMatches(r.URL.Path, scope) {
+			if path.excludes(r.URL.Path) || !path.appliesTo(r) {
+				return true, "", nil
 			}
+			// We only have to test the first path that matches because it is the most specific
+			allow, err := ipf.evaluate(path, r, cost)
+			return allow, scope, err
+		}
+	}
 
-			// request status.
-			var rs Status
-
-			if len(path.CountryCodes) != 0 {
-				// do the lookup.
-				var result OnlyCountry
-				for _, clientIP := range clientIPs {
-					if err = ipf.Config.DBHandler.Lookup(clientIP, &result); err != nil {
-						return false, scope, err
-					}
-
-					// get only the ISOCode out of the lookup results.
-					clientCountry := result.Country.ISOCode
-					for _, c := range path.CountryCodes {
-						if clientCountry == c {
-							rs.countryMatch = true
-							break
-						}
-					}
-					if rs.countryMatch {
-						break
-					}
-				}
+	// no scope match, pass-through.
+	return true, "", nil
+}
+
+// evaluate decides if a request that is in one of path's scopes should be allowed.
+func (ipf IPFilter) evaluate(path IPPath, r *http.Request, cost *requestCost) (bool, error) {
+	// extract the client IP(s) and parse them.
+	clientIPs, err := ipf.clientIPs(r, path.Strict)
+	if err == errNoClientIP && ipf.Config.NoClientIP != "" {
+		return ipf.Config.NoClientIP == ActionAllow, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ipf.Config.AllowLoopback && isLoopback(r, clientIPs) {
+		return true, nil
+	}
+
+	allow, _, err := ipf.evaluateIPs(path, clientIPs, r, cost)
+	return allow, err
+}
+
+// evaluateDefault decides if a request no IPPath applies to should be allowed, see DefaultAction.
+func (ipf IPFilter) evaluateDefault(r *http.Request) bool {
+	if ipf.Config.DefaultAction != ActionBlock {
+		return true
+	}
+	if ipf.Config.AllowLoopback {
+		if clientIPs, err := ipf.clientIPs(r, false); err == nil && isLoopback(r, clientIPs) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopback returns true if the request comes from the host itself, directly: with a local reverse proxy,
+// the client IPs from its headers aren't loopback addresses, and a remote client can't send them.
+func isLoopback(r *http.Request, clientIPs []net.IP) bool {
+	if remote := remoteIP(r); remote == nil || !remote.IsLoopback() {
+		return false
+	}
+	for _, clientIP := range clientIPs {
+		if !clientIP.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluateIPs decides if clients with these IPs should be allowed by 'path', it also returns the country of
+// the client as in match.
+func (ipf IPFilter) evaluateIPs(path IPPath, clientIPs []net.IP, r *http.Request, cost *requestCost) (bool, string, error) {
+	if ipf.Config.Monitoring.allows(path.AllowMonitoring, clientIPs) {
+		return true, "", nil
+	}
+
+	switch path.XFFPolicy {
+	case XFFPolicyFirst:
+		clientIPs = clientIPs[:1]
+	case XFFPolicyLast:
+		clientIPs = clientIPs[len(clientIPs)-1:]
+	case XFFPolicyAll:
+		if len(clientIPs) > 1 {
+			return ipf.evaluateEach(path, clientIPs, r, cost)
+		}
+	}
+
+	matched, country, err := ipf.match(path, clientIPs, r, cost)
+	if err != nil {
+		return false, country, err
+	}
+
+	if matched && !ipf.excepted(path, clientIPs, cost) {
+		ipf.Config.hooks.matched(path)
+		// Rule matched, if the rule has IsBlock = true then we have to deny access
+		return !path.IsBlock, country, nil
+	}
+	// Rule did not match, if the rule has IsBlock = true then we have to allow access
+	return path.IsBlock, country, nil
+}
+
+// evaluateEach allows the clients only if every IP is allowed by 'path' on its own, see XFFPolicyAll,
+// the country is the one of the first IP that isn't allowed, or of the last IP.
+func (ipf IPFilter) evaluateEach(path IPPath, clientIPs []net.IP, r *http.Request, cost *requestCost) (bool, string, error) {
+	var country string
+	for _, clientIP := range clientIPs {
+		allow, ipCountry, err := ipf.evaluateIPs(path, []net.IP{clientIP}, r, cost)
+		if err != nil || !allow {
+			return false, ipCountry, err
+		}
+		country = ipCountry
+	}
+	return true, country, nil
+}
+
+// match returns true if any of the client IPs matches one of the path's countries, ranges, feeds, hostnames or matchers, and the
+// country of the IP that matched, or of the last one looked up, empty if the path has no country codes.
+// A failed lookup is only returned if nothing matched.
+// With a Family, only the client IPs of that family can match, and they all do if there are no other conditions.
+// With MatchAll, see matchAll.
+func (ipf IPFilter) match(path IPPath, clientIPs []net.IP, r *http.Request, cost *requestCost) (bool, string, error) {
+	if path.Family != "" {
+		var sameFamily []net.IP
+		for _, clientIP := range clientIPs {
+			if ipFamily(clientIP) == path.Family {
+				sameFamily = append(sameFamily, clientIP)
 			}
+		}
+		if len(sameFamily) == 0 {
+			return false, "", nil
+		}
+		if len(path.CountryCodes) == 0 && !path.hasRanges() && len(path.Feeds) == 0 && len(path.Hostnames) == 0 && len(path.Matchers) == 0 {
+			return true, "", nil
+		}
+		clientIPs = sameFamily
+	}
+	if path.MatchAll {
+		return ipf.matchAll(path, clientIPs, r, cost)
+	}
 
-			if len(path.Ranges) != 0 {
-				for _, rng := range path.Ranges {
-					for _, clientIP := range clientIPs {
-						if rng.InRange(&clientIP) {
-							rs.inRange = true
-							break
-						}
-					}
-					if rs.inRange {
-						break
-					}
+	// request status.
+	var rs Status
+	// a failed lookup only matters if nothing matched, so the order of the conditions doesn't.
+	var lookupErr error
+
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+
+	countries := countryMatcher{ipf: ipf, path: path, cost: cost}
+	if len(path.CountryCodes) != 0 {
+		for _, clientIP := range clientIPs {
+			matched, err := countries.Match(ctx, clientIP, r)
+			if err != nil {
+				if lookupErr == nil {
+					lookupErr = err
 				}
+				continue
+			}
+			if matched {
+				rs.countryMatch = true
+				break
 			}
+		}
+	}
 
-			scopeMatched = scope
-			if rs.Any() {
-				// Rule matched, if the rule has IsBlock = true then we have to deny access
-				allow = !path.IsBlock
-			} else {
-				// Rule did not match, if the rule has IsBlock = true then we have to allow access
-				allow = path.IsBlock
+	if path.hasRanges() {
+		start := cost.now()
+		ranges := path.ranges()
+		for _, clientIP := range clientIPs {
+			rs.inRange, _ = ranges.Match(ctx, clientIP, r)
+			if rs.inRange {
+				break
 			}
+		}
+		cost.track(CostRangeMatch, start)
+	}
+	if !rs.inRange && len(path.Feeds) != 0 {
+		rs.inRange = ipf.Config.Feeds.contains(path.Feeds, clientIPs)
+	}
+	if !rs.inRange && len(path.Hostnames) != 0 {
+		rs.inRange = ipf.Config.Hostnames.contains(path.Hostnames, clientIPs)
+	}
 
-			// We only have to test the first path that matches because it is the most specific
+	if len(path.Matchers) != 0 {
+		ctx = context.WithValue(ctx, lookupsKey{}, filterLookups{ipf: ipf, cost: cost})
+	}
+	for _, m := range path.Matchers {
+		if rs.Any() {
 			break
 		}
+		for _, clientIP := range clientIPs {
+			matched, err := m.Match(ctx, clientIP, r)
+			if err != nil {
+				if lookupErr == nil {
+					lookupErr = err
+				}
+				continue
+			}
+			if matched {
+				rs.matcherMatch = true
+				break
+			}
+		}
 	}
 
-	// no scope match, pass-through.
-	return allow, scopeMatched, nil
+	if rs.Any() {
+		return true, countries.country, nil
+	}
+	return false, countries.country, lookupErr
 }
 
-func (ipf IPFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	allow := true
-	matchedPath := ""
-	blockPage := ""
+// matchAll returns true if one of the client IPs matches the path's countries, its ranges or feeds, and every
+// one of its matchers, the conditions the path doesn't have are left out. The country is the one of the IP
+// that matched, or of the last one looked up, a failed lookup is only returned if nothing matched.
+func (ipf IPFilter) matchAll(path IPPath, clientIPs []net.IP, r *http.Request, cost *requestCost) (bool, string, error) {
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	if len(path.Matchers) != 0 {
+		ctx = context.WithValue(ctx, lookupsKey{}, filterLookups{ipf: ipf, cost: cost})
+	}
 
-	// Loop over all IPPaths in the config
-	for _, path := range ipf.Config.Paths {
-		pathAllow, pathMathedPath, err := ipf.ShouldAllow(path, r)
+	countries := countryMatcher{ipf: ipf, path: path, cost: cost}
+	var lookupErr error
+	for _, clientIP := range clientIPs {
+		matched, err := ipf.matchesAll(ctx, path, &countries, clientIP, r, cost)
 		if err != nil {
+			if lookupErr == nil {
+				lookupErr = err
+			}
+			continue
+		}
+		if matched {
+			return true, countries.country, nil
+		}
+	}
+	return false, countries.country, lookupErr
+}
+
+// matchesAll returns true if 'ip' matches every kind of condition of 'path', see matchAll.
+func (ipf IPFilter) matchesAll(ctx context.Context, path IPPath, countries *countryMatcher, ip net.IP, r *http.Request, cost *requestCost) (bool, error) {
+	if len(path.CountryCodes) != 0 {
+		if matched, err := countries.Match(ctx, ip, r); err != nil || !matched {
+			return false, err
+		}
+	}
+
+	if path.hasRanges() || len(path.Feeds) != 0 || len(path.Hostnames) != 0 {
+		start := cost.now()
+		inRange, _ := path.ranges().Match(ctx, ip, r)
+		cost.track(CostRangeMatch, start)
+		if !inRange && !ipf.Config.Feeds.contains(path.Feeds, []net.IP{ip}) &&
+			!ipf.Config.Hostnames.contains(path.Hostnames, []net.IP{ip}) {
+			return false, nil
+		}
+	}
+
+	for _, m := range path.Matchers {
+		if matched, err := m.Match(ctx, ip, r); err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// exceptedASN returns true if 'ip' belongs to one of the ExceptASNs of 'path'.
+func (ipf IPFilter) exceptedASN(path IPPath, ip net.IP, cost *requestCost) (bool, error) {
+	clientASN, err := ipf.lookupASN(ip, cost)
+	if err != nil {
+		return false, err
+	}
+
+	for _, asn := range path.ExceptASNs {
+		if clientASN == asn {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lookupASN returns the autonomous system number of 'ip', 0 if it is unknown.
+func (ipf IPFilter) lookupASN(ip net.IP, cost *requestCost) (uint, error) {
+	start := cost.now()
+	_, asn, err := ipf.Config.asnLayout.lookup(ipf.Config.ASNHandler, ip)
+	cost.track(CostDBLookup, start)
+	return asn, err
+}
+
+// lookupCountry returns the country's ISO code of 'ip', using the GeoCache if we have one.
+func (ipf IPFilter) lookupCountry(ip net.IP, cost *requestCost) (string, error) {
+	if ipf.Config.GeoCache != nil {
+		start := cost.now()
+		country, ok := ipf.Config.GeoCache.Get(ip)
+		cost.track(CostCache, start)
+		if ok {
+			counters.CacheHits.Add(1)
+			return country, nil
+		}
+		counters.CacheMisses.Add(1)
+	}
+
+	var country string
+	var err error
+	ws := ipf.Config.GeoWebService
+	if ws != nil && ws.stale(ipf.Config.dbBuilt()) {
+		// the database is out of date, it only answers when the web service can't.
+		if country, err = ipf.lookupWebCountry(ip, cost); err != nil {
+			log.Printf("[ERROR] %v, falling back to the database", err)
+			country, err = ipf.lookupDBCountry(ip, cost)
+		}
+	} else {
+		if ipf.Config.DBHandler != nil || ipf.Config.CountryDB != nil {
+			country, err = ipf.lookupDBCountry(ip, cost)
+		}
+		if err == nil && country == "" && ws != nil {
+			country, err = ipf.lookupWebCountry(ip, cost)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if ipf.Config.GeoCache != nil {
+		ipf.Config.GeoCache.Add(ip, country)
+	}
+	return country, nil
+}
+
+// lookupDBCountry returns the country's ISO code of 'ip' in the database.
+func (ipf IPFilter) lookupDBCountry(ip net.IP, cost *requestCost) (string, error) {
+	var country string
+	var err error
+	start := cost.now()
+	if ipf.Config.CountryDB != nil {
+		country, err = ipf.Config.CountryDB.Country(ip)
+	} else {
+		country, _, err = ipf.Config.dbLayout.lookup(ipf.Config.DBHandler, ip)
+	}
+	cost.track(CostDBLookup, start)
+	counters.Lookups.Add(1)
+	if err != nil {
+		counters.LookupErrors.Add(1)
+		return "", err
+	}
+	return country, nil
+}
+
+// lookupWebCountry returns the country's ISO code of 'ip' from the GeoWebService.
+func (ipf IPFilter) lookupWebCountry(ip net.IP, cost *requestCost) (string, error) {
+	start := cost.now()
+	country, err := ipf.Config.GeoWebService.Country(ip)
+	cost.track(CostRemote, start)
+	if err != nil {
+		counters.LookupErrors.Add(1)
+	}
+	return country, err
+}
+
+// deny blocks the request, 'rule' is the 1-based position of the ipfilter block that denied it, BanRule or DefaultRule.
+func (ipf IPFilter) deny(w http.ResponseWriter, r *http.Request, path IPPath, rule int) (int, error) {
+	ipf.Config.Threat.recordBlock()
+	counters.Blocked.Add(1)
+
+	if ipf.Config.SupportKey == nil && ipf.Config.Webhook == nil && ipf.Config.Alerts == nil && !ipf.logsDecisions() {
+		return block(path.BlockPage, nil, &w)
+	}
+
+	var clientIP net.IP
+	if clientIPs, err := ipf.clientIPs(r, path.Strict); err == nil {
+		clientIP = clientIPs[0]
+	}
+	if ipf.Config.Webhook != nil || ipf.Config.Alerts != nil || ipf.logsDecisions() {
+		d := ipf.decision(r, path, rule, ActionBlock, clientIP)
+		ipf.logDecision(r, d)
+		event := d.blockEvent()
+		ipf.Config.Webhook.send(event)
+		ipf.Config.Alerts.record(event)
+	}
+	if ipf.Config.SupportKey == nil {
+		return block(path.BlockPage, nil, &w)
+	}
+	code := NewSupportCode(ipf.Config.SupportKey, clientIP, time.Now(), rule)
+	log.Printf("[INFO] ipfilter: blocked %s requesting %s by rule %d, support code: %s", clientIP, r.URL.Path, rule, code)
+
+	return block(path.BlockPage, map[string]string{"{support_code}": code}, &w)
+}
+
+// isBanned returns true if any of the client IPs has been banned at runtime.
+func (ipf IPFilter) isBanned(r *http.Request, strict bool) bool {
+	clientIPs, err := ipf.clientIPs(r, strict)
+	if err != nil {
+		return false
+	}
+
+	for _, clientIP := range clientIPs {
+		if ipf.Config.Bans.IsBanned(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ipf IPFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	// use the latest config, it might have been swapped through the admin endpoint.
+	if ipf.live != nil {
+		ipf.Config = *ipf.live.Load()
+	}
+
+	if admin := ipf.Config.Admin; admin != nil && pathMatches(r.URL.Path, admin.Path) {
+		return ipf.serveAdmin(w, r)
+	}
+	// everyone but the allowlist is blocked during a maintenance, whatever the rules.
+	if ipf.blocksMaintenance(r) {
+		ipf.setDebugHeader(w, ActionBlock, 0, reasonMaintenance)
+		return ipf.serveMaintenancePage(w)
+	}
+	if ipf.Config.PassCookie != nil && r.URL.Path == ChallengePath {
+		return ipf.serveChallenge(w, r)
+	}
+
+	var cost *requestCost
+	if ipf.Config.Costs != nil {
+		cost = newRequestCost()
+		defer cost.done(ipf.Config.Costs)
+	}
+
+	// configs that didn't go through ipfilterParse have no trie yet.
+	scopes := ipf.Config.scopes
+	if scopes == nil {
+		scopes = newScopeTrie(ipf.Config.Paths, ipf.Config.MatchMode)
+	}
+
+	// find the IPPath with the most specific scope.
+	idx, _ := scopes.at(ipf.Config.Threat.Level()).matchIf(r.URL.Path, func(i int) bool {
+		return ipf.Config.Paths[i].appliesTo(r)
+	})
+	// excluded paths pass through, the less specific blocks and the default don't apply either.
+	excluded := idx >= 0 && ipf.Config.Paths[idx].excludes(r.URL.Path)
+	if excluded {
+		idx = -1
+	}
+
+	// a 'rule allow' block letting the client in wins over the block of the scope.
+	if idx >= 0 && ipf.Config.MatchMode == MatchAllowOverrides && ipf.Config.Paths[idx].IsBlock {
+		applies := func(i int) bool { return ipf.Config.Paths[i].appliesTo(r) }
+		allows := func(path IPPath) bool {
+			allow, err := ipf.evaluate(path, r, cost)
+			return err == nil && allow
+		}
+		if i := ipf.allowOverride(r.URL.Path, ipf.Config.Threat.Level(), applies, allows); i >= 0 {
+			idx = i
+		}
+	}
+
+	// the headers are ignored in strict blocks and from untrusted clients.
+	if ipf.Config.RejectMalformedXFF && (idx < 0 || !ipf.Config.Paths[idx].Strict) && ipf.Config.trustsProxy(r) {
+		if status, err := checkForwarded(r, ipf.Config.ClientIPHeaders); status != 0 {
+			return status, err
+		}
+	}
+
+	// banned clients are blocked on every path.
+	if ipf.Config.Bans != nil {
+		var path IPPath
+		if idx >= 0 {
+			path = ipf.Config.Paths[idx]
+		}
+		if ipf.isBanned(r, path.Strict) {
+			ipf.setDebugHeader(w, ActionBlock, BanRule, reasonBan)
+			return ipf.deny(w, r, path, BanRule)
+		}
+	}
+
+	// the clients going over the request rate of the block get banned.
+	if idx >= 0 && ipf.Config.Paths[idx].AutoBan != nil {
+		path := ipf.Config.Paths[idx]
+		if clientIPs, err := ipf.clientIPs(r, path.Strict); err == nil && path.AutoBan.record(clientIPs[0], ipf.Config.Bans, path.id) {
+			ipf.setDebugHeader(w, ActionBlock, BanRule, reasonAutoBan)
+			return ipf.deny(w, r, path, BanRule)
+		}
+	}
+
+	// no scope match, the default action applies, pass-through unless 'default block'.
+	if idx < 0 {
+		if !excluded && !ipf.evaluateDefault(r) {
+			ipf.setDebugHeader(w, ActionBlock, DefaultRule, "")
+			return ipf.deny(w, r, IPPath{}, DefaultRule)
+		}
+		ipf.setDebugHeader(w, ActionAllow, 0, "")
+		return ipf.next(w, r, false, cost)
+	}
+
+	// the reason of the debug header, the conditions that matched unless something else decided.
+	var reason string
+	path := ipf.Config.Paths[idx]
+	allow, err := ipf.evaluate(path, r, cost)
+	if err != nil {
+		counters.RuleErrors.Add(1)
+		if ipf.Config.OnError == "" || ipf.Config.OnError == OnError500 {
 			return http.StatusInternalServerError, err
 		}
+		log.Printf("[ERROR] %v, on_error %s applies", err, ipf.Config.OnError)
+		allow = ipf.Config.OnError == ActionAllow
+		reason = reasonError
+	}
 
-		if len(pathMathedPath) >= len(matchedPath) {
-			allow = pathAllow
-			matchedPath = pathMathedPath
-			blockPage = path.BlockPage
+	if ipf.Config.DecisionHook != nil {
+		action := ipf.hookDecision(r, path, idx, allow, cost)
+		if (action == ActionAllow) != allow || action == ActionChallenge {
+			reason = reasonDecisionHook
+		}
+		allow = action == ActionAllow
+		// the challenge of the block, or the js one.
+		if action == ActionChallenge && path.Challenge == "" {
+			path.Challenge = ChallengeJS
 		}
 	}
 
+	// the 1-based position of the block.
+	rule := idx + 1
 	if !allow {
-		return block(blockPage, &w)
+		// the approved clients go through, whatever the rules.
+		if !ipf.passed(w, r, path) {
+			// the clients out of the sample of the block go through, the denial is only logged.
+			if !ipf.enforced(path, r) {
+				ipf.debugDecision(w, r, path, rule, ActionLogOnly, reason)
+				ipf.logOnly(r, path, rule)
+				return ipf.next(w, r, path.Strict, cost)
+			}
+			if path.Challenge != "" {
+				ipf.debugDecision(w, r, path, rule, ActionChallenge, reason)
+				return ipf.challenge(w, r, path, rule)
+			}
+			ipf.debugDecision(w, r, path, rule, ActionBlock, reason)
+			return ipf.deny(w, r, path, rule)
+		}
+		reason = reasonPassCookie
+	}
+	ipf.debugDecision(w, r, path, rule, ActionAllow, reason)
+	ipf.logRequestDecision(r, path, rule, ActionAllow)
+	return ipf.next(w, r, path.Strict, cost)
+}
+
+// ParseASN parses an autonomous system number, with or without the 'AS' prefix.
+func ParseASN(asn string) (uint, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+	if err != nil || n == 0 {
+		return 0, errors.New("ipfilter: Can't parse ASN: " + asn)
 	}
-	return ipf.Next.ServeHTTP(w, r)
+	return uint(n), nil
+}
+
+// Keywords of 'ip' standing for a set of networks.
+const (
+	IPPrivate = "private" // the private, loopback and link-local networks.
+	IPBogon   = "bogon"   // the networks no public client can come from: reserved, documentation, special-use...
+)
+
+// ipKeywords are the networks of the keywords of 'ip'.
+var ipKeywords = map[string][]string{
+	IPPrivate: {
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16",
+		"::1/128", "fc00::/7", "fe80::/10",
+	},
+	// RFC 6890 and the IANA special-purpose registries, without the IPv4-mapped addresses of the IPv4 clients.
+	IPBogon: {
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+		"224.0.0.0/4", "240.0.0.0/4",
+		"::/96", "100::/64", "2001:10::/28", "2001:db8::/32", "3ffe::/16", "fc00::/7", "fe80::/10", "fec0::/10", "ff00::/8",
+	},
+}
+
+// parseIPEntries parses the values of 'ip', the ranges of the entries starting with '!' are returned apart,
+// they are carved out of the others by subtractRanges. The hostnames are returned apart too, see HostnameLists.
+func parseIPEntries(ips []string) ([]Range, []Range, []string, error) {
+	var ranges, negated []Range
+	var hostnames []string
+	for _, ip := range ips {
+		entry := strings.TrimPrefix(ip, "!")
+		if isHostname(entry) {
+			if entry != ip {
+				return nil, nil, nil, errors.New("Hostnames can't be negated: " + ip)
+			}
+			name, err := parseHostname(entry)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			hostnames = append(hostnames, name)
+			continue
+		}
+		ipRanges, err := parseIPs(entry)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if entry != ip {
+			negated = append(negated, ipRanges...)
+		} else {
+			ranges = append(ranges, ipRanges...)
+		}
+	}
+	return ranges, negated, hostnames, nil
+}
+
+// subtractRanges returns the addresses of 'ranges' that aren't in 'negated'.
+func subtractRanges(ranges, negated []Range) []Range {
+	one := uint128{0, 1}
+	for _, neg := range negated {
+		negStart, _ := toUint128(neg.start)
+		negEnd, _ := toUint128(neg.end)
+
+		kept := make([]Range, 0, len(ranges))
+		for _, rng := range ranges {
+			start, _ := toUint128(rng.start)
+			end, _ := toUint128(rng.end)
+			if end.less(negStart) || negEnd.less(start) {
+				kept = append(kept, rng)
+				continue
+			}
+			// the parts of the range before and after the negated one.
+			if start.less(negStart) {
+				kept = append(kept, Range{rng.start, negStart.sub(one).ip()})
+			}
+			if negEnd.less(end) {
+				kept = append(kept, Range{negEnd.add(one).ip(), rng.end})
+			}
+		}
+		ranges = kept
+	}
+	return ranges
+}
+
+// parseIPs parses a value of 'ip', an IP range, a CIDR or one of the ipKeywords.
+func parseIPs(ip string) ([]Range, error) {
+	if strings.Contains(ip, "/") {
+		_, network, err := net.ParseCIDR(ip)
+		if err != nil {
+			return nil, errors.New("Can't parse CIDR: " + ip)
+		}
+		return []Range{networkRange(network)}, nil
+	}
+
+	cidrs, ok := ipKeywords[ip]
+	if !ok {
+		ipRange, err := parseIP(ip)
+		return []Range{ipRange}, err
+	}
+
+	ranges := make([]Range, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, networkRange(network))
+	}
+	return ranges, nil
+}
+
+// networkRange returns the Range of the addresses of 'network'.
+func networkRange(network *net.IPNet) Range {
+	end := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		end[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return Range{normalizeIP(network.IP), normalizeIP(end)}
 }
 
 // parseIP parses a string to an IP range.
 func parseIP(ip string) (Range, error) {
+	// IPv6 addresses are only accepted in full, e.g. 2001:db8::1 or 2001:db8::-2001:db8::ff.
+	if strings.Contains(ip, ":") {
+		bounds := strings.SplitN(ip, "-", 2)
+		start := net.ParseIP(bounds[0])
+		end := start
+		if len(bounds) == 2 {
+			end = net.ParseIP(bounds[1])
+		}
+		if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+			return Range{start, end}, errors.New("Can't parse IPv6 address")
+		}
+		return Range{start, end}, nil
+	}
+
 	// check if the ip isn't complete;
 	// e.g. 192.168 -> Range{"192.168.0.0", "192.168.255.255"}
 	dotSplit := strings.Split(ip, ".")
@@ -277,10 +1055,16 @@ func parseIP(ip string) (Range, error) {
 			return Range{start, start}, errors.New("Can't parse IPv4 address")
 		}
 
+		// the end of the range is either a complete IP e.g. 1.1.1.1-1.1.2.255, or the last field only e.g. 1.1.1.1-10;
 		// split the start of the range on "." and switch the last field with splitted[1], e.g 1.1.1.1 -> 1.1.1.10
-		fields := strings.Split(start.String(), ".")
-		fields[3] = splitted[1]
-		end := net.ParseIP(strings.Join(fields, "."))
+		var end net.IP
+		if strings.Contains(splitted[1], ".") {
+			end = net.ParseIP(splitted[1])
+		} else {
+			fields := strings.Split(start.String(), ".")
+			fields[3] = splitted[1]
+			end = net.ParseIP(strings.Join(fields, "."))
+		}
 
 		// parse the end range.
 		if end.To4() == nil {
@@ -300,124 +1084,6 @@ func parseIP(ip string) (Range, error) {
 	return Range{parsedIP, parsedIP}, nil
 }
 
-// ipfilterParseSingle parses a single ipfilter {} block from the caddy config.
-func ipfilterParseSingle(config *IPFConfig, c *caddy.Controller) (IPPath, error) {
-	var cPath IPPath
-
-	// Get PathScopes
-	cPath.PathScopes = c.RemainingArgs()
-	if len(cPath.PathScopes) == 0 {
-		return cPath, c.ArgErr()
-	}
-
-	// Sort PathScopes by length (the longest is always the most specific so should be tested first)
-	sort.Sort(sort.Reverse(ByLength(cPath.PathScopes)))
-
-	for c.NextBlock() {
-		value := c.Val()
-
-		switch value {
-		case "rule":
-			if !c.NextArg() {
-				return cPath, c.ArgErr()
-			}
-
-			rule := c.Val()
-			if rule == "block" {
-				cPath.IsBlock = true
-			} else if rule != "allow" {
-				return cPath, c.Err("ipfilter: Rule should be 'block' or 'allow'")
-			}
-		case "database":
-			if !c.NextArg() {
-				return cPath, c.ArgErr()
-			}
-			// Check if a database has already been opened
-			if config.DBHandler != nil {
-				return cPath, c.Err("ipfilter: A database is already opened")
-			}
-
-			database := c.Val()
-
-			// Open the database.
-			var err error
-			config.DBHandler, err = maxminddb.Open(database)
-			if err != nil {
-				return cPath, c.Err("ipfilter: Can't open database: " + database)
-			}
-		case "blockpage":
-			if !c.NextArg() {
-				return cPath, c.ArgErr()
-			}
-
-			// check if blockpage exists.
-			blockpage := c.Val()
-			if _, err := os.Stat(blockpage); os.IsNotExist(err) {
-				return cPath, c.Err("ipfilter: No such file: " + blockpage)
-			}
-			cPath.BlockPage = blockpage
-		case "country":
-			cPath.CountryCodes = c.RemainingArgs()
-			if len(cPath.CountryCodes) == 0 {
-				return cPath, c.ArgErr()
-			}
-		case "ip":
-			ips := c.RemainingArgs()
-			if len(ips) == 0 {
-				return cPath, c.ArgErr()
-			}
-
-			for _, ip := range ips {
-				ipRange, err := parseIP(ip)
-				if err != nil {
-					return cPath, c.Err("ipfilter: " + err.Error())
-				}
-
-				cPath.Ranges = append(cPath.Ranges, ipRange)
-			}
-		case "strict":
-			cPath.Strict = true
-		}
-	}
-
-	return cPath, nil
-}
-
-// ipfilterParse parses all ipfilter {} blocks to an IPFConfig
-func ipfilterParse(c *caddy.Controller) (IPFConfig, error) {
-	var config IPFConfig
-
-	var hasCountryCodes, hasRanges bool
-
-	for c.Next() {
-		path, err := ipfilterParseSingle(&config, c)
-		if err != nil {
-			return config, err
-		}
-
-		if len(path.CountryCodes) != 0 {
-			hasCountryCodes = true
-		}
-		if len(path.Ranges) != 0 {
-			hasRanges = true
-		}
-
-		config.Paths = append(config.Paths, path)
-	}
-
-	// having a database is mandatory if you are blocking by country codes.
-	if hasCountryCodes && config.DBHandler == nil {
-		return config, c.Err("ipfilter: Database is required to block/allow by country")
-	}
-
-	// needs atleast one of the three.
-	if !hasCountryCodes && !hasRanges {
-		return config, c.Err("ipfilter: No IPs or Country codes has been provided")
-	}
-
-	return config, nil
-}
-
 // ByLength sorts strings by length and alphabetically (if same length)
 type ByLength []string
 
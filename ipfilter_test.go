@@ -2,12 +2,14 @@ package ipfilter
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
@@ -825,6 +827,17 @@ func TestIpfilterParseSingle(t *testing.T) {
 			},
 		}, &maxminddb.Reader{},
 		},
+		{`/ {
+			rule allow
+			ip 10.0.0.1-10.0.1.255
+			}`, false, IPPath{
+			PathScopes: []string{"/"},
+			IsBlock:    false,
+			Ranges: []Range{
+				{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.1.255")},
+			},
+		}, nil,
+		},
 		{`/ {
 			rule allow
 			ip 11.
@@ -849,12 +862,41 @@ func TestIpfilterParseSingle(t *testing.T) {
 			IsBlock:    false,
 		}, nil,
 		},
+		{`/ {
+			rule allow_only
+			ip 10.0.0.1
+			}`, false, IPPath{
+			PathScopes: []string{"/"},
+			IsBlock:    false,
+			Ranges: []Range{
+				{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1")},
+			},
+		}, nil,
+		},
+		{`/ {
+			rule block_all_except
+			ip 10.0.0.1
+			}`, false, IPPath{
+			PathScopes: []string{"/"},
+			IsBlock:    false,
+			Ranges: []Range{
+				{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1")},
+			},
+		}, nil,
+		},
+		{`/ {
+			rule block_only
+			ip 10.0.0.1
+			}`, true, IPPath{
+			PathScopes: []string{"/"},
+		}, nil,
+		},
 	}
 
 	for i, test := range tests {
 		c := caddy.NewTestController("http", test.inputIpfilterConfig)
 
-		actualConfig := IPFConfig{[]IPPath{test.expectedPath}, nil}
+		actualConfig := IPFConfig{Paths: []IPPath{test.expectedPath}}
 
 		actualPath, err := ipfilterParseSingle(&actualConfig, c)
 
@@ -1101,6 +1143,436 @@ func TestMultipleIpFilters(t *testing.T) {
 	}
 }
 
+func TestFamily(t *testing.T) {
+	tests := []struct {
+		input          string
+		shouldErr      bool
+		reqIP          string
+		fwdFor         string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule block\nfamily ipv6\n}", false, "[2001:db8::1]:_", "", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfamily ipv6\n}", false, "8.8.8.8:_", "", http.StatusOK},
+		{"ipfilter / {\nrule block\nfamily ipv6\n}", false, "10.0.0.1:_", "8.8.8.8, 2001:db8::1", http.StatusForbidden},
+		{"ipfilter / {\nrule allow\nfamily ipv4\nip 8.8.8.8\n}", false, "8.8.8.8:_", "", http.StatusOK},
+		{"ipfilter / {\nrule allow\nfamily ipv4\nip 8.8.8.8\n}", false, "1.1.1.1:_", "", http.StatusForbidden},
+		{"ipfilter / {\nrule allow\nfamily ipv4\nip 8.8.8.8\n}", false, "[2001:db8::1]:_", "", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfamily ipv4\ndatabase " + DataBase + "\ncountry US\n}", false, "8.8.8.8:_", "", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nfamily ipv4\ndatabase " + DataBase + "\ncountry US\n}", false, "24.53.192.20:_", "", http.StatusOK},
+		{"ipfilter / {\nrule block\nfamily ipv4\ndatabase " + DataBase + "\ncountry US\n}", false, "[2001:db8::1]:_", "", http.StatusOK},
+		{"ipfilter / {\nrule block\nfamily ipv5\n}", true, "", "", 0},
+		{"ipfilter / {\nrule block\nfamily\n}", true, "", "", 0},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", test.fwdFor)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestIPv4Mapped(t *testing.T) {
+	tests := []struct {
+		input          string
+		reqIP          string
+		fwdFor         string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule block\nip 1.1.1.1\n}", "[::ffff:1.1.1.1]:_", "", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\n}", "8.8.8.8:_", "::ffff:1.1.1.1", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip ::ffff:1.1.1.1\n}", "1.1.1.1:_", "", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip 1.1.1.0-1.1.1.10\n}", "[::ffff:1.1.1.5]:_", "", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip 1.1.1.0-1.1.1.10\n}", "[::ffff:1.1.1.11]:_", "", http.StatusOK},
+		{"ipfilter / {\nrule block\nfamily ipv6\n}", "[::ffff:1.1.1.1]:_", "", http.StatusOK},
+		{"ipfilter / {\nrule block\ndatabase " + DataBase + "\ncountry US\n}", "[::ffff:8.8.8.8]:_", "", http.StatusForbidden},
+		{"ipfilter / {\nrule block\ndatabase " + DataBase + "\ncountry US\n}", "[::ffff:24.53.192.20]:_", "", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", test.fwdFor)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	// 4-byte IPs match the ranges too.
+	rng, _ := parseIP("1.1.1.0-1.1.1.10")
+	for _, ip := range []net.IP{net.ParseIP("1.1.1.5").To4(), net.ParseIP("::ffff:1.1.1.5"), net.IPv4(1, 1, 1, 5)} {
+		if !rng.InRange(&ip) {
+			t.Fatalf("Expected %v (%d bytes) to be in %s", ip, len(ip), rng)
+		}
+	}
+}
+
+func TestNoClientIP(t *testing.T) {
+	tests := []struct {
+		config         string
+		reqIP          string
+		fwdFor         string
+		expectedStatus int
+		shouldErr      bool
+	}{
+		// 1.1.1.1 and 2001:db8::1 are blocked.
+		{"", "1.1.1.1", "", http.StatusForbidden, false},
+		{"", "[2001:db8::1]", "", http.StatusForbidden, false},
+		{"", "8.8.8.8", "", http.StatusOK, false},
+		{"trusted_proxies 10.0.0.0/8", "10.0.0.1", "1.1.1.1", http.StatusForbidden, false},
+		{"", "@", "", http.StatusInternalServerError, true},
+		{"", "/run/caddy.sock", "", http.StatusInternalServerError, true},
+		{"no_client_ip allow", "@", "", http.StatusOK, false},
+		{"no_client_ip block", "@", "", http.StatusForbidden, false},
+		// the headers still apply.
+		{"no_client_ip allow", "@", "1.1.1.1", http.StatusForbidden, false},
+	}
+
+	for i, test := range tests {
+		input := "ipfilter / {\nrule block\nip 1.1.1.1\n" + test.config + "\n}\nipfilter /v6 {\nrule block\nfamily ipv6\n}"
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		path := "/"
+		if test.reqIP[0] == '[' {
+			path = "/v6"
+		}
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", test.fwdFor)
+		}
+
+		status, err := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus || (err != nil) != test.shouldErr {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d' (%v)", i, test.expectedStatus, status, err)
+		}
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 1.1.1.1\nno_client_ip maybe\n}")); err == nil {
+		t.Fatal("Expected an error for an unknown decision")
+	}
+}
+
+// failingCountryDB is a CountryDB whose lookups fail.
+type failingCountryDB struct{}
+
+func (failingCountryDB) Country(ip net.IP) (string, error) { return "", errors.New("corrupt database") }
+func (failingCountryDB) Built() time.Time                  { return time.Time{} }
+func (failingCountryDB) Close() error                      { return nil }
+
+func TestOnError(t *testing.T) {
+	tests := []struct {
+		onError        string
+		reqIP          string
+		expectedStatus int
+		shouldErr      bool
+	}{
+		{"", "8.8.8.8:_", http.StatusInternalServerError, true},
+		{"on_error 500", "8.8.8.8:_", http.StatusInternalServerError, true},
+		{"on_error allow", "8.8.8.8:_", http.StatusOK, false},
+		{"on_error block", "8.8.8.8:_", http.StatusForbidden, false},
+		// the requests without a client IP fail too.
+		{"on_error allow", "@", http.StatusOK, false},
+		{"on_error block", "@", http.StatusForbidden, false},
+		// the other conditions don't need the database.
+		{"on_error allow", "1.1.1.1:_", http.StatusForbidden, false},
+	}
+
+	for i, test := range tests {
+		input := "ipfilter / {\nrule block\nip 1.1.1.1\ndatabase " + DataBase + "\ncountry RU\n" + test.onError + "\n}"
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		config.DBHandler.Close()
+		config.DBHandler, config.CountryDB = nil, failingCountryDB{}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		before := counters.RuleErrors.Value()
+		status, err := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus || (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: Expected StatusCode: '%d', Got: '%d' (%v)", i, test.expectedStatus, status, err)
+		}
+		if counted := counters.RuleErrors.Value() - before; counted != 1 && test.reqIP != "1.1.1.1:_" {
+			t.Errorf("Test %d: Expected the error to be counted, Got: %d", i, counted)
+		}
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 1.1.1.1\non_error 503\n}")); err == nil {
+		t.Fatal("Expected an error for an unknown decision")
+	}
+}
+
+func TestIPKeywords(t *testing.T) {
+	tests := []struct {
+		input          string
+		shouldErr      bool
+		reqIP          string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule allow\nip private\n}", false, "10.1.2.3:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "172.31.0.1:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "172.32.0.1:_", http.StatusForbidden},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "192.168.1.1:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "127.0.0.1:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "169.254.169.254:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "[::1]:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "[fd00::1]:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "[fe80::1]:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "[2001:db8::1]:_", http.StatusForbidden},
+		{"ipfilter / {\nrule allow\nip private\n}", false, "8.8.8.8:_", http.StatusForbidden},
+		{"ipfilter / {\nrule allow\nip private 8.8.8.8\n}", false, "8.8.8.8:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "0.1.2.3:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "100.64.0.1:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "192.0.2.1:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "198.19.255.255:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "203.0.113.5:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "224.0.0.1:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "255.255.255.255:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "[::]:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "[2001:db8::1]:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "[ff02::1]:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "8.8.8.8:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "100.128.0.1:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "[::ffff:8.8.8.8]:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip bogon\n}", false, "[2606:4700::1111]:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip 2001:db8::1-2001:db8::ff\n}", false, "[2001:db8::10]:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip 2001:db8::1-2001:db8::ff\n}", false, "[2001:db8::100]:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip 2001:db8::ff-2001:db8::1\n}", true, "", 0},
+		{"ipfilter / {\nrule block\nip 2001:db8::1-10\n}", true, "", 0},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		// the expanded ranges can be read back.
+		if _, err := RulesFromPaths(config.Paths).ToPaths(false, false); err != nil {
+			t.Fatalf("Test %d: Can't read the rules back: %v", i, err)
+		}
+
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestNegatedIPs(t *testing.T) {
+	tests := []struct {
+		input          string
+		shouldErr      bool
+		reqIP          string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule block\nip 10.0.0.0/8 !10.0.5.0/24\n}", false, "10.0.4.255:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip 10.0.0.0/8 !10.0.5.0/24\n}", false, "10.0.5.1:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip 10.0.0.0/8 !10.0.5.0/24\n}", false, "10.0.6.0:_", http.StatusForbidden},
+		// the negated entries win whatever their order.
+		{"ipfilter / {\nrule block\nip !10.0.5.0/24\nip 10.0.0.0/8\n}", false, "10.0.5.1:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private !192.168.1.10 !10\n}", false, "192.168.1.10:_", http.StatusForbidden},
+		{"ipfilter / {\nrule allow\nip private !192.168.1.10 !10\n}", false, "192.168.1.11:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip private !192.168.1.10 !10\n}", false, "10.1.1.1:_", http.StatusForbidden},
+		{"ipfilter / {\nrule allow\nip private !192.168.1.10 !10\n}", false, "172.16.0.1:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip 2001:db8::/32 !2001:db8::1\n}", false, "[2001:db8::1]:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip 2001:db8::/32 !2001:db8::1\n}", false, "[2001:db8::2]:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip_list testdata/firehol.netset\nip !5.188.10.7\n}", false, "5.188.10.7:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip_list testdata/firehol.netset\nip !5.188.10.7\n}", false, "5.188.10.8:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip !10.0.5.0/24\n}", true, "", 0},
+		{"ipfilter / {\nrule block\nip 10.0.0.0/8 !10.0.5.0/33\n}", true, "", 0},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	rs := RuleSet{Paths: []Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"10.0.0.0/8", "!10.0.5.0/24"}}}}
+	paths, err := rs.ToPaths(false, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ips := RulesFromPaths(paths).Paths[0].IPs; !reflect.DeepEqual(ips, []string{"10.0.0.0-10.0.4.255", "10.0.6.0-10.255.255.255"}) {
+		t.Fatalf("Expected the carved ranges, Got: %v", ips)
+	}
+	rs.Paths[0].IPs = []string{"!10.0.5.0/24"}
+	if _, err := rs.ToPaths(false, false); err == nil {
+		t.Fatal("Expected an error for negated entries alone")
+	}
+}
+
+func TestAllowLoopback(t *testing.T) {
+	tests := []struct {
+		config         string
+		reqIP          string
+		fwdFor         string
+		expectedStatus int
+	}{
+		// only CA is allowed.
+		{"", "127.0.0.1:_", "", http.StatusForbidden},
+		{"allow_loopback", "127.0.0.1:_", "", http.StatusOK},
+		{"allow_loopback", "[::1]:_", "", http.StatusOK},
+		{"allow_loopback", "127.0.0.1:_", "127.0.0.1", http.StatusOK},
+		{"allow_loopback", "24.53.192.20:_", "", http.StatusOK},
+		{"allow_loopback", "8.8.8.8:_", "", http.StatusForbidden},
+		// behind a local reverse proxy, the clients are the ones of the header.
+		{"allow_loopback", "127.0.0.1:_", "8.8.8.8", http.StatusForbidden},
+		{"allow_loopback", "8.8.8.8:_", "127.0.0.1", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		input := "ipfilter / {\nrule allow\ndatabase " + DataBase + "\ncountry CA\n" + test.config + "\n}"
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", test.fwdFor)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+
+		if test.config != "" && test.fwdFor == "" {
+			host, _, _ := net.SplitHostPort(test.reqIP)
+			expected := ActionBlock
+			if test.expectedStatus == http.StatusOK {
+				expected = ActionAllow
+			}
+			if d := ipf.Decide(net.ParseIP(host), "/"); d.Action != expected {
+				t.Fatalf("Test %d: Expected Decide to %s, Got: %+v", i, expected, d)
+			}
+		}
+	}
+}
+
 // helps printRanges for the Ranges tests
 func prettyPrintRanges(ranges []Range) string {
 	buf := new(bytes.Buffer)
@@ -0,0 +1,77 @@
+package ipfilter
+
+import (
+	"hash/fnv"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// jsChallengeTTL is how long a client has to answer the JS challenge.
+const jsChallengeTTL = 5 * time.Minute
+
+// jsChallengePage computes the answer to the nonce and sends it right away, only the clients running
+// JavaScript get through.
+var jsChallengePage = template.Must(template.New("js").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Checking your browser</title>
+</head>
+<body>
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="challenge" value="js">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<input type="hidden" name="answer" value="">
+</form>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<script>
+(function() {
+	var nonce = {{.Nonce}}, h = 0x811c9dc5;
+	for (var i = 0; i < nonce.length; i++) {
+		h = Math.imul(h ^ nonce.charCodeAt(i), 0x01000193) >>> 0;
+	}
+	var form = document.forms[0];
+	form.elements.answer.value = h.toString(16);
+	form.submit();
+})();
+</script>
+</body>
+</html>
+`))
+
+// jsChallengeAnswer returns the answer to 'nonce': the FNV-1a hash the page computes.
+func jsChallengeAnswer(nonce string) string {
+	h := fnv.New32a()
+	h.Write([]byte(nonce))
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
+
+// serveJSChallenge writes the page of the JS challenge, its nonce is bound to 'ip' and signed with the key
+// of 'pc' so that no state is kept until the client answers.
+func serveJSChallenge(w http.ResponseWriter, r *http.Request, pc *PassCookie, ip net.IP) (int, error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	err := jsChallengePage.Execute(w, struct {
+		Action, Redirect, Nonce string
+	}{ChallengePath, r.URL.RequestURI(), newSignedToken(pc.Key, "challenge", ip, time.Now().Add(jsChallengeTTL))})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// we wrote the page, return OK.
+	return http.StatusOK, nil
+}
+
+// verifyJSChallenge returns true if 'form' answers a nonce given to 'ip' that hasn't expired.
+func verifyJSChallenge(pc *PassCookie, form url.Values, ip net.IP, now time.Time) bool {
+	nonce := form.Get("nonce")
+	if !verifySignedToken(pc.Key, "challenge", nonce, ip, now) {
+		return false
+	}
+	return form.Get("answer") == jsChallengeAnswer(nonce)
+}
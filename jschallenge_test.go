@@ -0,0 +1,182 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestJSChallenge(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8 8.8.4.4\nchallenge js\npass_cookie secret\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	request := func(method, target, remoteAddr string, form url.Values, cookie *http.Cookie) (int, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		return status, rec
+	}
+
+	status, rec := request("GET", "/login", "8.8.8.8:_", nil, nil)
+	if status != http.StatusOK || rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected the challenge page with a 403, Got: '%d' and '%d'", status, rec.Code)
+	}
+	match := regexp.MustCompile(`name="nonce" value="([^"]+)"`).FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		t.Fatalf("Expected a nonce in the challenge page, Got: %s", rec.Body.String())
+	}
+	nonce := match[1]
+
+	answer := func(nonce, answer string) url.Values {
+		return url.Values{"challenge": {"js"}, "redirect": {"/login"}, "nonce": {nonce}, "answer": {answer}}
+	}
+	expired := newSignedToken([]byte("secret"), "challenge", net.ParseIP("8.8.8.8"), time.Now().Add(-time.Minute))
+	pass := NewPassToken([]byte("secret"), net.ParseIP("8.8.8.8"), time.Now().Add(time.Hour))
+	tests := []struct {
+		remoteAddr string
+		form       url.Values
+		passed     bool
+	}{
+		{"8.8.8.8:_", answer(nonce, "0"), false},
+		{"8.8.8.8:_", answer(nonce, ""), false},
+		{"8.8.4.4:_", answer(nonce, jsChallengeAnswer(nonce)), false},
+		{"8.8.8.8:_", answer(expired, jsChallengeAnswer(expired)), false},
+		// a pass isn't a nonce.
+		{"8.8.8.8:_", answer(pass, jsChallengeAnswer(pass)), false},
+		{"8.8.8.8:_", answer(nonce, jsChallengeAnswer(nonce)), true},
+	}
+	for i, test := range tests {
+		status, rec := request("POST", ChallengePath, test.remoteAddr, test.form, nil)
+		if status != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+			t.Fatalf("Test %d: Expected a redirect to /login, Got: '%d' to %s", i, status, rec.Header().Get("Location"))
+		}
+		cookies := rec.Result().Cookies()
+		if (len(cookies) == 1) != test.passed {
+			t.Fatalf("Test %d: Expected a pass: %t, Got: %v", i, test.passed, cookies)
+		}
+		if test.passed {
+			if status, _ := request("GET", "/login", test.remoteAddr, nil, cookies[0]); status != http.StatusOK {
+				t.Fatalf("Test %d: Expected StatusCode: '%d' with the pass, Got: '%d'", i, http.StatusOK, status)
+			}
+		}
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\nchallenge js\n}")); err == nil {
+		t.Fatal("Expected an error without a pass_cookie")
+	}
+}
+
+func TestJSChallengePassStrength(t *testing.T) {
+	defer withCaptchaServer("hcaptcha", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"success": %t}`, r.PostFormValue("response") == "solved")
+	})()
+
+	config, err := ipfilterParse(caddy.NewTestController("http", `ipfilter / {
+		rule block
+		ip 8.8.8.8
+		challenge js
+		pass_cookie secret
+		captcha hcaptcha sitekey secret
+	}
+	ipfilter /login {
+		rule block
+		ip 8.8.8.8
+		challenge captcha
+	}
+	ipfilter /admin {
+		rule block
+		ip 8.8.8.8
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	request := func(method, target string, form url.Values, cookie *http.Cookie) (int, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "8.8.8.8:_"
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		return status, rec
+	}
+	solve := func(form url.Values) *http.Cookie {
+		_, rec := request("POST", ChallengePath, form, nil)
+		if cookies := rec.Result().Cookies(); len(cookies) == 1 {
+			return cookies[0]
+		}
+		return nil
+	}
+
+	nonce := newSignedToken([]byte("secret"), "challenge", net.ParseIP("8.8.8.8"), time.Now().Add(time.Minute))
+	js := solve(url.Values{"challenge": {"js"}, "redirect": {"/"}, "nonce": {nonce}, "answer": {jsChallengeAnswer(nonce)}})
+	captcha := solve(url.Values{"challenge": {"captcha"}, "redirect": {"/login"}, "h-captcha-response": {"solved"}})
+	if js == nil || captcha == nil {
+		t.Fatalf("Expected the passes of both challenges, Got: %v and %v", js, captcha)
+	}
+	pass := &http.Cookie{Name: PassCookieName, Value: NewPassToken([]byte("secret"), net.ParseIP("8.8.8.8"), time.Now().Add(time.Hour))}
+
+	tests := []struct {
+		path   string
+		cookie *http.Cookie
+		passes bool
+	}{
+		{"/", js, true},
+		// the captcha isn't skipped by solving the JavaScript.
+		{"/login", js, false},
+		{"/admin", js, false},
+		{"/", captcha, true},
+		{"/login", captcha, true},
+		{"/admin", captcha, false},
+		// the passes of support go through every rule.
+		{"/admin", pass, true},
+	}
+	for i, test := range tests {
+		status, rec := request("GET", test.path, nil, test.cookie)
+		if passes := status == http.StatusOK && rec.Code == http.StatusOK; passes != test.passes {
+			t.Errorf("Test %d: Expected the pass to go through: %t, Got: '%d' and '%d'", i, test.passes, status, rec.Code)
+		}
+	}
+
+	// no rule serves the JavaScript challenge anymore.
+	config.Paths[0].Challenge = ChallengeCaptcha
+	ipf.Config = config
+	if cookie := solve(url.Values{"challenge": {"js"}, "redirect": {"/"}, "nonce": {nonce}, "answer": {jsChallengeAnswer(nonce)}}); cookie != nil {
+		t.Errorf("Expected no pass for a challenge no rule serves, Got: %v", cookie)
+	}
+}
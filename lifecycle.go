@@ -0,0 +1,80 @@
+//go:build !nocaddy
+// +build !nocaddy
+
+package ipfilter
+
+import (
+	"sync"
+
+	"github.com/mholt/caddy"
+)
+
+// filtersKey is the key of the filters of a caddy instance in its storage.
+type filtersKey struct{}
+
+// filters are the shutdowns of the filters caddy set up and didn't shut down yet.
+var filters = struct {
+	sync.Mutex
+	shutdown map[*liveConfig]func() error
+}{shutdown: make(map[*liveConfig]func() error)}
+
+// trackFilter runs 'shutdown' once, when the instance of 'c' shuts down, restarts included, or when the restart
+// setting up the filter 'live' fails: caddy drops the new instance without shutting it down, the old instance
+// shuts down the filters it doesn't own, their databases would stay mapped otherwise.
+func trackFilter(c *caddy.Controller, live *liveConfig, shutdown func() error) {
+	filters.Lock()
+	filters.shutdown[live] = shutdown
+	filters.Unlock()
+
+	own, _ := c.Get(filtersKey{}).(map[*liveConfig]bool)
+	if own == nil {
+		own = make(map[*liveConfig]bool)
+		c.Set(filtersKey{}, own)
+		c.OnRestartFailed(func() error {
+			shutdownFiltersBut(own)
+			return nil
+		})
+	}
+	own[live] = true
+
+	c.OnShutdown(func() error {
+		return shutdownFilter(live)
+	})
+}
+
+// shutdownFilter runs the shutdown of 'live', unless it already ran.
+func shutdownFilter(live *liveConfig) error {
+	filters.Lock()
+	shutdown, ok := filters.shutdown[live]
+	delete(filters.shutdown, live)
+	filters.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return shutdown()
+}
+
+// shutdownFiltersBut shuts down every filter but the 'own' ones.
+func shutdownFiltersBut(own map[*liveConfig]bool) {
+	filters.Lock()
+	var others []*liveConfig
+	for live := range filters.shutdown {
+		if !own[live] {
+			others = append(others, live)
+		}
+	}
+	filters.Unlock()
+
+	for _, live := range others {
+		shutdownFilter(live)
+	}
+}
+
+// discardConfig closes the databases and the ban store of a config that won't be started.
+func discardConfig(config IPFConfig) {
+	config.closeDatabases()
+	if config.Bans != nil {
+		config.Bans.Close()
+	}
+}
@@ -0,0 +1,83 @@
+package ipfilter
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// closingCountryDB counts its closes.
+type closingCountryDB struct {
+	closes int
+	err    error
+}
+
+func (db *closingCountryDB) Country(ip net.IP) (string, error) { return "", nil }
+func (db *closingCountryDB) Built() time.Time                  { return time.Time{} }
+func (db *closingCountryDB) Close() error {
+	db.closes++
+	return db.err
+}
+
+func TestTrackFilter(t *testing.T) {
+	shutdowns := make(map[string]int)
+	track := func(c *caddy.Controller, name string) *liveConfig {
+		live := newLiveConfig(&IPFConfig{})
+		trackFilter(c, live, func() error {
+			shutdowns[name]++
+			return nil
+		})
+		return live
+	}
+
+	// the old instance, and the new one of a restart that failed.
+	old := caddy.NewTestController("http", "")
+	site := track(old, "old")
+	restart := caddy.NewTestController("http", "")
+	track(restart, "new1")
+	track(restart, "new2")
+
+	shutdownFiltersBut(old.Get(filtersKey{}).(map[*liveConfig]bool))
+	if shutdowns["new1"] != 1 || shutdowns["new2"] != 1 || shutdowns["old"] != 0 {
+		t.Fatalf("Expected the filters of the failed restart to be shut down, Got: %v", shutdowns)
+	}
+	if err := shutdownFilter(site); err != nil || shutdowns["old"] != 1 {
+		t.Fatalf("Expected the old filter to be shut down, Got: %v, %v", shutdowns, err)
+	}
+	// every filter shuts down once.
+	shutdownFilter(site)
+	shutdownFiltersBut(nil)
+	if shutdowns["new1"] != 1 || shutdowns["new2"] != 1 || shutdowns["old"] != 1 {
+		t.Fatalf("Expected one shutdown per filter, Got: %v", shutdowns)
+	}
+}
+
+func TestCloseDatabases(t *testing.T) {
+	db, err := maxminddb.Open(DataBase)
+	if err != nil {
+		t.Fatalf("Could not open the database: %v", err)
+	}
+	countryDB := &closingCountryDB{err: errors.New("busy")}
+	config := IPFConfig{DBHandler: db, CountryDB: countryDB}
+	if err := config.closeDatabases(); err == nil || err.Error() != "busy" {
+		t.Errorf("Expected the error of the country database, Got: %v", err)
+	}
+	if countryDB.closes != 1 {
+		t.Errorf("Expected the country database to be closed once, Got: %d", countryDB.closes)
+	}
+	if err := (&IPFConfig{}).closeDatabases(); err != nil {
+		t.Errorf("Unexpected error without databases: %v", err)
+	}
+
+	// a config failing to parse keeps the databases it opened until it is discarded.
+	input := "ipfilter / {\nrule block\ndatabase " + DataBase + "\ncountry RU\nrule deny\n}"
+	config, err = ipfilterParse(caddy.NewTestController("http", input))
+	if err == nil || config.DBHandler == nil {
+		t.Fatalf("Expected an error with an opened database, Got: %v", err)
+	}
+	discardConfig(config)
+}
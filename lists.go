@@ -0,0 +1,182 @@
+package ipfilter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Formats of 'ip_list'.
+const (
+	// ListFireHOL is the format of the .netset and .ipset lists of FireHOL, and of most public block lists:
+	// one IP or CIDR per line, '#' starts a comment.
+	ListFireHOL = "firehol"
+	// ListSpamhaus is the format of the DROP and EDROP lists of Spamhaus: "<cidr> ; <SBL id>" per line,
+	// ';' starts a comment.
+	ListSpamhaus = "spamhaus"
+	// ListDShield is the format of the top 20 block list of DShield: tab-separated "<start> <end> <bits> ..."
+	// per line after a header, '#' starts a comment.
+	ListDShield = "dshield"
+)
+
+// listFormats are the formats of 'ip_list', by name.
+var listFormats = map[string]func(io.Reader) ([]*net.IPNet, error){
+	ListFireHOL:  parseFireHOL,
+	ListSpamhaus: parseSpamhaus,
+	ListDShield:  parseDShield,
+}
+
+// ListFormats returns the formats 'ip_list' accepts.
+func ListFormats() []string {
+	names := make([]string, 0, len(listFormats))
+	for name := range listFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IPList is a list of IPs read from a file or an http(s) URL when the rules are loaded, its entries are
+// added to the ranges of the rule.
+type IPList struct {
+	Format string `json:"format,omitempty"` // ListFireHOL if empty.
+	Source string `json:"source"`
+}
+
+// parseIPLists returns the lists of the arguments of 'ip_list', the first one may be a format.
+func parseIPLists(args []string) ([]IPList, error) {
+	var format string
+	if _, ok := listFormats[args[0]]; ok {
+		format, args = args[0], args[1:]
+	}
+	if len(args) == 0 {
+		return nil, errors.New("ipfilter: ip_list needs a file or a URL")
+	}
+
+	lists := make([]IPList, 0, len(args))
+	for _, source := range args {
+		lists = append(lists, IPList{Format: format, Source: source})
+	}
+	return lists, nil
+}
+
+// Load reads the list, URLs are fetched with 'client'.
+func (l IPList) Load(client *http.Client) ([]Range, error) {
+	return l.load(context.Background(), client)
+}
+
+// load is Load, giving up the fetch once 'ctx' is done.
+func (l IPList) load(ctx context.Context, client *http.Client) ([]Range, error) {
+	format := l.Format
+	if format == "" {
+		format = ListFireHOL
+	}
+	parse, ok := listFormats[format]
+	if !ok {
+		return nil, errors.New("ipfilter: Unknown list format: " + format + ", expected one of " + strings.Join(ListFormats(), ", "))
+	}
+
+	var r io.ReadCloser
+	if strings.HasPrefix(l.Source, "http://") || strings.HasPrefix(l.Source, "https://") {
+		req, err := http.NewRequest(http.MethodGet, l.Source, nil)
+		if err != nil {
+			return nil, fmt.Errorf("ipfilter: Can't fetch the list %s: %v", l.Source, err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("ipfilter: Can't fetch the list %s: %v", l.Source, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("ipfilter: Can't fetch the list %s: %s", l.Source, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(l.Source)
+		if err != nil {
+			return nil, errors.New("ipfilter: Can't open the list: " + l.Source)
+		}
+		r = f
+	}
+	defer r.Close()
+
+	nets, err := parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("ipfilter: Invalid list %s: %v", l.Source, err)
+	}
+	ranges := make([]Range, 0, len(nets))
+	for _, network := range nets {
+		ranges = append(ranges, networkRange(network))
+	}
+	return ranges, nil
+}
+
+// loadIPLists returns the ranges of 'lists', fetched until 'ctx' is done.
+func loadIPLists(ctx context.Context, lists []IPList, client *http.Client) ([]Range, error) {
+	var ranges []Range
+	for _, l := range lists {
+		listRanges, err := l.load(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, listRanges...)
+	}
+	return ranges, nil
+}
+
+// parseFireHOL reads a FireHOL list.
+func parseFireHOL(r io.Reader) ([]*net.IPNet, error) {
+	return parseListLines(r, "#", parseNetwork)
+}
+
+// parseSpamhaus reads a DROP or EDROP list, the SBL id after the CIDR is a comment.
+func parseSpamhaus(r io.Reader) ([]*net.IPNet, error) {
+	return parseListLines(r, ";", parseNetwork)
+}
+
+// parseDShield reads the top 20 block list, its "Start End Netblock" header is skipped.
+func parseDShield(r io.Reader) ([]*net.IPNet, error) {
+	return parseListLines(r, "#", func(entry string) (*net.IPNet, bool) {
+		fields := strings.Fields(entry)
+		if len(fields) < 3 {
+			return nil, false
+		}
+		if fields[0] == "Start" {
+			return nil, true
+		}
+		return parseNetwork(fields[0] + "/" + fields[2])
+	})
+}
+
+// parseListLines reads the entries of a list, one per line, 'comment' starts a comment. 'parse' returns the
+// network of an entry, nil for entries to skip, or false if the entry is invalid: unlike parseNetworkLines,
+// that is an error so that a list that changed format doesn't silently match nothing.
+func parseListLines(r io.Reader, comment string, parse func(string) (*net.IPNet, bool)) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.Index(entry, comment); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		network, ok := parse(entry)
+		if !ok {
+			return nil, fmt.Errorf("line %d: invalid entry %q", line, entry)
+		}
+		if network != nil {
+			nets = append(nets, network)
+		}
+	}
+	return nets, scanner.Err()
+}
@@ -0,0 +1,171 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestParseFireHOL(t *testing.T) {
+	tests := []struct {
+		list        string
+		expected    []string
+		expectedErr bool
+	}{
+		{"# header\n#\n1.2.3.0/24\n\n5.6.7.8\n", []string{"1.2.3.0/24", "5.6.7.8/32"}, false},
+		{"1.2.3.4 # trailing comment\r\n2001:db8::/32\n", []string{"1.2.3.4/32", "2001:db8::/32"}, false},
+		{"# only comments\n", nil, false},
+		{"1.2.3.0/24\n1.2.3.4-1.2.3.8\n", nil, true},
+		{"<html>not found</html>\n", nil, true},
+	}
+
+	for i, test := range tests {
+		nets, err := parseFireHOL(strings.NewReader(test.list))
+		if test.expectedErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		var got []string
+		for _, network := range nets {
+			got = append(got, network.String())
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Fatalf("Test %d: Expected: %v, Got: %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestParseSpamhaus(t *testing.T) {
+	list := "; Spamhaus DROP List 2024/01/01 - (c) 2024 The Spamhaus Project\n" +
+		"; https://www.spamhaus.org/drop/drop.txt\n" +
+		"1.10.16.0/20 ; SBL256894\n" +
+		"2.56.192.0/22 ; SBL459831\n"
+	nets, err := parseSpamhaus(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(nets) != 2 || nets[0].String() != "1.10.16.0/20" || nets[1].String() != "2.56.192.0/22" {
+		t.Fatalf("Expected the two prefixes, Got: %v", nets)
+	}
+
+	if _, err := parseSpamhaus(strings.NewReader("1.10.16.0/20 SBL256894\n")); err == nil {
+		t.Fatal("Expected an error for an entry without ';'")
+	}
+}
+
+func TestParseDShield(t *testing.T) {
+	list := "#\n#   DShield.org Recommended Block List\n#   comments: info@dshield.org\n#\n" +
+		"Start\tEnd\tNetblock\tAttacks\tName\tCountry\temail\n" +
+		"61.177.172.0\t61.177.172.255\t24\t4721\tCHINANET-JS\tCN\tabuse@example.com\n" +
+		"45.148.10.0\t45.148.10.255\t24\t1845\t\t\t\n"
+	nets, err := parseDShield(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(nets) != 2 || nets[0].String() != "61.177.172.0/24" || nets[1].String() != "45.148.10.0/24" {
+		t.Fatalf("Expected the two netblocks, Got: %v", nets)
+	}
+
+	if _, err := parseDShield(strings.NewReader("61.177.172.0\t61.177.172.255\n")); err == nil {
+		t.Fatal("Expected an error for an entry without netblock")
+	}
+}
+
+func TestIPList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/level1.netset":
+			fmt.Fprint(w, "# remote list\n203.0.113.0/24\n")
+		case "/drop.txt":
+			fmt.Fprint(w, "; Spamhaus DROP List\n198.51.100.0/24 ; SBL1\n")
+		case "/block.txt":
+			fmt.Fprint(w, "# DShield\nStart\tEnd\tNetblock\tAttacks\n192.0.2.0\t192.0.2.255\t24\t12\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		input          string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule block\nip_list testdata/firehol.netset\n}", "5.188.11.20:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip_list testdata/firehol.netset\n}", "45.14.148.203:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip_list testdata/firehol.netset\n}", "45.14.148.204:_", http.StatusOK},
+		{"ipfilter / {\nrule block\nip_list firehol " + server.URL + "/level1.netset\n}", "203.0.113.9:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip_list firehol " + server.URL + "/level1.netset\n}", "5.188.11.20:_", http.StatusOK},
+		// the lists add up with each other and with 'ip'.
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nip_list testdata/firehol.netset " + server.URL + "/level1.netset\n}", "8.8.8.8:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nip_list testdata/firehol.netset " + server.URL + "/level1.netset\n}", "203.0.113.9:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip_list spamhaus " + server.URL + "/drop.txt\n}", "198.51.100.7:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip_list dshield " + server.URL + "/block.txt\n}", "192.0.2.7:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nip_list dshield " + server.URL + "/block.txt\n}", "198.51.100.7:_", http.StatusOK},
+		{"ipfilter / {\nstorage compact\nrule allow\nip_list testdata/firehol.netset\n}", "31.184.199.1:_", http.StatusOK},
+		{"ipfilter / {\nstorage compact\nrule allow\nip_list testdata/firehol.netset\n}", "8.8.8.8:_", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	for i, input := range []string{
+		"ipfilter / {\nrule block\nip_list\n}",
+		"ipfilter / {\nrule block\nip_list firehol\n}",
+		"ipfilter / {\nrule block\nip_list testdata/missing.netset\n}",
+		"ipfilter / {\nrule block\nip_list " + server.URL + "/missing.netset\n}",
+		"ipfilter / {\nrule block\nip_list testdata/blockpage.html\n}",
+		"ipfilter / {\nrule block\nip_list dshield testdata/firehol.netset\n}",
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Fatalf("Test %d: Expected an error", i)
+		}
+	}
+
+	rs := RuleSet{Paths: []Rule{{PathScopes: []string{"/"}, Rule: "block", IPLists: []IPList{{Source: "testdata/firehol.netset"}}}}}
+	paths, err := rs.ToPaths(false, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ip := net.ParseIP("45.14.148.203")
+	if len(paths[0].Ranges) != 4 || !paths[0].Ranges[3].InRange(&ip) {
+		t.Fatalf("Expected the ranges of the list, Got: %v", paths[0].Ranges)
+	}
+	rs.Paths[0].IPLists[0].Format = "csv"
+	if _, err := rs.ToPaths(false, false); err == nil {
+		t.Fatal("Expected an error for an unknown format")
+	}
+}
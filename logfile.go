@@ -0,0 +1,213 @@
+package ipfilter
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Defaults of 'log_file'.
+const (
+	defaultLogFileSize = 100 << 20 // bytes, the file is rotated before it gets bigger.
+	defaultLogFileKeep = 10        // rotated files kept.
+	logFileQueueSize   = 10000     // records waiting to be written, the next ones are dropped.
+)
+
+// LogFile writes the decisions to a dedicated file as JSON lines, the file is rotated when it reaches MaxSize
+// and the old files are compressed: <path>.1.gz is the most recent one, <path>.<Keep>.gz the oldest.
+type LogFile struct {
+	Path    string
+	MaxSize int64
+	Keep    int
+
+	records chan []byte
+	dropped int32 // records dropped since the last report, logged by run.
+	file    *os.File
+	size    int64
+}
+
+// ParseLogFile parses the arguments of 'log_file': '<path> [rotate <size>] [keep <n>]', where the size is
+// in bytes or has a kb, mb or gb suffix.
+func ParseLogFile(args []string) (*LogFile, error) {
+	if len(args) == 0 || len(args)%2 == 0 {
+		return nil, errors.New("ipfilter: log_file should be '<path> [rotate <size>] [keep <n>]'")
+	}
+
+	lf := &LogFile{Path: args[0], MaxSize: defaultLogFileSize, Keep: defaultLogFileKeep, records: make(chan []byte, logFileQueueSize)}
+	for i := 1; i < len(args); i += 2 {
+		switch args[i] {
+		case "rotate":
+			size, err := parseSize(args[i+1])
+			if err != nil || size <= 0 {
+				return nil, errors.New("ipfilter: log_file rotate should be a positive size, e.g. '100mb'")
+			}
+			lf.MaxSize = size
+		case "keep":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return nil, errors.New("ipfilter: log_file keep should be a number of files")
+			}
+			lf.Keep = n
+		default:
+			return nil, errors.New("ipfilter: Unknown log_file option: " + args[i])
+		}
+	}
+
+	if info, err := os.Stat(filepath.Dir(lf.Path)); err != nil || !info.IsDir() {
+		return nil, errors.New("ipfilter: The directory of the log_file doesn't exist: " + lf.Path)
+	}
+	return lf, nil
+}
+
+// parseSize parses a size in bytes, with an optional b, kb, mb or gb suffix.
+func parseSize(s string) (int64, error) {
+	s = strings.ToLower(s)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"b", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSuffix(s, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// send queues the record of 'd', it is dropped if the queue is full.
+func (lf *LogFile) send(d DecisionRecord) {
+	record, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	select {
+	case lf.records <- append(record, '\n'):
+	default:
+		atomic.AddInt32(&lf.dropped, 1)
+	}
+}
+
+// run writes the queued records until 'ctx' is done, the records still queued then are written before the file is closed.
+func (lf *LogFile) run(ctx context.Context) {
+	defer func() {
+		if lf.file != nil {
+			lf.file.Close()
+			lf.file = nil
+		}
+	}()
+
+	for {
+		select {
+		case record := <-lf.records:
+			lf.write(record)
+		case <-ctx.Done():
+			for {
+				select {
+				case record := <-lf.records:
+					lf.write(record)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write appends 'record' to the file, rotating it first if it would get bigger than MaxSize.
+func (lf *LogFile) write(record []byte) {
+	if dropped := atomic.SwapInt32(&lf.dropped, 0); dropped != 0 {
+		log.Printf("[ERROR] ipfilter: log_file: dropped %d records", dropped)
+	}
+	if lf.file != nil && lf.size > 0 && lf.size+int64(len(record)) > lf.MaxSize {
+		lf.file.Close()
+		lf.file = nil
+		if err := lf.rotate(); err != nil {
+			log.Printf("[ERROR] ipfilter: Can't rotate %s: %v", lf.Path, err)
+		}
+	}
+	if lf.file == nil {
+		file, err := os.OpenFile(lf.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Printf("[ERROR] ipfilter: Can't open %s: %v", lf.Path, err)
+			return
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			log.Printf("[ERROR] ipfilter: Can't open %s: %v", lf.Path, err)
+			return
+		}
+		lf.file, lf.size = file, info.Size()
+	}
+
+	n, err := lf.file.Write(record)
+	lf.size += int64(n)
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: Can't write to %s: %v", lf.Path, err)
+		lf.file.Close()
+		lf.file = nil
+	}
+}
+
+// rotate compresses the file to <path>.1.gz, after shifting the rotated files and removing the oldest one.
+func (lf *LogFile) rotate() error {
+	if lf.Keep == 0 {
+		return os.Remove(lf.Path)
+	}
+	os.Remove(lf.rotated(lf.Keep))
+	for i := lf.Keep - 1; i >= 1; i-- {
+		if err := os.Rename(lf.rotated(i), lf.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := compressFile(lf.Path, lf.rotated(1)); err != nil {
+		return err
+	}
+	return os.Remove(lf.Path)
+}
+
+// rotated returns the path of the i-th rotated file.
+func (lf *LogFile) rotated(i int) string {
+	return lf.Path + "." + strconv.Itoa(i) + ".gz"
+}
+
+// compressFile writes 'src' gzipped to 'dst', through a temporary file so 'dst' is never partial.
+func compressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,130 @@
+package ipfilter
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatalf("Could not create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipfilter.log")
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\ndatabase "+DataBase+
+		"\nlog_file "+path+" rotate 1kb keep 2\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer config.DBHandler.Close()
+	if config.LogFile.MaxSize != 1024 || config.LogFile.Keep != 2 {
+		t.Fatalf("Unexpected log_file: %+v", config.LogFile)
+	}
+
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+	serve := func(reqIP string) {
+		req, err := http.NewRequest("GET", "http://example.com/page", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = reqIP
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("8.8.8.8:_")
+	serve("24.53.192.20:_")
+	// the records are written before run returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	config.LogFile.run(ctx)
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Could not read the log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, Got: %q", content)
+	}
+	var d DecisionRecord
+	if err := json.Unmarshal([]byte(lines[0]), &d); err != nil {
+		t.Fatalf("Invalid record %q: %v", lines[0], err)
+	}
+	if d.Action != ActionBlock || d.IP != "8.8.8.8" || d.Country != "US" || d.Host != "example.com" || d.Path != "/page" || d.Rule != 1 {
+		t.Errorf("Unexpected record: %+v", d)
+	}
+	if !strings.Contains(lines[1], `"action":"allow","ip":"24.53.192.20","country":"CA"`) {
+		t.Errorf("Unexpected record: %s", lines[1])
+	}
+
+	for i, input := range []string{
+		"ipfilter / {\nrule block\nip 8.8.8.8\nlog_file\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nlog_file " + path + " rotate\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nlog_file " + path + " rotate 100tb\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nlog_file " + path + " keep -1\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nlog_file " + path + " compress yes\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nlog_file " + filepath.Join(dir, "missing", "ipfilter.log") + "\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nlog_file " + path + "\nlog_file " + path + "\n}",
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
+
+func TestLogFileRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatalf("Could not create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	lf, err := ParseLogFile([]string{filepath.Join(dir, "ipfilter.log"), "rotate", "100b", "keep", "2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// every record gets a file of its own: the last one is current, the two before are rotated, the first is removed.
+	for _, record := range []string{"first", "second", "third", "fourth"} {
+		lf.write([]byte(strings.Repeat(record[:1], 80) + " " + record + "\n"))
+	}
+	lf.file.Close()
+
+	content, err := ioutil.ReadFile(lf.Path)
+	if err != nil || !strings.HasSuffix(string(content), " fourth\n") {
+		t.Errorf("Expected the fourth record, Got: %q, %v", content, err)
+	}
+	for i, expected := range []string{"third", "second"} {
+		f, err := os.Open(lf.rotated(i + 1))
+		if err != nil {
+			t.Fatalf("Expected a rotated file: %v", err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Expected a gzipped file: %v", err)
+		}
+		content, err := ioutil.ReadAll(zr)
+		f.Close()
+		if err != nil || !strings.HasSuffix(string(content), " "+expected+"\n") {
+			t.Errorf("Expected the %s record in %s, Got: %q, %v", expected, lf.rotated(i+1), content, err)
+		}
+	}
+	if _, err := os.Stat(lf.rotated(3)); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed", lf.rotated(3))
+	}
+}
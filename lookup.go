@@ -0,0 +1,80 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// maxLookupBatch is the maximum number of IPs of a lookup request.
+const maxLookupBatch = 10000
+
+// LookupResult describes an IP of a lookup request.
+type LookupResult struct {
+	IP       string    `json:"ip"`
+	Country  string    `json:"country,omitempty"` // empty without a database.
+	ASN      uint      `json:"asn,omitempty"`     // 0 without an ASN database.
+	Decision *Decision `json:"decision,omitempty"`
+	Error    string    `json:"error,omitempty"` // the IP can't be parsed, or a lookup failed.
+}
+
+// Lookup returns the country, ASN and decision of the rules for a client from 'ip' requesting 'path'.
+func (ipf IPFilter) Lookup(ip net.IP, path string) LookupResult {
+	ip = normalizeIP(ip)
+	result := LookupResult{IP: ip.String()}
+
+	var err error
+	if ipf.Config.hasCountryLookups() {
+		if result.Country, err = ipf.lookupCountry(ip, nil); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	if ipf.Config.ASNHandler != nil {
+		if result.ASN, err = ipf.lookupASN(ip, nil); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	d := ipf.Decide(ip, path)
+	if d.Err != nil {
+		result.Error = d.Err.Error()
+	}
+	result.Decision = &d
+	return result
+}
+
+// serveLookup answers a JSON array of IPs with their LookupResults, the decisions are for the 'path' query
+// parameter, "/" by default.
+func (ipf IPFilter) serveLookup(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	var ips []string
+	if err := json.NewDecoder(r.Body).Decode(&ips); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(ips) > maxLookupBatch {
+		return http.StatusRequestEntityTooLarge, errors.New("ipfilter: lookups are limited to " + strconv.Itoa(maxLookupBatch) + " IPs")
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+
+	results := make([]LookupResult, len(ips))
+	for i, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			results[i] = LookupResult{IP: s, Error: "ipfilter: Can't parse IP address: " + s}
+			continue
+		}
+		results[i] = ipf.Lookup(ip, path)
+	}
+	return writeJSON(w, results)
+}
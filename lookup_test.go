@@ -0,0 +1,78 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestAdminLookup(t *testing.T) {
+	db, err := maxminddb.Open(DataBase)
+	if err != nil {
+		t.Fatalf("Error opening the database: %v", err)
+	}
+	defer db.Close()
+	asnPath := writeTestASNDB(t, map[string]uint{"8.8.8.0/24": 15169})
+	defer os.RemoveAll(filepath.Dir(asnPath))
+	asnDB, err := maxminddb.Open(asnPath)
+	if err != nil {
+		t.Fatalf("Error opening the ASN database: %v", err)
+	}
+	defer asnDB.Close()
+
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{
+			{PathScopes: []string{"/"}, IsBlock: true, CountryCodes: []string{"RU"}},
+			{PathScopes: []string{"/api"}, CountryCodes: []string{"US"}},
+		},
+		DBHandler:  db,
+		ASNHandler: asnDB,
+	}, "secret")
+
+	tests := []struct {
+		path           string
+		body           string
+		expectedStatus int
+		expected       []LookupResult
+	}{
+		{"/ipfilter/lookup", `["8.8.8.8", "5.175.96.22", "nope"]`, http.StatusOK, []LookupResult{
+			{IP: "8.8.8.8", Country: "US", ASN: 15169, Decision: &Decision{Action: ActionAllow, Rule: 1, Scope: "/", Country: "US"}},
+			{IP: "5.175.96.22", Country: "RU", Decision: &Decision{Action: ActionBlock, Rule: 1, Scope: "/", Country: "RU"}},
+			{IP: "nope", Error: "ipfilter: Can't parse IP address: nope"},
+		}},
+		{"/ipfilter/lookup?path=/api/users", `["8.8.8.8", "24.53.192.20"]`, http.StatusOK, []LookupResult{
+			{IP: "8.8.8.8", Country: "US", ASN: 15169, Decision: &Decision{Action: ActionAllow, Rule: 2, Scope: "/api", Country: "US"}},
+			{IP: "24.53.192.20", Country: "CA", Decision: &Decision{Action: ActionBlock, Rule: 2, Scope: "/api", Country: "CA"}},
+		}},
+		{"/ipfilter/lookup", `{"ip": "8.8.8.8"}`, http.StatusBadRequest, nil},
+	}
+
+	for i, test := range tests {
+		status, rec := adminRequest(t, ipf, "POST", test.path, test.body, "8.8.8.8:_", "secret")
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+		if test.expected == nil {
+			continue
+		}
+		var results []LookupResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Test %d: Could not decode the results: %v", i, err)
+		}
+		if !reflect.DeepEqual(results, test.expected) {
+			t.Fatalf("Test %d: Expected: %+v, Got: %+v", i, test.expected, results)
+		}
+	}
+
+	if status, _ := adminRequest(t, ipf, "POST", "/ipfilter/lookup", `["8.8.8.8"]`, "8.8.8.8:_", ""); status != http.StatusUnauthorized {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusUnauthorized, status)
+	}
+	if status, _ := adminRequest(t, ipf, "GET", "/ipfilter/lookup", "", "8.8.8.8:_", "secret"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusMethodNotAllowed, status)
+	}
+}
@@ -0,0 +1,195 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// reasonMaintenance is the reason of the debug header of the requests blocked by the maintenance mode.
+const reasonMaintenance = "maintenance"
+
+// Maintenance blocks every client but those in Allow while it is on, e.g. during a migration, and serves
+// Page to them. It is switched on and off through the admin endpoint, optionally for a limited time.
+type Maintenance struct {
+	Allow []Range
+	Page  string // served with a 503 to the blocked clients, a plain 503 if empty.
+
+	mu    sync.Mutex
+	on    bool
+	until time.Time // zero if the maintenance doesn't end by itself.
+	now   func() time.Time
+}
+
+// MaintenanceStatus describes the maintenance mode of a site.
+type MaintenanceStatus struct {
+	Enabled bool      `json:"enabled"`
+	Until   time.Time `json:"until,omitempty"` // zero if the maintenance doesn't end by itself.
+	Allow   []string  `json:"allow"`
+}
+
+// NewMaintenance returns a Maintenance that is off.
+func NewMaintenance() *Maintenance {
+	return &Maintenance{now: time.Now}
+}
+
+// Set switches the maintenance mode on for 'ttl', or until it is switched off if 'ttl' is zero, or off.
+func (m *Maintenance) Set(on bool, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.on = on
+	m.until = time.Time{}
+	if on && ttl > 0 {
+		m.until = m.now().Add(ttl)
+	}
+}
+
+// Status returns the state of the maintenance mode.
+func (m *Maintenance) Status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := MaintenanceStatus{Enabled: m.enabled(m.now()), Until: m.until, Allow: make([]string, 0, len(m.Allow))}
+	for _, rng := range m.Allow {
+		status.Allow = append(status.Allow, rng.String())
+	}
+	return status
+}
+
+// Enabled returns true if the maintenance mode is on, false for a nil Maintenance.
+func (m *Maintenance) Enabled() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.enabled(m.now())
+}
+
+// enabled returns true if the maintenance mode is on at 'now', m.mu must be held.
+func (m *Maintenance) enabled(now time.Time) bool {
+	if m.on && !m.until.IsZero() && !now.Before(m.until) {
+		log.Printf("[INFO] ipfilter: maintenance mode ended after its ttl")
+		m.on = false
+		m.until = time.Time{}
+	}
+	return m.on
+}
+
+// AllowIPs adds single IPs, CIDRs and ranges to the allowlist.
+func (m *Maintenance) AllowIPs(ips []string) error {
+	for _, ip := range ips {
+		ranges, err := parseIPs(ip)
+		if err != nil {
+			return errors.New("ipfilter: " + err.Error())
+		}
+		m.Allow = append(m.Allow, ranges...)
+	}
+	return nil
+}
+
+// allows returns true if 'ip' is in the allowlist.
+func (m *Maintenance) allows(ip net.IP) bool {
+	for _, rng := range m.Allow {
+		if rng.InRange(&ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfter returns the seconds until the end of the maintenance, 0 if it doesn't end by itself.
+func (m *Maintenance) retryAfter() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.until.IsZero() {
+		return 0
+	}
+	return int(m.until.Sub(m.now()).Seconds()) + 1
+}
+
+// blocksMaintenance returns true if the maintenance mode is on and the client of 'r' isn't in its allowlist.
+func (ipf IPFilter) blocksMaintenance(r *http.Request) bool {
+	if !ipf.Config.Maintenance.Enabled() {
+		return false
+	}
+	clientIPs, err := ipf.clientIPs(r, false)
+	return err != nil || !ipf.Config.Maintenance.allows(clientIPs[0])
+}
+
+// serveMaintenancePage answers the requests blocked by the maintenance mode with its page.
+func (ipf IPFilter) serveMaintenancePage(w http.ResponseWriter) (int, error) {
+	m := ipf.Config.Maintenance
+	if seconds := m.retryAfter(); seconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	if m.Page == "" {
+		return http.StatusServiceUnavailable, nil
+	}
+
+	page, err := os.Open(m.Page)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer page.Close()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if _, err := io.Copy(w, page); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// we wrote the page, return OK.
+	return http.StatusOK, nil
+}
+
+// maintenanceRequest is the body of the maintenance mode requests.
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	TTL     string `json:"ttl,omitempty"`
+}
+
+// serveMaintenance returns the maintenance mode on GET and switches it on PUT or POST.
+func (ipf IPFilter) serveMaintenance(w http.ResponseWriter, r *http.Request) (int, error) {
+	if ipf.Config.Maintenance == nil {
+		return http.StatusInternalServerError, errors.New("ipfilter: no maintenance mode configured")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, ipf.Config.Maintenance.Status())
+	case http.MethodPut, http.MethodPost:
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return http.StatusBadRequest, err
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				return http.StatusBadRequest, errors.New("ipfilter: ttl should be a positive duration, e.g. '1h'")
+			}
+		}
+
+		ipf.Config.Maintenance.Set(req.Enabled, ttl)
+		if req.Enabled {
+			log.Printf("[INFO] ipfilter: maintenance mode switched on through the admin endpoint")
+		} else {
+			log.Printf("[INFO] ipfilter: maintenance mode switched off through the admin endpoint")
+		}
+		return writeJSON(w, ipf.Config.Maintenance.Status())
+	}
+
+	w.Header().Set("Allow", "GET, PUT, POST")
+	return http.StatusMethodNotAllowed, nil
+}
@@ -0,0 +1,141 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestMaintenanceParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter-maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	page := filepath.Join(dir, "maintenance.html")
+	if err := ioutil.WriteFile(page, []byte("back soon"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input          string
+		reqIP          string
+		expectedStatus int
+		expectedBody   string
+		shouldErr      bool
+	}{
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nmaintenance\nmaintenance_allow 10.0.0.0/8\nmaintenance_page " + page + "\n}",
+			"8.8.4.4:_", http.StatusServiceUnavailable, "back soon", false},
+		// the allowlist goes through the maintenance, and the rules still apply.
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nmaintenance\nmaintenance_allow 10.0.0.0/8\nmaintenance_page " + page + "\n}",
+			"10.1.2.3:_", http.StatusOK, "", false},
+		{"ipfilter / {\nrule block\nip 10.1.2.3\nmaintenance on\nmaintenance_allow 10.0.0.0/8\n}",
+			"10.1.2.3:_", http.StatusForbidden, "", false},
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nmaintenance on\n}", "8.8.4.4:_", http.StatusServiceUnavailable, "", false},
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nmaintenance off\nmaintenance_allow 10.0.0.0/8\n}", "8.8.4.4:_", http.StatusOK, "", false},
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nmaintenance maybe\n}", "", 0, "", true},
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nmaintenance_allow 10.0.0.0/33\n}", "", 0, "", true},
+		{"ipfilter / {\nrule block\nip 8.8.8.8\nmaintenance_page " + filepath.Join(dir, "missing.html") + "\n}", "", 0, "", true},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr != (err != nil) {
+			t.Fatalf("Test %d: Expected error: %v, Got: %v", i, test.shouldErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		// the page is written with its status.
+		if status == http.StatusOK && rec.Code != http.StatusOK {
+			status = rec.Code
+		}
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+		if rec.Body.String() != test.expectedBody {
+			t.Errorf("Test %d: Expected body: %q, Got: %q", i, test.expectedBody, rec.Body.String())
+		}
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	maintenance := NewMaintenance()
+	maintenance.now = func() time.Time { return now }
+	maintenance.Allow = []Range{{net.ParseIP("10.0.0.0"), net.ParseIP("10.255.255.255")}}
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths:       []IPPath{{PathScopes: []string{"/"}, IsBlock: true, Ranges: []Range{{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}}}},
+		Maintenance: maintenance,
+	}, "secret")
+
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "8.8.4.4:_", ""); status != http.StatusOK {
+		t.Fatalf("Expected the client to be allowed before the maintenance, Got: %d", status)
+	}
+
+	status, rec := adminRequest(t, ipf, "PUT", "/ipfilter/maintenance", `{"enabled": true, "ttl": "30m"}`, "127.0.0.1:_", "secret")
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected status: %d, %s", status, rec.Body.String())
+	}
+	var got MaintenanceStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Enabled || !got.Until.Equal(now.Add(30*time.Minute)) || len(got.Allow) != 1 || got.Allow[0] != "10.0.0.0-10.255.255.255" {
+		t.Errorf("Unexpected status: %+v", got)
+	}
+
+	status, rec = adminRequest(t, ipf, "GET", "/", "", "8.8.4.4:_", "")
+	if status != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1801" {
+		t.Errorf("Expected a 503 with Retry-After, Got: %d %q", status, rec.Header().Get("Retry-After"))
+	}
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "10.0.0.1:_", ""); status != http.StatusOK {
+		t.Errorf("Expected the allowlist to go through, Got: %d", status)
+	}
+	// the admin endpoint stays reachable to switch it off.
+	if status, _ := adminRequest(t, ipf, "GET", "/ipfilter/maintenance", "", "8.8.4.4:_", "secret"); status != http.StatusOK {
+		t.Errorf("Expected the admin endpoint to be reachable, Got: %d", status)
+	}
+
+	now = now.Add(30 * time.Minute)
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "8.8.4.4:_", ""); status != http.StatusOK {
+		t.Errorf("Expected the maintenance to end after its ttl, Got: %d", status)
+	}
+
+	adminRequest(t, ipf, "PUT", "/ipfilter/maintenance", `{"enabled": true}`, "127.0.0.1:_", "secret")
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "8.8.4.4:_", ""); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected the maintenance to be on, Got: %d", status)
+	}
+	adminRequest(t, ipf, "POST", "/ipfilter/maintenance", `{"enabled": false}`, "127.0.0.1:_", "secret")
+	if status, _ := adminRequest(t, ipf, "GET", "/", "", "8.8.4.4:_", ""); status != http.StatusOK {
+		t.Errorf("Expected the maintenance to be off, Got: %d", status)
+	}
+
+	if status, _ := adminRequest(t, ipf, "PUT", "/ipfilter/maintenance", `{"enabled": true, "ttl": "-1h"}`, "127.0.0.1:_", "secret"); status != http.StatusBadRequest {
+		t.Errorf("Expected a bad request, Got: %d", status)
+	}
+	if status, _ := adminRequest(t, ipf, "DELETE", "/ipfilter/maintenance", "", "127.0.0.1:_", "secret"); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected method not allowed, Got: %d", status)
+	}
+}
@@ -0,0 +1,192 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Matcher is a condition of an ipfilter block, the block matches a client if any of its
+// countries, ranges or matchers matches one of the client IPs, or all of them with 'match all'.
+// 'r' is nil when the decision isn't about a request, see Decide.
+type Matcher interface {
+	Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error)
+}
+
+// MatcherFunc is a function implementing Matcher.
+type MatcherFunc func(ctx context.Context, ip net.IP, r *http.Request) (bool, error)
+
+// Match implements Matcher.
+func (f MatcherFunc) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	return f(ctx, ip, r)
+}
+
+// Arguments of 'match' choosing how the conditions of an ipfilter block combine, see IPPath.MatchAll.
+const (
+	MatchAllConditions = "all"
+	MatchAnyCondition  = "any"
+)
+
+// MatcherFactory creates a Matcher from the arguments of a 'match <name> [args...]' subdirective.
+type MatcherFactory func(args []string) (Matcher, error)
+
+// MatcherSpec is the JSON representation of a registered matcher of a rule.
+type MatcherSpec struct {
+	Name string   `json:"name"`
+	Args []string `json:"args,omitempty"`
+}
+
+var (
+	matchersMu sync.RWMutex
+	matchers   = make(map[string]MatcherFactory)
+)
+
+// RegisterMatcher makes the matchers of 'factory' available as 'match <name>' in ipfilter blocks and in the
+// JSON rules, plugins call it from their init function.
+func RegisterMatcher(name string, factory MatcherFactory) {
+	matchersMu.Lock()
+	defer matchersMu.Unlock()
+
+	if _, ok := matchers[name]; ok {
+		panic("ipfilter: matcher " + name + " is already registered")
+	}
+	if name == MatchAllConditions || name == MatchAnyCondition {
+		panic("ipfilter: matcher " + name + " is reserved for 'match " + name + "'")
+	}
+	matchers[name] = factory
+}
+
+// NewMatcher creates the registered matcher described by 'spec'.
+func NewMatcher(spec MatcherSpec) (Matcher, error) {
+	matchersMu.RLock()
+	factory, ok := matchers[spec.Name]
+	matchersMu.RUnlock()
+	if !ok {
+		return nil, errors.New("ipfilter: Unknown matcher: " + spec.Name)
+	}
+
+	m, err := factory(spec.Args)
+	if err != nil {
+		return nil, errors.New("ipfilter: matcher " + spec.Name + ": " + err.Error())
+	}
+	return namedMatcher{Matcher: m, spec: spec}, nil
+}
+
+// namedMatcher is a matcher created by NewMatcher, it remembers how, so rules can be exported.
+type namedMatcher struct {
+	Matcher
+	spec MatcherSpec
+}
+
+// matcherSpecs returns the specs of the registered matchers in 'ms', the others can't be described.
+func matcherSpecs(ms []Matcher) []MatcherSpec {
+	var specs []MatcherSpec
+	for _, m := range ms {
+		if named, ok := m.(namedMatcher); ok {
+			specs = append(specs, named.spec)
+		}
+	}
+	return specs
+}
+
+// usesMatcher returns true if 'path' has a matcher registered as 'name'.
+func usesMatcher(path IPPath, name string) bool {
+	for _, spec := range matcherSpecs(path.Matchers) {
+		if spec.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookups gives matchers the database lookups of the site, with its cache and cost accounting.
+type Lookups interface {
+	Country(ip net.IP) (string, error)
+	ASN(ip net.IP) (uint, error)
+	AnonymousIP(ip net.IP) (AnonymousIP, error)
+}
+
+type lookupsKey struct{}
+
+// LookupsFromContext returns the Lookups of the context passed to Matchers, nil in other contexts.
+func LookupsFromContext(ctx context.Context) Lookups {
+	lookups, _ := ctx.Value(lookupsKey{}).(Lookups)
+	return lookups
+}
+
+// filterLookups implements Lookups with the databases of an IPFilter.
+type filterLookups struct {
+	ipf  IPFilter
+	cost *requestCost
+}
+
+func (fl filterLookups) Country(ip net.IP) (string, error) {
+	if !fl.ipf.Config.hasCountryLookups() {
+		return "", errors.New("ipfilter: Database is required to look up countries")
+	}
+	return fl.ipf.lookupCountry(ip, fl.cost)
+}
+
+func (fl filterLookups) ASN(ip net.IP) (uint, error) {
+	if fl.ipf.Config.ASNHandler == nil {
+		return 0, errors.New("ipfilter: ASN database is required to look up ASNs")
+	}
+	return fl.ipf.lookupASN(ip, fl.cost)
+}
+
+func (fl filterLookups) AnonymousIP(ip net.IP) (AnonymousIP, error) {
+	if fl.ipf.Config.AnonymousIPHandler == nil {
+		return AnonymousIP{}, errors.New("ipfilter: Anonymous-IP database is required to look up anonymous IPs")
+	}
+	return fl.ipf.lookupAnonymousIP(ip, fl.cost)
+}
+
+// countryMatcher matches the clients in the CountryCodes of a path, or out of them with NegateCountries,
+// unless they are in its ExceptASNs.
+type countryMatcher struct {
+	ipf     IPFilter
+	path    IPPath
+	cost    *requestCost
+	country string // country of the last IP looked up.
+}
+
+// Match implements Matcher.
+func (m *countryMatcher) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	country, err := m.ipf.lookupCountry(ip, m.cost)
+	if err != nil {
+		return false, err
+	}
+	m.country = country
+
+	listed := false
+	for _, c := range m.path.CountryCodes {
+		if country == c {
+			listed = true
+			break
+		}
+	}
+	if listed == m.path.NegateCountries {
+		return false, nil
+	}
+	if len(m.path.ExceptASNs) == 0 {
+		return true, nil
+	}
+	// carved out of the country.
+	excepted, err := m.ipf.exceptedASN(m.path, ip, m.cost)
+	return !excepted, err
+}
+
+// rangeMatcher matches the clients in any of its ranges.
+type rangeMatcher []Range
+
+// Match implements Matcher.
+func (m rangeMatcher) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	for _, rng := range m {
+		if rng.InRange(&ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,166 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	// 'header <name>' matches the requests carrying the header, whatever the IP.
+	RegisterMatcher("header", func(args []string) (Matcher, error) {
+		if len(args) != 1 {
+			return nil, errors.New("expected a header name")
+		}
+		return MatcherFunc(func(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+			return r != nil && r.Header.Get(args[0]) != "", nil
+		}), nil
+	})
+}
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		input          string
+		header         string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule block\nmatch header X-Scanner\n}", "X-Scanner", "8.8.8.8:_", http.StatusForbidden},
+		{"ipfilter / {\nrule block\nmatch header X-Scanner\n}", "", "8.8.8.8:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nmatch header X-Internal\n}", "X-Internal", "8.8.8.8:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nmatch header X-Internal\n}", "", "10.0.0.1:_", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nmatch header X-Internal\n}", "", "8.8.8.8:_", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.header != "" {
+			req.Header.Set(test.header, "1")
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestMatcherParse(t *testing.T) {
+	for i, input := range []string{
+		"ipfilter / {\nrule block\nmatch\n}",
+		"ipfilter / {\nrule block\nmatch unknown\n}",
+		"ipfilter / {\nrule block\nmatch header\n}",
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Fatalf("Test %d: Expected an error", i)
+		}
+	}
+
+	// registered matchers survive a JSON round trip.
+	rs := RuleSet{Paths: []Rule{{PathScopes: []string{"/"}, Rule: "block", Matchers: []MatcherSpec{{Name: "header", Args: []string{"X-Scanner"}}}}}}
+	paths, err := rs.ToPaths(false, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := RulesFromPaths(paths); !reflect.DeepEqual(got, rs) {
+		t.Fatalf("Expected: %+v, Got: %+v", rs, got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected registering a matcher twice to panic")
+		}
+	}()
+	RegisterMatcher("header", nil)
+}
+
+func TestMatchAll(t *testing.T) {
+	tests := []struct {
+		config         string
+		header         string
+		reqIP          string
+		fwdFor         string
+		expectedStatus int
+	}{
+		// US clients of the 8.8.8.0/24 datacenter.
+		{"country US\nip 8.8.8.0/24\nmatch all", "", "8.8.8.8:_", "", http.StatusForbidden},
+		{"country US\nip 8.8.8.0/24\nmatch all", "", "8.8.4.4:_", "", http.StatusOK},
+		{"country US\nip 8.8.8.0/24 24.53.192.0/24\nmatch all", "", "24.53.192.20:_", "", http.StatusOK},
+		{"country US\nip 8.8.8.0/24\nmatch any", "", "8.8.4.4:_", "", http.StatusForbidden},
+		// a single IP of the chain has to match everything.
+		{"country US\nip 24.53.192.0/24\nmatch all", "", "10.0.0.1:_", "8.8.8.8, 24.53.192.20", http.StatusOK},
+		{"country US CA\nip 24.53.192.0/24\nmatch all", "", "10.0.0.1:_", "8.8.8.8, 24.53.192.20", http.StatusForbidden},
+		{"country US\nmatch header X-Scanner\nmatch all", "X-Scanner", "8.8.8.8:_", "", http.StatusForbidden},
+		{"country US\nmatch header X-Scanner\nmatch all", "", "8.8.8.8:_", "", http.StatusOK},
+		{"country US\nmatch header X-Scanner\nmatch all", "X-Scanner", "24.53.192.20:_", "", http.StatusOK},
+		{"country US\nfamily ipv4\nmatch all", "", "8.8.8.8:_", "", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\ndatabase "+DataBase+"\n"+test.config+"\n}"))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.header != "" {
+			req.Header.Set(test.header, "1")
+		}
+		if test.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", test.fwdFor)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	rs := RulesFromPaths([]IPPath{{PathScopes: []string{"/"}, CountryCodes: []string{"US"}, MatchAll: true}})
+	paths, err := rs.ToPaths(true, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !paths[0].MatchAll {
+		t.Fatal("Expected match all to survive a JSON round trip")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected registering a matcher named all to panic")
+		}
+	}()
+	RegisterMatcher(MatchAllConditions, nil)
+}
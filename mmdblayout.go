@@ -0,0 +1,137 @@
+package ipfilter
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Fields holding the countries and the ASNs in the records of the mmdb databases.
+const (
+	fieldISOCode     = "country.iso_code"         // GeoLite2, GeoIP2, DB-IP and IP2Location.
+	fieldCountryCode = "country_code"             // IPinfo Lite and ip-location-db.
+	fieldCountry     = "country"                  // IPinfo Country, the ISO code itself.
+	fieldASN         = "autonomous_system_number" // GeoLite2, GeoIP2, DB-IP and ip-location-db.
+	fieldAS          = "asn"                      // IPinfo, e.g. "AS15169".
+)
+
+// mmdbLayout is where the records of an mmdb database keep the country and the ASN, the zero value is GeoLite2's.
+type mmdbLayout struct {
+	country string // fieldISOCode if empty.
+	asn     string // fieldASN if empty.
+}
+
+// geoIP2Types are the lowercased prefixes of the database types laid out like GeoLite2.
+var geoIP2Types = []string{"geolite2", "geoip2", "dbip", "db-ip", "ip2location"}
+
+// layoutProbes are looked up to find the fields of the other databases, they all have one of them.
+var layoutProbes = []string{"8.8.8.8", "1.1.1.1", "9.9.9.9", "2001:4860:4860::8888"}
+
+// detectMMDBLayout returns the layout of 'db', from its type for the vendors copying GeoLite2, else from the
+// records of the layoutProbes.
+func detectMMDBLayout(db *maxminddb.Reader) mmdbLayout {
+	dbType := strings.ToLower(db.Metadata.DatabaseType)
+	for _, prefix := range geoIP2Types {
+		if strings.HasPrefix(dbType, prefix) {
+			return mmdbLayout{}
+		}
+	}
+
+	for _, probe := range layoutProbes {
+		var record map[string]interface{}
+		// an IPv4 only database can't look up the IPv6 probe.
+		if err := db.Lookup(net.ParseIP(probe), &record); err != nil || len(record) == 0 {
+			continue
+		}
+		var layout mmdbLayout
+		if _, ok := record[fieldCountryCode].(string); ok {
+			layout.country = fieldCountryCode
+		} else if _, ok := record[fieldCountry].(string); ok {
+			layout.country = fieldCountry
+		}
+		if _, ok := record[fieldASN]; !ok && record[fieldAS] != nil {
+			layout.asn = fieldAS
+		}
+		return layout
+	}
+	log.Printf("[WARNING] ipfilter: Unknown layout of the %q database, reading it as GeoLite2", db.Metadata.DatabaseType)
+	return mmdbLayout{}
+}
+
+// mmdbRecord holds the fields of the records that decisions are made on, for every layout but fieldCountry.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	CountryCode string      `maxminddb:"country_code"`
+	ASN         uint        `maxminddb:"autonomous_system_number"`
+	AS          interface{} `maxminddb:"asn"`
+}
+
+// flatMMDBRecord is mmdbRecord for the fieldCountry layouts.
+type flatMMDBRecord struct {
+	Country string      `maxminddb:"country"`
+	ASN     uint        `maxminddb:"autonomous_system_number"`
+	AS      interface{} `maxminddb:"asn"`
+}
+
+// decode returns the country and the ASN of the record 'decode' fills, e.g. with a Lookup of the database.
+func (l mmdbLayout) decode(decode func(result interface{}) error) (string, uint, error) {
+	var country string
+	var asn uint
+	var as interface{}
+	if l.country == fieldCountry {
+		var result flatMMDBRecord
+		if err := decode(&result); err != nil {
+			return "", 0, err
+		}
+		country, asn, as = result.Country, result.ASN, result.AS
+	} else {
+		var result mmdbRecord
+		if err := decode(&result); err != nil {
+			return "", 0, err
+		}
+		country, asn, as = result.Country.ISOCode, result.ASN, result.AS
+		if l.country == fieldCountryCode {
+			country = result.CountryCode
+		}
+	}
+	if l.asn == fieldAS {
+		asn = parseAS(as)
+	}
+	return country, asn, nil
+}
+
+// lookup returns the country and the ASN of 'ip' in 'db'.
+func (l mmdbLayout) lookup(db *maxminddb.Reader, ip net.IP) (string, uint, error) {
+	return l.decode(func(result interface{}) error {
+		return db.Lookup(ip, result)
+	})
+}
+
+// parseAS returns the number of an 'asn' field, "AS15169" or 15169, 0 if it is neither.
+func parseAS(as interface{}) uint {
+	switch as := as.(type) {
+	case string:
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(as), "AS"), 10, 32)
+		if err == nil {
+			return uint(n)
+		}
+	case uint64:
+		return uint(as)
+	}
+	return 0
+}
+
+// detectLayouts sets the layouts of the country and ASN databases.
+func (config *IPFConfig) detectLayouts() {
+	if config.DBHandler != nil {
+		config.dbLayout = detectMMDBLayout(config.DBHandler)
+	}
+	if config.ASNHandler != nil {
+		config.asnLayout = detectMMDBLayout(config.ASNHandler)
+	}
+}
@@ -0,0 +1,148 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbMap encodes 'record' for writeTestMMDB, its values are strings, uint32s or such maps.
+func mmdbMap(record map[string]interface{}) []byte {
+	var keys []string
+	for key := range record {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b := mmdbControl(7, len(record))
+	for _, key := range keys {
+		b = append(b, mmdbString(key)...)
+		switch v := record[key].(type) {
+		case string:
+			b = append(b, mmdbString(v)...)
+		case uint32:
+			b = append(b, mmdbUint(6, uint64(v))...)
+		case map[string]interface{}:
+			b = append(b, mmdbMap(v)...)
+		}
+	}
+	return b
+}
+
+// writeLayoutDB writes an mmdb database of 'dbType' holding the 'records' of CIDR networks.
+func writeLayoutDB(t *testing.T, dbType string, records map[string]map[string]interface{}) string {
+	encoded := make(map[string][]byte, len(records))
+	for cidr, record := range records {
+		encoded[cidr] = mmdbMap(record)
+	}
+	return writeTestMMDB(t, dbType, encoded)
+}
+
+func TestMMDBLayout(t *testing.T) {
+	tests := []struct {
+		dbType          string
+		records         map[string]map[string]interface{}
+		expected        mmdbLayout
+		expectedCountry string
+		expectedASN     uint
+	}{
+		{"GeoLite2-Country", map[string]map[string]interface{}{
+			"8.8.8.0/24": {"country": map[string]interface{}{"iso_code": "US"}},
+		}, mmdbLayout{}, "US", 0},
+		{"DBIP-ASN-Lite", map[string]map[string]interface{}{
+			"8.8.8.0/24": {"autonomous_system_number": uint32(15169)},
+		}, mmdbLayout{}, "", 15169},
+		{"ipinfo lite.mmdb", map[string]map[string]interface{}{
+			"8.8.8.0/24": {"country_code": "US", "asn": "AS15169", "as_name": "Google LLC"},
+		}, mmdbLayout{country: fieldCountryCode, asn: fieldAS}, "US", 15169},
+		{"ipinfo country.mmdb", map[string]map[string]interface{}{
+			"8.8.8.0/24": {"country": "US", "country_name": "United States"},
+		}, mmdbLayout{country: fieldCountry}, "US", 0},
+		// 8.8.8.8 isn't in the database, 1.1.1.1 is.
+		{"geo-whois-asn-country", map[string]map[string]interface{}{
+			"1.1.1.0/24": {"country_code": "AU"},
+			"5.0.0.0/8":  {"country_code": "DE"},
+		}, mmdbLayout{country: fieldCountryCode}, "", 0},
+		{"custom", map[string]map[string]interface{}{
+			"8.8.8.0/24": {"country": map[string]interface{}{"iso_code": "US"}},
+		}, mmdbLayout{}, "US", 0},
+		{"unknown", map[string]map[string]interface{}{
+			"5.0.0.0/8": {"country_code": "DE"},
+		}, mmdbLayout{}, "", 0},
+	}
+	for i, test := range tests {
+		path := writeLayoutDB(t, test.dbType, test.records)
+		defer os.RemoveAll(filepath.Dir(path))
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			t.Fatalf("Test %d: Could not open the database: %v", i, err)
+		}
+		layout := detectMMDBLayout(db)
+		if layout != test.expected {
+			t.Errorf("Test %d: Expected: %+v, Got: %+v", i, test.expected, layout)
+		}
+		country, asn, err := layout.lookup(db, net.ParseIP("8.8.8.8"))
+		if err != nil || country != test.expectedCountry || asn != test.expectedASN {
+			t.Errorf("Test %d: Expected: %s AS%d, Got: %s AS%d, %v", i, test.expectedCountry, test.expectedASN, country, asn, err)
+		}
+		db.Close()
+	}
+}
+
+func TestMMDBLayoutParse(t *testing.T) {
+	records := map[string]map[string]interface{}{
+		"8.8.8.0/24":  {"country_code": "US", "asn": "AS15169"},
+		"8.8.4.0/24":  {"country_code": "US", "asn": "AS15169"},
+		"9.9.9.0/24":  {"country_code": "CH", "asn": "AS19281"},
+		"52.0.0.0/11": {"country_code": "US", "asn": "AS16509"},
+	}
+	database := writeLayoutDB(t, "ipinfo lite.mmdb", records)
+	defer os.RemoveAll(filepath.Dir(database))
+
+	tests := []struct {
+		reqIP          string
+		expectedStatus int
+	}{
+		{"9.9.9.9:_", http.StatusOK},
+		{"52.0.0.1:_", http.StatusOK},
+		{"8.8.8.8:_", http.StatusForbidden},
+		{"8.8.4.4:_", http.StatusForbidden},
+	}
+	input := "ipfilter / {\nrule allow\ndatabase " + database + "\nasn_database " + database + "\ncountry US CH\nexcept_asn AS15169\n}"
+	config, err := ipfilterParse(caddy.NewTestController("http", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer config.DBHandler.Close()
+	defer config.ASNHandler.Close()
+	for i, test := range tests {
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+	}
+
+	spans, err := dbSpans(config.DBHandler, config.dbLayout)
+	if err != nil {
+		t.Fatalf("dbSpans failed: %v", err)
+	}
+	if len(spans) != len(records) || spans[0].label != "US" {
+		t.Errorf("Expected %d spans starting with US, Got: %+v", len(records), spans)
+	}
+}
@@ -0,0 +1,222 @@
+package ipfilter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// monitoringRefresh is how often the lists of the monitoring providers are fetched again.
+	monitoringRefresh = 24 * time.Hour
+	// monitoringRetry is how long to wait before fetching a list again after an error.
+	monitoringRetry = 5 * time.Minute
+)
+
+// monitoringProviders are the URLs where uptime-monitoring services publish the IPs of their probes,
+// one IP or CIDR per line.
+var monitoringProviders = map[string][]string{
+	"pingdom":     {"https://my.pingdom.com/probes/ipv4", "https://my.pingdom.com/probes/ipv6"},
+	"uptimerobot": {"https://uptimerobot.com/inc/files/ips/IPv4andIPv6.txt"},
+	"statuscake":  {"https://app.statuscake.com/Workfloor/Locations.php?format=txt"},
+}
+
+// MonitoringProviders returns the names of the providers 'allow_monitoring' accepts.
+func MonitoringProviders() []string {
+	names := make([]string, 0, len(monitoringProviders))
+	for name := range monitoringProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkMonitoringProviders returns an error if one of 'names' isn't a known provider.
+func checkMonitoringProviders(names []string) error {
+	for _, name := range names {
+		if _, ok := monitoringProviders[name]; !ok {
+			return errors.New("ipfilter: Unknown monitoring provider: " + name + ", expected one of " + strings.Join(MonitoringProviders(), ", "))
+		}
+	}
+	return nil
+}
+
+// monitoringProvidersOf returns the providers used by 'paths'.
+func monitoringProvidersOf(paths []IPPath) []string {
+	seen := make(map[string]bool)
+	var providers []string
+	for _, path := range paths {
+		for _, provider := range path.AllowMonitoring {
+			if !seen[provider] {
+				seen[provider] = true
+				providers = append(providers, provider)
+			}
+		}
+	}
+	return providers
+}
+
+// MonitoringLists holds the probe IPs of the monitoring providers used by a site. A list is fetched the first
+// time it is needed, and refreshed in the background once it is older than monitoringRefresh; until it is
+// fetched, no client is in it.
+type MonitoringLists struct {
+	client *http.Client
+
+	mu    sync.Mutex
+	lists map[string]*monitoringList
+}
+
+// monitoringList is the list of a single provider.
+type monitoringList struct {
+	mu       sync.Mutex
+	nets     []*net.IPNet
+	next     time.Time // when to fetch the list again.
+	fetching bool
+}
+
+// NewMonitoringLists returns MonitoringLists fetching the lists with 'client'.
+func NewMonitoringLists(client *http.Client) *MonitoringLists {
+	return &MonitoringLists{client: client, lists: make(map[string]*monitoringList)}
+}
+
+// list returns the list of 'provider', creating it if needed.
+func (ml *MonitoringLists) list(provider string) *monitoringList {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	l, ok := ml.lists[provider]
+	if !ok {
+		l = &monitoringList{}
+		ml.lists[provider] = l
+	}
+	return l
+}
+
+// Contains returns true if 'ip' is a probe of 'provider', it starts fetching the list if it is due.
+func (ml *MonitoringLists) Contains(provider string, ip net.IP) bool {
+	l := ml.list(provider)
+
+	l.mu.Lock()
+	if !l.fetching && !time.Now().Before(l.next) {
+		l.fetching = true
+		go ml.fetch(provider, l)
+	}
+	nets := l.nets
+	l.mu.Unlock()
+
+	for _, network := range nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true if every client IP is a probe of one of 'providers', a single IP of the chain
+// isn't enough as it might have been added by the client.
+func (ml *MonitoringLists) allows(providers []string, clientIPs []net.IP) bool {
+	if ml == nil || len(providers) == 0 {
+		return false
+	}
+
+	for _, clientIP := range clientIPs {
+		probe := false
+		for _, provider := range providers {
+			if ml.Contains(provider, clientIP) {
+				probe = true
+				break
+			}
+		}
+		if !probe {
+			return false
+		}
+	}
+	return true
+}
+
+// Refresh fetches the lists of 'providers' now, and returns the first error.
+func (ml *MonitoringLists) Refresh(providers ...string) error {
+	var firstErr error
+	for _, provider := range providers {
+		l := ml.list(provider)
+		l.mu.Lock()
+		l.fetching = true
+		l.mu.Unlock()
+
+		if err := ml.fetch(provider, l); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// fetch replaces the list of 'provider' with the one it publishes, the list is kept as is on errors.
+func (ml *MonitoringLists) fetch(provider string, l *monitoringList) error {
+	var nets []*net.IPNet
+	var err error
+	for _, url := range monitoringProviders[provider] {
+		var fetched []*net.IPNet
+		if fetched, err = ml.fetchURL(url); err != nil {
+			break
+		}
+		nets = append(nets, fetched...)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.fetching = false
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: Can't fetch the probes of %s: %v", provider, err)
+		l.next = time.Now().Add(monitoringRetry)
+		return err
+	}
+	l.nets = nets
+	l.next = time.Now().Add(monitoringRefresh)
+	return nil
+}
+
+// fetchURL reads the list at 'url', see parseNetworkLines.
+func (ml *MonitoringLists) fetchURL(url string) ([]*net.IPNet, error) {
+	resp, err := ml.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+
+	nets, err := parseNetworkLines(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(nets) == 0 {
+		return nil, errors.New(url + " has no IPs")
+	}
+	return nets, nil
+}
+
+// parseNetworkLines reads a list of IPs and CIDRs, one per line, lines that are neither are skipped.
+func parseNetworkLines(r io.Reader) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if network, ok := parseNetwork(line); ok {
+			nets = append(nets, network)
+		}
+	}
+	return nets, scanner.Err()
+}
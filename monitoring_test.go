@@ -0,0 +1,139 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// withMonitoringServer points the monitoring providers to a test server for the duration of a test.
+func withMonitoringServer(handler http.HandlerFunc) func() {
+	server := httptest.NewServer(handler)
+	saved := monitoringProviders
+	monitoringProviders = map[string][]string{
+		"pingdom":     {server.URL + "/pingdom/ipv4", server.URL + "/pingdom/ipv6"},
+		"uptimerobot": {server.URL + "/uptimerobot"},
+		"statuscake":  {server.URL + "/statuscake"},
+	}
+	return func() {
+		monitoringProviders = saved
+		server.Close()
+	}
+}
+
+func TestAllowMonitoring(t *testing.T) {
+	defer withMonitoringServer(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pingdom/ipv4":
+			fmt.Fprint(w, "# probes\n9.9.9.9\n9.9.10.0/24\n\n")
+		case "/pingdom/ipv6":
+			fmt.Fprint(w, "2001:db8::9\n")
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	})()
+
+	tests := []struct {
+		input          string
+		reqIP          string
+		fwdFor         string
+		expectedStatus int
+	}{
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring pingdom\n}", "9.9.9.9:_", "", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring pingdom\n}", "9.9.10.20:_", "", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring pingdom\n}", "[2001:db8::9]:_", "", http.StatusOK},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring pingdom\n}", "9.9.9.8:_", "", http.StatusForbidden},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring pingdom\n}", "10.0.0.1:_", "", http.StatusOK},
+		// every IP of the chain must be a probe.
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring pingdom\n}", "10.0.0.2:_", "1.1.1.1, 9.9.9.9", http.StatusForbidden},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring pingdom\n}", "10.0.0.2:_", "9.9.9.9, 9.9.10.1", http.StatusOK},
+		{"ipfilter / {\nrule block\nip 9.9\nallow_monitoring pingdom\n}", "9.9.9.9:_", "", http.StatusOK},
+		{"ipfilter / {\nrule block\nip 9.9\nallow_monitoring pingdom\n}", "9.9.9.8:_", "", http.StatusForbidden},
+		// the list of uptimerobot can't be fetched.
+		{"ipfilter / {\nrule block\nip 9.9\nallow_monitoring uptimerobot\n}", "9.9.9.9:_", "", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		config.Monitoring.Refresh(monitoringProvidersOf(config.Paths)...)
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", test.fwdFor)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestMonitoringListsFetch(t *testing.T) {
+	defer withMonitoringServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/statuscake" {
+			fmt.Fprint(w, "<html>maintenance</html>\n")
+			return
+		}
+		fmt.Fprint(w, "9.9.9.9\n")
+	})()
+
+	ml := NewMonitoringLists(defaultHTTPClient)
+	ip := net.ParseIP("9.9.9.9")
+
+	// the first lookup starts fetching the list.
+	deadline := time.Now().Add(5 * time.Second)
+	for !ml.Contains("uptimerobot", ip) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The list of uptimerobot wasn't fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := ml.Refresh("statuscake"); err == nil {
+		t.Fatalf("Expected an error for a list without IPs")
+	}
+	if ml.Contains("statuscake", ip) {
+		t.Fatalf("Expected an empty list for statuscake")
+	}
+}
+
+func TestAllowMonitoringParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring pingdom uptimerobot statuscake\n}", false},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring nagios\n}", true},
+		{"ipfilter / {\nrule allow\nip 10.0.0.1\nallow_monitoring\n}", true},
+	}
+
+	for i, test := range tests {
+		_, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr && err == nil {
+			t.Fatalf("Test %d: Expected an error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+	}
+}
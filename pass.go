@@ -0,0 +1,190 @@
+package ipfilter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PassCookieName is the cookie letting an approved client through the rules, see PassCookie.
+const PassCookieName = "ipfilter_pass"
+
+// passQueryParam grants the cookie from a link, e.g. one support sends after approving a client.
+const passQueryParam = "ipfilter_pass"
+
+// defaultPassTTL is how long a pass is valid without a TTL.
+const defaultPassTTL = 24 * time.Hour
+
+// PassCookie lets the clients that were approved, by passing a challenge or by support, through the rules
+// until their pass expires. A pass is an HMAC of the client IP and the expiry, it can't be forged without
+// the key nor used from another IP. The pass of a challenge only lets the client through the rules with
+// a challenge no harder than it, see passStrength. Banned clients stay blocked.
+type PassCookie struct {
+	Key []byte
+	TTL time.Duration // defaultPassTTL if 0.
+}
+
+// ttl returns how long the passes are valid.
+func (pc *PassCookie) ttl() time.Duration {
+	if pc.TTL > 0 {
+		return pc.TTL
+	}
+	return defaultPassTTL
+}
+
+// NewPassToken returns a pass for a client with 'ip' valid until 'expires', e.g. "kq3b5c.<mac>", it lets the
+// client through every rule.
+func NewPassToken(key []byte, ip net.IP, expires time.Time) string {
+	return newSignedToken(key, "pass", ip, expires)
+}
+
+// VerifyPassToken returns true if 'token' was generated with 'key' for a client with 'ip' and hasn't expired.
+func VerifyPassToken(key []byte, token string, ip net.IP, now time.Time) bool {
+	return verifySignedToken(key, "pass", token, ip, now)
+}
+
+// passKind names the challenge a pass was granted for, e.g. "js", "pow18" or "captcha", empty for the passes
+// of support.
+func passKind(challenge string, difficulty int) string {
+	if challenge == ChallengePow {
+		return challenge + strconv.Itoa(difficulty)
+	}
+	return challenge
+}
+
+// passStrength returns how hard the challenge of 'kind' is: 'js', then 'pow' by difficulty, then 'captcha',
+// the passes of support are the strongest. It returns -1 for an unknown kind.
+func passStrength(kind string) int {
+	switch {
+	case kind == "":
+		return maxPowDifficulty + 3
+	case kind == ChallengeCaptcha:
+		return maxPowDifficulty + 2
+	case kind == ChallengeJS:
+		return 1
+	case strings.HasPrefix(kind, ChallengePow):
+		difficulty, err := strconv.Atoi(strings.TrimPrefix(kind, ChallengePow))
+		if err == nil && difficulty > 0 && difficulty <= maxPowDifficulty {
+			return 1 + difficulty
+		}
+	}
+	return -1
+}
+
+// requiredPass returns the kind of the weakest pass letting a client through 'path': the passes of its
+// challenge, only those of support if it has none.
+func requiredPass(path IPPath) string {
+	switch path.Challenge {
+	case "":
+		return ""
+	case ChallengePow:
+		return passKind(ChallengePow, powDifficulty(path))
+	}
+	return path.Challenge
+}
+
+// newChallengePass returns the pass of a challenge of 'kind' for a client with 'ip', e.g. "pow18.kq3b5c.<mac>",
+// the kind is signed with the rest.
+func newChallengePass(key []byte, kind string, ip net.IP, expires time.Time) string {
+	if kind == "" {
+		return NewPassToken(key, ip, expires)
+	}
+	return kind + "." + newSignedToken(key, "pass:"+kind, ip, expires)
+}
+
+// verifyPass returns the kind of 'token' if it is a valid pass for a client with 'ip', of a challenge or of
+// support, false otherwise.
+func verifyPass(key []byte, token string, ip net.IP, now time.Time) (string, bool) {
+	if strings.Count(token, ".") != 2 {
+		return "", VerifyPassToken(key, token, ip, now)
+	}
+	i := strings.IndexByte(token, '.')
+	kind := token[:i]
+	if kind == "" || passStrength(kind) < 0 {
+		return "", false
+	}
+	return kind, verifySignedToken(key, "pass:"+kind, token[i+1:], ip, now)
+}
+
+// newSignedToken returns a token for 'purpose' and a client with 'ip', valid until 'expires': the tokens of
+// a purpose can't be used for another.
+func newSignedToken(key []byte, purpose string, ip net.IP, expires time.Time) string {
+	exp := expires.Unix()
+	return strconv.FormatInt(exp, 36) + "." + base64.RawURLEncoding.EncodeToString(signedTokenMAC(key, purpose, ip, exp))
+}
+
+// verifySignedToken returns true if 'token' was generated by newSignedToken with the same arguments and
+// hasn't expired.
+func verifySignedToken(key []byte, purpose, token string, ip net.IP, now time.Time) bool {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return false
+	}
+	exp, err := strconv.ParseInt(token[:i], 36, 64)
+	if err != nil || now.Unix() >= exp {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac, signedTokenMAC(key, purpose, ip, exp))
+}
+
+func signedTokenMAC(key []byte, purpose string, ip net.IP, exp int64) []byte {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], uint64(exp))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	mac.Write(ip.To16())
+	mac.Write(raw[:])
+	return mac.Sum(nil)[:16]
+}
+
+// grant sets the cookie of a pass of 'kind' for 'ip' on the response.
+func (pc *PassCookie) grant(w http.ResponseWriter, r *http.Request, ip net.IP, kind string) {
+	expires := time.Now().Add(pc.ttl())
+	http.SetCookie(w, &http.Cookie{
+		Name:     PassCookieName,
+		Value:    newChallengePass(pc.Key, kind, ip, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// passed returns true if the client of 'r' has a valid pass at least as strong as the one 'path' requires, in
+// its cookie or in the link it followed: the cookie is then set for the next requests.
+func (ipf IPFilter) passed(w http.ResponseWriter, r *http.Request, path IPPath) bool {
+	pc := ipf.Config.PassCookie
+	if pc == nil {
+		return false
+	}
+	clientIPs, err := ipf.clientIPs(r, path.Strict)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	required := passStrength(requiredPass(path))
+
+	if cookie, err := r.Cookie(PassCookieName); err == nil {
+		if kind, ok := verifyPass(pc.Key, cookie.Value, clientIPs[0], now); ok && passStrength(kind) >= required {
+			return true
+		}
+	}
+	if token := r.URL.Query().Get(passQueryParam); token != "" {
+		if kind, ok := verifyPass(pc.Key, token, clientIPs[0], now); ok && passStrength(kind) >= required {
+			pc.grant(w, r, clientIPs[0], kind)
+			return true
+		}
+	}
+	return false
+}
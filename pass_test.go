@@ -0,0 +1,160 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestPassToken(t *testing.T) {
+	key := []byte("secret")
+	ip := net.ParseIP("8.8.8.8")
+	now := time.Now()
+	token := NewPassToken(key, ip, now.Add(time.Hour))
+
+	if !VerifyPassToken(key, token, ip, now) {
+		t.Fatal("Expected a valid pass")
+	}
+	if VerifyPassToken(key, token, ip, now.Add(2*time.Hour)) {
+		t.Fatal("Expected an expired pass")
+	}
+	if VerifyPassToken(key, token, net.ParseIP("8.8.4.4"), now) {
+		t.Fatal("Expected the pass to be bound to its IP")
+	}
+	if VerifyPassToken([]byte("other"), token, ip, now) {
+		t.Fatal("Expected the pass to be bound to its key")
+	}
+	// pushing the expiry breaks the MAC.
+	forged := NewPassToken([]byte("other"), ip, now.Add(48*time.Hour))
+	if VerifyPassToken(key, forged[:len(forged)-22]+token[len(token)-22:], ip, now) {
+		t.Fatal("Expected a forged pass to be rejected")
+	}
+	for _, invalid := range []string{"", ".", "abc", "zzzzzzzzzzzzzz.AAAA", token + "A"} {
+		if VerifyPassToken(key, invalid, ip, now) {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestPassCookie(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8 8.8.4.4\npass_cookie secret 1h\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := newTestAdminFilter(config, "admin")
+
+	request := func(url, remoteAddr string, cookie *http.Cookie) (int, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = remoteAddr
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		return status, rec
+	}
+
+	if status, _ := request("/", "8.8.8.8:_", nil); status != http.StatusForbidden {
+		t.Fatalf("Expected StatusCode: '%d' without a pass, Got: '%d'", http.StatusForbidden, status)
+	}
+
+	// support approves the client, which follows the link.
+	status, rec := adminRequest(t, ipf, "POST", "/ipfilter/pass", `{"ip": "8.8.8.8"}`, "127.0.0.1:12345", "admin")
+	if status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	var pass passResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &pass); err != nil {
+		t.Fatalf("Could not decode the pass: %v", err)
+	}
+	if pass.IP != "8.8.8.8" || time.Until(pass.Expires) > time.Hour || time.Until(pass.Expires) < 59*time.Minute {
+		t.Fatalf("Expected a pass of an hour for 8.8.8.8, Got: %+v", pass)
+	}
+
+	status, rec = request("/?ipfilter_pass="+pass.Token, "8.8.8.8:_", nil)
+	if status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d' with the link, Got: '%d'", http.StatusOK, status)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != PassCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("Expected the pass cookie, Got: %v", cookies)
+	}
+
+	if status, _ := request("/", "8.8.8.8:_", cookies[0]); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d' with the cookie, Got: '%d'", http.StatusOK, status)
+	}
+	if status, _ := request("/", "8.8.4.4:_", cookies[0]); status != http.StatusForbidden {
+		t.Fatalf("Expected StatusCode: '%d' with the cookie of another IP, Got: '%d'", http.StatusForbidden, status)
+	}
+	if status, _ := request("/?ipfilter_pass="+pass.Token, "8.8.4.4:_", nil); status != http.StatusForbidden {
+		t.Fatalf("Expected StatusCode: '%d' with the link of another IP, Got: '%d'", http.StatusForbidden, status)
+	}
+
+	// banned clients stay blocked.
+	if status, _ := adminRequest(t, ipf, "POST", "/ipfilter/ban", `{"ip": "8.8.8.8"}`, "127.0.0.1:12345", "admin"); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	if status, _ := request("/", "8.8.8.8:_", cookies[0]); status != http.StatusForbidden {
+		t.Fatalf("Expected StatusCode: '%d' for a banned client, Got: '%d'", http.StatusForbidden, status)
+	}
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"pass_cookie secret", false},
+		{"pass_cookie", true},
+		{"pass_cookie secret soon", true},
+		{"pass_cookie secret 1h extra", true},
+		{"pass_cookie secret\npass_cookie other", true},
+	}
+	for i, test := range tests {
+		_, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\n"+test.input+"\n}"))
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestPassKinds(t *testing.T) {
+	key := []byte("secret")
+	ip := net.ParseIP("8.8.8.8")
+	now := time.Now()
+
+	for _, kind := range []string{"", ChallengeJS, "pow8", "pow24", ChallengeCaptcha} {
+		token := newChallengePass(key, kind, ip, now.Add(time.Hour))
+		if got, ok := verifyPass(key, token, ip, now); !ok || got != kind {
+			t.Errorf("Expected a valid pass of %q, Got: %q, %t", kind, got, ok)
+		}
+		// the kind is signed.
+		if kind != "" {
+			if _, ok := verifyPass(key, ChallengeCaptcha+token[len(kind):], ip, now); ok && kind != ChallengeCaptcha {
+				t.Errorf("Expected the pass of %q not to be a captcha pass", kind)
+			}
+		}
+	}
+	for _, invalid := range []string{"pow40.a.b", "other.a.b", ".a.b", "a.b.c.d"} {
+		if _, ok := verifyPass(key, invalid, ip, now); ok {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+
+	// js, then pow by difficulty, then captcha, then support.
+	kinds := []string{ChallengeJS, "pow1", "pow16", "pow32", ChallengeCaptcha, ""}
+	for i := 1; i < len(kinds); i++ {
+		if passStrength(kinds[i]) <= passStrength(kinds[i-1]) {
+			t.Errorf("Expected %q to be stronger than %q", kinds[i], kinds[i-1])
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package ipfilter
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Placeholders of the decision on a request, set for the handlers after ipfilter when 'placeholders' is set,
+// e.g. {ipfilter_country} in a log format or a header.
+const (
+	PlaceholderCountry = "ipfilter_country" // ISO code of the client, empty without a database.
+	PlaceholderASN     = "ipfilter_asn"     // autonomous system of the client, empty without an ASN database.
+	PlaceholderAction  = "ipfilter_action"  // ActionAllow, ActionBlock or ActionChallenge.
+	PlaceholderRule    = "ipfilter_rule"    // 1-based position of the ipfilter block, BanRule or DefaultRule.
+)
+
+// PlaceholderSetter sets the placeholder 'name' of 'r', through the replacer of the server.
+type PlaceholderSetter func(r *http.Request, name, value string)
+
+var (
+	placeholderSettersMu sync.RWMutex
+	placeholderSetters   []PlaceholderSetter
+)
+
+// RegisterPlaceholderSetter adds a setter of the placeholders, the caddy plugins register theirs.
+func RegisterPlaceholderSetter(set PlaceholderSetter) {
+	placeholderSettersMu.Lock()
+	defer placeholderSettersMu.Unlock()
+	placeholderSetters = append(placeholderSetters, set)
+}
+
+// setPlaceholders sets the placeholders of the decision 'd' on 'r'.
+func setPlaceholders(r *http.Request, d DecisionRecord) {
+	var asn string
+	if d.ASN != 0 {
+		asn = strconv.FormatUint(uint64(d.ASN), 10)
+	}
+	values := map[string]string{
+		PlaceholderCountry: d.Country,
+		PlaceholderASN:     asn,
+		PlaceholderAction:  d.Action,
+		PlaceholderRule:    strconv.Itoa(d.Rule),
+	}
+
+	placeholderSettersMu.RLock()
+	defer placeholderSettersMu.RUnlock()
+	for _, set := range placeholderSetters {
+		for name, value := range values {
+			set(r, name, value)
+		}
+	}
+}
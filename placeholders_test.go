@@ -0,0 +1,66 @@
+package ipfilter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// testReplacer records the placeholders that are set.
+type testReplacer map[string]string
+
+func (tr testReplacer) Replace(s string) string { return s }
+func (tr testReplacer) Set(key, value string)   { tr[key] = value }
+
+func TestPlaceholders(t *testing.T) {
+	tests := []struct {
+		input    string
+		reqIP    string
+		reqPath  string
+		expected testReplacer
+	}{
+		{"ipfilter / {\nrule block\ncountry RU\ndatabase " + DataBase + "\nplaceholders\n}", "5.175.96.22:_", "/",
+			testReplacer{"ipfilter_country": "RU", "ipfilter_asn": "", "ipfilter_action": "block", "ipfilter_rule": "1"}},
+		{"ipfilter / {\nrule block\ncountry RU\ndatabase " + DataBase + "\nplaceholders\n}", "8.8.8.8:_", "/",
+			testReplacer{"ipfilter_country": "US", "ipfilter_asn": "", "ipfilter_action": "allow", "ipfilter_rule": "1"}},
+		{"ipfilter /private {\nrule allow\nip 10.0.0.1\n}\nipfilter / {\nrule block\nip 8.8.8.8\nchallenge js\npass_cookie secret\nplaceholders\n}",
+			"8.8.8.8:_", "/page", testReplacer{"ipfilter_country": "", "ipfilter_asn": "", "ipfilter_action": "challenge", "ipfilter_rule": "2"}},
+		// no block applies.
+		{"ipfilter /private {\nrule block\nip 8.8.8.8\nplaceholders\n}", "8.8.8.8:_", "/", testReplacer{}},
+		// not enabled.
+		{"ipfilter / {\nrule block\nip 8.8.8.8\n}", "8.8.8.8:_", "/", testReplacer{}},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", test.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		repl := testReplacer{}
+		req = req.WithContext(context.WithValue(req.Context(), httpserver.ReplacerCtxKey, httpserver.Replacer(repl)))
+
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if config.DBHandler != nil {
+			config.DBHandler.Close()
+		}
+		if !reflect.DeepEqual(repl, test.expected) {
+			t.Errorf("Test %d: Expected: %v, Got: %v", i, test.expected, repl)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package ipfilter
+
+import "fmt"
+
+// Policy describes the ipfilter blocks of a site, its JSON fields are the ones of the Caddy 2 handler.
+type Policy struct {
+	Database       string `json:"database,omitempty"`
+	DatabaseFormat string `json:"database_format,omitempty"`
+	ASNDatabase    string `json:"asn_database,omitempty"`
+	MatchMode      string `json:"match_mode,omitempty"`
+	Rules          []Rule `json:"rules"`
+}
+
+// Warning is a valid, but most likely unintended, part of a configuration.
+type Warning struct {
+	Rule    int    `json:"rule"` // 1-based position of the ipfilter block.
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("ipfilter block %d: %s", w.Rule, w.Message)
+}
+
+// policyWarnings returns the warnings about the paths of 'config': scopes where another block always
+// takes precedence.
+func policyWarnings(config IPFConfig) []Warning {
+	var warnings []Warning
+	scopes := config.scopes
+	if scopes == nil {
+		scopes = newScopeTrie(config.Paths, config.MatchMode)
+	}
+
+	for i, path := range config.Paths {
+		// the block winning at the root of a scope wins below it as well.
+		for _, scope := range path.PathScopes {
+			// the other blocks restricted to some requests leave it the rest.
+			idx, _ := scopes.at(path.ThreatLevel).matchIf(scope, func(j int) bool {
+				return j == i || !config.Paths[j].restricted()
+			})
+			if idx != i {
+				warnings = append(warnings, Warning{i + 1, fmt.Sprintf("scope %s never applies, block %d takes precedence", scope, idx+1)})
+			}
+		}
+	}
+	return warnings
+}
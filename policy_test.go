@@ -0,0 +1,60 @@
+package ipfilter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCaddyfileFragment(t *testing.T) {
+	tests := []struct {
+		input            string
+		shouldErr        bool
+		expectedRules    int
+		expectedWarnings []Warning
+	}{
+		{"ipfilter / {\nrule block\nip 192.168\n}", false, 1, nil},
+		{"ipfilter / {\nrule allow\ndatabase " + DataBase + "\ncountry US us\n}", false, 1, nil},
+		{"ipfilter / {\nrule allow\ndatabase " + DataBase + "\ncountry US usa\n}", true, 0, nil},
+		// the README pitfall: with match_mode first, '/' shadows every other block.
+		{"ipfilter / {\nrule allow\nip 32.55.3.10\nmatch_mode first\n}\nipfilter /webhook /api {\nrule allow\nip 131.133.10\n}", false, 2,
+			[]Warning{{2, "scope /webhook never applies, block 1 takes precedence"}, {2, "scope /api never applies, block 1 takes precedence"}}},
+		{"ipfilter /api {\nrule allow\nip 10.0\n}\nipfilter /api {\nrule block\nip 1.1.1.1\n}", false, 2,
+			[]Warning{{1, "scope /api never applies, block 2 takes precedence"}}},
+		{"ipfilter / {\nrule allow\nip 32.55.3.10\n}\nipfilter /webhook {\nrule allow\nip 131.133.10\n}", false, 2, nil},
+		{"ipfilter / {\nrule deny\nip 192.168\n}", true, 0, nil},
+		{"ipfilter / {\nrule block\nip 192.168\n}\ngzip", true, 0, nil},
+		{"ipfilter / {\nrule block\ncountry US\n}", true, 0, nil},
+	}
+
+	for i, test := range tests {
+		policy, warnings, err := ParseCaddyfileFragment([]byte(test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if len(policy.Rules) != test.expectedRules {
+			t.Fatalf("Test %d: Expected %d rules, Got: %+v", i, test.expectedRules, policy.Rules)
+		}
+		if !reflect.DeepEqual(warnings, test.expectedWarnings) {
+			t.Fatalf("Test %d: Expected warnings: %v, Got: %v", i, test.expectedWarnings, warnings)
+		}
+	}
+
+	policy, _, err := ParseCaddyfileFragment([]byte("ipfilter /secret {\nrule allow\ndatabase " + DataBase + "\ncountry US\nmatch_mode priority\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &Policy{
+		Database:  DataBase,
+		MatchMode: MatchPriority,
+		Rules:     []Rule{{PathScopes: []string{"/secret"}, Rule: "allow", CountryCodes: []string{"US"}}},
+	}
+	if !reflect.DeepEqual(policy, expected) {
+		t.Fatalf("Expected: %+v, Got: %+v", expected, policy)
+	}
+}
@@ -0,0 +1,84 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadPolicyDir reads the rules delegated to the files of 'dir', every '<scope>.json' file holds the rules of
+// '/<scope>', in the JSON of the admin endpoint, e.g. 'api/v2.json' holds the rules of '/api/v2'. Rules without
+// scopes get the one of their file, rules with scopes outside of it are rejected.
+// The directory and the files must be owned by root or by the user running caddy, and not be world-writable,
+// symlinks are rejected.
+func LoadPolicyDir(dir string) (RuleSet, error) {
+	var rs RuleSet
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		isJSON := fi.Mode().IsRegular() && filepath.Ext(file) == ".json"
+		if !fi.IsDir() && !isJSON && fi.Mode()&os.ModeSymlink == 0 {
+			// e.g. a README or an editor's swap file.
+			return nil
+		}
+		if err := checkPolicyFile(fi); err != nil {
+			return errors.New(file + ": " + err.Error())
+		}
+		if !isJSON {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		scope := "/" + filepath.ToSlash(strings.TrimSuffix(rel, ".json"))
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var fileRules RuleSet
+		if err := json.Unmarshal(data, &fileRules); err != nil {
+			return errors.New(file + ": " + err.Error())
+		}
+		if len(fileRules.Paths) == 0 {
+			return errors.New(file + ": no rules")
+		}
+
+		for _, rule := range fileRules.Paths {
+			if len(rule.PathScopes) == 0 {
+				rule.PathScopes = []string{scope}
+			}
+			for _, ruleScope := range rule.PathScopes {
+				if ruleScope != scope && !strings.HasPrefix(ruleScope, scope+"/") {
+					return errors.New(file + ": scope " + ruleScope + " is outside of " + scope)
+				}
+			}
+			rs.Paths = append(rs.Paths, rule)
+		}
+		return nil
+	})
+	if err != nil {
+		return RuleSet{}, errors.New("ipfilter: policy_dir: " + err.Error())
+	}
+	return rs, nil
+}
+
+// checkPolicyFile returns an error unless a file of a policy_dir can only be written by root or caddy.
+func checkPolicyFile(fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return errors.New("symlinks aren't allowed")
+	}
+	if fi.Mode().Perm()&0002 != 0 {
+		return errors.New("is world-writable")
+	}
+	if uid, ok := fileOwner(fi); ok && uid != 0 && uid != os.Getuid() {
+		return errors.New("must be owned by root or by the user running caddy")
+	}
+	return nil
+}
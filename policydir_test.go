@@ -0,0 +1,127 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+// writePolicyDir writes 'files', relative paths to their content, to a new policy directory.
+func writePolicyDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatalf("Could not create a temporary directory: %v", err)
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("Could not create %s: %v", filepath.Dir(file), err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("Could not write %s: %v", file, err)
+		}
+	}
+	return dir
+}
+
+func TestLoadPolicyDir(t *testing.T) {
+	dir := writePolicyDir(t, map[string]string{
+		"api.json":    `{"paths": [{"rule": "block", "ips": ["1.1.1.1"]}]}`,
+		"api/v2.json": `{"paths": [{"scopes": ["/api/v2/admin"], "rule": "allow", "ips": ["10.0.0.1"]}]}`,
+		"README":      "team policies",
+	})
+	defer os.RemoveAll(dir)
+
+	rs, err := LoadPolicyDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// in lexical order, 'api' comes before 'api.json'.
+	expected := RuleSet{Paths: []Rule{
+		{PathScopes: []string{"/api/v2/admin"}, Rule: "allow", IPs: []string{"10.0.0.1"}},
+		{PathScopes: []string{"/api"}, Rule: "block", IPs: []string{"1.1.1.1"}},
+	}}
+	if !reflect.DeepEqual(rs, expected) {
+		t.Fatalf("Expected: %+v, Got: %+v", expected, rs)
+	}
+
+	tests := []struct {
+		files map[string]string
+		setup func(dir string) error
+	}{
+		// scopes can't leave the file's scope.
+		{map[string]string{"api.json": `{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["1.1.1.1"]}]}`}, nil},
+		{map[string]string{"api.json": `{"paths": [{"scopes": ["/apix"], "rule": "block", "ips": ["1.1.1.1"]}]}`}, nil},
+		{map[string]string{"api.json": `{"paths": []}`}, nil},
+		{map[string]string{"api.json": `{"paths": [`}, nil},
+		{map[string]string{"api.json": `{"paths": [{"rule": "block", "ips": ["1.1.1.1"]}]}`}, func(dir string) error {
+			return os.Chmod(filepath.Join(dir, "api.json"), 0646)
+		}},
+		{map[string]string{"api/v2.json": `{"paths": [{"rule": "block", "ips": ["1.1.1.1"]}]}`}, func(dir string) error {
+			return os.Chmod(filepath.Join(dir, "api"), 0777)
+		}},
+		{map[string]string{"web.txt": "not a policy"}, func(dir string) error {
+			return os.Symlink(filepath.Join(dir, "web.txt"), filepath.Join(dir, "web.json"))
+		}},
+	}
+
+	for i, test := range tests {
+		dir := writePolicyDir(t, test.files)
+		if test.setup != nil {
+			if err := test.setup(dir); err != nil {
+				t.Fatalf("Test %d: Setup failed: %v", i, err)
+			}
+		}
+		if _, err := LoadPolicyDir(dir); err == nil {
+			t.Fatalf("Test %d: Expected an error", i)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPolicyDirParse(t *testing.T) {
+	dir := writePolicyDir(t, map[string]string{
+		"api.json": `{"paths": [{"rule": "block", "ips": ["1.1.1.1"]}]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\npolicy_dir "+dir+"\n}\nipfilter /admin {\nrule allow\nip 10.0.0.1\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rs := RulesFromPaths(config.Paths)
+	expected := RuleSet{Paths: []Rule{
+		{PathScopes: []string{"/admin"}, Rule: "allow", IPs: []string{"10.0.0.1"}},
+		{PathScopes: []string{"/api"}, Rule: "block", IPs: []string{"1.1.1.1"}},
+	}}
+	if !reflect.DeepEqual(rs, expected) {
+		t.Fatalf("Expected: %+v, Got: %+v", expected, rs)
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\npolicy_dir /nonexistent\n}")); err == nil {
+		t.Fatalf("Expected an error for a missing policy_dir")
+	}
+}
+
+func TestPolicyDirBlockPage(t *testing.T) {
+	dir := writePolicyDir(t, map[string]string{
+		"api.json": `{"paths": [{"rule": "block", "ips": ["1.1.1.1"], "blockpage": "` + BlockPage + `"}]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	// a team can use the blockpages of the Caddyfile, not any file caddy can read.
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\npolicy_dir "+dir+"\n}\nipfilter /admin {\nrule allow\nip 10.0.0.1\nblockpage "+BlockPage+"\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.Paths) != 2 || config.Paths[1].BlockPage != BlockPage {
+		t.Fatalf("Expected the blockpage of the policy, Got: %+v", config.Paths)
+	}
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\npolicy_dir "+dir+"\n}\nipfilter /admin {\nrule allow\nip 10.0.0.1\n}")); err == nil {
+		t.Fatalf("Expected an error for a blockpage missing from the Caddyfile")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package ipfilter
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the uid of the owner of a file.
+func fileOwner(fi os.FileInfo) (int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
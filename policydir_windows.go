@@ -0,0 +1,8 @@
+package ipfilter
+
+import "os"
+
+// fileOwner returns false, files have no uid on windows, only their permissions are checked.
+func fileOwner(fi os.FileInfo) (int, bool) {
+	return 0, false
+}
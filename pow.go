@@ -0,0 +1,158 @@
+package ipfilter
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Difficulties of 'challenge pow', the number of leading zero bits of the hash: every bit doubles the
+// work, the default takes a browser well under a second.
+const (
+	defaultPowDifficulty = 16
+	maxPowDifficulty     = 32
+)
+
+// powChallengeTTL is how long a client has to solve the puzzle.
+const powChallengeTTL = 5 * time.Minute
+
+// powChallengePage looks for a counter so that the SHA-256 of "<nonce>:<counter>" starts with 'difficulty'
+// zero bits, and sends it once found. The search yields to the browser between rounds.
+var powChallengePage = template.Must(template.New("pow").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Checking your browser</title>
+</head>
+<body>
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="challenge" value="pow">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<input type="hidden" name="difficulty" value="{{.Difficulty}}">
+<input type="hidden" name="answer" value="">
+</form>
+<p>Checking your browser, this can take a few seconds.</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<script>
+(function() {
+	var K = [
+		0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+		0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+		0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+		0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+		0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+		0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+		0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+		0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+	];
+
+	// the first 32 bits of the SHA-256 of the ASCII string s.
+	function sha256(s) {
+		var H = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+		var n = s.length, blocks = ((n + 8) >> 6) + 1, m = [], w = [], i, j;
+		for (i = 0; i < blocks * 16; i++) {
+			m[i] = 0;
+		}
+		for (i = 0; i < n; i++) {
+			m[i >> 2] |= s.charCodeAt(i) << (24 - (i % 4) * 8);
+		}
+		m[n >> 2] |= 0x80 << (24 - (n % 4) * 8);
+		m[blocks * 16 - 1] = n * 8;
+		for (i = 0; i < m.length; i += 16) {
+			var a = H[0], b = H[1], c = H[2], d = H[3], e = H[4], f = H[5], g = H[6], h = H[7];
+			for (j = 0; j < 64; j++) {
+				if (j < 16) {
+					w[j] = m[i + j];
+				} else {
+					var x = w[j - 15], y = w[j - 2];
+					w[j] = (((x >>> 7 | x << 25) ^ (x >>> 18 | x << 14) ^ (x >>> 3)) + w[j - 16] +
+						((y >>> 17 | y << 15) ^ (y >>> 19 | y << 13) ^ (y >>> 10)) + w[j - 7]) | 0;
+				}
+				var t1 = (h + ((e >>> 6 | e << 26) ^ (e >>> 11 | e << 21) ^ (e >>> 25 | e << 7)) +
+					((e & f) ^ (~e & g)) + K[j] + w[j]) | 0;
+				var t2 = (((a >>> 2 | a << 30) ^ (a >>> 13 | a << 19) ^ (a >>> 22 | a << 10)) +
+					((a & b) ^ (a & c) ^ (b & c))) | 0;
+				h = g; g = f; f = e; e = (d + t1) | 0; d = c; c = b; b = a; a = (t1 + t2) | 0;
+			}
+			H[0] = (H[0] + a) | 0; H[1] = (H[1] + b) | 0; H[2] = (H[2] + c) | 0; H[3] = (H[3] + d) | 0;
+			H[4] = (H[4] + e) | 0; H[5] = (H[5] + f) | 0; H[6] = (H[6] + g) | 0; H[7] = (H[7] + h) | 0;
+		}
+		return H[0] >>> 0;
+	}
+
+	var nonce = {{.Nonce}}, difficulty = {{.Difficulty}}, counter = 0;
+	var form = document.forms[0];
+	function search() {
+		for (var end = counter + 50000; counter < end; counter++) {
+			if ((sha256(nonce + ":" + counter) >>> (32 - difficulty)) === 0) {
+				form.elements.answer.value = counter;
+				form.submit();
+				return;
+			}
+		}
+		setTimeout(search, 0);
+	}
+	search();
+})();
+</script>
+</body>
+</html>
+`))
+
+// powDifficulty returns the difficulty of 'path'.
+func powDifficulty(path IPPath) int {
+	if path.ChallengeDifficulty > 0 {
+		return path.ChallengeDifficulty
+	}
+	return defaultPowDifficulty
+}
+
+// powSolves returns true if the SHA-256 of "<nonce>:<answer>" starts with 'difficulty' zero bits.
+func powSolves(nonce, answer string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(nonce + ":" + answer))
+	return binary.BigEndian.Uint32(sum[:4])>>uint(32-difficulty) == 0
+}
+
+// powPurpose signs the nonces of a difficulty, so that a client can't claim an easier one.
+func powPurpose(difficulty int) string {
+	return "pow:" + strconv.Itoa(difficulty)
+}
+
+// servePowChallenge writes the page of the proof-of-work challenge, its nonce is bound to 'ip' and to
+// 'difficulty', and signed with the key of 'pc' so that no state is kept until the client answers.
+func servePowChallenge(w http.ResponseWriter, r *http.Request, pc *PassCookie, ip net.IP, difficulty int) (int, error) {
+	nonce := newSignedToken(pc.Key, powPurpose(difficulty), ip, time.Now().Add(powChallengeTTL))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	err := powChallengePage.Execute(w, struct {
+		Action, Redirect, Nonce string
+		Difficulty              int
+	}{ChallengePath, r.URL.RequestURI(), nonce, difficulty})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// we wrote the page, return OK.
+	return http.StatusOK, nil
+}
+
+// verifyPowChallenge returns the difficulty of the puzzle 'form' solves, if it was given to 'ip' and hasn't
+// expired, 0 otherwise.
+func verifyPowChallenge(pc *PassCookie, form url.Values, ip net.IP, now time.Time) int {
+	difficulty, err := strconv.Atoi(form.Get("difficulty"))
+	if err != nil || difficulty <= 0 || difficulty > maxPowDifficulty {
+		return 0
+	}
+	nonce, answer := form.Get("nonce"), form.Get("answer")
+	if answer == "" || !verifySignedToken(pc.Key, powPurpose(difficulty), nonce, ip, now) || !powSolves(nonce, answer, difficulty) {
+		return 0
+	}
+	return difficulty
+}
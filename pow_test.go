@@ -0,0 +1,192 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// solvePow returns the first answer to 'nonce', like the page does.
+func solvePow(nonce string, difficulty int) string {
+	for counter := 0; ; counter++ {
+		if answer := strconv.Itoa(counter); powSolves(nonce, answer, difficulty) {
+			return answer
+		}
+	}
+}
+
+func TestPowChallenge(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8 8.8.4.4\nchallenge pow 8\npass_cookie secret\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	request := func(method, target, remoteAddr string, form url.Values) (int, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		return status, rec
+	}
+
+	status, rec := request("GET", "/", "8.8.8.8:_", nil)
+	if status != http.StatusOK || rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected the challenge page with a 403, Got: '%d' and '%d'", status, rec.Code)
+	}
+	page := rec.Body.String()
+	match := regexp.MustCompile(`name="nonce" value="([^"]+)"`).FindStringSubmatch(page)
+	if match == nil || !strings.Contains(page, `name="difficulty" value="8"`) {
+		t.Fatalf("Expected a nonce of difficulty 8 in the challenge page, Got: %s", page)
+	}
+	nonce := match[1]
+
+	answer := func(difficulty, answer string) url.Values {
+		return url.Values{"challenge": {"pow"}, "redirect": {"/"}, "nonce": {nonce}, "difficulty": {difficulty}, "answer": {answer}}
+	}
+	var wrong string
+	for counter := 0; wrong == ""; counter++ {
+		if !powSolves(nonce, strconv.Itoa(counter), 8) {
+			wrong = strconv.Itoa(counter)
+		}
+	}
+	tests := []struct {
+		remoteAddr string
+		form       url.Values
+		passed     bool
+	}{
+		{"8.8.8.8:_", answer("8", wrong), false},
+		{"8.8.8.8:_", answer("8", ""), false},
+		// the nonce was signed for its difficulty.
+		{"8.8.8.8:_", answer("1", solvePow(nonce, 1)), false},
+		{"8.8.8.8:_", answer("40", "0"), false},
+		{"8.8.4.4:_", answer("8", solvePow(nonce, 8)), false},
+		{"8.8.8.8:_", answer("8", solvePow(nonce, 8)), true},
+	}
+	for i, test := range tests {
+		status, rec := request("POST", ChallengePath, test.remoteAddr, test.form)
+		if status != http.StatusSeeOther {
+			t.Fatalf("Test %d: Expected a redirect, Got: '%d'", i, status)
+		}
+		if cookies := rec.Result().Cookies(); (len(cookies) == 1) != test.passed {
+			t.Fatalf("Test %d: Expected a pass: %t, Got: %v", i, test.passed, cookies)
+		}
+	}
+}
+
+func TestPowParse(t *testing.T) {
+	tests := []struct {
+		input      string
+		difficulty int
+		shouldErr  bool
+	}{
+		{"challenge pow", 0, false},
+		{"challenge pow 20", 20, false},
+		{"challenge pow 0", 0, true},
+		{"challenge pow 33", 0, true},
+		{"challenge pow hard", 0, true},
+		{"challenge js 20", 0, true},
+		{"challenge pow 20 30", 0, true},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\npass_cookie secret\n"+test.input+"\n}"))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if config.Paths[0].ChallengeDifficulty != test.difficulty {
+			t.Errorf("Test %d: Expected difficulty %d, Got: %d", i, test.difficulty, config.Paths[0].ChallengeDifficulty)
+		}
+	}
+}
+
+func TestPowPassDifficulty(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", `ipfilter / {
+		rule block
+		ip 8.8.8.8
+		challenge pow 8
+		pass_cookie secret
+	}
+	ipfilter /api {
+		rule block
+		ip 8.8.8.8
+		challenge pow 24
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	request := func(method, target string, form url.Values, cookie *http.Cookie) (int, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "8.8.8.8:_"
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		return status, rec
+	}
+
+	// the easy puzzle of the first scope, claimed for the second one.
+	nonce := newSignedToken([]byte("secret"), powPurpose(8), net.ParseIP("8.8.8.8"), time.Now().Add(time.Minute))
+	_, rec := request("POST", ChallengePath, url.Values{"challenge": {"pow"}, "redirect": {"/api"}, "nonce": {nonce}, "difficulty": {"8"}, "answer": {solvePow(nonce, 8)}}, nil)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a pass, Got: %v", cookies)
+	}
+	if status, rec := request("GET", "/", nil, cookies[0]); status != http.StatusOK || rec.Code != http.StatusOK {
+		t.Errorf("Expected the pass to go through the easy challenge, Got: '%d' and '%d'", status, rec.Code)
+	}
+	status, rec := request("GET", "/api", nil, cookies[0])
+	if status != http.StatusOK || rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `name="difficulty" value="24"`) {
+		t.Errorf("Expected the puzzle of difficulty 24 despite the pass, Got: '%d' and '%d'", status, rec.Code)
+	}
+
+	// a pass of difficulty 24 goes through both.
+	pass := &http.Cookie{Name: PassCookieName, Value: newChallengePass([]byte("secret"), passKind(ChallengePow, 24), net.ParseIP("8.8.8.8"), time.Now().Add(time.Hour))}
+	for _, path := range []string{"/", "/api"} {
+		if status, rec := request("GET", path, nil, pass); status != http.StatusOK || rec.Code != http.StatusOK {
+			t.Errorf("Expected the pass to go through %s, Got: '%d' and '%d'", path, status, rec.Code)
+		}
+	}
+
+	// a difficulty no rule serves gets no pass.
+	nonce = newSignedToken([]byte("secret"), powPurpose(4), net.ParseIP("8.8.8.8"), time.Now().Add(time.Minute))
+	_, rec = request("POST", ChallengePath, url.Values{"challenge": {"pow"}, "redirect": {"/"}, "nonce": {nonce}, "difficulty": {"4"}, "answer": {solvePow(nonce, 4)}}, nil)
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("Expected no pass for difficulty 4, Got: %v", cookies)
+	}
+}
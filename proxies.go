@@ -0,0 +1,139 @@
+package ipfilter
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Strategies selecting the client IPs among the X-Forwarded-For entries.
+const (
+	XFFAll                = "all"                 // every entry is checked, the default.
+	XFFLeftmost           = "leftmost"            // the first entry, as set by the client itself.
+	XFFRightmost          = "rightmost"           // the last entry, as set by the proxy in front of caddy.
+	XFFRightmostUntrusted = "rightmost_untrusted" // the last entry that isn't a trusted proxy, or the TrustedHops-th from the right.
+)
+
+// Policies of IPPath.XFFPolicy, deciding how the client IPs of a forwarding chain are evaluated.
+const (
+	XFFPolicyAny   = "any"   // the block applies if any IP matches, the default.
+	XFFPolicyAll   = "all"   // the request is only allowed if every IP is allowed on its own.
+	XFFPolicyFirst = "first" // only the first IP, the client as seen by the first proxy.
+	XFFPolicyLast  = "last"  // only the last IP, the hop closest to caddy.
+)
+
+// checkXFFPolicy returns an error if 'policy' isn't one of the XFF policies, empty is XFFPolicyAny.
+func checkXFFPolicy(policy string) error {
+	switch policy {
+	case "", XFFPolicyAny, XFFPolicyAll, XFFPolicyFirst, XFFPolicyLast:
+		return nil
+	}
+	return errors.New("ipfilter: xff_policy should be 'any', 'all', 'first' or 'last'")
+}
+
+// ParseTrustedProxies parses the CIDRs or single IPs of trusted proxies.
+func ParseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		network, ok := parseNetwork(value)
+		if !ok {
+			return nil, errors.New("ipfilter: Can't parse trusted proxy: " + value)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// parseNetwork parses a CIDR, or a single IP as a network of its own.
+func parseNetwork(value string) (*net.IPNet, bool) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, false
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	return network, err == nil
+}
+
+// SetXFFStrategy validates and sets XFFStrategy, 'hops' is the TrustedHops of XFFRightmostUntrusted, 0 if unset.
+func (config *IPFConfig) SetXFFStrategy(strategy string, hops int) error {
+	switch strategy {
+	case XFFAll, XFFLeftmost, XFFRightmost, XFFRightmostUntrusted:
+	default:
+		return errors.New("ipfilter: xff_strategy should be 'all', 'leftmost', 'rightmost' or 'rightmost_untrusted'")
+	}
+	if hops < 0 {
+		return errors.New("ipfilter: the number of trusted hops should be a positive number")
+	}
+	if hops != 0 && strategy != XFFRightmostUntrusted {
+		return errors.New("ipfilter: only 'rightmost_untrusted' takes a number of trusted hops")
+	}
+
+	config.XFFStrategy, config.TrustedHops = strategy, hops
+	return nil
+}
+
+// trustsProxy returns true if the X-Forwarded-For header of 'r' can be honored, that is if there are no
+// TrustedProxies or if the request comes from one of them.
+func (config *IPFConfig) trustsProxy(r *http.Request) bool {
+	if len(config.TrustedProxies) == 0 {
+		return true
+	}
+
+	ip := remoteIP(r)
+	return ip != nil && config.isTrustedProxy(ip)
+}
+
+// isTrustedProxy returns true if 'ip' belongs to one of the TrustedProxies.
+func (config *IPFConfig) isTrustedProxy(ip net.IP) bool {
+	for _, network := range config.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectForwarded returns the entries of a X-Forwarded-For header to check, according to XFFStrategy.
+func (config *IPFConfig) selectForwarded(ips []net.IP) []net.IP {
+	switch config.XFFStrategy {
+	case XFFLeftmost:
+		return ips[:1]
+	case XFFRightmost:
+		return ips[len(ips)-1:]
+	case XFFRightmostUntrusted:
+		if config.TrustedHops > 0 {
+			// a shorter chain didn't go through all the proxies, its first entry is the closest to the client.
+			if config.TrustedHops >= len(ips) {
+				return ips[:1]
+			}
+			return ips[len(ips)-config.TrustedHops : len(ips)-config.TrustedHops+1]
+		}
+		for i := len(ips) - 1; i > 0; i-- {
+			if !config.isTrustedProxy(ips[i]) {
+				return ips[i : i+1]
+			}
+		}
+		return ips[:1]
+	}
+	return ips
+}
+
+// clientIPs returns the IPs of the client of 'r', the forwarding headers are ignored if 'strict'
+// or if the request doesn't come from a trusted proxy, otherwise their entries are selected by XFFStrategy.
+func (ipf IPFilter) clientIPs(r *http.Request, strict bool) ([]net.IP, error) {
+	strict = strict || !ipf.Config.trustsProxy(r)
+	ips, forwarded, err := getClientIPs(r, strict, ipf.Config.ClientIPHeaders)
+	if err != nil || !forwarded {
+		return ips, err
+	}
+	return ipf.Config.selectForwarded(ips), nil
+}
@@ -0,0 +1,197 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 1.1.1.1\ntrusted_proxies 10.0.0.0/8 192.168.1.1\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		reqIP          string
+		fwdFor         string
+		expectedStatus int
+	}{
+		{"10.1.2.3:_", "1.1.1.1", http.StatusForbidden},
+		{"192.168.1.1:_", "1.1.1.1", http.StatusForbidden},
+		{"10.1.2.3:_", "8.8.8.8", http.StatusOK},
+		// the header of untrusted clients is ignored.
+		{"192.168.1.2:_", "1.1.1.1", http.StatusOK},
+		{"8.8.8.8:_", "1.1.1.1", http.StatusOK},
+		{"1.1.1.1:_", "8.8.8.8", http.StatusForbidden},
+		{"1.1.1.1:_", "", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		if test.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", test.fwdFor)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestXFFStrategy(t *testing.T) {
+	tests := []struct {
+		config         string
+		fwdFor         string
+		expectedStatus int
+	}{
+		// 1.1.1.1 is blocked, 8.8.8.8 isn't, 10.0.0.0/8 are trusted proxies.
+		{"", "8.8.8.8, 1.1.1.1", http.StatusForbidden},
+		{"xff_strategy all", "1.1.1.1, 8.8.8.8", http.StatusForbidden},
+		{"xff_strategy leftmost", "1.1.1.1, 8.8.8.8", http.StatusForbidden},
+		{"xff_strategy leftmost", "8.8.8.8, 1.1.1.1", http.StatusOK},
+		{"xff_strategy rightmost", "1.1.1.1, 8.8.8.8", http.StatusOK},
+		{"xff_strategy rightmost", "8.8.8.8, 1.1.1.1", http.StatusForbidden},
+		{"xff_strategy rightmost_untrusted", "8.8.8.8, 1.1.1.1, 10.0.0.2", http.StatusForbidden},
+		{"xff_strategy rightmost_untrusted", "1.1.1.1, 8.8.8.8, 10.0.0.2", http.StatusOK},
+		{"xff_strategy rightmost_untrusted", "1.1.1.1, 10.0.0.3, 10.0.0.2", http.StatusForbidden},
+		{"xff_strategy rightmost_untrusted 2", "8.8.8.8, 1.1.1.1, 9.9.9.9", http.StatusForbidden},
+		{"xff_strategy rightmost_untrusted 2", "1.1.1.1, 8.8.8.8, 9.9.9.9", http.StatusOK},
+		{"xff_strategy rightmost_untrusted 3", "1.1.1.1, 8.8.8.8", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		input := "ipfilter / {\nrule block\nip 1.1.1.1\ntrusted_proxies 10.0.0.0/8\n" + test.config + "\n}"
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "10.0.0.1:_"
+		req.Header.Set("X-Forwarded-For", test.fwdFor)
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	for _, input := range []string{"xff_strategy", "xff_strategy middle", "xff_strategy leftmost 1", "xff_strategy rightmost_untrusted 0"} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 1.1.1.1\n"+input+"\n}")); err == nil {
+			t.Fatalf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestXFFPolicy(t *testing.T) {
+	tests := []struct {
+		config         string
+		fwdFor         string
+		expectedStatus int
+	}{
+		// 1.1.1.1 and 2.2.2.2 are allowed, the others are blocked.
+		{"rule allow\nip 1.1.1.1 2.2.2.2", "1.1.1.1, 8.8.8.8", http.StatusOK},
+		{"rule allow\nip 1.1.1.1 2.2.2.2\nxff_policy any", "8.8.8.8, 1.1.1.1", http.StatusOK},
+		{"rule allow\nip 1.1.1.1 2.2.2.2\nxff_policy all", "1.1.1.1, 8.8.8.8", http.StatusForbidden},
+		{"rule allow\nip 1.1.1.1 2.2.2.2\nxff_policy all", "1.1.1.1, 2.2.2.2", http.StatusOK},
+		{"rule allow\nip 1.1.1.1 2.2.2.2\nxff_policy all", "2.2.2.2", http.StatusOK},
+		{"rule allow\nip 1.1.1.1 2.2.2.2\nxff_policy first", "1.1.1.1, 8.8.8.8", http.StatusOK},
+		{"rule allow\nip 1.1.1.1 2.2.2.2\nxff_policy first", "8.8.8.8, 1.1.1.1", http.StatusForbidden},
+		{"rule allow\nip 1.1.1.1 2.2.2.2\nxff_policy last", "1.1.1.1, 8.8.8.8", http.StatusForbidden},
+		{"rule allow\nip 1.1.1.1 2.2.2.2\nxff_policy last", "8.8.8.8, 1.1.1.1", http.StatusOK},
+		// a blocked IP anywhere is already enough to block the request.
+		{"rule block\nip 8.8.8.8\nxff_policy all", "1.1.1.1, 8.8.8.8", http.StatusForbidden},
+		{"rule block\nip 8.8.8.8\nxff_policy first", "1.1.1.1, 8.8.8.8", http.StatusOK},
+		// with xff_strategy, the policy applies to the selected entries.
+		{"rule allow\nip 1.1.1.1 2.2.2.2\nxff_policy all\nxff_strategy rightmost", "8.8.8.8, 1.1.1.1", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		input := "ipfilter / {\n" + test.config + "\n}"
+		config, err := ipfilterParse(caddy.NewTestController("http", input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "10.0.0.1:_"
+		req.Header.Set("X-Forwarded-For", test.fwdFor)
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	for _, input := range []string{"xff_policy", "xff_policy most"} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 1.1.1.1\n"+input+"\n}")); err == nil {
+			t.Fatalf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		values    []string
+		shouldErr bool
+		expected  []string
+	}{
+		{[]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8", "::1"}, false, []string{"10.0.0.0/8", "192.168.1.1/32", "fd00::/8", "::1/128"}},
+		{[]string{"10.0.0.0/33"}, true, nil},
+		{[]string{"10.0"}, true, nil},
+	}
+
+	for i, test := range tests {
+		nets, err := ParseTrustedProxies(test.values)
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if len(nets) != len(test.expected) {
+			t.Fatalf("Test %d: Expected: %v, Got: %v", i, test.expected, nets)
+		}
+		for j, network := range nets {
+			if network.String() != test.expected[j] {
+				t.Fatalf("Test %d: Expected: %v, Got: %v", i, test.expected, nets)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultProxyProtocolTimeout is how long a connection has to send its PROXY protocol header.
+const defaultProxyProtocolTimeout = 5 * time.Second
+
+var (
+	// proxyV1Prefix starts the text header of the PROXY protocol version 1.
+	proxyV1Prefix = []byte("PROXY ")
+	// proxyV2Signature starts the binary header of the PROXY protocol version 2.
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ProxyProtocolListener reads the PROXY protocol header (version 1 or 2) that load balancers such as
+// HAProxy or an AWS NLB send at the start of every connection, the RemoteAddr of the accepted connections
+// is the client's address from the header. If Sources isn't empty, only the connections from these CIDRs
+// are expected to send a header, the others are served as is.
+type ProxyProtocolListener struct {
+	net.Listener
+	Sources []*net.IPNet
+	Timeout time.Duration // defaultProxyProtocolTimeout if zero.
+}
+
+// NewProxyProtocolListener wraps 'l' to read the PROXY protocol header of the connections from 'sources',
+// or of every connection if 'sources' is empty.
+func NewProxyProtocolListener(l net.Listener, sources []*net.IPNet) *ProxyProtocolListener {
+	return &ProxyProtocolListener{Listener: l, Sources: sources}
+}
+
+// Accept returns the next connection, its header is read on the first Read or RemoteAddr so that a slow
+// client doesn't hold up the others.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.expectsHeader(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = defaultProxyProtocolTimeout
+	}
+	return &proxyProtocolConn{Conn: conn, timeout: timeout}, nil
+}
+
+// expectsHeader returns true if the connection from 'addr' has to start with a header.
+func (l *ProxyProtocolListener) expectsHeader(addr net.Addr) bool {
+	if len(l.Sources) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.Sources {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// File implements caddy.Listener if the underlying listener does.
+func (l *ProxyProtocolListener) File() (*os.File, error) {
+	if fl, ok := l.Listener.(interface {
+		File() (*os.File, error)
+	}); ok {
+		return fl.File()
+	}
+	return nil, errors.New("ipfilter: the listener doesn't support File()")
+}
+
+// proxyProtocolConn is a connection starting with a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr // nil if the header doesn't carry an address, e.g. the health checks of the load balancer.
+	err    error
+}
+
+// readHeader reads the header once, the connection is unusable if it is invalid.
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = errors.New("ipfilter: invalid PROXY protocol header from " + c.Conn.RemoteAddr().String() + ": " + c.err.Error())
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client's address from the header, or the address of the connection.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a version 1 or 2 header, and returns the source address it carries.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	if bytes.Equal(prefix, proxyV2Signature[:len(prefix)]) {
+		return readProxyV2(r)
+	}
+	return nil, errors.New("no header")
+}
+
+// readProxyV1 reads a text header, e.g. "PROXY TCP4 1.1.1.1 10.0.0.1 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// a header is 107 bytes at most.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed header " + strconv.Quote(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errors.New("malformed header " + strconv.Quote(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, errors.New("no header")
+	}
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return nil, errors.New("unsupported version " + strconv.Itoa(int(verCmd>>4)))
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0xf {
+	case 0x0:
+		// LOCAL, sent by the load balancer itself.
+		return nil, nil
+	case 0x1:
+		// PROXY.
+	default:
+		return nil, errors.New("unsupported command " + strconv.Itoa(int(verCmd&0xf)))
+	}
+
+	// the addresses are followed by the ports, and optional TLVs that are skipped.
+	var size int
+	switch family >> 4 {
+	case 0x1:
+		size = net.IPv4len
+	case 0x2:
+		size = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX, there is no IP.
+		return nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, errors.New("addresses too short")
+	}
+	ip := make(net.IP, size)
+	copy(ip, body[:size])
+	port := binary.BigEndian.Uint16(body[2*size:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,151 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestProxyProtocolListener(t *testing.T) {
+	v2 := func(verCmd, family byte, addrs ...byte) string {
+		return string(proxyV2Signature) + string([]byte{verCmd, family, 0, byte(len(addrs))}) + string(addrs)
+	}
+
+	tests := []struct {
+		sources        string
+		header         string
+		expectedRemote string // the address of the connection if empty.
+		expectedErr    bool
+	}{
+		{"", "PROXY TCP4 1.1.1.1 10.0.0.1 56324 443\r\n", "1.1.1.1:56324", false},
+		{"", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"", "PROXY UNKNOWN\r\n", "", false},
+		{"", "PROXY TCP4 2001:db8::1 10.0.0.1 56324 443\r\n", "", true},
+		{"", "PROXY TCP4 1.1.1.1 10.0.0.1 56324\r\n", "", true},
+		{"", "PROXY TCP4 1.1.1.1 10.0.0.1 56324 443\n", "", true},
+		{"", "GET / HTTP/1.1\r\n", "", true},
+		{"", v2(0x21, 0x11, 1, 1, 1, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb), "1.1.1.1:56324", false},
+		{"", v2(0x21, 0x21,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+			0xdc, 0x04, 0x01, 0xbb), "[2001:db8::1]:56324", false},
+		// TLVs are skipped.
+		{"", v2(0x21, 0x11, 1, 1, 1, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb, 0x04, 0x00, 0x01, 0x00), "1.1.1.1:56324", false},
+		{"", v2(0x20, 0x00), "", false},
+		{"", v2(0x21, 0x11, 1, 1, 1, 1), "", true},
+		{"", v2(0x11, 0x11, 1, 1, 1, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb), "", true},
+		// connections from other sources are served as is.
+		{"127.0.0.0/8", "PROXY TCP4 1.1.1.1 10.0.0.1 56324 443\r\n", "1.1.1.1:56324", false},
+		{"10.0.0.0/8", "", "", false},
+	}
+
+	for i, test := range tests {
+		var sources []*net.IPNet
+		if test.sources != "" {
+			sources, _ = ParseTrustedProxies([]string{test.sources})
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Test %d: Can't listen: %v", i, err)
+		}
+		pl := NewProxyProtocolListener(ln, sources)
+
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Test %d: Can't dial: %v", i, err)
+		}
+		if _, err := client.Write([]byte(test.header + "hello")); err != nil {
+			t.Fatalf("Test %d: Can't write: %v", i, err)
+		}
+		client.Close()
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("Test %d: Can't accept: %v", i, err)
+		}
+		remote := conn.RemoteAddr().String()
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		ln.Close()
+
+		if test.expectedErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error, Got: %q", i, data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if test.expectedRemote == "" {
+			test.expectedRemote = client.LocalAddr().String()
+		}
+		if remote != test.expectedRemote {
+			t.Fatalf("Test %d: Expected RemoteAddr: %s, Got: %s", i, test.expectedRemote, remote)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("Test %d: Expected the data after the header, Got: %q", i, data)
+		}
+	}
+}
+
+func TestProxyProtocolStrict(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 1.1.1.1\nstrict\nproxy_protocol 127.0.0.1\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.ProxyProtocol || len(config.ProxyProtocolSources) != 1 {
+		t.Fatalf("Expected proxy_protocol from 127.0.0.1, Got: %v %v", config.ProxyProtocol, config.ProxyProtocolSources)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	server := &httptest.Server{
+		Listener: NewProxyProtocolListener(ln, config.ProxyProtocolSources),
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status, _ := ipf.ServeHTTP(w, r)
+			w.WriteHeader(status)
+		})},
+	}
+	server.Start()
+	defer server.Close()
+
+	tests := []struct {
+		client         string
+		expectedStatus int
+	}{
+		{"1.1.1.1", http.StatusForbidden},
+		{"8.8.8.8", http.StatusOK},
+	}
+	for i, test := range tests {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Test %d: Can't dial: %v", i, err)
+		}
+		conn.Write([]byte("PROXY TCP4 " + test.client + " 127.0.0.1 56324 80\r\nGET / HTTP/1.0\r\n\r\n"))
+		resp, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("Test %d: Can't read the response: %v", i, err)
+		}
+		expected := "HTTP/1.0 " + strconv.Itoa(test.expectedStatus) + " " + http.StatusText(test.expectedStatus)
+		if status := strings.SplitN(string(resp), "\r\n", 2)[0]; status != expected {
+			t.Fatalf("Test %d: Expected: %s, Got: %s", i, expected, status)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterMatcher("rdns", newRDNSMatcher)
+}
+
+// Defaults of the rdns matcher.
+const (
+	defaultRDNSTimeout = time.Second
+	rdnsTTL            = time.Hour
+)
+
+// The resolvers of the rdns matchers.
+var (
+	rdnsLookupAddr   = net.DefaultResolver.LookupAddr
+	rdnsLookupIPAddr = net.DefaultResolver.LookupIPAddr
+)
+
+// rdnsMatcher matches the clients whose PTR record matches one of its patterns, e.g. '*.googlebot.com'.
+// The hostname is only trusted if it is forward-confirmed, it must resolve back to the client IP since
+// whoever owns the IP can put any name in its PTR record.
+type rdnsMatcher struct {
+	patterns []string
+	timeout  time.Duration
+	cache    *ttlCache // matched by IP.
+}
+
+// newRDNSMatcher creates the matcher of 'rdns <patterns...> [timeout=<duration>]'.
+func newRDNSMatcher(args []string) (Matcher, error) {
+	m := &rdnsMatcher{timeout: defaultRDNSTimeout, cache: newTTLCache()}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "timeout=") {
+			timeout, err := time.ParseDuration(strings.TrimPrefix(arg, "timeout="))
+			if err != nil || timeout <= 0 {
+				return nil, errors.New("the timeout should be a positive duration, e.g. '1s'")
+			}
+			m.timeout = timeout
+			continue
+		}
+		pattern := normalizeHostname(arg)
+		if pattern == "" || strings.ContainsAny(pattern, "/=") {
+			return nil, errors.New("invalid hostname pattern " + arg)
+		}
+		m.patterns = append(m.patterns, pattern)
+	}
+	if len(m.patterns) == 0 {
+		return nil, errors.New("expected hostname patterns")
+	}
+	return m, nil
+}
+
+// Match implements Matcher.
+func (m *rdnsMatcher) Match(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+	key := ip.String()
+	if matched, ok := m.cache.get(key); ok {
+		return matched.(bool), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	matched, err := m.lookup(ctx, ip)
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: rdns lookup of %s: %v", ip, err)
+		return false, nil
+	}
+	m.cache.set(key, matched, rdnsTTL)
+	return matched, nil
+}
+
+// lookup returns true if one of the PTR records of 'ip' matches a pattern and resolves back to 'ip'.
+func (m *rdnsMatcher) lookup(ctx context.Context, ip net.IP) (bool, error) {
+	names, err := rdnsLookupAddr(ctx, ip.String())
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.IsTimeout && !dnsErr.Temporary() {
+			// no PTR record.
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, name := range names {
+		name = normalizeHostname(name)
+		if !m.matches(name) {
+			continue
+		}
+		addrs, err := rdnsLookupIPAddr(ctx, name)
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.IsTimeout && !dnsErr.Temporary() {
+				continue
+			}
+			return false, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matches returns true if 'name' matches one of the patterns.
+func (m *rdnsMatcher) matches(name string) bool {
+	for _, pattern := range m.patterns {
+		if wildcardMatch(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHostname returns 'name' in lower case without its trailing dot.
+func normalizeHostname(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,99 @@
+package ipfilter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestRDNS(t *testing.T) {
+	var queries int32
+	defer func(saved func(context.Context, string) ([]string, error)) { rdnsLookupAddr = saved }(rdnsLookupAddr)
+	defer func(saved func(context.Context, string) ([]net.IPAddr, error)) { rdnsLookupIPAddr = saved }(rdnsLookupIPAddr)
+	rdnsLookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		atomic.AddInt32(&queries, 1)
+		switch addr {
+		case "8.8.8.8":
+			return []string{"Bot-1.Crawl.Partner.example."}, nil
+		case "8.8.4.4":
+			// a PTR record claiming to be the partner.
+			return []string{"bot-2.crawl.partner.example."}, nil
+		case "5.175.96.22":
+			return []string{"host.other.example.", "bot-3.crawl.partner.example."}, nil
+		case "1.1.1.1":
+			return nil, &net.DNSError{Err: "i/o timeout", Name: addr, IsTimeout: true}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: addr}
+	}
+	rdnsLookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&queries, 1)
+		switch host {
+		case "bot-1.crawl.partner.example":
+			return []net.IPAddr{{IP: net.ParseIP("8.8.8.8")}}, nil
+		case "bot-2.crawl.partner.example":
+			return []net.IPAddr{{IP: net.ParseIP("24.53.192.20")}}, nil
+		case "bot-3.crawl.partner.example":
+			return []net.IPAddr{{IP: net.ParseIP("5.175.96.22")}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule allow\nrdns *.crawl.partner.example timeout=50ms\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		reqIP          string
+		expectedStatus int
+	}{
+		{"8.8.8.8:_", http.StatusOK},
+		{"5.175.96.22:_", http.StatusOK},
+		// not forward-confirmed.
+		{"8.8.4.4:_", http.StatusForbidden},
+		// no PTR record.
+		{"24.53.192.20:_", http.StatusForbidden},
+		// failures don't match.
+		{"1.1.1.1:_", http.StatusForbidden},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	// the results are cached.
+	before := atomic.LoadInt32(&queries)
+	for _, reqIP := range []string{"8.8.8.8:_", "8.8.4.4:_"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = reqIP
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if got := atomic.LoadInt32(&queries) - before; got != 0 {
+		t.Fatalf("Expected the results to be cached, Got: %d queries", got)
+	}
+
+	for i, args := range [][]string{{}, {"timeout=1s"}, {"*.example.com", "timeout=soon"}, {"."}} {
+		if _, err := NewMatcher(MatcherSpec{Name: "rdns", Args: args}); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
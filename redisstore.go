@@ -0,0 +1,164 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisKeyPrefix namespaces every key ipfilter writes to Redis.
+const redisKeyPrefix = "ipfilter:"
+
+// SharedStore is a BanStore shared by every caddy instance using it,
+// it also holds the request counters of AutoBan so they are shared too.
+type SharedStore interface {
+	BanStore
+
+	// IsBanned returns true if 'ip' is banned, expired bans are never returned.
+	IsBanned(ip string) (bool, error)
+	// Incr increments a counter, starting a 'window' long expiry when it is created, and returns its new value.
+	Incr(key string, window time.Duration) (int64, error)
+}
+
+// RedisStore is a SharedStore backed by Redis, bans and counters expire through Redis TTLs.
+type RedisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore returns a RedisStore connecting to 'addr', 'password' is optional.
+func NewRedisStore(addr, password string) *RedisStore {
+	return &RedisStore{pool: &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr,
+				redis.DialPassword(password),
+				redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(time.Second),
+				redis.DialWriteTimeout(time.Second),
+			)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}}
+}
+
+// Ping checks that Redis is reachable.
+func (rs *RedisStore) Ping() error {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
+
+func banKey(ip string) string {
+	return redisKeyPrefix + "ban:" + ip
+}
+
+// Save implements BanStore.
+func (rs *RedisStore) Save(ban Ban) error {
+	value, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	if ban.Expires.IsZero() {
+		_, err = conn.Do("SET", banKey(ban.IP), value)
+		return err
+	}
+	ttl := time.Until(ban.Expires)
+	if ttl <= 0 {
+		return nil
+	}
+	_, err = conn.Do("SET", banKey(ban.IP), value, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+// Delete implements BanStore.
+func (rs *RedisStore) Delete(ip string) error {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", banKey(ip))
+	return err
+}
+
+// Load implements BanStore.
+func (rs *RedisStore) Load() ([]Ban, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	var bans []Ban
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", banKey("*"), "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			value, err := redis.Bytes(conn.Do("GET", key))
+			if err == redis.ErrNil {
+				// expired since the scan.
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			var ban Ban
+			if err := json.Unmarshal(value, &ban); err != nil {
+				return nil, err
+			}
+			bans = append(bans, ban)
+		}
+
+		if cursor == "0" {
+			return bans, nil
+		}
+	}
+}
+
+// Close implements BanStore.
+func (rs *RedisStore) Close() error {
+	return rs.pool.Close()
+}
+
+// IsBanned implements SharedStore.
+func (rs *RedisStore) IsBanned(ip string) (bool, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", banKey(ip)))
+}
+
+// Incr implements SharedStore.
+func (rs *RedisStore) Incr(key string, window time.Duration) (int64, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	key = redisKeyPrefix + "counter:" + key
+	count, err := redis.Int64(conn.Do("INCR", key))
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		if _, err := conn.Do("PEXPIRE", key, int64(window/time.Millisecond)); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,124 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a SharedStore kept in memory, standing in for another instance's view of Redis.
+type memoryStore struct {
+	mu     sync.Mutex
+	bans   map[string]Ban
+	counts map[string]int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{bans: map[string]Ban{}, counts: map[string]int64{}}
+}
+
+func (ms *memoryStore) Save(ban Ban) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.bans[ban.IP] = ban
+	return nil
+}
+
+func (ms *memoryStore) Delete(ip string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.bans, ip)
+	return nil
+}
+
+func (ms *memoryStore) Load() ([]Ban, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var bans []Ban
+	for _, ban := range ms.bans {
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+func (ms *memoryStore) Close() error { return nil }
+
+func (ms *memoryStore) IsBanned(ip string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, ok := ms.bans[ip]
+	return ok, nil
+}
+
+func (ms *memoryStore) Incr(key string, window time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.counts[key]++
+	return ms.counts[key], nil
+}
+
+func TestSharedBanList(t *testing.T) {
+	store := newMemoryStore()
+	nodeA, err := NewPersistentBanList(store)
+	if err != nil {
+		t.Fatalf("Could not create the ban list: %v", err)
+	}
+	nodeB, err := NewPersistentBanList(store)
+	if err != nil {
+		t.Fatalf("Could not create the ban list: %v", err)
+	}
+
+	// a ban on one node applies everywhere.
+	nodeA.Ban(net.ParseIP("1.2.3.4"), time.Hour)
+	if !nodeB.IsBanned(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("Expected '1.2.3.4' to be banned on every node")
+	}
+	if bans, _ := nodeB.List(); len(bans) != 1 || bans[0].IP != "1.2.3.4" {
+		t.Errorf("Expected the ban to be listed on every node, got: %+v", bans)
+	}
+
+	if unbanned, err := nodeB.Unban(net.ParseIP("1.2.3.4")); !unbanned || err != nil {
+		t.Fatalf("Expected the ban to be lifted from another node, got: (%t, %v)", unbanned, err)
+	}
+	if nodeA.IsBanned(net.ParseIP("1.2.3.4")) {
+		t.Errorf("Expected '1.2.3.4' to be unbanned on every node")
+	}
+	if unbanned, _ := nodeA.Unban(net.ParseIP("1.2.3.4")); unbanned {
+		t.Errorf("Expected unbanning an IP that isn't banned to return false")
+	}
+}
+
+// TestRedisStore runs against a real Redis server, e.g. IPFILTER_TEST_REDIS=localhost:6379
+func TestRedisStore(t *testing.T) {
+	addr := os.Getenv("IPFILTER_TEST_REDIS")
+	if addr == "" {
+		t.Skip("IPFILTER_TEST_REDIS is not set")
+	}
+
+	store := NewRedisStore(addr, "")
+	defer store.Close()
+	if err := store.Ping(); err != nil {
+		t.Fatalf("Could not connect to redis: %v", err)
+	}
+
+	if err := store.Save(Ban{IP: "192.0.2.1", Expires: time.Now().Add(100 * time.Millisecond)}); err != nil {
+		t.Fatalf("Could not save the ban: %v", err)
+	}
+	if banned, err := store.IsBanned("192.0.2.1"); !banned || err != nil {
+		t.Fatalf("Expected '192.0.2.1' to be banned, got: (%t, %v)", banned, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if banned, _ := store.IsBanned("192.0.2.1"); banned {
+		t.Errorf("Expected the ban to expire through its TTL")
+	}
+
+	counter := fmt.Sprintf("test:%d", time.Now().UnixNano())
+	for i := int64(1); i <= 3; i++ {
+		if count, err := store.Incr(counter, time.Second); count != i || err != nil {
+			t.Fatalf("Expected the counter to be %d, got: (%d, %v)", i, count, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package ipfilter
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits of a lookupCache.
+const (
+	lookupCacheSize  = 100000
+	lookupErrorRetry = time.Minute // how long a failed lookup isn't retried.
+)
+
+// lookupCache holds the results of the lookups of the reputation matchers, which query services too slow
+// to be waited for: a missing result starts the lookup in the background and the client doesn't match
+// until it lands, so no request waits on the service. Results expire after the TTL the lookup returned.
+type lookupCache struct {
+	name string // of the service, for the logs.
+
+	mu       sync.Mutex
+	entries  map[string]lookupEntry
+	inFlight map[string]bool
+	paused   time.Time // no lookup until then, e.g. when the service is rate limiting.
+	now      func() time.Time
+}
+
+// lookupEntry is a cached result, until 'expires'.
+type lookupEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// pauseError is returned by a lookup to stop the lookups of its cache until a time.
+type pauseError struct {
+	until time.Time
+	err   error
+}
+
+func (e pauseError) Error() string {
+	return e.err.Error()
+}
+
+// ttlCache holds the answers of the lookups made while a request waits, e.g. DNS queries.
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]lookupEntry
+	now     func() time.Time
+}
+
+func newTTLCache() *ttlCache {
+	return &ttlCache{entries: make(map[string]lookupEntry), now: time.Now}
+}
+
+// get returns the value of 'key', false if it isn't cached or expired.
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !c.now().Before(entry.expires) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// set caches 'value' for 'ttl', the cache starts over when it holds lookupCacheSize values.
+func (c *ttlCache) set(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= lookupCacheSize {
+		c.entries = make(map[string]lookupEntry)
+	}
+	c.entries[key] = lookupEntry{value: value, expires: c.now().Add(ttl)}
+}
+
+// rateLimited returns the pauseError of a service answering 429, until its Retry-After or for an hour.
+func rateLimited(resp *http.Response) error {
+	retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	until := time.Now().Add(time.Duration(retry) * time.Second)
+	if retry <= 0 {
+		until = time.Now().Add(time.Hour)
+	}
+	return pauseError{until: until, err: fmt.Errorf("rate limited until %s", until.Format(time.RFC3339))}
+}
+
+func newLookupCache(name string) *lookupCache {
+	return &lookupCache{
+		name:     name,
+		entries:  make(map[string]lookupEntry),
+		inFlight: make(map[string]bool),
+		now:      time.Now,
+	}
+}
+
+// get returns the cached result for 'key', or false and starts 'lookup' in the background. 'lookup'
+// returns the result and how long it can be cached, failed lookups are retried after lookupErrorRetry.
+func (lc *lookupCache) get(key string, lookup func() (interface{}, time.Duration, error)) (interface{}, bool) {
+	now := lc.now()
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if entry, ok := lc.entries[key]; ok && now.Before(entry.expires) {
+		return entry.value, entry.value != nil
+	}
+	if lc.inFlight[key] || now.Before(lc.paused) {
+		return nil, false
+	}
+	lc.inFlight[key] = true
+	go lc.fetch(key, lookup)
+	return nil, false
+}
+
+// fetch runs 'lookup' and caches its result.
+func (lc *lookupCache) fetch(key string, lookup func() (interface{}, time.Duration, error)) {
+	value, ttl, err := lookup()
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	delete(lc.inFlight, key)
+	now := lc.now()
+	if err != nil {
+		log.Printf("[ERROR] ipfilter: %s lookup of %s: %v", lc.name, key, err)
+		if pause, ok := err.(pauseError); ok {
+			lc.paused = pause.until
+		}
+		value, ttl = nil, lookupErrorRetry
+	}
+
+	if len(lc.entries) >= lookupCacheSize {
+		for k, entry := range lc.entries {
+			if !now.Before(entry.expires) {
+				delete(lc.entries, k)
+			}
+		}
+		// still full of fresh results, start over rather than growing.
+		if len(lc.entries) >= lookupCacheSize {
+			lc.entries = make(map[string]lookupEntry)
+		}
+	}
+	lc.entries[key] = lookupEntry{value: value, expires: now.Add(ttl)}
+}
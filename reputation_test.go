@@ -0,0 +1,43 @@
+package ipfilter
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// eventually fails the test if 'cond' doesn't hold within a few seconds, for the lookups in the background.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLookupCachePause(t *testing.T) {
+	var lookups int32
+	lc := newLookupCache("test")
+	lookup := func() (interface{}, time.Duration, error) {
+		atomic.AddInt32(&lookups, 1)
+		return nil, 0, pauseError{until: time.Now().Add(time.Hour), err: fmt.Errorf("rate limited")}
+	}
+
+	lc.get("a", lookup)
+	eventually(t, "the lookup of a", func() bool {
+		lc.mu.Lock()
+		defer lc.mu.Unlock()
+		return len(lc.inFlight) == 0 && atomic.LoadInt32(&lookups) == 1
+	})
+	if _, ok := lc.get("b", lookup); ok {
+		t.Fatal("Expected no result while paused")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&lookups) != 1 {
+		t.Fatalf("Expected no lookup while paused, Got: %d", atomic.LoadInt32(&lookups))
+	}
+}
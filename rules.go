@@ -0,0 +1,441 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// RuleSet is the JSON representation of the ipfilter blocks of a site.
+type RuleSet struct {
+	Paths []Rule `json:"paths"`
+}
+
+// Rule is the JSON representation of a single ipfilter block.
+type Rule struct {
+	PathScopes      []string          `json:"scopes"`
+	Rule            string            `json:"rule"`
+	BlockPage       string            `json:"blockpage,omitempty"`
+	CountryCodes    []string          `json:"countries,omitempty"`
+	NegateCountries bool              `json:"negate_countries,omitempty"` // the countries don't match, see IPPath.
+	IPs             []string          `json:"ips,omitempty"`
+	IPLists         []IPList          `json:"ip_lists,omitempty"` // added to IPs when the rules are loaded.
+	Strict          bool              `json:"strict,omitempty"`
+	Priority        int               `json:"priority,omitempty"`
+	ThreatLevel     int               `json:"threat_level,omitempty"`
+	ExceptASNs      []uint            `json:"except_asns,omitempty"`
+	ExceptIPs       []string          `json:"except_ips,omitempty"`
+	ExceptCountries []string          `json:"except_countries,omitempty"`
+	Matchers        []MatcherSpec     `json:"matchers,omitempty"`
+	Family          string            `json:"family,omitempty"`
+	AllowMonitoring []string          `json:"allow_monitoring,omitempty"` // see MonitoringProviders.
+	XFFPolicy       string            `json:"xff_policy,omitempty"`
+	Feeds           []string          `json:"feeds,omitempty"` // see Feeds.
+	MatchAll        bool              `json:"match_all,omitempty"`
+	Excludes        []string          `json:"exclude,omitempty"`
+	Hosts           []string          `json:"hosts,omitempty"`
+	Methods         []string          `json:"methods,omitempty"`
+	Headers         []HeaderCondition `json:"headers,omitempty"`
+	Schedules       []string          `json:"schedule,omitempty"`     // see ParseSchedule.
+	ActiveFrom      string            `json:"active_from,omitempty"`  // RFC 3339, see ParseTimestamp.
+	ActiveUntil     string            `json:"active_until,omitempty"` // RFC 3339, see ParseTimestamp.
+	Challenge       string            `json:"challenge,omitempty"`
+	// leading zero bits of the 'pow' challenge, defaultPowDifficulty if 0.
+	ChallengeDifficulty int `json:"challenge_difficulty,omitempty"`
+	// "<n> requests per <window> for <duration>", see AutoBan.
+	AutoBan string `json:"autoban,omitempty"`
+	// percentage of the clients the rule is enforced on, the others are only logged, all if 0.
+	Sample int `json:"sample,omitempty"`
+}
+
+// ParseRuleKind returns true for the 'block' rules and false for 'allow', 'allow_only' and 'block_all_except',
+// the two latter spell out what 'allow' does: the matching clients are let in, every other one is blocked.
+func ParseRuleKind(rule string) (bool, error) {
+	switch rule {
+	case "block":
+		return true, nil
+	case "allow", "allow_only", "block_all_except":
+		return false, nil
+	}
+	return false, errors.New("ipfilter: Rule should be 'block', 'allow', 'allow_only' or 'block_all_except'")
+}
+
+// RulesFromPaths returns the RuleSet describing 'paths'.
+func RulesFromPaths(paths []IPPath) RuleSet {
+	rs := RuleSet{Paths: make([]Rule, 0, len(paths))}
+	for _, path := range paths {
+		rule := Rule{
+			PathScopes:          path.PathScopes,
+			Rule:                "allow",
+			BlockPage:           path.BlockPage,
+			CountryCodes:        path.CountryCodes,
+			NegateCountries:     path.NegateCountries,
+			Strict:              path.Strict,
+			Priority:            path.Priority,
+			ThreatLevel:         path.ThreatLevel,
+			ExceptASNs:          path.ExceptASNs,
+			ExceptCountries:     path.ExceptCountries,
+			Matchers:            matcherSpecs(path.Matchers),
+			Family:              path.Family,
+			AllowMonitoring:     path.AllowMonitoring,
+			XFFPolicy:           path.XFFPolicy,
+			Feeds:               path.Feeds,
+			MatchAll:            path.MatchAll,
+			Excludes:            path.Excludes,
+			Hosts:               path.Hosts,
+			Methods:             path.Methods,
+			Headers:             path.Headers,
+			Challenge:           path.Challenge,
+			ChallengeDifficulty: path.ChallengeDifficulty,
+			Sample:              path.Sample,
+		}
+		for _, schedule := range path.Schedules {
+			rule.Schedules = append(rule.Schedules, schedule.String())
+		}
+		if !path.ActiveFrom.IsZero() {
+			rule.ActiveFrom = path.ActiveFrom.Format(time.RFC3339)
+		}
+		if !path.ActiveUntil.IsZero() {
+			rule.ActiveUntil = path.ActiveUntil.Format(time.RFC3339)
+		}
+		if path.IsBlock {
+			rule.Rule = "block"
+		}
+		if path.AutoBan != nil {
+			rule.AutoBan = path.AutoBan.String()
+		}
+		for _, rng := range path.allRanges() {
+			rule.IPs = append(rule.IPs, rng.String())
+		}
+		rule.IPs = append(rule.IPs, path.Hostnames...)
+		for _, rng := range path.ExceptRanges {
+			rule.ExceptIPs = append(rule.ExceptIPs, rng.String())
+		}
+		rs.Paths = append(rs.Paths, rule)
+	}
+	return rs
+}
+
+// ToPaths validates the RuleSet and converts it to IPPaths, 'hasDB' and 'hasASNDB' tell
+// whether a database is available for country rules and an ASN database for their carve-outs.
+// The ip_lists URLs are fetched with a default client.
+func (rs RuleSet) ToPaths(hasDB, hasASNDB bool) ([]IPPath, error) {
+	return rs.toPaths(context.Background(), hasDB, hasASNDB, defaultHTTPClient)
+}
+
+// rulePaths is ToPaths for the rules 'config' enforces: the ip_lists URLs are fetched with its client until
+// 'ctx' is done, and the paths are checked like the ipfilter blocks of a Caddyfile against its match_mode,
+// challenges and databases. Their blockpages must be ones of the Caddyfile, they are served to any client.
+func (config *IPFConfig) rulePaths(ctx context.Context, rs RuleSet) ([]IPPath, error) {
+	paths, err := rs.toPaths(ctx, config.hasCountryLookups(), config.ASNHandler != nil, config.httpClient())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPriorities(paths, config.MatchMode); err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if path.BlockPage != "" && !config.blockPages[path.BlockPage] {
+			return nil, errors.New("ipfilter: blockpage should be one of the blockpages of the Caddyfile: " + path.BlockPage)
+		}
+	}
+	checked := *config
+	checked.Paths = paths
+	if err := checked.CheckChallenges(); err != nil {
+		return nil, err
+	}
+	if err := checked.CheckAnonymousIP(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// checkPriorities returns an error if a path has a priority but 'matchMode' isn't MatchPriority,
+// it would be silently ignored.
+func checkPriorities(paths []IPPath, matchMode string) error {
+	if matchMode == MatchPriority {
+		return nil
+	}
+	for _, path := range paths {
+		if path.Priority != 0 {
+			return errors.New("ipfilter: priority requires 'match_mode priority'")
+		}
+	}
+	return nil
+}
+
+// toPaths is ToPaths, fetching the ip_lists URLs with 'client' until 'ctx' is done.
+func (rs RuleSet) toPaths(ctx context.Context, hasDB, hasASNDB bool, client *http.Client) ([]IPPath, error) {
+	var hasCountryCodes, hasRanges, hasMatchers, hasFamily bool
+
+	paths := make([]IPPath, 0, len(rs.Paths))
+	for _, rule := range rs.Paths {
+		var path IPPath
+
+		if len(rule.PathScopes) == 0 {
+			return nil, errors.New("ipfilter: Every rule needs at least one scope")
+		}
+		path.PathScopes = append([]string(nil), rule.PathScopes...)
+		sort.Sort(sort.Reverse(ByLength(path.PathScopes)))
+
+		isBlock, err := ParseRuleKind(rule.Rule)
+		if err != nil {
+			return nil, err
+		}
+		path.IsBlock = isBlock
+
+		if rule.BlockPage != "" {
+			if _, err := os.Stat(rule.BlockPage); os.IsNotExist(err) {
+				return nil, errors.New("ipfilter: No such file: " + rule.BlockPage)
+			}
+			path.BlockPage = rule.BlockPage
+		}
+
+		countries, err := ParseCountryCodes(rule.CountryCodes)
+		if err != nil {
+			return nil, err
+		}
+		path.CountryCodes = countries
+		if rule.NegateCountries && len(countries) == 0 {
+			return nil, errors.New("ipfilter: negate_countries needs countries")
+		}
+		path.NegateCountries = rule.NegateCountries
+		ranges, negated, hostnames, err := parseIPEntries(rule.IPs)
+		if err != nil {
+			return nil, errors.New("ipfilter: " + err.Error())
+		}
+		listRanges, err := loadIPLists(ctx, rule.IPLists, client)
+		if err != nil {
+			return nil, err
+		}
+		if len(negated) != 0 && len(ranges) == 0 && len(rule.IPLists) == 0 {
+			return nil, errors.New("ipfilter: The '!' entries of ips need other IPs to be carved out of")
+		}
+		path.Ranges = subtractRanges(append(ranges, listRanges...), negated)
+		path.Hostnames = hostnames
+		for _, ip := range rule.ExceptIPs {
+			ranges, err := parseIPs(ip)
+			if err != nil {
+				return nil, errors.New("ipfilter: " + err.Error())
+			}
+			path.ExceptRanges = append(path.ExceptRanges, ranges...)
+		}
+		if path.ExceptCountries, err = ParseCountryCodes(rule.ExceptCountries); err != nil {
+			return nil, err
+		}
+		path.Strict = rule.Strict
+		path.Priority = rule.Priority
+		if rule.Sample < 0 || rule.Sample > 100 {
+			return nil, errors.New("ipfilter: sample should be a percentage between 1 and 100")
+		}
+		path.Sample = rule.Sample
+		if rule.ThreatLevel < 0 {
+			return nil, errors.New("ipfilter: threat_level should be positive")
+		}
+		path.ThreatLevel = rule.ThreatLevel
+		for _, spec := range rule.Matchers {
+			if spec.Name == "hosting" && !hasASNDB {
+				return nil, errors.New("ipfilter: ASN database is required for hosting")
+			}
+			m, err := NewMatcher(spec)
+			if err != nil {
+				return nil, err
+			}
+			path.Matchers = append(path.Matchers, m)
+		}
+		switch rule.Family {
+		case "", FamilyIPv4, FamilyIPv6:
+			path.Family = rule.Family
+		default:
+			return nil, errors.New("ipfilter: family should be 'ipv4' or 'ipv6'")
+		}
+		if err := checkMonitoringProviders(rule.AllowMonitoring); err != nil {
+			return nil, err
+		}
+		path.AllowMonitoring = rule.AllowMonitoring
+		if err := checkXFFPolicy(rule.XFFPolicy); err != nil {
+			return nil, err
+		}
+		path.XFFPolicy = rule.XFFPolicy
+		if err := checkFeeds(rule.Feeds); err != nil {
+			return nil, err
+		}
+		path.Feeds = rule.Feeds
+		path.MatchAll = rule.MatchAll
+		path.Excludes = rule.Excludes
+		path.Hosts = rule.Hosts
+		for _, header := range rule.Headers {
+			hc, err := parseHeaderCondition(append([]string{header.Name}, header.Values...))
+			if err != nil {
+				return nil, err
+			}
+			path.Headers = append(path.Headers, hc)
+		}
+		for _, spec := range rule.Schedules {
+			schedule, err := ParseSchedule(strings.Fields(spec))
+			if err != nil {
+				return nil, err
+			}
+			path.Schedules = append(path.Schedules, schedule)
+		}
+		if rule.ActiveFrom != "" {
+			if path.ActiveFrom, err = ParseTimestamp(rule.ActiveFrom); err != nil {
+				return nil, err
+			}
+		}
+		if rule.ActiveUntil != "" {
+			if path.ActiveUntil, err = ParseTimestamp(rule.ActiveUntil); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkActiveRange(path.ActiveFrom, path.ActiveUntil); err != nil {
+			return nil, err
+		}
+		for _, method := range rule.Methods {
+			path.Methods = append(path.Methods, strings.ToUpper(method))
+		}
+		if err := checkChallenge(rule.Challenge, rule.ChallengeDifficulty); err != nil {
+			return nil, err
+		}
+		path.Challenge, path.ChallengeDifficulty = rule.Challenge, rule.ChallengeDifficulty
+		if rule.AutoBan != "" {
+			if path.AutoBan, err = ParseAutoBan(strings.Fields(rule.AutoBan)); err != nil {
+				return nil, err
+			}
+		}
+		if len(rule.ExceptASNs) != 0 {
+			if len(rule.CountryCodes) == 0 {
+				return nil, errors.New("ipfilter: except_asns only applies to country rules")
+			}
+			if !hasASNDB {
+				return nil, errors.New("ipfilter: ASN database is required for except_asns")
+			}
+			path.ExceptASNs = rule.ExceptASNs
+		}
+
+		if len(path.CountryCodes) != 0 || len(path.ExceptCountries) != 0 {
+			hasCountryCodes = true
+		}
+		if len(path.Ranges) != 0 || len(rule.IPLists) != 0 || len(path.Feeds) != 0 || len(path.Hostnames) != 0 {
+			hasRanges = true
+		}
+		if len(path.Matchers) != 0 {
+			hasMatchers = true
+		}
+		if path.Family != "" {
+			hasFamily = true
+		}
+		paths = append(paths, path)
+	}
+
+	// same requirements as ipfilterParse.
+	if hasCountryCodes && !hasDB {
+		return nil, errors.New("ipfilter: Database is required to block/allow by country")
+	}
+	if !hasCountryCodes && !hasRanges && !hasMatchers && !hasFamily {
+		return nil, errors.New("ipfilter: No IPs or Country codes has been provided")
+	}
+
+	return paths, nil
+}
+
+// NewConfig returns an IPFConfig enforcing 'rs', for IPFilters that aren't configured through a Caddyfile,
+// 'db' is needed for country rules and 'asnDB' for their carve-outs, both may be nil, an empty 'matchMode' is MatchLongest.
+func NewConfig(rs RuleSet, db, asnDB *maxminddb.Reader, matchMode string) (IPFConfig, error) {
+	return NewConfigWithLookups(rs, IPFConfig{DBHandler: db, ASNHandler: asnDB, MatchMode: matchMode})
+}
+
+// NewConfigWithLookups is NewConfig for the sites looking up the clients with more than the databases,
+// it keeps the DBHandler, CountryDB, ASNHandler, GeoWebService and MatchMode of 'lookups' and ignores the rest.
+func NewConfigWithLookups(rs RuleSet, lookups IPFConfig) (IPFConfig, error) {
+	matchMode := lookups.MatchMode
+	switch matchMode {
+	case "", MatchLongest, MatchFirst, MatchPriority, MatchAllowOverrides:
+	default:
+		return IPFConfig{}, errors.New("ipfilter: match_mode should be 'first', 'longest', 'priority' or 'allow_overrides'")
+	}
+
+	paths, err := rs.ToPaths(lookups.hasCountryLookups(), lookups.ASNHandler != nil)
+	if err != nil {
+		return IPFConfig{}, err
+	}
+	if err := checkPriorities(paths, matchMode); err != nil {
+		return IPFConfig{}, err
+	}
+
+	config := IPFConfig{
+		Paths:         withRuleIDs(paths),
+		DBHandler:     lookups.DBHandler,
+		CountryDB:     lookups.CountryDB,
+		ASNHandler:    lookups.ASNHandler,
+		GeoWebService: lookups.GeoWebService,
+		Bans:          NewBanList(),
+		Threat:        NewThreat(),
+		Maintenance:   NewMaintenance(),
+		Monitoring:    NewMonitoringLists(defaultHTTPClient),
+		Feeds:         NewFeedLists(defaultHTTPClient),
+		Hostnames:     NewHostnameLists(0),
+		MatchMode:     matchMode,
+		hooks:         &hookDispatcher{client: defaultHTTPClient},
+	}
+	config.detectLayouts()
+	config.scopes = newScopeTrie(config.Paths, config.MatchMode)
+	config.Bans.hooks = config.hooks
+	return config, nil
+}
+
+// liveConfig holds the IPFConfig of a running IPFilter, it can be swapped at runtime without a reload.
+type liveConfig struct {
+	v     atomic.Value // *IPFConfig
+	mu    sync.Mutex   // serializes writers.
+	slots policySlots
+}
+
+func newLiveConfig(config *IPFConfig) *liveConfig {
+	lc := &liveConfig{
+		slots: policySlots{paths: map[string][]IPPath{SlotBlue: config.Paths}, active: SlotBlue},
+	}
+	lc.v.Store(config)
+	return lc
+}
+
+// Load returns the current config, it must not be modified.
+func (lc *liveConfig) Load() *IPFConfig {
+	return lc.v.Load().(*IPFConfig)
+}
+
+// SwapPaths atomically replaces the paths of the current config, everything else is kept as is.
+func (lc *liveConfig) SwapPaths(paths []IPPath) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.swapPaths(paths)
+}
+
+// swapPaths replaces the paths of the current config and of the active slot, lc.mu must be held.
+func (lc *liveConfig) swapPaths(paths []IPPath) {
+	config := *lc.Load()
+	old := config.Paths
+	config.Paths = compactPaths(withRuleIDs(paths), config.Storage)
+	config.scopes = newScopeTrie(paths, config.MatchMode)
+	lc.v.Store(&config)
+	lc.slots.paths[lc.slots.active] = config.Paths
+
+	config.hooks.acquire(config.Paths)
+	config.hooks.release(old)
+}
+
+// Close stops the pending slot revert, if any.
+func (lc *liveConfig) Close() {
+	lc.mu.Lock()
+	lc.cancelRevert()
+	lc.mu.Unlock()
+}
@@ -0,0 +1,212 @@
+package ipfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RuleSource is an external store the rules of a site are read from, e.g. a Consul or etcd key holding a JSON RuleSet.
+type RuleSource interface {
+	// Fetch returns the rules and their version, if 'version' is not empty it waits for a newer version
+	// (or a while, in which case the same version is returned).
+	Fetch(ctx context.Context, version string) (RuleSet, string, error)
+}
+
+const (
+	// defaultRuleSourceInterval is how often etcd is polled, and how long a Consul blocking query waits,
+	// it is kept below the timeout of defaultHTTPClient.
+	defaultRuleSourceInterval = 20 * time.Second
+	// ruleSourceRetry is how long to wait before fetching again after an error.
+	ruleSourceRetry = 5 * time.Second
+)
+
+// loadRuleSource replaces the paths of 'config' with the rules of its RuleSource.
+func (config *IPFConfig) loadRuleSource() error {
+	// the client is set here as http_fixtures may come after rule_source.
+	switch src := config.RuleSource.(type) {
+	case *ConsulSource:
+		if src.Client == nil {
+			src.Client = config.httpClient()
+		}
+	case *EtcdSource:
+		if src.Client == nil {
+			src.Client = config.httpClient()
+		}
+	}
+
+	rs, version, err := config.RuleSource.Fetch(context.Background(), "")
+	if err != nil {
+		return fmt.Errorf("ipfilter: Can't read the rules of rule_source: %v", err)
+	}
+	paths, err := config.rulePaths(context.Background(), rs)
+	if err != nil {
+		return err
+	}
+	config.Paths = paths
+	config.ruleVersion = version
+	return nil
+}
+
+// watchRuleSource swaps the paths of 'live' whenever the rules of 'src' change, until 'ctx' is done.
+func watchRuleSource(ctx context.Context, src RuleSource, live *liveConfig, version string) {
+	for {
+		rs, newVersion, err := src.Fetch(ctx, version)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("[ERROR] ipfilter: fetching the rules: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(ruleSourceRetry):
+			}
+			continue
+		}
+		if newVersion == version {
+			continue
+		}
+
+		paths, err := live.Load().rulePaths(ctx, rs)
+		if err != nil {
+			// keep enforcing the previous rules.
+			counters.ParseErrors.Add(1)
+			log.Printf("[ERROR] ipfilter: invalid rules, version %s: %v", newVersion, err)
+		} else {
+			live.SwapPaths(paths)
+			log.Printf("[INFO] ipfilter: rules updated to version %s", newVersion)
+		}
+		version = newVersion
+	}
+}
+
+// ConsulSource reads the rules from a Consul KV key, changes are watched with blocking queries.
+type ConsulSource struct {
+	Addr   string // e.g. http://127.0.0.1:8500
+	Key    string
+	Wait   time.Duration // how long a blocking query waits for a change.
+	Client *http.Client
+}
+
+// Fetch implements RuleSource.
+func (cs *ConsulSource) Fetch(ctx context.Context, version string) (RuleSet, string, error) {
+	var rs RuleSet
+
+	query := url.Values{"raw": {""}}
+	if version != "" {
+		query.Set("index", version)
+		query.Set("wait", fmt.Sprintf("%ds", int(cs.Wait/time.Second)))
+	}
+	u := strings.TrimSuffix(cs.Addr, "/") + "/v1/kv/" + strings.TrimPrefix(cs.Key, "/") + "?" + query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return rs, "", err
+	}
+	body, resp, err := doSourceRequest(ctx, cs.Client, req)
+	if err != nil {
+		return rs, "", err
+	}
+
+	index := resp.Header.Get("X-Consul-Index")
+	if index == "" {
+		return rs, "", errors.New("consul: missing X-Consul-Index header")
+	}
+	if index == version {
+		return rs, version, nil
+	}
+
+	if err := json.Unmarshal(body, &rs); err != nil {
+		return rs, "", fmt.Errorf("consul: decoding %s: %v", cs.Key, err)
+	}
+	return rs, index, nil
+}
+
+// EtcdSource reads the rules from an etcd v3 key through its JSON gateway, changes are polled every Interval.
+type EtcdSource struct {
+	Addr     string // e.g. http://127.0.0.1:2379
+	Key      string
+	Interval time.Duration
+	Client   *http.Client
+}
+
+// etcdRange is the response of the etcd v3 range API.
+type etcdRange struct {
+	Kvs []struct {
+		Value       string `json:"value"` // base64
+		ModRevision string `json:"mod_revision"`
+	} `json:"kvs"`
+}
+
+// Fetch implements RuleSource.
+func (es *EtcdSource) Fetch(ctx context.Context, version string) (RuleSet, string, error) {
+	var rs RuleSet
+
+	if version != "" {
+		select {
+		case <-ctx.Done():
+			return rs, "", ctx.Err()
+		case <-time.After(es.Interval):
+		}
+	}
+
+	payload, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(es.Key))})
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(es.Addr, "/")+"/v3/kv/range", bytes.NewReader(payload))
+	if err != nil {
+		return rs, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	body, _, err := doSourceRequest(ctx, es.Client, req)
+	if err != nil {
+		return rs, "", err
+	}
+
+	var rng etcdRange
+	if err := json.Unmarshal(body, &rng); err != nil {
+		return rs, "", fmt.Errorf("etcd: decoding the range response: %v", err)
+	}
+	if len(rng.Kvs) == 0 {
+		return rs, "", errors.New("etcd: no such key: " + es.Key)
+	}
+	kv := rng.Kvs[0]
+	if kv.ModRevision == version {
+		return rs, version, nil
+	}
+
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return rs, "", fmt.Errorf("etcd: decoding %s: %v", es.Key, err)
+	}
+	if err := json.Unmarshal(value, &rs); err != nil {
+		return rs, "", fmt.Errorf("etcd: decoding %s: %v", es.Key, err)
+	}
+	return rs, kv.ModRevision, nil
+}
+
+// doSourceRequest sends 'req' and returns the body of a 200 response.
+func doSourceRequest(ctx context.Context, client *http.Client, req *http.Request) ([]byte, *http.Response, error) {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s %s: unexpected status %s", req.Method, req.URL, resp.Status)
+	}
+	return body, resp, nil
+}
@@ -0,0 +1,191 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// fakeKV serves a single key through the Consul KV and etcd v3 range APIs.
+type fakeKV struct {
+	mu      sync.Mutex
+	value   string
+	version int
+	changed chan struct{}
+}
+
+func newFakeKV(value string) *fakeKV {
+	return &fakeKV{value: value, version: 1, changed: make(chan struct{})}
+}
+
+func (kv *fakeKV) set(value string) {
+	kv.mu.Lock()
+	kv.value = value
+	kv.version++
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+	kv.mu.Unlock()
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv.mu.Lock()
+	value, version, changed := kv.value, kv.version, kv.changed
+	kv.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/v1/kv/ipfilter/rules":
+		// blocking query.
+		if r.URL.Query().Get("index") == fmt.Sprint(version) {
+			select {
+			case <-changed:
+				kv.mu.Lock()
+				value, version = kv.value, kv.version
+				kv.mu.Unlock()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(version))
+		w.Write([]byte(value))
+	case "/v3/kv/range":
+		body, _ := ioutil.ReadAll(r.Body)
+		var req struct{ Key string }
+		json.Unmarshal(body, &req)
+		if key, _ := base64.StdEncoding.DecodeString(req.Key); string(key) != "/ipfilter/rules" {
+			w.Write([]byte(`{"header": {}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kvs": []map[string]string{{
+				"value":        base64.StdEncoding.EncodeToString([]byte(value)),
+				"mod_revision": fmt.Sprint(version),
+			}},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+const (
+	sourceRules  = `{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.8.8"]}]}`
+	sourceRules2 = `{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.4.4"]}]}`
+)
+
+func TestRuleSourceFetch(t *testing.T) {
+	kv := newFakeKV(sourceRules)
+	ts := httptest.NewServer(kv)
+	defer ts.Close()
+
+	expected := RuleSet{Paths: []Rule{{PathScopes: []string{"/"}, Rule: "block", IPs: []string{"8.8.8.8"}}}}
+
+	sources := map[string]RuleSource{
+		"consul": &ConsulSource{Addr: ts.URL, Key: "ipfilter/rules", Wait: time.Second, Client: ts.Client()},
+		"etcd":   &EtcdSource{Addr: ts.URL, Key: "/ipfilter/rules", Interval: time.Millisecond, Client: ts.Client()},
+	}
+	for name, src := range sources {
+		rs, version, err := src.Fetch(context.Background(), "")
+		if err != nil {
+			t.Fatalf("%s: Fetch failed: %v", name, err)
+		}
+		if version != "1" {
+			t.Fatalf("%s: Expected version: '1', Got: '%s'", name, version)
+		}
+		if !reflect.DeepEqual(rs, expected) {
+			t.Fatalf("%s: Expected rules: %+v, Got: %+v", name, expected, rs)
+		}
+
+		// unchanged.
+		if _, version, err := src.Fetch(context.Background(), "1"); err != nil || version != "1" {
+			t.Fatalf("%s: Expected version: '1', Got: '%s' (%v)", name, version, err)
+		}
+	}
+
+	missing := &EtcdSource{Addr: ts.URL, Key: "/missing", Interval: time.Millisecond, Client: ts.Client()}
+	if _, _, err := missing.Fetch(context.Background(), ""); err == nil {
+		t.Fatal("Expected an error for a missing etcd key")
+	}
+}
+
+func TestWatchRuleSource(t *testing.T) {
+	kv := newFakeKV(sourceRules)
+	ts := httptest.NewServer(kv)
+	defer ts.Close()
+
+	for _, src := range []RuleSource{
+		&ConsulSource{Addr: ts.URL, Key: "ipfilter/rules", Wait: time.Second, Client: ts.Client()},
+		&EtcdSource{Addr: ts.URL, Key: "/ipfilter/rules", Interval: 10 * time.Millisecond, Client: ts.Client()},
+	} {
+		config := IPFConfig{RuleSource: src}
+		if err := config.loadRuleSource(); err != nil {
+			t.Fatalf("loadRuleSource failed: %v", err)
+		}
+		live := newLiveConfig(&config)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			watchRuleSource(ctx, src, live, config.ruleVersion)
+			close(done)
+		}()
+
+		// invalid rules are ignored.
+		kv.set(`{"paths": [{"scopes": ["/"], "rule": "deny", "ips": ["8.8.4.4"]}]}`)
+		kv.set(sourceRules2)
+
+		deadline := time.Now().Add(2 * time.Second)
+		for live.Load().Paths[0].Ranges[0].start.String() != "8.8.4.4" {
+			if time.Now().After(deadline) {
+				t.Fatalf("%T: the rules were not updated", src)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		cancel()
+		<-done
+		kv.set(sourceRules)
+	}
+}
+
+func TestRuleSourceParse(t *testing.T) {
+	kv := newFakeKV(sourceRules)
+	ts := httptest.NewServer(kv)
+	defer ts.Close()
+
+	tests := []struct {
+		directive string
+		shouldErr bool
+	}{
+		{fmt.Sprintf("rule_source consul %s ipfilter/rules", ts.URL), false},
+		{fmt.Sprintf("rule_source etcd %s /ipfilter/rules 30s", ts.URL), false},
+		{fmt.Sprintf("rule_source zookeeper %s /ipfilter/rules", ts.URL), true},
+		{fmt.Sprintf("rule_source etcd %s /ipfilter/rules never", ts.URL), true},
+		{fmt.Sprintf("rule_source etcd %s /missing", ts.URL), true},
+		{"rule_source consul", true},
+	}
+
+	for _, test := range tests {
+		c := caddy.NewTestController("http", "ipfilter / {\n"+test.directive+"\n}")
+		config, err := ipfilterParse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Expected an error for '%s'", test.directive)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for '%s': %v", test.directive, err)
+		}
+		if len(config.Paths) != 1 || !config.Paths[0].IsBlock || config.Paths[0].Ranges[0].start.String() != "8.8.8.8" {
+			t.Fatalf("Expected the rules of the source for '%s', Got: %+v", test.directive, config.Paths)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package ipfilter
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ActionLogOnly is the action of the requests a block with 'sample' would deny, their clients are out of the
+// sample so they are only logged.
+const ActionLogOnly = "log_only"
+
+// ParseSample parses the percentage of the clients a block is enforced on, e.g. "10%".
+func ParseSample(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+	if err != nil || n < 1 || n > 100 {
+		return 0, errors.New("ipfilter: sample should be a percentage between 1% and 100%: " + s)
+	}
+	return n, nil
+}
+
+// enforced returns true if 'path' is enforced on the client of 'r', always without 'sample'. The clients are
+// picked by a hash of their IP, a client is in or out of the sample on every request and across restarts.
+func (ipf IPFilter) enforced(path IPPath, r *http.Request) bool {
+	if path.Sample == 0 || path.Sample >= 100 {
+		return true
+	}
+	clientIPs, err := ipf.clientIPs(r, path.Strict)
+	if err != nil {
+		return true
+	}
+	return inSample(clientIPs[0], path.Sample)
+}
+
+// inSample returns true if 'ip' is in the 'percent' of the clients of a sample.
+func inSample(ip net.IP, percent int) bool {
+	h := fnv.New32a()
+	h.Write(ip.To16())
+	return h.Sum32()%100 < uint32(percent)
+}
+
+// logOnly records the request a block would have denied, to the decision logs, or to the process log if
+// there are none.
+func (ipf IPFilter) logOnly(r *http.Request, path IPPath, rule int) {
+	if ipf.logsDecisions() {
+		ipf.logRequestDecision(r, path, rule, ActionLogOnly)
+		return
+	}
+	var clientIP net.IP
+	if clientIPs, err := ipf.clientIPs(r, path.Strict); err == nil {
+		clientIP = clientIPs[0]
+	}
+	log.Printf("[INFO] ipfilter: rule %d would deny %s requesting %s, out of its %d%% sample", rule, clientIP, r.URL.Path, path.Sample)
+}
@@ -0,0 +1,113 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestParseSample(t *testing.T) {
+	tests := []struct {
+		input       string
+		expected    int
+		shouldError bool
+	}{
+		{"10%", 10, false},
+		{"100%", 100, false},
+		{"25", 25, false},
+		{"0%", 0, true},
+		{"101%", 0, true},
+		{"ten%", 0, true},
+	}
+	for i, test := range tests {
+		got, err := ParseSample(test.input)
+		if test.shouldError != (err != nil) {
+			t.Errorf("Test %d: Expected error: %v, Got: %v", i, test.shouldError, err)
+		}
+		if got != test.expected {
+			t.Errorf("Test %d: Expected: %d, Got: %d", i, test.expected, got)
+		}
+	}
+}
+
+func TestInSample(t *testing.T) {
+	var in int
+	for i := 0; i < 10000; i++ {
+		if inSample(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), 10) {
+			in++
+		}
+	}
+	if in < 800 || in > 1200 {
+		t.Errorf("Expected about 1000 clients in a 10%% sample, Got: %d", in)
+	}
+	ip := net.ParseIP("10.1.2.3")
+	if inSample(ip, 10) != inSample(ip, 10) {
+		t.Errorf("Expected the sample to be deterministic")
+	}
+}
+
+func TestSampleServeHTTP(t *testing.T) {
+	// find a client in and a client out of a 50% sample.
+	var in, out string
+	for i := 1; in == "" || out == ""; i++ {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		if inSample(ip, 50) {
+			in = ip.String()
+		} else {
+			out = ip.String()
+		}
+	}
+
+	tests := []struct {
+		input          string
+		reqIP          string
+		expectedStatus int
+		expectedDebug  string
+	}{
+		{"ipfilter / {\nrule block\nip 10.0.0.0/16\nsample 50%\ndebug\n}", in, http.StatusForbidden, "blocked; rule=1; match=ip:" + in},
+		{"ipfilter / {\nrule block\nip 10.0.0.0/16\nsample 50%\ndebug\n}", out, http.StatusOK, "logged; rule=1; match=ip:" + out},
+		{"ipfilter / {\nrule block\nip 10.0.0.0/16\nsample 100%\ndebug\n}", out, http.StatusForbidden, "blocked; rule=1; match=ip:" + out},
+		{"ipfilter / {\nrule block\nip 10.0.0.0/16\nsample 50%\nchallenge js\npass_cookie secret\ndebug\n}", out, http.StatusOK, "logged; rule=1; match=ip:" + out},
+		// the allowed clients aren't sampled.
+		{"ipfilter / {\nrule block\nip 10.0.0.0/16\nsample 50%\ndebug\n}", "8.8.8.8", http.StatusOK, "allowed; rule=1; match=none"},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		summary := NewSummary(defaultSummaryWindow)
+		config.Summary = summary
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP + ":_"
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+		if got := rec.Header().Get(HeaderDebug); got != test.expectedDebug {
+			t.Errorf("Test %d: Expected: %q, Got: %q", i, test.expectedDebug, got)
+		}
+		var loggedOnly uint64
+		if strings.HasPrefix(test.expectedDebug, "logged") {
+			loggedOnly = 1
+		}
+		if report := summary.Report(defaultSummaryTop); report.LoggedOnly != loggedOnly {
+			t.Errorf("Test %d: Expected %d logged only requests, Got: %d", i, loggedOnly, report.LoggedOnly)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package ipfilter
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a weekly window a block is active in, e.g. "09:00-17:00 Mon-Fri Europe/Paris". A window ending
+// before it starts runs overnight, into the next day.
+type Schedule struct {
+	Start    int            // minutes since midnight.
+	End      int            // minutes since midnight, up to 24:00.
+	Days     [7]bool        // by time.Weekday, the days the window starts on.
+	Location *time.Location // time.Local if the schedule has no timezone.
+
+	spec string
+}
+
+// weekdays are the names of the days of 'schedule', by time.Weekday.
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseSchedule parses '<HH:MM>-<HH:MM> [<days>] [<timezone>]', the days are a range such as 'Mon-Fri' or a list
+// such as 'Mon,Wed,Fri', every day if missing. The timezone is an IANA name, the local time of the server if
+// missing.
+func ParseSchedule(args []string) (Schedule, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return Schedule{}, errors.New("ipfilter: schedule should be '<HH:MM>-<HH:MM> [<days>] [<timezone>]'")
+	}
+	s := Schedule{Location: time.Local, spec: strings.Join(args, " ")}
+
+	hours := strings.SplitN(args[0], "-", 2)
+	if len(hours) != 2 {
+		return Schedule{}, errors.New("ipfilter: Invalid schedule hours: " + args[0])
+	}
+	var err error
+	if s.Start, err = parseClock(hours[0]); err != nil || s.Start == 24*60 {
+		return Schedule{}, errors.New("ipfilter: Invalid schedule hours: " + args[0])
+	}
+	if s.End, err = parseClock(hours[1]); err != nil || s.End == s.Start {
+		return Schedule{}, errors.New("ipfilter: Invalid schedule hours: " + args[0])
+	}
+
+	args = args[1:]
+	if len(args) != 0 {
+		if days, err := parseDays(args[0]); err == nil {
+			s.Days = days
+			args = args[1:]
+		} else if len(args) == 2 {
+			return Schedule{}, err
+		}
+	}
+	if s.Days == [7]bool{} {
+		s.Days = [7]bool{true, true, true, true, true, true, true}
+	}
+	if len(args) != 0 {
+		if s.Location, err = time.LoadLocation(args[0]); err != nil {
+			return Schedule{}, errors.New("ipfilter: Unknown schedule timezone: " + args[0])
+		}
+	}
+	return s, nil
+}
+
+// parseClock parses 'HH:MM' into minutes since midnight, "24:00" is the end of the day.
+func parseClock(clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 || len(parts[1]) != 2 {
+		return 0, errors.New("ipfilter: Invalid time: " + clock)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, errors.New("ipfilter: Invalid time: " + clock)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || hours == 24 && minutes != 0 {
+		return 0, errors.New("ipfilter: Invalid time: " + clock)
+	}
+	return hours*60 + minutes, nil
+}
+
+// parseDays parses a range of days such as 'Mon-Fri', wrapping over the week with 'Fri-Mon', or a list such
+// as 'Mon,Wed,Fri'.
+func parseDays(spec string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := parseWeekday(bounds[0])
+		if err != nil {
+			return days, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parseWeekday(bounds[1]); err != nil {
+				return days, err
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseWeekday parses the three first letters of a day, in any case.
+func parseWeekday(day string) (int, error) {
+	for i, name := range weekdays {
+		if strings.ToLower(day) == name {
+			return i, nil
+		}
+	}
+	return 0, errors.New("ipfilter: Invalid schedule day: " + day)
+}
+
+// activeAt returns true if 't' is in the window of the schedule.
+func (s Schedule) activeAt(t time.Time) bool {
+	t = t.In(s.Location)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if s.Start < s.End {
+		return s.Days[day] && minute >= s.Start && minute < s.End
+	}
+	// overnight, the morning belongs to the window of the day before.
+	if minute >= s.Start {
+		return s.Days[day]
+	}
+	return minute < s.End && s.Days[(day+6)%7]
+}
+
+// String returns the schedule as it was configured.
+func (s Schedule) String() string {
+	return s.spec
+}
+
+// ParseTimestamp parses the time of 'active_from' and 'active_until', RFC 3339 or a date such as '2024-06-01',
+// at midnight in the local time of the server.
+func ParseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("ipfilter: Invalid timestamp, it should be RFC 3339 or a date: " + s)
+	}
+	return t, nil
+}
+
+// checkActiveRange returns an error unless 'until' is after 'from', either may be zero.
+func checkActiveRange(from, until time.Time) error {
+	if !from.IsZero() && !until.IsZero() && !until.After(from) {
+		return errors.New("ipfilter: active_until should be after active_from")
+	}
+	return nil
+}
+
+// activeAt returns true if 't' is between the dates of 'path' and in any of its schedules.
+func (path IPPath) activeAt(t time.Time) bool {
+	if !path.ActiveFrom.IsZero() && t.Before(path.ActiveFrom) {
+		return false
+	}
+	if !path.ActiveUntil.IsZero() && !t.Before(path.ActiveUntil) {
+		return false
+	}
+	if len(path.Schedules) == 0 {
+		return true
+	}
+	for _, s := range path.Schedules {
+		if s.activeAt(t) {
+			return true
+		}
+	}
+	return false
+}
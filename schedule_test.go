@@ -0,0 +1,159 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		input       []string
+		shouldError bool
+	}{
+		{[]string{"09:00-17:00"}, false},
+		{[]string{"09:00-17:00", "Mon-Fri"}, false},
+		{[]string{"09:00-17:00", "mon,wed,fri", "Europe/Paris"}, false},
+		{[]string{"22:00-06:00", "UTC"}, false},
+		{[]string{"00:00-24:00", "Sat-Sun"}, false},
+		{[]string{}, true},
+		{[]string{"09:00"}, true},
+		{[]string{"09:00-09:00"}, true},
+		{[]string{"9-17"}, true},
+		{[]string{"09:00-25:00"}, true},
+		{[]string{"24:00-06:00"}, true},
+		{[]string{"09:00-17:00", "Mon-Fry", "UTC"}, true},
+		{[]string{"09:00-17:00", "Nowhere/City"}, true},
+		{[]string{"09:00-17:00", "Mon-Fri", "UTC", "extra"}, true},
+	}
+	for i, test := range tests {
+		_, err := ParseSchedule(test.input)
+		if test.shouldError != (err != nil) {
+			t.Errorf("Test %d: Expected error: %v, Got: %v", i, test.shouldError, err)
+		}
+	}
+}
+
+func TestScheduleActiveAt(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("No timezone database")
+	}
+	tests := []struct {
+		schedule string
+		at       time.Time
+		expected bool
+	}{
+		// 2024-01-01 is a Monday.
+		{"09:00-17:00 Mon-Fri UTC", time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC), true},
+		{"09:00-17:00 Mon-Fri UTC", time.Date(2024, 1, 1, 17, 0, 0, 0, time.UTC), false},
+		{"09:00-17:00 Mon-Fri UTC", time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC), false},
+		{"09:00-17:00 Mon-Fri Europe/Paris", time.Date(2024, 1, 1, 8, 30, 0, 0, time.UTC), true},
+		{"09:00-17:00 Mon-Fri Europe/Paris", time.Date(2024, 1, 1, 8, 30, 0, 0, paris), false},
+		{"22:00-06:00 Fri UTC", time.Date(2024, 1, 5, 23, 0, 0, 0, time.UTC), true},
+		{"22:00-06:00 Fri UTC", time.Date(2024, 1, 6, 5, 59, 0, 0, time.UTC), true},
+		{"22:00-06:00 Fri UTC", time.Date(2024, 1, 5, 5, 0, 0, 0, time.UTC), false},
+		{"00:00-24:00 Fri-Mon UTC", time.Date(2024, 1, 7, 23, 59, 0, 0, time.UTC), true},
+		{"00:00-24:00 Fri-Mon UTC", time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC), false},
+	}
+	for i, test := range tests {
+		s, err := ParseSchedule(strings.Fields(test.schedule))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if got := s.activeAt(test.at); got != test.expected {
+			t.Errorf("Test %d: Expected: %v, Got: %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestScheduleServeHTTP(t *testing.T) {
+	today := time.Now().UTC().Weekday()
+	inTwoDays := weekdays[(today+2)%7]
+
+	tests := []struct {
+		schedule       string
+		expectedStatus int
+	}{
+		{"00:00-24:00 UTC", http.StatusOK},
+		// the scheduled block doesn't apply, the next one does.
+		{"00:00-24:00 " + inTwoDays + " UTC", http.StatusForbidden},
+	}
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter /admin {\nrule allow\nip 8.8.8.8 10.0.0.0/8\nschedule "+
+			test.schedule+"\n}\nipfilter /admin {\nrule allow\nip 10.0.0.0/8\n}"))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/admin", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "8.8.8.8:_"
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestActiveRange(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		dates          string
+		expectedStatus int
+		shouldErr      bool
+	}{
+		{"active_from " + past, http.StatusForbidden, false},
+		{"active_from " + future, http.StatusOK, false},
+		{"active_until " + future, http.StatusForbidden, false},
+		{"active_until " + past, http.StatusOK, false},
+		{"active_from " + past + "\nactive_until " + future, http.StatusForbidden, false},
+		{"active_from 2000-01-01\nactive_until 2001-01-01", http.StatusOK, false},
+		{"active_from " + future + "\nactive_until " + past, 0, true},
+		{"active_until tomorrow", 0, true},
+	}
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\n"+test.dates+"\n}"))
+		if test.shouldErr != (err != nil) {
+			t.Fatalf("Test %d: Expected error: %v, Got: %v", i, test.shouldErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		// the dates survive the JSON rules.
+		paths, err := RulesFromPaths(config.Paths).ToPaths(false, false)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		if !paths[0].ActiveFrom.Equal(config.Paths[0].ActiveFrom) || !paths[0].ActiveUntil.Equal(config.Paths[0].ActiveUntil) {
+			t.Errorf("Test %d: Expected the dates %v, Got: %v", i, config.Paths[0], paths[0])
+		}
+
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "8.8.8.8:_"
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status: %d, Got: %d", i, test.expectedStatus, status)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// caseSensitivePath tells whether scopes are case sensitive, it follows caddy's setting when built as a plugin.
+var caseSensitivePath = func() bool { return false }
+
+// pathMatches returns true if 'reqPath' is in the scope 'base', like caddy's httpserver.Path.Matches.
+func pathMatches(reqPath, base string) bool {
+	if base == "/" || base == "" {
+		return true
+	}
+	if caseSensitivePath() {
+		return strings.HasPrefix(reqPath, base)
+	}
+	return strings.HasPrefix(strings.ToLower(reqPath), strings.ToLower(base))
+}
+
+// excludes returns true if 'reqPath' is in one of the Excludes of 'path', they match like scopes and a
+// trailing '*' is ignored: "/static/*" excludes everything under "/static/".
+func (path IPPath) excludes(reqPath string) bool {
+	for _, exclude := range path.Excludes {
+		if pathMatches(reqPath, strings.TrimSuffix(exclude, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeOf returns the most specific scope of 'path' that 'reqPath' is in, empty if none.
+func (path IPPath) scopeOf(reqPath string) string {
+	var scope string
+	for _, base := range path.PathScopes {
+		if pathMatches(reqPath, base) && len(base) > len(scope) {
+			scope = base
+		}
+	}
+	return scope
+}
+
+// restricted returns true if the block only applies to some of the requests in its scopes, see appliesTo.
+func (path IPPath) restricted() bool {
+	return len(path.Hosts) != 0 || len(path.Methods) != 0 || len(path.Headers) != 0
+}
+
+// appliesTo returns true if the request conditions of 'path' accept 'r', the blocks that don't apply leave
+// the request to the other blocks matching its path.
+func (path IPPath) appliesTo(r *http.Request) bool {
+	if len(path.Hosts) != 0 && !hostMatches(r.Host, path.Hosts) {
+		return false
+	}
+	if len(path.Methods) != 0 && !methodMatches(r.Method, path.Methods) {
+		return false
+	}
+	for _, header := range path.Headers {
+		if !header.matches(r) {
+			return false
+		}
+	}
+	return path.activeAt(time.Now())
+}
+
+// methodMatches returns true if 'method' is one of 'methods', they are uppercase.
+func methodMatches(method string, methods []string) bool {
+	for _, m := range methods {
+		if method == m {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches returns true if 'host', with or without a port, is one of 'hosts', "*.example.com" matches the
+// subdomains of example.com.
+func hostMatches(host string, hosts []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range hosts {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Match modes, deciding which IPPath applies when several scopes match a request.
+const (
+	MatchLongest  = "longest"  // the most specific scope wins, the default.
+	MatchFirst    = "first"    // the first declared block wins, like nginx allow/deny.
+	MatchPriority = "priority" // the block with the highest priority wins, then the most specific scope.
+	// a 'rule allow' block letting the client in wins over the others, whatever its scope, else like MatchLongest.
+	MatchAllowOverrides = "allow_overrides"
+)
+
+// allowOverride returns the first 'rule allow' IPPath active at 'level', in a scope of 'reqPath', that 'applies'
+// accepts and 'allows' lets the client through, -1 if none, see MatchAllowOverrides.
+func (ipf IPFilter) allowOverride(reqPath string, level int, applies func(int) bool, allows func(IPPath) bool) int {
+	for i, path := range ipf.Config.Paths {
+		if path.IsBlock || path.ThreatLevel > level || path.scopeOf(reqPath) == "" || path.excludes(reqPath) {
+			continue
+		}
+		if applies != nil && !applies(i) {
+			continue
+		}
+		if allows(path) {
+			return i
+		}
+	}
+	return -1
+}
+
+// scopeTrie is a prefix trie of all the PathScopes of a config,
+// it finds the IPPath applying to a request path in a single traversal.
+type scopeTrie struct {
+	root          *scopeNode
+	caseSensitive bool
+	mode          string
+	priorities    []int    // of every IPPath, for MatchPriority.
+	restricted    []bool   // of every IPPath, whether it only applies to some requests, see appliesTo.
+	ties          []string // of every IPPath, breaks the ties between identical scopes, see tieKey.
+
+	level    int          // threat level of the trie, IPPaths with a higher ThreatLevel are left out.
+	elevated []*scopeTrie // tries of the higher threat levels used by the IPPaths, by ascending level.
+}
+
+type scopeNode struct {
+	children map[byte]*scopeNode
+	// paths are the IPPaths with a scope ending at this node, the one that wins first: the next ones only
+	// apply to the requests the previous ones don't apply to.
+	paths []scopeEntry
+}
+
+// scopeEntry is an IPPath of a scopeNode, with its scope ending there.
+type scopeEntry struct {
+	path  int
+	scope string
+}
+
+func newScopeNode() *scopeNode {
+	return &scopeNode{children: make(map[byte]*scopeNode)}
+}
+
+// insert adds the IPPath 'path' to the node, after the ones it doesn't beat.
+func (node *scopeNode) insert(t *scopeTrie, path int, scope string) {
+	at := len(node.paths)
+	for j, entry := range node.paths {
+		if entry.path == path {
+			return
+		}
+		if at == len(node.paths) && t.beats(path, 0, entry.path, 0) {
+			at = j
+		}
+	}
+	node.paths = append(node.paths, scopeEntry{})
+	copy(node.paths[at+1:], node.paths[at:])
+	node.paths[at] = scopeEntry{path, scope}
+}
+
+// winner returns the first IPPath of the node 'applies' accepts, a nil 'applies' accepts all of them.
+func (node *scopeNode) winner(applies func(int) bool) (scopeEntry, bool) {
+	for _, entry := range node.paths {
+		if applies == nil || applies(entry.path) {
+			return entry, true
+		}
+	}
+	return scopeEntry{}, false
+}
+
+// newScopeTrie builds the trie for 'paths', it must be rebuilt if 'paths' changes,
+// an empty 'mode' is MatchLongest.
+func newScopeTrie(paths []IPPath, mode string) *scopeTrie {
+	ties := make([]string, len(paths))
+	for i, path := range paths {
+		ties[i] = tieKey(path)
+	}
+	t := newLevelTrie(paths, mode, 0, ties)
+
+	var levels []int
+	for _, path := range paths {
+		if path.ThreatLevel > 0 {
+			levels = append(levels, path.ThreatLevel)
+		}
+	}
+	sort.Ints(levels)
+	for i, level := range levels {
+		if i == 0 || level != levels[i-1] {
+			t.elevated = append(t.elevated, newLevelTrie(paths, mode, level, ties))
+		}
+	}
+	return t
+}
+
+// tieKey orders the IPPaths sharing a scope whatever their declaration order, the smallest key wins:
+// blocking rules win over allowing ones, then the rule IDs, hashes of the rules, decide. Rules that only
+// differ by matchers that weren't created by NewMatcher can't be told apart and keep their declaration order.
+func tieKey(path IPPath) string {
+	if path.IsBlock {
+		return "0" + ruleID(path)
+	}
+	return "1" + ruleID(path)
+}
+
+// newLevelTrie builds the trie of the IPPaths enforced at the threat level 'level', 'ties' are their tieKeys.
+func newLevelTrie(paths []IPPath, mode string, level int, ties []string) *scopeTrie {
+	t := &scopeTrie{
+		root:          newScopeNode(),
+		caseSensitive: caseSensitivePath(),
+		mode:          mode,
+		priorities:    make([]int, len(paths)),
+		restricted:    make([]bool, len(paths)),
+		ties:          ties,
+		level:         level,
+	}
+
+	for i, path := range paths {
+		t.priorities[i] = path.Priority
+		t.restricted[i] = path.restricted()
+		if path.ThreatLevel > level {
+			continue
+		}
+		for _, scope := range path.PathScopes {
+			node := t.root
+			// "/" matches everything, just like pathMatches.
+			if scope != "/" {
+				key := t.key(scope)
+				for j := 0; j < len(key); j++ {
+					child, ok := node.children[key[j]]
+					if !ok {
+						child = newScopeNode()
+						node.children[key[j]] = child
+					}
+					node = child
+				}
+			}
+
+			node.insert(t, i, scope)
+		}
+	}
+
+	return t
+}
+
+// beats returns true if the IPPath 'a', matching with a scope of length 'aDepth',
+// takes precedence over 'b' matching with a scope of length 'bDepth'.
+func (t *scopeTrie) beats(a, aDepth, b, bDepth int) bool {
+	switch t.mode {
+	case MatchFirst:
+		// a block with several matching scopes keeps its most specific one.
+		return a < b || (a == b && aDepth > bDepth)
+	case MatchPriority:
+		if t.priorities[a] != t.priorities[b] {
+			return t.priorities[a] > t.priorities[b]
+		}
+	}
+	if aDepth != bDepth {
+		return aDepth > bDepth
+	}
+	// between identical scopes, a block restricted to some requests is the most specific.
+	if t.restricted[a] != t.restricted[b] {
+		return t.restricted[a]
+	}
+	// identical rules are interchangeable, the first one is kept.
+	return t.ties[a] < t.ties[b]
+}
+
+func (t *scopeTrie) key(s string) string {
+	if t.caseSensitive {
+		return s
+	}
+	return strings.ToLower(s)
+}
+
+// at returns the trie of the threat level 'level'.
+func (t *scopeTrie) at(level int) *scopeTrie {
+	at := t
+	for _, elevated := range t.elevated {
+		if elevated.level > level {
+			break
+		}
+		at = elevated
+	}
+	return at
+}
+
+// match returns the index of the IPPath applying to 'reqPath' and its matching scope, or -1 if no scope matches.
+func (t *scopeTrie) match(reqPath string) (int, string) {
+	return t.matchIf(reqPath, nil)
+}
+
+// matchIf is match among the IPPaths 'applies' accepts, see appliesTo.
+func (t *scopeTrie) matchIf(reqPath string, applies func(int) bool) (int, string) {
+	node := t.root
+	path, scope, depth := -1, "", 0
+	if entry, ok := node.winner(applies); ok {
+		path, scope = entry.path, entry.scope
+	}
+
+	key := t.key(reqPath)
+	for i := 0; i < len(key); i++ {
+		child, ok := node.children[key[i]]
+		if !ok {
+			break
+		}
+		node = child
+		if entry, ok := node.winner(applies); ok && (path < 0 || t.beats(entry.path, i+1, path, depth)) {
+			path, scope, depth = entry.path, entry.scope, i+1
+		}
+	}
+
+	return path, scope
+}
@@ -0,0 +1,432 @@
+package ipfilter
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/quick"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestScopeTrie(t *testing.T) {
+	paths := []IPPath{
+		{PathScopes: []string{"/"}},
+		{PathScopes: []string{"/private", "/blog"}},
+		{PathScopes: []string{"/private/keys"}},
+		{PathScopes: []string{"/blog"}, IsBlock: true},
+	}
+	trie := newScopeTrie(paths, "")
+
+	tests := []struct {
+		reqPath       string
+		expectedPath  int
+		expectedScope string
+	}{
+		{"/", 0, "/"},
+		{"/about", 0, "/"},
+		{"/private", 1, "/private"},
+		{"/private/index.html", 1, "/private"},
+		{"/private/keys/id_rsa", 2, "/private/keys"},
+		{"/Private/Keys", 2, "/private/keys"},
+		// blocking rules win between identical scopes.
+		{"/blog/post", 3, "/blog"},
+	}
+
+	for i, test := range tests {
+		path, scope := trie.match(test.reqPath)
+		if path != test.expectedPath || scope != test.expectedScope {
+			t.Errorf("Test %d expected (%d, %s) got: (%d, %s)",
+				i, test.expectedPath, test.expectedScope, path, scope)
+		}
+	}
+
+	// whatever the declaration order.
+	reversed := []IPPath{paths[3], paths[2], paths[1], paths[0]}
+	if path, _ := newScopeTrie(reversed, "").match("/blog/post"); path != 0 {
+		t.Errorf("Expected the blocking rule for '/blog/post', got: %d", path)
+	}
+
+	if path, _ := newScopeTrie(paths[1:], "").match("/public"); path != -1 {
+		t.Errorf("Expected no match for '/public', got: %d", path)
+	}
+}
+
+func TestScopeTrieMatchModes(t *testing.T) {
+	paths := []IPPath{
+		{PathScopes: []string{"/"}},
+		{PathScopes: []string{"/api", "/api/internal"}, Priority: 10},
+		{PathScopes: []string{"/api/internal"}},
+		{PathScopes: []string{"/api/internal/health"}, Priority: 10},
+	}
+
+	tests := []struct {
+		mode          string
+		reqPath       string
+		expectedPath  int
+		expectedScope string
+	}{
+		{MatchLongest, "/api/users", 1, "/api"},
+		{MatchLongest, "/api/internal/x", 2, "/api/internal"},
+		{MatchLongest, "/api/internal/health", 3, "/api/internal/health"},
+
+		// the first declared block matching wins.
+		{MatchFirst, "/api/users", 0, "/"},
+		{MatchFirst, "/api/internal/health", 0, "/"},
+		{MatchFirst, "/other", 0, "/"},
+
+		// highest priority, then the most specific scope.
+		{MatchPriority, "/other", 0, "/"},
+		{MatchPriority, "/api/users", 1, "/api"},
+		{MatchPriority, "/api/internal/x", 1, "/api/internal"},
+		{MatchPriority, "/api/internal/health", 3, "/api/internal/health"},
+	}
+
+	for i, test := range tests {
+		path, scope := newScopeTrie(paths, test.mode).match(test.reqPath)
+		if path != test.expectedPath || scope != test.expectedScope {
+			t.Errorf("Test %d (%s) expected (%d, %s) got: (%d, %s)",
+				i, test.mode, test.expectedPath, test.expectedScope, path, scope)
+		}
+	}
+
+	// a block with several matching scopes keeps its most specific one.
+	if path, scope := newScopeTrie(paths[1:], MatchFirst).match("/api/internal/x"); path != 0 || scope != "/api/internal" {
+		t.Errorf("Expected (0, /api/internal) got: (%d, %s)", path, scope)
+	}
+}
+
+func TestMatchModeParse(t *testing.T) {
+	tests := []struct {
+		input        string
+		shouldErr    bool
+		expectedMode string
+	}{
+		{"ipfilter / {\nrule block\nip 1.1.1.1\n}", false, ""},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\nmatch_mode first\n}", false, MatchFirst},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\nmatch_mode priority\n}\nipfilter /a {\nrule allow\nip 1.1.1.1\npriority 5\n}", false, MatchPriority},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\nmatch_mode allow_overrides\n}", false, MatchAllowOverrides},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\npriority 5\n}", true, ""},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\nmatch_mode priority\npriority high\n}", true, ""},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\nmatch_mode random\n}", true, ""},
+		{"ipfilter / {\nrule block\nip 1.1.1.1\nmatch_mode first\n}\nipfilter /a {\nrule block\nip 1.1.1.1\nmatch_mode longest\n}", true, ""},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %v", i, err)
+			continue
+		}
+		if config.MatchMode != test.expectedMode || config.scopes.mode != test.expectedMode {
+			t.Errorf("Test %d: Expected match mode '%s', got: '%s'", i, test.expectedMode, config.MatchMode)
+		}
+	}
+}
+
+func TestAllowOverrides(t *testing.T) {
+	const blocks = "ipfilter / {\nrule block\ndatabase " + DataBase + "\ncountry US\n}\n" +
+		"ipfilter / {\nrule allow\nip 8.8.8.8\n}\n" +
+		"ipfilter /api {\nrule block\nip 8.8.0.0/16\n}\n" +
+		"ipfilter /admin {\nrule allow\nip 8.8.4.4\n}\n"
+
+	tests := []struct {
+		matchMode      string
+		path           string
+		ip             string
+		expectedAction string
+		expectedRule   int
+	}{
+		{"allow_overrides", "/", "8.8.8.8", ActionAllow, 2},
+		{"allow_overrides", "/api/users", "8.8.8.8", ActionAllow, 2},
+		{"allow_overrides", "/", "8.8.4.4", ActionBlock, 1},
+		{"allow_overrides", "/api/users", "8.8.4.4", ActionBlock, 3},
+		{"allow_overrides", "/admin", "8.8.4.4", ActionAllow, 4},
+		{"allow_overrides", "/", "24.53.192.20", ActionAllow, 1},
+		{"allow_overrides", "/admin", "24.53.192.20", ActionBlock, 4},
+		// the most specific scope wins otherwise.
+		{"longest", "/", "8.8.8.8", ActionBlock, 1},
+		{"longest", "/api/users", "8.8.8.8", ActionBlock, 3},
+	}
+
+	for i, test := range tests {
+		config, err := ipfilterParse(caddy.NewTestController("http", blocks+"ipfilter /x {\nrule block\nip 1.1.1.1\nmatch_mode "+test.matchMode+"\n}"))
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		d := ipf.Decide(net.ParseIP(test.ip), test.path)
+		if d.Action != test.expectedAction || d.Rule != test.expectedRule {
+			t.Errorf("Test %d: Expected %s by rule %d, Got: %s by rule %d", i, test.expectedAction, test.expectedRule, d.Action, d.Rule)
+		}
+
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.ip + ":_"
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if (status == http.StatusOK) != (test.expectedAction == ActionAllow) {
+			t.Errorf("Test %d: Expected %s, Got status: %d", i, test.expectedAction, status)
+		}
+		config.DBHandler.Close()
+	}
+}
+
+func TestExclude(t *testing.T) {
+	const input = "ipfilter / {\nrule block\nip 8.8.8.8\nexclude /health /static/*\n}\nipfilter /api {\nrule block\nip 8.8.4.4\nexclude /api/webhook\n}"
+	config, err := ipfilterParse(caddy.NewTestController("http", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{Config: config}
+
+	tests := []struct {
+		path           string
+		ip             string
+		expectedAction string
+	}{
+		{"/", "8.8.8.8", ActionBlock},
+		{"/health", "8.8.8.8", ActionAllow},
+		{"/healthz", "8.8.8.8", ActionAllow},
+		{"/static/app.js", "8.8.8.8", ActionAllow},
+		{"/static", "8.8.8.8", ActionBlock},
+		{"/api/users", "8.8.4.4", ActionBlock},
+		// an excluded path isn't filtered by the less specific blocks either.
+		{"/api/webhook", "8.8.4.4", ActionAllow},
+		{"/api/webhook", "8.8.8.8", ActionAllow},
+	}
+
+	for i, test := range tests {
+		d := ipf.Decide(net.ParseIP(test.ip), test.path)
+		if d.Action != test.expectedAction {
+			t.Errorf("Test %d: Expected %s for %s, got: %s", i, test.expectedAction, test.path, d.Action)
+		}
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\nexclude\n}")); err == nil {
+		t.Error("Expected an error for exclude without paths")
+	}
+}
+
+func TestHost(t *testing.T) {
+	const input = "ipfilter / {\nrule block\nip 8.8.8.8\n}\n" +
+		"ipfilter / {\nrule block\nip 8.8.4.4\nhost shop.example.com\n}\n" +
+		"ipfilter /admin {\nrule allow\nip 8.8.4.4\nhost *.example.org\n}"
+	config, err := ipfilterParse(caddy.NewTestController("http", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if warnings := policyWarnings(config); len(warnings) != 0 {
+		t.Fatalf("Unexpected warnings: %v", warnings)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		host           string
+		path           string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"example.com", "/", "8.8.8.8:_", http.StatusForbidden},
+		{"example.com", "/", "8.8.4.4:_", http.StatusOK},
+		{"shop.example.com", "/", "8.8.4.4:_", http.StatusForbidden},
+		{"SHOP.example.com:8080", "/", "8.8.4.4:_", http.StatusForbidden},
+		// the block of the host replaces the one of every host.
+		{"shop.example.com", "/", "8.8.8.8:_", http.StatusOK},
+		{"www.example.org", "/admin", "8.8.4.4:_", http.StatusOK},
+		{"www.example.org", "/admin", "24.53.192.20:_", http.StatusForbidden},
+		{"example.org", "/admin", "8.8.8.8:_", http.StatusForbidden},
+		{"example.org", "/admin", "24.53.192.20:_", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.Host = test.host
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	const input = "ipfilter / {\nrule allow\nip 8.8.8.8\nmethods post put delete\n}"
+	config, err := ipfilterParse(caddy.NewTestController("http", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		method         string
+		reqIP          string
+		expectedStatus int
+	}{
+		{"GET", "8.8.4.4:_", http.StatusOK},
+		{"HEAD", "8.8.4.4:_", http.StatusOK},
+		{"POST", "8.8.4.4:_", http.StatusForbidden},
+		{"DELETE", "8.8.4.4:_", http.StatusForbidden},
+		{"POST", "8.8.8.8:_", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	if _, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule allow\nip 8.8.8.8\nmethods\n}")); err == nil {
+		t.Error("Expected an error for methods without methods")
+	}
+}
+
+// randomPaths returns between 1 and 6 IPPaths drawn from few scopes and IPs, so they often overlap.
+func randomPaths(rnd *rand.Rand, mode string) []IPPath {
+	scopes := []string{"/", "/api", "/API", "/api/v1", "/blog"}
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0", "10.0.1.1-10", "192.168"}
+	families := []string{"", "", FamilyIPv4, FamilyIPv6}
+
+	paths := make([]IPPath, 1+rnd.Intn(6))
+	for i := range paths {
+		path := IPPath{IsBlock: rnd.Intn(2) == 0, Family: families[rnd.Intn(len(families))]}
+		for j := 1 + rnd.Intn(2); j > 0; j-- {
+			path.PathScopes = append(path.PathScopes, scopes[rnd.Intn(len(scopes))])
+		}
+		for j := rnd.Intn(3); j > 0; j-- {
+			rng, _ := parseIP(ips[rnd.Intn(len(ips))])
+			path.Ranges = append(path.Ranges, rng)
+		}
+		if len(path.Ranges) == 0 && path.Family == "" {
+			path.Family = FamilyIPv4
+		}
+		if mode == MatchPriority {
+			path.Priority = rnd.Intn(3)
+		}
+		path.ThreatLevel = rnd.Intn(2)
+		paths[i] = path
+	}
+	return paths
+}
+
+// TestDeterministicDecisions checks that the declaration order of the ipfilter blocks doesn't change any
+// decision, except with 'match_mode first' where it is the point.
+func TestDeterministicDecisions(t *testing.T) {
+	reqPaths := []string{"/", "/api", "/api/v1/users", "/Api/V1", "/blog/post", "/other"}
+	reqIPs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.200", "10.0.1.5", "192.168.3.4", "8.8.8.8", "2001:db8::1"}
+
+	property := func(seed int64) bool {
+		rnd := rand.New(rand.NewSource(seed))
+		mode := []string{MatchLongest, MatchPriority}[rnd.Intn(2)]
+		paths := randomPaths(rnd, mode)
+
+		shuffled := make([]IPPath, len(paths))
+		for i, j := range rnd.Perm(len(paths)) {
+			shuffled[j] = paths[i]
+		}
+
+		a, err := New(Config{Paths: paths, MatchMode: mode})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		b, err := New(Config{Paths: shuffled, MatchMode: mode})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		level := rnd.Intn(2)
+		a.Config.Threat.Set(level, 0)
+		b.Config.Threat.Set(level, 0)
+
+		for _, reqPath := range reqPaths {
+			for _, reqIP := range reqIPs {
+				da, db := a.Decide(net.ParseIP(reqIP), reqPath), b.Decide(net.ParseIP(reqIP), reqPath)
+				if da.Action != db.Action || da.Scope != db.Scope || (da.Rule == 0) != (db.Rule == 0) {
+					t.Logf("seed %d: %s %s: %+v with %v, %+v with %v", seed, reqIP, reqPath, da, paths, db, shuffled)
+					return false
+				}
+				// the same rule applies, whatever its position.
+				if da.Rule != 0 && ruleID(a.Config.Paths[da.Rule-1]) != ruleID(b.Config.Paths[db.Rule-1]) {
+					t.Logf("seed %d: %s %s: rule %d of %v, rule %d of %v", seed, reqIP, reqPath, da.Rule, paths, db.Rule, shuffled)
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDeterministicMatchers checks that a failed lookup doesn't hide a match, whatever the order of the matchers.
+func TestDeterministicMatchers(t *testing.T) {
+	failing := MatcherFunc(func(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+		return false, errors.New("lookup failed")
+	})
+	matching := MatcherFunc(func(ctx context.Context, ip net.IP, r *http.Request) (bool, error) {
+		return ip.Equal(net.ParseIP("10.0.0.1")), nil
+	})
+
+	tests := []struct {
+		matchers []Matcher
+		ip       string
+		expected string
+		err      bool
+	}{
+		{[]Matcher{failing, matching}, "10.0.0.1", ActionBlock, false},
+		{[]Matcher{matching, failing}, "10.0.0.1", ActionBlock, false},
+		{[]Matcher{failing, matching}, "10.0.0.2", ActionBlock, true},
+		{[]Matcher{matching, failing}, "10.0.0.2", ActionBlock, true},
+	}
+
+	for i, test := range tests {
+		ipf, err := New(Config{Paths: []IPPath{{PathScopes: []string{"/"}, IsBlock: true, Matchers: test.matchers}}})
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		d := ipf.Decide(net.ParseIP(test.ip), "/")
+		if d.Action != test.expected || (d.Err != nil) != test.err {
+			t.Fatalf("Test %d: Expected %s (error: %v), Got: %+v", i, test.expected, test.err, d)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+//go:build !nocaddy
+// +build !nocaddy
+
+package ipfilter
+
+import (
+	"github.com/mholt/caddy"
+)
+
+// setsKey is the key of the ipfilter_set blocks in the storage of the caddy instance, so that every site
+// can use them.
+type setsKey struct{}
+
+// ipfilterSets returns the sets defined so far, by name.
+func ipfilterSets(c *caddy.Controller) map[string]IPPath {
+	sets, _ := c.Get(setsKey{}).(map[string]IPPath)
+	if sets == nil {
+		sets = make(map[string]IPPath)
+		c.Set(setsKey{}, sets)
+	}
+	return sets
+}
+
+// SetupSet parses the ipfilter_set blocks, ipfilter blocks add their conditions with 'use <name>'.
+func SetupSet(c *caddy.Controller) error {
+	// a site with several addresses runs its directives for each of them.
+	return c.OncePerServerBlock(func() error {
+		return ipfilterSetParse(c)
+	})
+}
+
+// ipfilterSetParse parses all ipfilter_set {} blocks, a set only holds the conditions of a rule.
+func ipfilterSetParse(c *caddy.Controller) error {
+	sets := ipfilterSets(c)
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		name := args[0]
+		if _, ok := sets[name]; ok {
+			return c.Err("ipfilter: ipfilter_set " + name + " is already defined")
+		}
+
+		var set IPPath
+		for c.NextBlock() {
+			switch c.Val() {
+			case "country", "ip", "ip_list", "feed", "expr", "dnsbl", "rdns", "hosting", "match", "except":
+				if err := parseCondition(&set, c); err != nil {
+					return err
+				}
+			default:
+				return c.Err("ipfilter: " + c.Val() + " can't be used in an ipfilter_set")
+			}
+		}
+		if set.MatchAll {
+			return c.Err("ipfilter: match all applies to the ipfilter blocks using the set")
+		}
+		sets[name] = set
+	}
+	return nil
+}
+
+// use adds the conditions of 'set' to the ones of the path.
+func (path *IPPath) use(set IPPath) error {
+	if len(path.CountryCodes) != 0 && len(set.CountryCodes) != 0 && path.NegateCountries != set.NegateCountries {
+		return errCountryNot
+	}
+	if len(set.CountryCodes) != 0 {
+		path.NegateCountries = set.NegateCountries
+	}
+	path.CountryCodes = append(path.CountryCodes, set.CountryCodes...)
+	path.Ranges = append(path.Ranges, set.Ranges...)
+	path.negated = append(path.negated, set.negated...)
+	path.lists = append(path.lists, set.lists...)
+	path.Feeds = append(path.Feeds, set.Feeds...)
+	path.Hostnames = append(path.Hostnames, set.Hostnames...)
+	path.Matchers = append(path.Matchers, set.Matchers...)
+	path.ExceptRanges = append(path.ExceptRanges, set.ExceptRanges...)
+	path.ExceptCountries = append(path.ExceptCountries, set.ExceptCountries...)
+	return nil
+}
@@ -0,0 +1,101 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+const testSets = `ipfilter_set office {
+	ip 8.8.4.0/24 !8.8.4.8
+}
+ipfilter_set north {
+	country CA
+	except ip 24.53.192.20
+}`
+
+func TestSets(t *testing.T) {
+	tests := []struct {
+		input          string
+		shouldErr      bool
+		reqIP          string
+		expectedStatus int
+	}{
+		{"rule allow\nuse office", false, "8.8.4.4:_", http.StatusOK},
+		{"rule allow\nuse office", false, "8.8.4.8:_", http.StatusForbidden},
+		{"rule allow\nuse office", false, "8.8.8.8:_", http.StatusForbidden},
+		// the conditions of the sets add up with the ones of the block.
+		{"rule allow\nuse office\nip 8.8.8.8", false, "8.8.8.8:_", http.StatusOK},
+		{"rule allow\nuse office north", false, "8.8.4.4:_", http.StatusOK},
+		{"rule block\nuse north", false, "24.53.192.20:_", http.StatusOK},
+		{"rule block\nuse north\ncountry US", false, "8.8.8.8:_", http.StatusForbidden},
+		{"rule block\nuse home", true, "", 0},
+		{"rule block\nuse", true, "", 0},
+	}
+
+	for i, test := range tests {
+		sc := caddy.NewTestController("http", testSets)
+		if err := SetupSet(sc); err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		// the sets are kept in the storage of the instance, shared by the sites.
+		c := caddy.NewTestController("http", "ipfilter / {\ndatabase "+DataBase+"\n"+test.input+"\n}")
+		c.Set(setsKey{}, sc.Get(setsKey{}))
+
+		config, err := ipfilterParse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Fatalf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestSetParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"ipfilter_set office {\nip 10.0.0.0/8\nfeed aws\nexpr \"method == 'POST'\"\n}", false},
+		{"ipfilter_set office {\nip 10.0.0.0/8\n}\nipfilter_set office {\nip 10.0.0.1\n}", true},
+		{"ipfilter_set {\nip 10.0.0.0/8\n}", true},
+		{"ipfilter_set office home {\nip 10.0.0.0/8\n}", true},
+		{"ipfilter_set office {\nrule block\n}", true},
+		{"ipfilter_set office {\nip 10.0.0.0/8\nmatch all\n}", true},
+		{"ipfilter_set office {\nip 10.0.0.300\n}", true},
+	}
+
+	for i, test := range tests {
+		err := SetupSet(caddy.NewTestController("http", test.input))
+		if test.shouldErr && err == nil {
+			t.Fatalf("Test %d: Expected an error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i, err)
+		}
+	}
+}
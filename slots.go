@@ -0,0 +1,210 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Policy slots, the rules of the Caddyfile are loaded in SlotBlue.
+const (
+	SlotBlue  = "blue"
+	SlotGreen = "green"
+)
+
+// SlotStatus describes the policy slots of a site.
+type SlotStatus struct {
+	Active   string             `json:"active"`
+	Slots    map[string]RuleSet `json:"slots"`
+	RevertTo string             `json:"revert_to,omitempty"`
+	RevertAt time.Time          `json:"revert_at,omitempty"` // zero if no revert is pending.
+}
+
+// policySlots holds the rules of the blue and green slots, one of them being enforced.
+type policySlots struct {
+	paths    map[string][]IPPath
+	active   string
+	revert   *time.Timer // switches back to revertTo, nil if no revert is pending.
+	revertTo string
+	revertAt time.Time
+}
+
+func validSlot(name string) bool {
+	return name == SlotBlue || name == SlotGreen
+}
+
+// LoadSlot replaces the rules of a slot, they are enforced right away if it is the active slot.
+func (lc *liveConfig) LoadSlot(name string, paths []IPPath) error {
+	if !validSlot(name) {
+		return errors.New("ipfilter: slot should be 'blue' or 'green'")
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if name == lc.slots.active {
+		lc.swapPaths(paths)
+		return nil
+	}
+	lc.slots.paths[name] = paths
+	return nil
+}
+
+// SwitchSlot enforces the rules of a slot, if 'revertAfter' isn't zero the previous slot is enforced
+// again after that long, unless ConfirmSlot is called before.
+func (lc *liveConfig) SwitchSlot(name string, revertAfter time.Duration) error {
+	if !validSlot(name) {
+		return errors.New("ipfilter: slot should be 'blue' or 'green'")
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	paths, ok := lc.slots.paths[name]
+	if !ok {
+		return errors.New("ipfilter: slot " + name + " has no rules")
+	}
+
+	lc.cancelRevert()
+	previous := lc.slots.active
+	if name != previous {
+		lc.slots.active = name
+		lc.swapPaths(paths)
+	}
+
+	if revertAfter > 0 && name != previous {
+		lc.slots.revertTo = previous
+		lc.slots.revertAt = time.Now().Add(revertAfter)
+		var timer *time.Timer
+		timer = time.AfterFunc(revertAfter, func() {
+			lc.mu.Lock()
+			defer lc.mu.Unlock()
+
+			// confirmed, or replaced by another switch, in the meantime.
+			if lc.slots.revert != timer {
+				return
+			}
+			log.Printf("[INFO] ipfilter: switch to slot %s not confirmed, reverting to slot %s", name, previous)
+			lc.slots.revert = nil
+			lc.slots.active = previous
+			lc.swapPaths(lc.slots.paths[previous])
+		})
+		lc.slots.revert = timer
+	}
+	return nil
+}
+
+// ConfirmSlot cancels the pending revert, it returns false if there was none.
+func (lc *liveConfig) ConfirmSlot() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	pending := lc.slots.revert != nil
+	lc.cancelRevert()
+	return pending
+}
+
+// cancelRevert stops the pending revert, lc.mu must be held.
+func (lc *liveConfig) cancelRevert() {
+	if lc.slots.revert != nil {
+		lc.slots.revert.Stop()
+	}
+	lc.slots.revert = nil
+	lc.slots.revertTo = ""
+	lc.slots.revertAt = time.Time{}
+}
+
+// Slots returns the status of the policy slots.
+func (lc *liveConfig) Slots() SlotStatus {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	status := SlotStatus{
+		Active:   lc.slots.active,
+		Slots:    make(map[string]RuleSet, len(lc.slots.paths)),
+		RevertTo: lc.slots.revertTo,
+		RevertAt: lc.slots.revertAt,
+	}
+	for name, paths := range lc.slots.paths {
+		status.Slots[name] = RulesFromPaths(paths)
+	}
+	return status
+}
+
+// switchRequest is the body of the slot switch requests.
+type switchRequest struct {
+	Slot        string `json:"slot"`
+	RevertAfter string `json:"revert_after,omitempty"`
+}
+
+// serveSlots handles the '/slots' routes of the management endpoint:
+// GET /slots, PUT /slots/blue|green, POST /slots/switch and POST /slots/confirm.
+func (ipf IPFilter) serveSlots(w http.ResponseWriter, r *http.Request, route string) (int, error) {
+	if ipf.live == nil {
+		return http.StatusInternalServerError, errors.New("ipfilter: rules can't be updated at runtime")
+	}
+
+	switch route {
+	case "/slots":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			return http.StatusMethodNotAllowed, nil
+		}
+		return writeJSON(w, ipf.live.Slots())
+	case "/slots/switch":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			return http.StatusMethodNotAllowed, nil
+		}
+		var req switchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return http.StatusBadRequest, err
+		}
+		var revertAfter time.Duration
+		if req.RevertAfter != "" {
+			var err error
+			revertAfter, err = time.ParseDuration(req.RevertAfter)
+			if err != nil || revertAfter <= 0 {
+				return http.StatusBadRequest, errors.New("ipfilter: revert_after should be a positive duration, e.g. '10m'")
+			}
+		}
+		if err := ipf.live.SwitchSlot(req.Slot, revertAfter); err != nil {
+			return http.StatusBadRequest, err
+		}
+		return writeJSON(w, ipf.live.Slots())
+	case "/slots/confirm":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			return http.StatusMethodNotAllowed, nil
+		}
+		if !ipf.live.ConfirmSlot() {
+			return http.StatusNotFound, nil
+		}
+		return writeJSON(w, ipf.live.Slots())
+	}
+
+	name := strings.TrimPrefix(route, "/slots/")
+	if !validSlot(name) {
+		return http.StatusNotFound, nil
+	}
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	var rs RuleSet
+	if err := json.NewDecoder(r.Body).Decode(&rs); err != nil {
+		return http.StatusBadRequest, err
+	}
+	paths, err := ipf.Config.rulePaths(r.Context(), rs)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := ipf.live.LoadSlot(name, paths); err != nil {
+		return http.StatusBadRequest, err
+	}
+	return writeJSON(w, RulesFromPaths(paths))
+}
@@ -0,0 +1,107 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPolicySlots(t *testing.T) {
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{
+			{
+				PathScopes: []string{"/"},
+				IsBlock:    true,
+				Ranges: []Range{
+					{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")},
+				},
+			},
+		},
+	}, "")
+
+	expectStatus := func(remoteAddr string, expected int) {
+		t.Helper()
+		if status, _ := adminRequest(t, ipf, "GET", "/", "", remoteAddr, ""); status != expected {
+			t.Fatalf("%s: Expected StatusCode: '%d', Got: '%d'", remoteAddr, expected, status)
+		}
+	}
+	slots := func() SlotStatus {
+		t.Helper()
+		status, rec := adminRequest(t, ipf, "GET", "/ipfilter/slots", "", "127.0.0.1:12345", "")
+		if status != http.StatusOK {
+			t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+		}
+		var ss SlotStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &ss); err != nil {
+			t.Fatalf("Could not decode the slots: %v", err)
+		}
+		return ss
+	}
+
+	// green has no rules yet.
+	if status, _ := adminRequest(t, ipf, "POST", "/ipfilter/slots/switch", `{"slot": "green"}`, "127.0.0.1:12345", ""); status != http.StatusBadRequest {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusBadRequest, status)
+	}
+
+	green := `{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["8.8.4.4"]}]}`
+	if status, _ := adminRequest(t, ipf, "PUT", "/ipfilter/slots/green", green, "127.0.0.1:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	// loading the inactive slot doesn't change anything.
+	expectStatus("8.8.8.8:12345", http.StatusForbidden)
+	expectStatus("8.8.4.4:12345", http.StatusOK)
+
+	if status, _ := adminRequest(t, ipf, "POST", "/ipfilter/slots/switch", `{"slot": "green"}`, "127.0.0.1:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	expectStatus("8.8.8.8:12345", http.StatusOK)
+	expectStatus("8.8.4.4:12345", http.StatusForbidden)
+	if ss := slots(); ss.Active != SlotGreen || len(ss.Slots) != 2 || !ss.RevertAt.IsZero() {
+		t.Fatalf("Unexpected slots: %+v", ss)
+	}
+
+	// switching back with a revert, confirmed.
+	if status, _ := adminRequest(t, ipf, "POST", "/ipfilter/slots/switch", `{"slot": "blue", "revert_after": "1h"}`, "127.0.0.1:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	if ss := slots(); ss.Active != SlotBlue || ss.RevertTo != SlotGreen || ss.RevertAt.IsZero() {
+		t.Fatalf("Unexpected slots: %+v", ss)
+	}
+	if status, _ := adminRequest(t, ipf, "POST", "/ipfilter/slots/confirm", "", "127.0.0.1:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	if status, _ := adminRequest(t, ipf, "POST", "/ipfilter/slots/confirm", "", "127.0.0.1:12345", ""); status != http.StatusNotFound {
+		t.Fatalf("Expected StatusCode: '%d' without a pending revert, Got: '%d'", http.StatusNotFound, status)
+	}
+	expectStatus("8.8.8.8:12345", http.StatusForbidden)
+
+	// not confirmed, reverted.
+	if err := ipf.live.SwitchSlot(SlotGreen, 10*time.Millisecond); err != nil {
+		t.Fatalf("SwitchSlot failed: %v", err)
+	}
+	expectStatus("8.8.4.4:12345", http.StatusForbidden)
+	deadline := time.Now().Add(2 * time.Second)
+	for ipf.live.Slots().Active != SlotBlue {
+		if time.Now().After(deadline) {
+			t.Fatal("The switch was not reverted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	expectStatus("8.8.8.8:12345", http.StatusForbidden)
+	expectStatus("8.8.4.4:12345", http.StatusOK)
+
+	// PUT /rules updates the active slot.
+	rules := `{"paths": [{"scopes": ["/"], "rule": "block", "ips": ["1.1.1.1"]}]}`
+	if status, _ := adminRequest(t, ipf, "PUT", "/ipfilter/rules", rules, "127.0.0.1:12345", ""); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+	if ss := slots(); ss.Slots[SlotBlue].Paths[0].IPs[0] != "1.1.1.1" {
+		t.Fatalf("Expected the blue slot to be updated, Got: %+v", ss.Slots[SlotBlue])
+	}
+
+	if status, _ := adminRequest(t, ipf, "PUT", "/ipfilter/slots/red", green, "127.0.0.1:12345", ""); status != http.StatusNotFound {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusNotFound, status)
+	}
+}
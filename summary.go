@@ -0,0 +1,176 @@
+package ipfilter
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults of 'summary'.
+const (
+	defaultSummaryWindow = time.Hour
+	defaultSummaryTop    = 10 // entries of the top lists, unless the report asks for more.
+	summaryBuckets       = 60 // the window is rolled a bucket at a time.
+)
+
+// Summary describes what the filter did over a rolling window: the most blocked IPs and countries, the blocks
+// per scope and how many requests each rule decided on. It is kept in buckets that expire one at a time.
+type Summary struct {
+	Window time.Duration
+
+	mu      sync.Mutex
+	span    time.Duration // of a bucket.
+	buckets []summaryBucket
+	now     func() time.Time
+}
+
+// summaryBucket counts the decisions of a span of the window.
+type summaryBucket struct {
+	start     time.Time
+	blocked   uint64
+	logOnly   uint64 // requests the blocks with 'sample' would have denied.
+	ips       map[string]uint64
+	countries map[string]uint64
+	scopes    map[string]uint64
+	rules     map[int]uint64
+}
+
+// NewSummary returns an empty Summary over 'window'.
+func NewSummary(window time.Duration) *Summary {
+	return &Summary{
+		Window:  window,
+		span:    window / summaryBuckets,
+		buckets: make([]summaryBucket, summaryBuckets),
+		now:     time.Now,
+	}
+}
+
+// Record counts the decision 'd'.
+func (s *Summary) Record(d DecisionRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := s.now().Truncate(s.span)
+	b := &s.buckets[int(start.UnixNano()/int64(s.span))%len(s.buckets)]
+	if !b.start.Equal(start) {
+		*b = summaryBucket{
+			start:     start,
+			ips:       make(map[string]uint64),
+			countries: make(map[string]uint64),
+			scopes:    make(map[string]uint64),
+			rules:     make(map[int]uint64),
+		}
+	}
+
+	if d.Rule != BanRule && d.Rule != DefaultRule {
+		b.rules[d.Rule]++
+	}
+	if d.Action == ActionLogOnly {
+		b.logOnly++
+	}
+	if d.Action != ActionBlock {
+		return
+	}
+	b.blocked++
+	if d.IP != "" {
+		b.ips[d.IP]++
+	}
+	country := d.Country
+	if country == "" {
+		country = UnknownCountry
+	}
+	b.countries[country]++
+	b.scopes[d.Scope]++
+}
+
+// SummaryReport is the Summary of the current window.
+type SummaryReport struct {
+	Window       string            `json:"window"`
+	Blocked      uint64            `json:"blocked"`
+	LoggedOnly   uint64            `json:"logged_only"` // requests out of the 'sample' of the blocks that would deny them.
+	TopIPs       []SummaryCount    `json:"top_blocked_ips"`
+	TopCountries []SummaryCount    `json:"top_blocked_countries"` // UnknownCountry for the clients missing from the database.
+	Scopes       map[string]uint64 `json:"blocked_per_scope"`     // "" for the bans outside of the blocks.
+	Rules        map[string]uint64 `json:"rule_hits"`             // requests decided by each rule, by 1-based position.
+}
+
+// SummaryCount is an entry of the top lists of a SummaryReport.
+type SummaryCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// Report returns the Summary of the current window, with 'top' entries in the top lists.
+func (s *Summary) Report(top int) SummaryReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ips := make(map[string]uint64)
+	countries := make(map[string]uint64)
+	report := SummaryReport{Window: s.Window.String(), Scopes: make(map[string]uint64), Rules: make(map[string]uint64)}
+	// the bucket of the oldest span is partly out of the window, it isn't counted.
+	oldest := s.now().Truncate(s.span).Add(-s.Window + s.span)
+	for _, b := range s.buckets {
+		if b.start.Before(oldest) {
+			continue
+		}
+		report.Blocked += b.blocked
+		report.LoggedOnly += b.logOnly
+		for ip, n := range b.ips {
+			ips[ip] += n
+		}
+		for country, n := range b.countries {
+			countries[country] += n
+		}
+		for scope, n := range b.scopes {
+			report.Scopes[scope] += n
+		}
+		for rule, n := range b.rules {
+			report.Rules[strconv.Itoa(rule)] += n
+		}
+	}
+	report.TopIPs = topCounts(ips, top)
+	report.TopCountries = topCounts(countries, top)
+	return report
+}
+
+// topCounts returns the 'n' largest counts, the ties are sorted by key.
+func topCounts(counts map[string]uint64, n int) []SummaryCount {
+	top := make([]SummaryCount, 0, len(counts))
+	for key, count := range counts {
+		top = append(top, SummaryCount{Key: key, Count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// serveSummary returns the Summary report, '?top=<n>' sets the length of the top lists.
+func (ipf IPFilter) serveSummary(w http.ResponseWriter, r *http.Request) (int, error) {
+	if ipf.Config.Summary == nil {
+		return http.StatusInternalServerError, errors.New("ipfilter: no summary configured")
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		return http.StatusMethodNotAllowed, nil
+	}
+	top := defaultSummaryTop
+	if value := r.URL.Query().Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return http.StatusBadRequest, errors.New("ipfilter: top should be a positive number")
+		}
+		top = n
+	}
+	return writeJSON(w, ipf.Config.Summary.Report(top))
+}
@@ -0,0 +1,98 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestSummary(t *testing.T) {
+	db, err := maxminddb.Open(DataBase)
+	if err != nil {
+		t.Fatalf("Error opening the database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	summary := NewSummary(time.Hour)
+	summary.now = func() time.Time { return now }
+	ipf := newTestAdminFilter(IPFConfig{
+		Paths: []IPPath{
+			{PathScopes: []string{"/"}, IsBlock: true, CountryCodes: []string{"RU"}},
+			{PathScopes: []string{"/private"}, IsBlock: true, Ranges: []Range{{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")}}},
+		},
+		DBHandler: db,
+		Summary:   summary,
+	}, "secret")
+
+	for _, test := range []struct {
+		reqIP, reqPath string
+	}{
+		{"5.175.96.22:_", "/"},
+		{"5.175.96.22:_", "/page"},
+		{"24.53.192.20:_", "/"},
+		{"8.8.8.8:_", "/private/page"},
+		{"8.8.4.4:_", "/private"},
+		{"10.0.0.1:_", "/private"},
+	} {
+		adminRequest(t, ipf, "GET", test.reqPath, "", test.reqIP, "")
+		now = now.Add(10 * time.Minute)
+	}
+
+	report := func(query string) SummaryReport {
+		status, rec := adminRequest(t, ipf, "GET", "/ipfilter/summary"+query, "", "8.8.8.8:_", "secret")
+		if status != http.StatusOK {
+			t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+		}
+		var report SummaryReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Could not decode the report: %v", err)
+		}
+		return report
+	}
+
+	// the first request is out of the window.
+	expected := SummaryReport{
+		Window:       "1h0m0s",
+		Blocked:      2,
+		TopIPs:       []SummaryCount{{"5.175.96.22", 1}},
+		TopCountries: []SummaryCount{{"RU", 1}},
+		Scopes:       map[string]uint64{"/": 1, "/private": 1},
+		Rules:        map[string]uint64{"1": 2, "2": 3},
+	}
+	if got := report("?top=1"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected: %+v, Got: %+v", expected, got)
+	}
+	if got := report(""); len(got.TopIPs) != 2 || got.TopIPs[1] != (SummaryCount{"8.8.8.8", 1}) || len(got.TopCountries) != 2 {
+		t.Errorf("Unexpected top lists: %+v", got)
+	}
+
+	now = now.Add(time.Hour)
+	if got := report(""); got.Blocked != 0 || len(got.TopIPs) != 0 || len(got.Rules) != 0 {
+		t.Errorf("Expected an empty summary, Got: %+v", got)
+	}
+
+	if status, _ := adminRequest(t, ipf, "GET", "/ipfilter/summary?top=none", "", "8.8.8.8:_", "secret"); status != http.StatusBadRequest {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusBadRequest, status)
+	}
+
+	for i, input := range []string{
+		"ipfilter / {\nrule block\nip 8.8.8.8\nsummary 10s\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nsummary 1h 10\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nsummary\nsummary\n}",
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 8.8.8.8\nsummary 24h\n}"))
+	if err != nil || config.Summary.Window != 24*time.Hour {
+		t.Errorf("Unexpected summary: %+v, %v", config.Summary, err)
+	}
+}
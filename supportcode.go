@@ -0,0 +1,77 @@
+package ipfilter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// BanRule is the rule number of support codes generated for dynamically banned clients,
+// other rule numbers are the 1-based position of the ipfilter block.
+const BanRule = 0
+
+// DefaultRule is the rule number of the requests no ipfilter block applies to, blocked by 'default block'.
+const DefaultRule = 1<<16 - 1
+
+var supportCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// A support code is made of the block time (4 bytes), the rule number (2 bytes)
+// and the first 4 bytes of an HMAC over the client IP, the time and the rule.
+const supportCodeLen = 4 + 2 + 4
+
+// NewSupportCode returns a short code identifying a block, e.g. "AAAA-BBBB-CCCC-DDDD",
+// it can be shown to the client and decoded by support with ParseSupportCode.
+func NewSupportCode(key []byte, ip net.IP, t time.Time, rule int) string {
+	var raw [supportCodeLen]byte
+	binary.BigEndian.PutUint32(raw[0:4], uint32(t.Unix()))
+	binary.BigEndian.PutUint16(raw[4:6], uint16(rule))
+	copy(raw[6:], supportCodeMAC(key, ip, raw[:6]))
+
+	encoded := supportCodeEncoding.EncodeToString(raw[:])
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, "-")
+}
+
+// ParseSupportCode returns the time and the rule number a support code was generated for.
+func ParseSupportCode(code string) (time.Time, int, error) {
+	raw, err := decodeSupportCode(code)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	t := time.Unix(int64(binary.BigEndian.Uint32(raw[0:4])), 0)
+	return t, int(binary.BigEndian.Uint16(raw[4:6])), nil
+}
+
+// VerifySupportCode returns true if 'code' was generated with 'key' for a client with 'ip'.
+func VerifySupportCode(key []byte, code string, ip net.IP) bool {
+	raw, err := decodeSupportCode(code)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(raw[6:], supportCodeMAC(key, ip, raw[:6]))
+}
+
+func decodeSupportCode(code string) ([]byte, error) {
+	code = strings.ToUpper(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	raw, err := supportCodeEncoding.DecodeString(code)
+	if err != nil || len(raw) != supportCodeLen {
+		return nil, errors.New("ipfilter: invalid support code")
+	}
+	return raw, nil
+}
+
+func supportCodeMAC(key []byte, ip net.IP, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ip.To16())
+	mac.Write(payload)
+	return mac.Sum(nil)[:4]
+}
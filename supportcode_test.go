@@ -0,0 +1,94 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSupportCode(t *testing.T) {
+	key := []byte("secret")
+	ip := net.ParseIP("8.8.8.8")
+	blockedAt := time.Date(2017, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	code := NewSupportCode(key, ip, blockedAt, 3)
+	if !regexp.MustCompile(`^[A-Z2-7]{4}(-[A-Z2-7]{4}){3}$`).MatchString(code) {
+		t.Fatalf("Expected a code like 'AAAA-BBBB-CCCC-DDDD', got: %s", code)
+	}
+
+	parsedAt, rule, err := ParseSupportCode(code)
+	if err != nil {
+		t.Fatalf("Could not parse the support code: %v", err)
+	}
+	if !parsedAt.Equal(blockedAt) || rule != 3 {
+		t.Errorf("Expected (%v, 3), got: (%v, %d)", blockedAt, parsedAt, rule)
+	}
+
+	// lowercase and ungrouped codes are accepted.
+	if _, _, err := ParseSupportCode(strings.ToLower(strings.Replace(code, "-", "", -1))); err != nil {
+		t.Errorf("Could not parse an ungrouped support code: %v", err)
+	}
+
+	if !VerifySupportCode(key, code, ip) {
+		t.Errorf("Expected the support code to be verified")
+	}
+	if VerifySupportCode(key, code, net.ParseIP("8.8.4.4")) {
+		t.Errorf("Expected the support code not to be verified for another IP")
+	}
+	if VerifySupportCode([]byte("other"), code, ip) {
+		t.Errorf("Expected the support code not to be verified with another key")
+	}
+	if _, _, err := ParseSupportCode("AAAA-BBBB"); err == nil {
+		t.Errorf("Expected an error for a truncated support code")
+	}
+}
+
+func TestSupportCodeBlockPage(t *testing.T) {
+	key := []byte("secret")
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: IPFConfig{
+			Paths: []IPPath{
+				{
+					PathScopes: []string{"/"},
+					BlockPage:  "./testdata/supportpage.html",
+					IsBlock:    true,
+					Ranges: []Range{
+						{net.ParseIP("8.8.8.8"), net.ParseIP("8.8.8.8")},
+					},
+				},
+			},
+			SupportKey: key,
+		},
+	}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = "8.8.8.8:12345"
+
+	rec := httptest.NewRecorder()
+	if status, _ := ipf.ServeHTTP(rec, req); status != http.StatusOK {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusOK, status)
+	}
+
+	match := regexp.MustCompile(`^You are not allowed here, support code: (\S+)$`).FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		t.Fatalf("Expected the support code in the blockpage, got: %s", rec.Body.String())
+	}
+	if _, rule, err := ParseSupportCode(match[1]); err != nil || rule != 1 {
+		t.Errorf("Expected a support code for rule 1, got: (%d, %v)", rule, err)
+	}
+	if !VerifySupportCode(key, match[1], net.ParseIP("8.8.8.8")) {
+		t.Errorf("Expected the support code to be verified for the client IP")
+	}
+}
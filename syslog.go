@@ -0,0 +1,187 @@
+package ipfilter
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the syslog output.
+const (
+	syslogQueueSize   = 10000       // messages waiting to be written, the next ones are dropped.
+	syslogRedial      = time.Second // how long to wait before connecting again after a failure.
+	syslogDialTimeout = 5 * time.Second
+)
+
+// syslogFacilities are the facilities 'syslog' accepts, by name.
+var syslogFacilities = map[string]int{
+	"user": 1, "daemon": 3, "auth": 4, "authpriv": 10,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities are the severities of the decisions, by action.
+var syslogSeverities = map[string]int{
+	ActionBlock:     4, // warning
+	ActionChallenge: 5, // notice
+	ActionLogOnly:   5, // notice
+	ActionAllow:     6, // informational
+}
+
+// localSyslogSockets are where the local syslog daemon listens, the first one that exists is used.
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogWriter sends the decisions to a syslog endpoint as RFC 5424 messages: one datagram per message over
+// UDP and unix sockets, octet-counted frames (RFC 6587) over TCP and TLS. Messages are written in the
+// background, they are dropped while the endpoint is unreachable so requests are never delayed.
+type SyslogWriter struct {
+	Network  string // "udp", "tcp", "tls", "unixgram" or "unix".
+	Address  string
+	Facility int
+
+	hostname string
+	messages chan []byte
+	dropped  int32 // messages dropped since the last report, logged by run.
+	dial     func() (net.Conn, error)
+}
+
+// NewSyslogWriter returns a SyslogWriter for 'endpoint': 'local' for the local daemon, or a URL such as
+// udp://10.0.0.5:514, tcp://logs.example.com:601 or tls://logs.example.com:6514. The facility is
+// local0 if empty.
+func NewSyslogWriter(endpoint, facility string) (*SyslogWriter, error) {
+	if facility == "" {
+		facility = "local0"
+	}
+	code, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, errors.New("ipfilter: Unknown syslog facility: " + facility)
+	}
+
+	sw := &SyslogWriter{Facility: code, messages: make(chan []byte, syslogQueueSize)}
+	if endpoint == "local" {
+		sw.Network = "unixgram"
+		for _, socket := range localSyslogSockets {
+			if _, err := os.Stat(socket); err == nil {
+				sw.Address = socket
+				break
+			}
+		}
+		if sw.Address == "" {
+			return nil, errors.New("ipfilter: No local syslog daemon")
+		}
+	} else {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, errors.New("ipfilter: Invalid syslog endpoint: " + endpoint)
+		}
+		switch u.Scheme {
+		case "udp", "tcp", "tls":
+			if u.Port() == "" {
+				return nil, errors.New("ipfilter: The syslog endpoint needs a port: " + endpoint)
+			}
+			sw.Network, sw.Address = u.Scheme, u.Host
+		case "unix", "unixgram":
+			sw.Network, sw.Address = u.Scheme, u.Path
+		default:
+			return nil, errors.New("ipfilter: syslog should be 'local' or a udp://, tcp://, tls:// or unix:// URL: " + endpoint)
+		}
+	}
+
+	sw.hostname, _ = os.Hostname()
+	if sw.hostname == "" {
+		sw.hostname = "-"
+	}
+	sw.dial = func() (net.Conn, error) {
+		if sw.Network == "tls" {
+			dialer := &net.Dialer{Timeout: syslogDialTimeout}
+			return tls.DialWithDialer(dialer, "tcp", sw.Address, nil)
+		}
+		return net.DialTimeout(sw.Network, sw.Address, syslogDialTimeout)
+	}
+	return sw, nil
+}
+
+// send queues the message of 'd', it is dropped if the queue is full.
+func (sw *SyslogWriter) send(d DecisionRecord) {
+	select {
+	case sw.messages <- sw.format(d):
+	default:
+		atomic.AddInt32(&sw.dropped, 1)
+	}
+}
+
+// format returns the RFC 5424 message of 'd'.
+func (sw *SyslogWriter) format(d DecisionRecord) []byte {
+	sd := fmt.Sprintf(`[ipfilter@32473 action="%s" ip="%s" country="%s" host="%s" method="%s" path="%s" scope="%s" rule="%d" rule_id="%s"]`,
+		sdEscape(d.Action), sdEscape(d.IP), sdEscape(d.Country), sdEscape(d.Host), sdEscape(d.Method), sdEscape(d.Path),
+		sdEscape(d.Scope), d.Rule, sdEscape(d.RuleID))
+	msg := fmt.Sprintf("%s %s requesting %s%s by rule %d", d.Action, d.IP, d.Host, d.Path, d.Rule)
+	return []byte(fmt.Sprintf("<%d>1 %s %s caddy %d decision %s %s",
+		sw.Facility*8+syslogSeverities[d.Action], d.Time.UTC().Format(time.RFC3339Nano), sw.hostname, os.Getpid(), sd, msg))
+}
+
+// sdEscape escapes a value of structured data.
+func sdEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// stream returns true if the messages are framed, over the connection-oriented transports.
+func (sw *SyslogWriter) stream() bool {
+	return sw.Network == "tcp" || sw.Network == "tls" || sw.Network == "unix"
+}
+
+// run writes the queued messages until 'ctx' is done, connecting again after failures.
+func (sw *SyslogWriter) run(ctx context.Context) {
+	var conn net.Conn
+	var nextDial time.Time
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var msg []byte
+		select {
+		case msg = <-sw.messages:
+		case <-ctx.Done():
+			return
+		}
+
+		if conn == nil {
+			if time.Now().Before(nextDial) {
+				atomic.AddInt32(&sw.dropped, 1)
+				continue
+			}
+			var err error
+			if conn, err = sw.dial(); err != nil {
+				log.Printf("[ERROR] ipfilter: Can't connect to syslog at %s: %v", sw.Address, err)
+				nextDial = time.Now().Add(syslogRedial)
+				atomic.AddInt32(&sw.dropped, 1)
+				continue
+			}
+		}
+		if dropped := atomic.SwapInt32(&sw.dropped, 0); dropped != 0 {
+			log.Printf("[ERROR] ipfilter: syslog: dropped %d messages", dropped)
+		}
+
+		if sw.stream() {
+			msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+		}
+		conn.SetWriteDeadline(time.Now().Add(syslogDialTimeout))
+		if _, err := conn.Write(msg); err != nil {
+			log.Printf("[ERROR] ipfilter: Can't write to syslog at %s: %v", sw.Address, err)
+			conn.Close()
+			conn = nil
+			nextDial = time.Now().Add(syslogRedial)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package ipfilter
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestSyslog(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer udp.Close()
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter /admin {\nrule block\nip 8.8.8.8\ndatabase "+DataBase+
+		"\nsyslog udp://"+udp.LocalAddr().String()+" auth\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer config.DBHandler.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go config.Syslog.run(ctx)
+
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+	for _, reqIP := range []string{"8.8.8.8:_", "24.53.192.20:_"} {
+		req, err := http.NewRequest("GET", "http://example.com/admin/users", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = reqIP
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	for i, expected := range []struct {
+		prefix, data string
+	}{
+		// auth (4) * 8 + warning (4)
+		{"<36>1 ", ` decision [ipfilter@32473 action="block" ip="8.8.8.8" country="US" host="example.com" method="GET" ` +
+			`path="/admin/users" scope="/admin" rule="1" rule_id="` + ruleID(config.Paths[0]) + `"] block 8.8.8.8`},
+		// auth (4) * 8 + informational (6)
+		{"<38>1 ", `action="allow" ip="24.53.192.20" country="CA"`},
+	} {
+		n, _, err := udp.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Test %d: Expected a syslog message: %v", i, err)
+		}
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, expected.prefix) || !strings.Contains(msg, expected.data) {
+			t.Errorf("Test %d: Unexpected message: %q", i, msg)
+		}
+	}
+
+	for i, input := range []string{
+		"ipfilter / {\nrule block\nip 8.8.8.8\nsyslog\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nsyslog udp://127.0.0.1\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nsyslog http://127.0.0.1:514\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nsyslog udp://127.0.0.1:514 kern\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nsyslog udp://127.0.0.1:514\nsyslog udp://127.0.0.1:514\n}",
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	sw, err := NewSyslogWriter("tcp://"+listener.Addr().String(), "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sw.run(ctx)
+	sw.send(DecisionRecord{Action: ActionChallenge, IP: "8.8.8.8", Path: `/"quoted"]`, Rule: 2})
+	sw.send(DecisionRecord{Action: ActionBlock, IP: "8.8.4.4", Rule: BanRule})
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for i, expected := range []string{
+		// local0 (16) * 8 + notice (5)
+		`<133>1 `,
+		// local0 (16) * 8 + warning (4)
+		`<132>1 `,
+	} {
+		// octet counting: the length of the message, a space and the message.
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatalf("Test %d: Expected a syslog message: %v", i, err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			t.Fatalf("Test %d: Invalid frame length %q", i, length)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatalf("Test %d: Truncated message: %v", i, err)
+		}
+		if !strings.HasPrefix(string(msg), expected) {
+			t.Errorf("Test %d: Expected %q, Got: %q", i, expected, msg)
+		}
+		if i == 0 && !strings.Contains(string(msg), `path="/\"quoted\"\]"`) {
+			t.Errorf("Test %d: Expected an escaped path, Got: %q", i, msg)
+		}
+	}
+}
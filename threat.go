@@ -0,0 +1,172 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Threat holds the threat level of a site, the ipfilter blocks with a 'threat_level' are only enforced from
+// their level. The level is set through the admin endpoint, or raised automatically while too many
+// requests are blocked, see SetAuto, the highest of both applies.
+type Threat struct {
+	mu          sync.Mutex
+	manual      int
+	manualUntil time.Time // zero if the manual level doesn't expire.
+	auto        int       // set by the block rate.
+
+	autoBlocks int // blocked requests per autoWindow raising the level to autoLevel, 0 if disabled.
+	autoWindow time.Duration
+	autoLevel  int
+	windowEnd  time.Time
+	blocks     int
+
+	now func() time.Time
+}
+
+// ThreatStatus describes the threat level of a site.
+type ThreatStatus struct {
+	Level       int       `json:"level"`
+	Manual      int       `json:"manual"`
+	ManualUntil time.Time `json:"manual_until,omitempty"` // zero if the manual level doesn't expire.
+	Auto        int       `json:"auto"`
+}
+
+// NewThreat returns a Threat at level 0.
+func NewThreat() *Threat {
+	return &Threat{now: time.Now}
+}
+
+// SetAuto raises the level to 'level' while at least 'blocks' requests are blocked per 'window',
+// it drops back after a window with less blocks. 'blocks' 0 disables it.
+func (t *Threat) SetAuto(blocks int, window time.Duration, level int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.autoBlocks, t.autoWindow, t.autoLevel = blocks, window, level
+	t.auto, t.blocks, t.windowEnd = 0, 0, time.Time{}
+}
+
+// Set sets the level to 'level' for 'ttl', or until it is set again if 'ttl' is zero.
+func (t *Threat) Set(level int, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.manual = level
+	t.manualUntil = time.Time{}
+	if ttl > 0 {
+		t.manualUntil = t.now().Add(ttl)
+	}
+}
+
+// Level returns the current threat level, 0 for a nil Threat.
+func (t *Threat) Level() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.status(t.now()).Level
+}
+
+// Status returns the current threat level and where it comes from.
+func (t *Threat) Status() ThreatStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.status(t.now())
+}
+
+// status returns the status at 'now', t.mu must be held.
+func (t *Threat) status(now time.Time) ThreatStatus {
+	if !t.manualUntil.IsZero() && !now.Before(t.manualUntil) {
+		t.manual = 0
+		t.manualUntil = time.Time{}
+	}
+	t.tick(now)
+
+	status := ThreatStatus{Level: t.manual, Manual: t.manual, ManualUntil: t.manualUntil, Auto: t.auto}
+	if t.auto > status.Level {
+		status.Level = t.auto
+	}
+	return status
+}
+
+// tick closes the block rate window if it is over, t.mu must be held.
+func (t *Threat) tick(now time.Time) {
+	if t.autoBlocks == 0 || now.Before(t.windowEnd) {
+		return
+	}
+
+	auto := 0
+	// a window without any request doesn't count the blocks of the one before.
+	if !t.windowEnd.IsZero() && now.Before(t.windowEnd.Add(t.autoWindow)) && t.blocks >= t.autoBlocks {
+		auto = t.autoLevel
+	}
+	if auto != t.auto {
+		log.Printf("[INFO] ipfilter: threat level set to %d after %d blocked requests in %s", auto, t.blocks, t.autoWindow)
+	}
+	t.auto = auto
+	t.blocks = 0
+	t.windowEnd = now.Add(t.autoWindow)
+}
+
+// recordBlock counts a blocked request for SetAuto.
+func (t *Threat) recordBlock() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.autoBlocks == 0 {
+		return
+	}
+	t.tick(t.now())
+	t.blocks++
+}
+
+// threatRequest is the body of the threat level requests.
+type threatRequest struct {
+	Level int    `json:"level"`
+	TTL   string `json:"ttl,omitempty"`
+}
+
+// serveThreat returns the threat level on GET and sets it on PUT or POST.
+func (ipf IPFilter) serveThreat(w http.ResponseWriter, r *http.Request) (int, error) {
+	if ipf.Config.Threat == nil {
+		return http.StatusInternalServerError, errors.New("ipfilter: no threat level configured")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, ipf.Config.Threat.Status())
+	case http.MethodPut, http.MethodPost:
+		var req threatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if req.Level < 0 {
+			return http.StatusBadRequest, errors.New("ipfilter: level should be positive")
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				return http.StatusBadRequest, errors.New("ipfilter: ttl should be a positive duration, e.g. '1h'")
+			}
+		}
+
+		ipf.Config.Threat.Set(req.Level, ttl)
+		log.Printf("[INFO] ipfilter: threat level set to %d through the admin endpoint", req.Level)
+		return writeJSON(w, ipf.Config.Threat.Status())
+	}
+
+	w.Header().Set("Allow", "GET, PUT, POST")
+	return http.StatusMethodNotAllowed, nil
+}
@@ -0,0 +1,142 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestThreatLevel(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	threat := NewThreat()
+	threat.now = func() time.Time { return now }
+
+	threat.Set(2, time.Hour)
+	if level := threat.Level(); level != 2 {
+		t.Fatalf("Expected level 2, Got: %d", level)
+	}
+	now = now.Add(time.Hour)
+	if level := threat.Level(); level != 0 {
+		t.Fatalf("Expected the manual level to expire, Got: %d", level)
+	}
+
+	// 3 blocks per minute raise the level to 1.
+	threat.SetAuto(3, time.Minute, 1)
+	for i := 0; i < 3; i++ {
+		threat.recordBlock()
+	}
+	if level := threat.Level(); level != 0 {
+		t.Fatalf("Expected level 0 during the first window, Got: %d", level)
+	}
+	now = now.Add(time.Minute)
+	if level := threat.Level(); level != 1 {
+		t.Fatalf("Expected level 1 after 3 blocks, Got: %d", level)
+	}
+	threat.Set(3, 0)
+	if status := threat.Status(); status.Level != 3 || status.Auto != 1 {
+		t.Fatalf("Expected the highest level to apply, Got: %+v", status)
+	}
+	threat.Set(0, 0)
+
+	// a quiet window lowers it back.
+	threat.recordBlock()
+	now = now.Add(time.Minute)
+	if level := threat.Level(); level != 0 {
+		t.Fatalf("Expected level 0 after a quiet window, Got: %d", level)
+	}
+
+	// so does a window without any request.
+	for i := 0; i < 3; i++ {
+		threat.recordBlock()
+	}
+	now = now.Add(time.Hour)
+	if level := threat.Level(); level != 0 {
+		t.Fatalf("Expected level 0 after an idle hour, Got: %d", level)
+	}
+}
+
+func TestThreatLevelRules(t *testing.T) {
+	config, err := ipfilterParse(caddy.NewTestController("http", `ipfilter / {
+		rule block
+		ip 10.0.0.1
+	}
+	ipfilter / {
+		rule block
+		ip 10.0.0.1 10.0.0.2
+		threat_level 1
+	}
+	ipfilter /api {
+		rule allow
+		ip 10.0.0.3
+		threat_level 2
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ipf := newTestAdminFilter(config, "secret")
+
+	tests := []struct {
+		level          int
+		reqIP          string
+		reqPath        string
+		expectedStatus int
+	}{
+		{0, "10.0.0.2:_", "/", http.StatusOK},
+		{0, "10.0.0.1:_", "/", http.StatusForbidden},
+		{0, "10.0.0.4:_", "/api", http.StatusOK},
+		{1, "10.0.0.2:_", "/", http.StatusForbidden},
+		{1, "10.0.0.4:_", "/api", http.StatusOK},
+		{2, "10.0.0.4:_", "/api", http.StatusForbidden},
+		{2, "10.0.0.3:_", "/api", http.StatusOK},
+		{2, "10.0.0.2:_", "/", http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		body, _ := json.Marshal(threatRequest{Level: test.level})
+		if status, _ := adminRequest(t, ipf, "PUT", "/ipfilter/threat", string(body), "10.0.0.9:_", "secret"); status != http.StatusOK {
+			t.Fatalf("Test %d: Could not set the threat level, status: %d", i, status)
+		}
+		if status, _ := adminRequest(t, ipf, "GET", test.reqPath, "", test.reqIP, ""); status != test.expectedStatus {
+			t.Fatalf("Test %d: Expected StatusCode: '%d', Got: '%d'", i, test.expectedStatus, status)
+		}
+	}
+
+	status, rec := adminRequest(t, ipf, "GET", "/ipfilter/threat", "", "10.0.0.9:_", "secret")
+	var threat ThreatStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &threat); status != http.StatusOK || err != nil || threat.Level != 2 {
+		t.Fatalf("Expected level 2, Got: %d %s", status, rec.Body)
+	}
+	if status, _ := adminRequest(t, ipf, "PUT", "/ipfilter/threat", `{"level": 1, "ttl": "-1h"}`, "10.0.0.9:_", "secret"); status != http.StatusBadRequest {
+		t.Fatalf("Expected StatusCode: '%d', Got: '%d'", http.StatusBadRequest, status)
+	}
+
+	if d := ipf.Decide(net.ParseIP("10.0.0.4"), "/api"); d.Action != ActionBlock || d.Rule != 3 {
+		t.Fatalf("Expected the threat level to apply to Decide, Got: %+v", d)
+	}
+}
+
+func TestThreatParse(t *testing.T) {
+	for i, input := range []string{
+		"ipfilter / {\nrule block\nip 10.0.0.1\nthreat_level high\n}",
+		"ipfilter / {\nrule block\nip 10.0.0.1\nthreat_level -1\n}",
+		"ipfilter / {\nrule block\nip 10.0.0.1\nthreat_auto 100 1m\n}",
+		"ipfilter / {\nrule block\nip 10.0.0.1\nthreat_auto 100 soon 2\n}",
+		"ipfilter / {\nrule block\nip 10.0.0.1\nthreat_auto 0 1m 2\n}",
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Fatalf("Test %d: Expected an error", i)
+		}
+	}
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter / {\nrule block\nip 10.0.0.1\nthreat_auto 100 1m 2\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.Threat.autoBlocks != 100 || config.Threat.autoWindow != time.Minute || config.Threat.autoLevel != 2 {
+		t.Fatalf("Unexpected threat_auto: %+v", config.Threat)
+	}
+}
@@ -0,0 +1,38 @@
+package ipfilter
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Headers of the allowed requests when 'set_headers' is set, for the applications behind caddy.
+const (
+	HeaderClientCountry = "X-Client-Country"     // ISO code of the client, unless it isn't in the database.
+	HeaderClientASN     = "X-Client-ASN"         // autonomous system of the client, with an ASN database.
+	HeaderClientIP      = "X-Client-IP-Resolved" // the client IP the rules checked, see ClientIPHeaders.
+)
+
+// setClientHeaders sets the client headers of 'r'. The values the client sent are always removed, so the
+// applications can trust them.
+func (ipf IPFilter) setClientHeaders(r *http.Request, strict bool, cost *requestCost) {
+	r.Header.Del(HeaderClientCountry)
+	r.Header.Del(HeaderClientASN)
+	r.Header.Del(HeaderClientIP)
+
+	clientIPs, err := ipf.clientIPs(r, strict)
+	if err != nil {
+		return
+	}
+	clientIP := clientIPs[0]
+	r.Header.Set(HeaderClientIP, clientIP.String())
+	if ipf.Config.hasCountryLookups() {
+		if country, err := ipf.lookupCountry(clientIP, cost); err == nil && country != "" {
+			r.Header.Set(HeaderClientCountry, country)
+		}
+	}
+	if ipf.Config.ASNHandler != nil {
+		if asn, err := ipf.lookupASN(clientIP, cost); err == nil && asn != 0 {
+			r.Header.Set(HeaderClientASN, strconv.FormatUint(uint64(asn), 10))
+		}
+	}
+}
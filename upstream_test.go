@@ -0,0 +1,73 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestSetHeaders(t *testing.T) {
+	asnPath := writeTestASNDB(t, map[string]uint{"8.8.8.0/24": 15169})
+	defer os.RemoveAll(filepath.Dir(asnPath))
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter /private {\nrule block\ncountry RU\ndatabase "+DataBase+
+		"\nasn_database "+asnPath+"\nset_headers\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer config.DBHandler.Close()
+	defer config.ASNHandler.Close()
+
+	var upstream http.Header
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			upstream = r.Header
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	tests := []struct {
+		reqIP, reqPath   string
+		header           map[string]string // sent by the client.
+		expectedUpstream map[string]string // nil if the request is blocked.
+	}{
+		{"8.8.8.8:_", "/private", nil,
+			map[string]string{HeaderClientIP: "8.8.8.8", HeaderClientCountry: "US", HeaderClientASN: "15169"}},
+		// no block applies, the request is still allowed.
+		{"24.53.192.20:_", "/", nil,
+			map[string]string{HeaderClientIP: "24.53.192.20", HeaderClientCountry: "CA"}},
+		// the client can't forge them.
+		{"10.0.0.1:_", "/private", map[string]string{HeaderClientCountry: "US", HeaderClientASN: "15169", HeaderClientIP: "8.8.8.8"},
+			map[string]string{HeaderClientIP: "10.0.0.1"}},
+		{"5.175.96.22:_", "/private", nil, nil},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = test.reqIP
+		for name, value := range test.header {
+			req.Header.Set(name, value)
+		}
+
+		upstream = nil
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if test.expectedUpstream == nil {
+			if upstream != nil {
+				t.Errorf("Test %d: Expected the request to be blocked", i)
+			}
+			continue
+		}
+		for _, name := range []string{HeaderClientIP, HeaderClientCountry, HeaderClientASN} {
+			if upstream.Get(name) != test.expectedUpstream[name] {
+				t.Errorf("Test %d: Expected %s: %q, Got: %q", i, name, test.expectedUpstream[name], upstream.Get(name))
+			}
+		}
+	}
+}
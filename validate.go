@@ -0,0 +1,135 @@
+package ipfilter
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// validateRemote is set by the '-ipfilter-validate-remote' flag of caddy, the feeds are fetched under
+// 'caddy -validate'.
+var validateRemote bool
+
+// deepValidation returns true under 'caddy -validate', the blocks are checked in depth then.
+var deepValidation = func() bool {
+	f := flag.Lookup("validate")
+	return f != nil && f.Value.String() == "true"
+}
+
+// mmdbKinds are the words of the database types of each kind of database.
+var mmdbKinds = map[string][]string{
+	"country":      {"country", "city", "enterprise"},
+	"ASN":          {"asn", "isp"},
+	"Anonymous-IP": {"anonymous"},
+}
+
+// deepCheck returns the problems the config would run into once serving, that the parsing doesn't catch: the
+// databases of another kind, the pages that can't be read and, with 'remote', the feeds and monitoring lists
+// that can't be fetched.
+func (config *IPFConfig) deepCheck(remote bool) []error {
+	var problems []error
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if config.DBHandler != nil {
+		check(checkMMDBKind(config.DBHandler, config.dbPath, "country"))
+	}
+	if config.ASNHandler != nil {
+		check(checkMMDBKind(config.ASNHandler, config.asnDBPath, "ASN"))
+	}
+	if config.AnonymousIPHandler != nil {
+		check(checkMMDBKind(config.AnonymousIPHandler, config.anonymousDBPath, "Anonymous-IP"))
+	}
+
+	checked := make(map[string]bool)
+	for i, path := range config.Paths {
+		if path.BlockPage != "" && !checked[path.BlockPage] {
+			checked[path.BlockPage] = true
+			if err := checkReadable(path.BlockPage); err != nil {
+				check(fmt.Errorf("ipfilter: block %d: Can't read the blockpage: %v", i+1, err))
+			}
+		}
+	}
+	if config.Maintenance != nil && config.Maintenance.Page != "" {
+		if err := checkReadable(config.Maintenance.Page); err != nil {
+			check(fmt.Errorf("ipfilter: Can't read the maintenance_page: %v", err))
+		}
+	}
+
+	if remote {
+		for _, name := range feedsOf(config.Paths) {
+			check(config.Feeds.Refresh(name))
+		}
+		for _, provider := range monitoringProvidersOf(config.Paths) {
+			check(config.Monitoring.Refresh(provider))
+		}
+	}
+	return problems
+}
+
+// Validate returns the problems of the files and databases the config refers to, all at once, see deepCheck.
+func (config *IPFConfig) Validate() error {
+	return joinProblems(config.deepCheck(false))
+}
+
+// checkMMDBKind returns an error if the type of 'db' names another kind of database than 'kind', one of
+// mmdbKinds. The types of no kind are accepted, they may be laid out like any.
+func checkMMDBKind(db *maxminddb.Reader, path, kind string) error {
+	dbType := strings.ToLower(db.Metadata.DatabaseType)
+	is := func(kind string) bool {
+		for _, word := range mmdbKinds[kind] {
+			if strings.Contains(dbType, word) {
+				return true
+			}
+		}
+		return false
+	}
+	if is(kind) {
+		return nil
+	}
+	if path == "" {
+		path = "the " + kind + " database"
+	}
+	for other := range mmdbKinds {
+		if is(other) {
+			return fmt.Errorf("ipfilter: %s is a %s database, it has no %s data", path, db.Metadata.DatabaseType, kind)
+		}
+	}
+	return nil
+}
+
+// checkReadable returns an error if the file 'path' can't be read, e.g. a directory or a file caddy has no
+// permission for.
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// joinProblems returns the problems as one error, the problem itself if there's only one.
+func joinProblems(problems []error) error {
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return problems[0]
+	}
+	lines := make([]string, len(problems))
+	for i, problem := range problems {
+		lines[i] = "\t" + problem.Error()
+	}
+	return fmt.Errorf("ipfilter: %d problems:\n%s", len(problems), strings.Join(lines, "\n"))
+}
@@ -0,0 +1,98 @@
+package ipfilter
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestCheckMMDBKind(t *testing.T) {
+	asnDB := writeTestASNDB(t, map[string]uint{"8.8.8.0/24": 15169})
+	defer os.RemoveAll(filepath.Dir(asnDB))
+	customDB := writeLayoutDB(t, "ipinfo lite.mmdb", map[string]map[string]interface{}{
+		"8.8.8.0/24": {"country_code": "US", "asn": "AS15169"},
+	})
+	defer os.RemoveAll(filepath.Dir(customDB))
+
+	tests := []struct {
+		path      string
+		kind      string
+		shouldErr bool
+	}{
+		{DataBase, "country", false},
+		{DataBase, "ASN", true},
+		{DataBase, "Anonymous-IP", true},
+		{asnDB, "ASN", false},
+		{asnDB, "country", true},
+		// the types of no kind may be laid out like any.
+		{customDB, "country", false},
+		{customDB, "ASN", false},
+	}
+	for i, test := range tests {
+		db, err := maxminddb.Open(test.path)
+		if err != nil {
+			t.Fatalf("Test %d: Could not open the database: %v", i, err)
+		}
+		err = checkMMDBKind(db, test.path, test.kind)
+		db.Close()
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: Expected an error: %v, Got: %v", i, test.shouldErr, err)
+		}
+	}
+}
+
+func TestDeepValidation(t *testing.T) {
+	dir := writePolicyDir(t, map[string]string{"good.netset": "1.2.3.0/24\n", "bad.netset": "1.2.3.0/24\nnot an ip\n"})
+	defer os.RemoveAll(dir)
+
+	// every problem is reported, the parsing goes on after the first one.
+	input := "ipfilter / {\nrule block\ndatabase " + DataBase + "\ncountry RU\nblockpage missing.html\n}\n" +
+		"ipfilter /api {\nrule block\nip_list " + filepath.Join(dir, "good.netset") + " " + filepath.Join(dir, "bad.netset") + " " + filepath.Join(dir, "none.netset") + "\nblockpage testdata\n}\n" +
+		"ipfilter /admin {\nrule allow\nip 10.0.0.0/8\nasn_database " + DataBase + "\n}"
+	_, _, err := ParseCaddyfileFragment([]byte(input))
+	if err == nil {
+		t.Fatal("Expected the problems to be reported")
+	}
+	for _, expected := range []string{
+		"5 problems",
+		"Invalid list " + filepath.Join(dir, "bad.netset"),
+		"Can't open the list: " + filepath.Join(dir, "none.netset"),
+		DataBase + " is a GeoLite2-Country database, it has no ASN data",
+		"block 1: Can't read the blockpage: open missing.html",
+		"block 2: Can't read the blockpage",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in the problems, Got: %v", expected, err)
+		}
+	}
+
+	// an error stopping the parsing is reported with the problems before it.
+	input = "ipfilter / {\nrule block\nip 1.1.1.1\nblockpage missing.html\n}\nipfilter /api {\nrule deny\n}"
+	if _, _, err := ParseCaddyfileFragment([]byte(input)); err == nil || !strings.Contains(err.Error(), "2 problems") {
+		t.Errorf("Expected 2 problems, Got: %v", err)
+	}
+	// outside of caddy -validate, the first problem stops the parsing.
+	if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil || strings.Contains(err.Error(), "problems") {
+		t.Errorf("Expected the first problem only, Got: %v", err)
+	}
+}
+
+func TestDeepValidationRemote(t *testing.T) {
+	defer withFeedServer(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	})()
+
+	input := "ipfilter / {\nrule block\nfeed aws\n}"
+	if _, err := validateParse(caddy.NewTestController("http", input), true, false); err != nil {
+		t.Fatalf("Unexpected error without the remote checks: %v", err)
+	}
+	_, err := validateParse(caddy.NewTestController("http", input), true, true)
+	if err == nil || !strings.Contains(err.Error(), "503 Service Unavailable") {
+		t.Errorf("Expected the feed to be unreachable, Got: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package ipfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the block webhook.
+const (
+	webhookBatchSize = 100             // events per POST at most.
+	webhookInterval  = 5 * time.Second // how long events wait for a batch to fill up.
+	webhookQueueSize = 10000           // events waiting to be sent, the next ones are dropped.
+	webhookRetries   = 5
+	webhookBackoff   = time.Second // doubled after every failed attempt.
+)
+
+// BlockEvent describes a blocked request.
+type BlockEvent struct {
+	IP      string    `json:"ip"`
+	Country string    `json:"country,omitempty"`
+	Host    string    `json:"host"`
+	Path    string    `json:"path"`
+	Rule    int       `json:"rule"`              // the 1-based position of the ipfilter block, BanRule or DefaultRule.
+	RuleID  string    `json:"rule_id,omitempty"` // see RuleEvent, empty for bans.
+	Time    time.Time `json:"time"`
+}
+
+// BlockWebhook POSTs the block events of a site to a URL, e.g. a SOC pipeline, as {"events": [...]}. Events
+// are sent in batches, a batch that fails is sent again with an exponential backoff, and dropped after a few
+// attempts; blocking requests never waits for the webhook.
+type BlockWebhook struct {
+	URL string
+
+	client   *http.Client
+	events   chan BlockEvent
+	interval time.Duration
+	backoff  time.Duration
+	dropped  int32 // events dropped since the last batch, logged by run.
+}
+
+// NewBlockWebhook returns a BlockWebhook posting to 'rawURL'.
+func NewBlockWebhook(rawURL string) (*BlockWebhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("ipfilter: webhook should be an http(s) URL: " + rawURL)
+	}
+	return &BlockWebhook{
+		URL:      rawURL,
+		client:   defaultHTTPClient,
+		events:   make(chan BlockEvent, webhookQueueSize),
+		interval: webhookInterval,
+		backoff:  webhookBackoff,
+	}, nil
+}
+
+// blockEvent returns the event of a blocked request.
+func (d DecisionRecord) blockEvent() BlockEvent {
+	return BlockEvent{IP: d.IP, Country: d.Country, Host: d.Host, Path: d.Path, Rule: d.Rule, RuleID: d.RuleID, Time: d.Time}
+}
+
+// send queues 'event', it is dropped if the queue is full.
+func (wh *BlockWebhook) send(event BlockEvent) {
+	if wh == nil {
+		return
+	}
+	select {
+	case wh.events <- event:
+	default:
+		atomic.AddInt32(&wh.dropped, 1)
+	}
+}
+
+// run sends the queued events until 'ctx' is done, the pending ones are sent one last time then.
+func (wh *BlockWebhook) run(ctx context.Context) {
+	ticker := time.NewTicker(wh.interval)
+	defer ticker.Stop()
+
+	var batch []BlockEvent
+	for {
+		select {
+		case event := <-wh.events:
+			batch = append(batch, event)
+			if len(batch) < webhookBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			for len(wh.events) > 0 {
+				batch = append(batch, <-wh.events)
+			}
+			if len(batch) != 0 {
+				wh.post(context.Background(), batch, 1)
+			}
+			return
+		}
+		if dropped := atomic.SwapInt32(&wh.dropped, 0); dropped != 0 {
+			log.Printf("[ERROR] ipfilter: webhook: queue full, dropped %d events", dropped)
+		}
+		if len(batch) != 0 {
+			wh.post(ctx, batch, webhookRetries)
+			batch = nil
+		}
+	}
+}
+
+// post sends 'batch', making up to 'attempts' attempts.
+func (wh *BlockWebhook) post(ctx context.Context, batch []BlockEvent, attempts int) {
+	body, err := json.Marshal(struct {
+		Events []BlockEvent `json:"events"`
+	}{batch})
+	if err != nil {
+		return
+	}
+
+	backoff := wh.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := wh.postOnce(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= attempts {
+			log.Printf("[ERROR] ipfilter: webhook: dropping %d events: %v", len(batch), err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			// shutting down, one last attempt.
+			attempts = attempt + 1
+		}
+	}
+}
+
+// postOnce POSTs 'body', it returns whether a failure is worth retrying.
+func (wh *BlockWebhook) postOnce(body []byte) (bool, error) {
+	resp, err := wh.client.Post(wh.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
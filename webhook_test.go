@@ -0,0 +1,115 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestBlockWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var events []BlockEvent
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// the first batch is retried.
+		if attempts == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var body struct {
+			Events []BlockEvent `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events = append(events, body.Events...)
+	}))
+	defer server.Close()
+
+	config, err := ipfilterParse(caddy.NewTestController("http", "ipfilter /admin {\nrule allow\nip 8.8.8.8\ndatabase "+DataBase+"\nwebhook "+server.URL+"\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer config.DBHandler.Close()
+	config.Webhook.interval, config.Webhook.backoff = 10*time.Millisecond, 10*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go config.Webhook.run(ctx)
+
+	ipf := IPFilter{
+		Next: NextFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+	for _, reqIP := range []string{"24.53.192.20:_", "8.8.8.8:_", "5.175.96.22:_"} {
+		req, err := http.NewRequest("GET", "http://example.com/admin/users", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = reqIP
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	eventually(t, "the block events", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	first := events[0]
+	if first.IP != "24.53.192.20" || first.Country != "CA" || first.Host != "example.com" || first.Path != "/admin/users" ||
+		first.Rule != 1 || first.RuleID != ruleID(config.Paths[0]) || first.Time.IsZero() {
+		t.Errorf("Unexpected event: %+v", first)
+	}
+	if events[1].IP != "5.175.96.22" || events[1].Country != "RU" {
+		t.Errorf("Unexpected event: %+v", events[1])
+	}
+
+	for i, input := range []string{
+		"ipfilter / {\nrule block\nip 8.8.8.8\nwebhook\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nwebhook ftp://example.com/events\n}",
+		"ipfilter / {\nrule block\nip 8.8.8.8\nwebhook " + server.URL + "\nwebhook " + server.URL + "\n}",
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+	}
+}
+
+func TestBlockWebhookDrop(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		http.Error(w, "invalid", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	wh, err := NewBlockWebhook(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	wh.backoff = time.Millisecond
+	wh.post(context.Background(), []BlockEvent{{IP: "8.8.8.8"}}, webhookRetries)
+
+	// the client errors aren't retried.
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 1 {
+		t.Fatalf("Expected a single attempt, Got: %d", attempts)
+	}
+}